@@ -2,8 +2,8 @@ package main
 
 import (
 	"encoding/base64"
+	pg "goserve/postgres"
 	"log"
-	pg "main/postgres"
 	"net/http"
 	"time"
 
@@ -38,12 +38,8 @@ func (hCtx *HandlerContext) validateSignup(user UserAuth) ([]byte, string, bool)
 		return passHash, "Invalid email address", notOk
 	}
 
-	if user.Password != user.ConfirmPassword {
-		return passHash, "Passwords must match", notOk
-	}
-
-	if len(user.Password) < 6 {
-		return passHash, "Password must be at least 6 characters", notOk
+	if msg := validatePassword(user.Password, user.ConfirmPassword); msg != "" {
+		return passHash, msg, notOk
 	}
 
 	if user.Consent != "agree" {
@@ -71,16 +67,28 @@ func (hCtx *HandlerContext) validateSignup(user UserAuth) ([]byte, string, bool)
 	return passHash, "Success", ok
 }
 
-func insertAccount(PGCtx *pg.PostgresContext, user UserAuth, passHash []byte) error {
+// validatePassword returns what's wrong with a new password, or "" if nothing is
+func validatePassword(password string, confirm string) string {
+	if password != confirm {
+		return "Passwords must match"
+	}
+	if len(password) < 6 {
+		return "Password must be at least 6 characters"
+	}
+	return ""
+}
+
+// insertAccount creates the account, already verified when verifiedAt is set, and returns its id
+func insertAccount(PGCtx *pg.PostgresContext, user UserAuth, passHash []byte, verifiedAt *time.Time) (string, error) {
 	encodedPassHash := base64.StdEncoding.EncodeToString(passHash)
 
 	uuid := uuid.New().String()
 
-	sqlStatement := `INSERT INTO users (id, email, password) VALUES ($1, $2, $3)`
+	sqlStatement := `INSERT INTO users (id, email, password, verified_at) VALUES ($1, $2, $3, $4)`
 
 	// Execute the SQL statement with the desired values.
-	_, err := PGCtx.Pool.Exec(PGCtx.Ctx, sqlStatement, uuid, user.Email, encodedPassHash)
-	return err
+	_, err := PGCtx.Pool.Exec(PGCtx.Ctx, sqlStatement, uuid, user.Email, encodedPassHash, verifiedAt)
+	return uuid, err
 }
 
 func (hCtx *HandlerContext) authenticateUser() (string, string, int) {
@@ -103,24 +111,25 @@ func (hCtx *HandlerContext) authenticateUser() (string, string, int) {
 	return uuid, "", http.StatusOK
 }
 
-func setCookie(c echo.Context, uuid string) bool {
-	expiry := time.Now().Add(time.Hour * 72)
-	claims := &jwt.MapClaims{
+// setCookie signs a short-lived access token for the account's session and sets it as the
+// auth_token cookie, returning the signed token
+func setCookie(c echo.Context, uuid string, sessionId string) (string, bool) {
+	expiry := time.Now().Add(sessionConfig.AccessTTL)
+	claims := jwt.MapClaims{
 		"exp":    expiry.Unix(),
 		"Issuer": "ResumeSheep",
 		"ID":     uuid,
+		"sid":    sessionId,
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	t, err := token.SignedString(jwtSecret)
+	t, err := jwtKeys.Sign(claims)
 	if err != nil {
-		log.Printf("Error signing jwt for user %v\n", uuid)
-		return false
+		log.Printf("Error signing jwt for user %v: %v\n", uuid, err)
+		return "", false
 	}
 
 	c.SetCookie(&http.Cookie{
-		Name:     "auth_token",
+		Name:     accessCookie,
 		Value:    t,
 		Expires:  expiry,
 		HttpOnly: true,
@@ -128,7 +137,7 @@ func setCookie(c echo.Context, uuid string) bool {
 		Secure:   false, // Set to true if using HTTPS, recommended for security
 		SameSite: http.SameSiteStrictMode,
 	})
-	return true
+	return t, true
 }
 
 func getUserPwd(user UserAuth, pgContext *pg.PostgresContext) (string, string, error) {
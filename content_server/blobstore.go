@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"io"
+	"log"
+	"path"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+)
+
+// Blob is a stored file body, shared by every files row with the same content
+type Blob struct {
+	SHA256   string
+	Location string
+	Key      string
+	Size     int64
+	KeyID    string
+}
+
+// blobKey shards by hash prefix so no single directory or S3 prefix gets every object
+func blobKey(sum string) string {
+	return path.Join("blobs", sum[:2], sum)
+}
+
+func stagingKey() string {
+	return path.Join("staging", uuid.New().String())
+}
+
+// putBlob streams a file into storage and takes a reference on its content.
+// The hash isn't known until the last byte, so the stream lands under a staging key first and is
+// moved under its hash only if those bytes aren't stored yet. The caller owns one reference and
+// must releaseBlob it if the files row that was meant to hold it never gets written.
+func putBlob(pgContext *pg.PostgresContext, filesystem Filesystem, file io.Reader) (Blob, error) {
+	blob := Blob{Location: filesystem.GetLocation(), KeyID: currentKeyID(filesystem)}
+	if file == nil {
+		file = bytes.NewReader(nil)
+	}
+
+	staging := stagingKey()
+	hasher := sha256.New()
+	counter := &sizeLimitReader{Reader: file, Limit: maxUploadBytes}
+	if err := filesystem.Write(io.TeeReader(counter, hasher), staging); err != nil {
+		return blob, asUploadErr(err)
+	}
+	blob.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	blob.Size = counter.N
+
+	err := addBlobRef(pgContext, filesystem, &blob, staging)
+	if err != nil {
+		if delErr := filesystem.Delete(staging); delErr != nil {
+			log.Printf("Failed to remove staged upload %s: %v", staging, delErr)
+		}
+	}
+	return blob, err
+}
+
+func addBlobRef(pgContext *pg.PostgresContext, filesystem Filesystem, blob *Blob, staging string) error {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	// The upsert row-locks the blob, so a concurrent upload of the same bytes waits here until
+	// this one has moved its copy into place. The content lock keeps a release that has already
+	// committed from deleting the bytes while this moves a fresh copy under the same key.
+	if err := lockBlobContent(pgContext, tx, blob.SHA256, blob.Location); err != nil {
+		return err
+	}
+	var inserted bool
+	sqlStatement := `
+	INSERT INTO blobs (sha256, location, storage_key, size, key_id)
+	VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+	ON CONFLICT (sha256, location) DO UPDATE SET ref_count = blobs.ref_count + 1
+	RETURNING storage_key, COALESCE(key_id, ''), (xmax = 0)`
+	err = tx.QueryRow(pgContext.Ctx, sqlStatement, blob.SHA256, blob.Location, blobKey(blob.SHA256), blob.Size, blob.KeyID).Scan(&blob.Key, &blob.KeyID, &inserted)
+	if err != nil {
+		return fmt.Errorf("error referencing blob %s: %w", blob.SHA256, err)
+	}
+
+	if inserted {
+		if err := filesystem.Move(staging, blob.Key); err != nil {
+			return fmt.Errorf("error moving upload into %s: %w", blob.Key, err)
+		}
+	} else if err := filesystem.Delete(staging); err != nil {
+		// the content is already stored, a leftover staging object is only wasted space
+		log.Printf("Failed to remove duplicate upload %s: %v", staging, err)
+	}
+	return tx.Commit(pgContext.Ctx)
+}
+
+// releaseBlobRef drops one reference inside tx. Along with the last one the blobs row goes and the
+// stored bytes are queued on cleanup, to be deleted once tx commits. Returns false if key isn't a
+// blob, i.e. the file was stored before content addressing and its bytes belong to that one row.
+func releaseBlobRef(pgContext *pg.PostgresContext, tx pgx.Tx, cleanup *storageCleanup, filesystem Filesystem, sum string, location string, key string) (bool, error) {
+	var refCount int
+	sqlStatement := `
+	UPDATE blobs SET ref_count = ref_count - 1
+	WHERE sha256 = $1 AND location = $2 AND storage_key = $3
+	RETURNING ref_count`
+	err := tx.QueryRow(pgContext.Ctx, sqlStatement, sum, location, key).Scan(&refCount)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error releasing blob %s: %w", sum, err)
+	}
+	if refCount > 0 {
+		return true, nil
+	}
+
+	if _, err := tx.Exec(pgContext.Ctx, `DELETE FROM blobs WHERE sha256 = $1 AND location = $2`, sum, location); err != nil {
+		return true, fmt.Errorf("error removing blob %s: %w", sum, err)
+	}
+	cleanup.addBlob(filesystem, key, sum, location)
+	return true, nil
+}
+
+// lockBlobContent serializes storing and deleting the bytes of one blob until tx ends
+func lockBlobContent(pgContext *pg.PostgresContext, tx pgx.Tx, sum string, location string) error {
+	if _, err := tx.Exec(pgContext.Ctx, `SELECT pg_advisory_xact_lock(hashtext($1 || '/' || $2))`, location, sum); err != nil {
+		return fmt.Errorf("error locking blob %s: %w", sum, err)
+	}
+	return nil
+}
+
+// storageCleanup collects the stored objects a transaction stops referencing, so they're deleted
+// only after it commits. Deleting earlier would lose the bytes of rows a failed commit leaves in
+// place; a delete that fails afterwards only leaves an orphan for the reconciler.
+type storageCleanup struct {
+	objects []cleanupObject
+}
+
+type cleanupObject struct {
+	filesystem Filesystem
+	key        string
+	// set for blobs, whose content may have been uploaded again by the time they're deleted
+	sha256   string
+	location string
+}
+
+func (sc *storageCleanup) add(filesystem Filesystem, key string) {
+	sc.objects = append(sc.objects, cleanupObject{filesystem: filesystem, key: key})
+}
+
+func (sc *storageCleanup) addBlob(filesystem Filesystem, key string, sum string, location string) {
+	sc.objects = append(sc.objects, cleanupObject{filesystem: filesystem, key: key, sha256: sum, location: location})
+}
+
+// run deletes the collected objects and their previews. Call it once the transaction has committed.
+func (sc *storageCleanup) run(pgContext *pg.PostgresContext) {
+	for _, object := range sc.objects {
+		var err error
+		if object.sha256 != "" {
+			err = deleteReleasedBlob(pgContext, object)
+		} else {
+			deletePreviews(object.filesystem, object.key)
+			err = object.filesystem.Delete(object.key)
+		}
+		if err != nil {
+			log.Printf("Failed to delete %s from %s storage, leaving it to the reconciler: %v", object.key, object.filesystem.GetLocation(), err)
+		}
+	}
+	sc.objects = nil
+}
+
+// deleteReleasedBlob deletes a released blob's bytes unless an upload of the same content has
+// stored them again since, holding the content lock so none can start meanwhile
+func deleteReleasedBlob(pgContext *pg.PostgresContext, object cleanupObject) error {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	if err := lockBlobContent(pgContext, tx, object.sha256, object.location); err != nil {
+		return err
+	}
+	var stored bool
+	sqlStatement := `SELECT EXISTS (SELECT 1 FROM blobs WHERE sha256 = $1 AND location = $2)`
+	if err := tx.QueryRow(pgContext.Ctx, sqlStatement, object.sha256, object.location).Scan(&stored); err != nil {
+		return fmt.Errorf("error checking blob %s: %w", object.sha256, err)
+	}
+	if stored {
+		return nil
+	}
+	deletePreviews(object.filesystem, object.key)
+	if err := object.filesystem.Delete(object.key); err != nil {
+		return err
+	}
+	return tx.Commit(pgContext.Ctx)
+}
+
+// addBlobRefTx takes another reference on content that's already stored, for a row that now
+// shares it. Returns false if key isn't a blob.
+func addBlobRefTx(pgContext *pg.PostgresContext, tx pgx.Tx, sum string, location string, key string) (bool, error) {
+	tag, err := tx.Exec(pgContext.Ctx, `
+	UPDATE blobs SET ref_count = ref_count + 1
+	WHERE sha256 = $1 AND location = $2 AND storage_key = $3`, sum, location, key)
+	if err != nil {
+		return false, fmt.Errorf("error referencing blob %s: %w", sum, err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// releaseStored gives up a row's claim on its stored bytes, whether they're a shared blob or a
+// file from before content addressing. Bytes nothing else needs are queued on cleanup.
+func releaseStored(pgContext *pg.PostgresContext, tx pgx.Tx, cleanup *storageCleanup, filesystem Filesystem, stored storedRef) error {
+	// the row's own backend, which isn't necessarily the one new uploads go to
+	if rowFilesystem, err := getFilesystem(stored.Location); err == nil {
+		filesystem = rowFilesystem
+	}
+	if stored.SHA256 != "" {
+		released, err := releaseBlobRef(pgContext, tx, cleanup, filesystem, stored.SHA256, stored.Location, stored.Filepath)
+		if released || err != nil {
+			return err
+		}
+	}
+	if stored.Filepath == "" {
+		return fmt.Errorf("no filepath specified, cannot delete stored file")
+	}
+	cleanup.add(filesystem, stored.Filepath)
+	return nil
+}
+
+// storedRef is where a files or file_versions row keeps its bytes
+type storedRef struct {
+	Filepath string
+	SHA256   string
+	Location string
+}
+
+// releaseBlob gives back a reference taken by putBlob that never made it into a files row
+func releaseBlob(pgContext *pg.PostgresContext, filesystem Filesystem, blob Blob) error {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	cleanup := &storageCleanup{}
+	if _, err := releaseBlobRef(pgContext, tx, cleanup, filesystem, blob.SHA256, blob.Location, blob.Key); err != nil {
+		return err
+	}
+	if err := tx.Commit(pgContext.Ctx); err != nil {
+		return err
+	}
+	cleanup.run(pgContext)
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	pg "goserve/postgres"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+)
+
+func blobRefCount(t *testing.T, pgContext *pg.PostgresContext, blob Blob) int {
+	t.Helper()
+	var refCount int
+	sqlStatement := `SELECT coalesce((SELECT ref_count FROM blobs WHERE sha256 = $1 AND location = $2), 0)`
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, blob.SHA256, blob.Location).Scan(&refCount); err != nil {
+		t.Fatalf("loading blob %s: %v", blob.SHA256, err)
+	}
+	return refCount
+}
+
+func TestPutBlobStoresEachContentOnce(t *testing.T) {
+	pgContext := newTestPG(t)
+	fs := newMemoryFilesystem("blob-test")
+
+	first, err := putBlob(pgContext, fs, strings.NewReader("same bytes"))
+	if err != nil {
+		t.Fatalf("putBlob: %v", err)
+	}
+	second, err := putBlob(pgContext, fs, strings.NewReader("same bytes"))
+	if err != nil {
+		t.Fatalf("putBlob again: %v", err)
+	}
+	other, err := putBlob(pgContext, fs, strings.NewReader("other bytes"))
+	if err != nil {
+		t.Fatalf("putBlob other: %v", err)
+	}
+
+	if first.Key != second.Key || first.Key != blobKey(first.SHA256) || first.Size != int64(len("same bytes")) {
+		t.Errorf("same content stored as %+v and %+v", first, second)
+	}
+	if other.Key == first.Key {
+		t.Error("different content got the same key")
+	}
+	// only the two blobs are left, no staging copies
+	if len(fs.objects) != 2 || !fs.has(first.Key) || !fs.has(other.Key) {
+		t.Errorf("storage holds %d objects, want the two blobs", len(fs.objects))
+	}
+	if refs := blobRefCount(t, pgContext, first); refs != 2 {
+		t.Errorf("ref_count = %d, want 2", refs)
+	}
+
+	// the bytes stay until the last reference goes
+	if err := releaseBlob(pgContext, fs, first); err != nil {
+		t.Fatalf("releaseBlob: %v", err)
+	}
+	if !fs.has(first.Key) || blobRefCount(t, pgContext, first) != 1 {
+		t.Error("releasing one of two references removed the blob")
+	}
+	if err := releaseBlob(pgContext, fs, second); err != nil {
+		t.Fatalf("releaseBlob: %v", err)
+	}
+	if fs.has(first.Key) || blobRefCount(t, pgContext, first) != 0 {
+		t.Error("releasing the last reference left the blob behind")
+	}
+	if !fs.has(other.Key) {
+		t.Error("releasing one blob removed another")
+	}
+}
+
+func TestReleaseBlobRefWithoutABlobRow(t *testing.T) {
+	pgContext := newTestPG(t)
+	fs := newMemoryFilesystem("blob-test")
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	// files stored before content addressing have no blob row
+	sum := strings.Repeat("0", 64)
+	found, err := releaseBlobRef(pgContext, tx, &storageCleanup{}, fs, sum, fs.GetLocation(), blobKey(sum))
+	if found || err != nil {
+		t.Errorf("releaseBlobRef of an unknown blob = %v, %v; want false, nil", found, err)
+	}
+}
+
+func TestReleasedBlobIsDeletedAfterCommit(t *testing.T) {
+	pgContext := newTestPG(t)
+	fs := newMemoryFilesystem("blob-test")
+	blob, err := putBlob(pgContext, fs, strings.NewReader("short-lived"))
+	if err != nil {
+		t.Fatalf("putBlob: %v", err)
+	}
+
+	release := func() (pgx.Tx, *storageCleanup) {
+		t.Helper()
+		tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+		if err != nil {
+			t.Fatalf("begin: %v", err)
+		}
+		cleanup := &storageCleanup{}
+		if found, err := releaseBlobRef(pgContext, tx, cleanup, fs, blob.SHA256, blob.Location, blob.Key); !found || err != nil {
+			t.Fatalf("releaseBlobRef = %v, %v", found, err)
+		}
+		return tx, cleanup
+	}
+
+	// a release that rolls back leaves the bytes and the reference
+	tx, _ := release()
+	if !fs.has(blob.Key) {
+		t.Fatal("the bytes were deleted before the transaction ended")
+	}
+	tx.Rollback(pgContext.Ctx)
+	if !fs.has(blob.Key) || blobRefCount(t, pgContext, blob) != 1 {
+		t.Fatal("a rolled back release lost the blob")
+	}
+
+	// content uploaded again between the commit and the cleanup keeps its bytes
+	tx, cleanup := release()
+	if err := tx.Commit(pgContext.Ctx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	again, err := putBlob(pgContext, fs, strings.NewReader("short-lived"))
+	if err != nil {
+		t.Fatalf("putBlob again: %v", err)
+	}
+	cleanup.run(pgContext)
+	if !fs.has(again.Key) {
+		t.Fatal("cleanup deleted bytes that were uploaded again")
+	}
+
+	if err := releaseBlob(pgContext, fs, again); err != nil {
+		t.Fatalf("releaseBlob: %v", err)
+	}
+	if fs.has(again.Key) {
+		t.Error("releasing the last reference left the bytes behind")
+	}
+}
+
+func TestStorageCleanupKeepsGoingPastFailedDeletes(t *testing.T) {
+	fs := newMemoryFilesystem("cleanup-test")
+	for _, key := range []string{"a", "b", "c", previewKey("a", previewThumb)} {
+		fs.objects[key] = []byte(key)
+	}
+	fs.failDelete["b"] = true
+
+	cleanup := &storageCleanup{}
+	for _, key := range []string{"a", "b", "c"} {
+		cleanup.add(fs, key)
+	}
+	if !fs.has("a") {
+		t.Fatal("add deleted right away, it must wait for run")
+	}
+	// objects without a blob hash never touch postgres
+	cleanup.run(nil)
+
+	if fs.has("a") || fs.has("c") || fs.has(previewKey("a", previewThumb)) {
+		t.Errorf("run left objects behind: %v", fs.objects)
+	}
+	if !fs.has("b") {
+		t.Error("b's delete was set to fail but it's gone")
+	}
+	if len(cleanup.objects) != 0 {
+		t.Errorf("run kept %d objects queued", len(cleanup.objects))
+	}
+}
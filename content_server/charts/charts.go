@@ -3,10 +3,10 @@ package charts
 import (
 	"encoding/json"
 	"fmt"
+	pg "goserve/postgres"
+	"goserve/templating/components"
 	"html/template"
 	"log"
-	pg "main/postgres"
-	"main/templating/components"
 
 	"github.com/labstack/echo/v4"
 )
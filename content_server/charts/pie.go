@@ -2,8 +2,8 @@ package charts
 
 import (
 	"fmt"
+	pg "goserve/postgres"
 	"log"
-	pg "main/postgres"
 	"strings"
 	"time"
 )
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+var ErrFileNotFound = errors.New("file not found")
+
+// Content types a browser may render in place. Anything else, html and svg especially, would run
+// in our origin if opened inline, so it's always sent as an attachment.
+var inlineContentTypes = map[string]bool{
+	"application/pdf": true,
+	"text/plain":      true,
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"audio/mpeg":      true,
+	"video/mp4":       true,
+}
+
+func FileDownload(hCtx HandlerContext) error {
+	fileId := hCtx.EchoCtx.Param("id")
+
+	uuid, ok := hCtx.EchoCtx.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	// viewers and editors of a shared file can download it as well as its owner
+	fileObject, _, err := getAccessibleFileObject(hCtx.PGCtx, fileId, uuid)
+	if err != nil {
+		if !errors.Is(err, ErrFileNotFound) {
+			// a malformed id fails uuid parsing in postgres, which is just another missing file
+			log.Printf("Failed to look up file for download: %v", err)
+		}
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	inline := hCtx.EchoCtx.QueryParam("disposition") == "inline"
+	return serveFile(hCtx.EchoCtx, fileObject, inline)
+}
+
+// serveFile streams a stored file from the backend named by its location.
+// Range and conditional requests are handled by http.ServeContent when the backend's reader can
+// seek (local files and S3 objects both can); otherwise the whole file is sent.
+func serveFile(c echo.Context, fo FileObject, inline bool) error {
+	if fo.ScanStatus == ScanInfected {
+		return echo.NewHTTPError(http.StatusForbidden, "File is quarantined")
+	}
+	fs, err := getFilesystem(fo.Location)
+	if err != nil {
+		log.Printf("Cannot serve file %s: %v", fo.FileId, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "File storage unavailable")
+	}
+	file, err := fs.Read(fo.Filepath)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("File %s is indexed but missing from %s storage", fo.FileId, fo.Location)
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	if err != nil {
+		log.Printf("Failed to read file %s: %v", fo.FileId, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to read file")
+	}
+	defer file.Close()
+
+	contentType := mime.TypeByExtension(strings.ToLower(fo.FileExt))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	disposition := "attachment"
+	if inline && inlineContentTypes[mediaType] {
+		disposition = "inline"
+	}
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, contentType)
+	header.Set(echo.HeaderContentDisposition, mime.FormatMediaType(disposition, map[string]string{"filename": fo.Filename}))
+	header.Set("ETag", fileETag(fo))
+	header.Set("Cache-Control", "private, no-cache")
+	header.Set(echo.HeaderXContentTypeOptions, "nosniff")
+
+	if seeker, ok := file.(io.ReadSeeker); ok {
+		http.ServeContent(c.Response(), c.Request(), fo.Filename, fo.UploadTime, seeker)
+		return nil
+	}
+
+	if etagMatches(c.Request().Header.Get("If-None-Match"), header.Get("ETag")) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	header.Set("Accept-Ranges", "none")
+	c.Response().WriteHeader(http.StatusOK)
+	if c.Request().Method == http.MethodHead {
+		return nil
+	}
+	if _, err := io.Copy(c.Response(), file); err != nil {
+		// headers are already sent, all we can do is note it
+		log.Printf("Download of file %s interrupted: %v", fo.FileId, err)
+	}
+	return nil
+}
+
+// fileETag uses the content hash when we have one. Rows from before hashing get a weak tag
+// from the id and upload time, which still changes whenever the row is replaced.
+func fileETag(fo FileObject) string {
+	if fo.SHA256 != "" {
+		return `"` + fo.SHA256 + `"`
+	}
+	return fmt.Sprintf(`W/"%s-%d"`, fo.FileId, fo.UploadTime.UnixNano())
+}
+
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	bare := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == bare {
+			return true
+		}
+	}
+	return false
+}
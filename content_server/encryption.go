@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	pg "goserve/postgres"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Stored objects written through EncryptedStorage start with this, anything else is plaintext
+// from before encryption was turned on
+const encMagic = "GSENC\x00\x01\x00"
+
+const (
+	// Plaintext is sealed in chunks so downloads can be decrypted as they stream
+	encChunkSize   = 64 << 10
+	encDataKeySize = 32
+	// STREAM-style nonces: a random per-object prefix, the chunk counter, and a last-chunk flag,
+	// so chunks can't be reordered, dropped, or the object cut short at a chunk boundary
+	encNoncePrefixSize = 7
+	encWrappedKeySize  = 12 + encDataKeySize + 16
+)
+
+var ErrUnknownKey = errors.New("object is encrypted with a master key that isn't configured")
+
+// Keyring holds the master keys data keys are wrapped with. New objects use Current; the others
+// are kept so objects written before a rotation can still be read.
+type Keyring struct {
+	Current string
+	keys    map[string]cipher.AEAD
+}
+
+// GetDefaultKeyring reads ENCRYPTION_KEYS, a comma-separated list of id:base64 256-bit keys, and
+// ENCRYPTION_KEY_ID, the one to encrypt with (default the first listed). Returns nil if encryption
+// isn't configured.
+func GetDefaultKeyring() (*Keyring, error) {
+	spec := os.Getenv("ENCRYPTION_KEYS")
+	if spec == "" {
+		return nil, nil
+	}
+	keyring := &Keyring{keys: map[string]cipher.AEAD{}}
+	for _, entry := range strings.Split(spec, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" || len(id) > 64 {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS entries must be id:base64key with an id of at most 64 characters")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %q must be 32 bytes, base64 encoded", id)
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys[id] = aead
+		if keyring.Current == "" {
+			keyring.Current = id
+		}
+	}
+	if id := os.Getenv("ENCRYPTION_KEY_ID"); id != "" {
+		if _, ok := keyring.keys[id]; !ok {
+			return nil, fmt.Errorf("ENCRYPTION_KEY_ID %q isn't in ENCRYPTION_KEYS", id)
+		}
+		keyring.Current = id
+	}
+	return keyring, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrap seals a data key under master key id, which is bound in as associated data
+func (k *Keyring) wrap(id string, dataKey []byte) ([]byte, error) {
+	master, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	nonce := make([]byte, master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return master.Seal(nonce, nonce, dataKey, []byte(id)), nil
+}
+
+func (k *Keyring) unwrap(id string, wrapped []byte) ([]byte, error) {
+	master, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	nonceSize := master.NonceSize()
+	dataKey, err := master.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key with master key %q: %w", id, err)
+	}
+	return dataKey, nil
+}
+
+// encHeader precedes the sealed chunks: magic, key id length and key id, wrapped data key, nonce prefix.
+// Only the header changes when a data key is re-wrapped, the chunks stay as they are.
+type encHeader struct {
+	KeyID       string
+	WrappedKey  []byte
+	NoncePrefix []byte
+}
+
+func (h encHeader) marshal() []byte {
+	buf := bytes.NewBufferString(encMagic)
+	buf.WriteByte(byte(len(h.KeyID)))
+	buf.WriteString(h.KeyID)
+	buf.Write(h.WrappedKey)
+	buf.Write(h.NoncePrefix)
+	return buf.Bytes()
+}
+
+// readEncHeader reads the header off r. ok is false, with nothing consumed, if r is plaintext.
+func readEncHeader(r *bufio.Reader) (h encHeader, ok bool, err error) {
+	magic, err := r.Peek(len(encMagic))
+	if err != nil || string(magic) != encMagic {
+		// too short to be encrypted, or written before encryption was turned on
+		return h, false, nil
+	}
+	r.Discard(len(encMagic))
+
+	idLen, err := r.ReadByte()
+	if err != nil {
+		return h, true, fmt.Errorf("truncated encryption header: %w", err)
+	}
+	rest := make([]byte, int(idLen)+encWrappedKeySize+encNoncePrefixSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return h, true, fmt.Errorf("truncated encryption header: %w", err)
+	}
+	h.KeyID = string(rest[:idLen])
+	h.WrappedKey = rest[idLen : int(idLen)+encWrappedKeySize]
+	h.NoncePrefix = rest[int(idLen)+encWrappedKeySize:]
+	return h, true, nil
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encNoncePrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// EncryptedStorage envelope-encrypts everything written to the Filesystem it wraps: each object gets
+// its own AES-256-GCM data key, stored in the object's header wrapped by the keyring's current master key.
+// Keys, locations and sizes pass through unchanged, and so does anything stored before it was turned on.
+type EncryptedStorage struct {
+	Filesystem
+	Keys *Keyring
+}
+
+var _ Filesystem = (*EncryptedStorage)(nil)
+
+func NewEncryptedStorage(filesystem Filesystem, keys *Keyring) *EncryptedStorage {
+	return &EncryptedStorage{Filesystem: filesystem, Keys: keys}
+}
+
+// currentKeyID is the master key new writes to filesystem are wrapped with, or "" for plaintext
+func currentKeyID(filesystem Filesystem) string {
+	if encrypted, ok := filesystem.(*EncryptedStorage); ok {
+		return encrypted.Keys.Current
+	}
+	return ""
+}
+
+func (e *EncryptedStorage) Write(file io.Reader, filename string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		// errors from file, e.g. ErrQuotaExceeded, reach the backend's Write unchanged
+		pw.CloseWithError(e.encrypt(pw, file))
+	}()
+	err := e.Filesystem.Write(pr, filename)
+	// unblocks the encrypting goroutine if the backend gave up before reading everything
+	pr.Close()
+	return err
+}
+
+func (e *EncryptedStorage) encrypt(w io.Writer, file io.Reader) error {
+	dataKey := make([]byte, encDataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	wrapped, err := e.Keys.wrap(e.Keys.Current, dataKey)
+	if err != nil {
+		return err
+	}
+	header := encHeader{KeyID: e.Keys.Current, WrappedKey: wrapped, NoncePrefix: make([]byte, encNoncePrefixSize)}
+	if _, err := rand.Read(header.NoncePrefix); err != nil {
+		return err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(header.marshal()); err != nil {
+		return err
+	}
+
+	// A chunk is only known to be the last once the read after it comes back empty,
+	// so each chunk is sealed once the next one has been read
+	cur := make([]byte, encChunkSize)
+	next := make([]byte, encChunkSize)
+	sealed := make([]byte, 0, encChunkSize+aead.Overhead())
+	n, readErr := io.ReadFull(file, cur)
+	for counter := uint32(0); ; counter++ {
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+		last := readErr != nil
+		var nextN int
+		if !last {
+			nextN, readErr = io.ReadFull(file, next)
+			last = readErr == io.EOF
+		}
+		sealed = aead.Seal(sealed[:0], chunkNonce(header.NoncePrefix, counter, last), cur[:n], nil)
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		cur, next, n = next, cur, nextN
+	}
+}
+
+func (e *EncryptedStorage) Read(filename string) (io.ReadCloser, error) {
+	stored, err := e.Filesystem.Read(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReaderSize(stored, encChunkSize+64)
+	header, ok, err := readEncHeader(r)
+	if err != nil {
+		stored.Close()
+		return nil, fmt.Errorf("error reading %s: %w", filename, err)
+	}
+	if !ok {
+		return struct {
+			io.Reader
+			io.Closer
+		}{r, stored}, nil
+	}
+
+	dataKey, err := e.Keys.unwrap(header.KeyID, header.WrappedKey)
+	if err != nil {
+		stored.Close()
+		return nil, fmt.Errorf("error reading %s: %w", filename, err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		stored.Close()
+		return nil, err
+	}
+	return &decryptReader{
+		src:    r,
+		closer: stored,
+		aead:   aead,
+		prefix: header.NoncePrefix,
+		buf:    make([]byte, encChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// decryptReader opens one chunk at a time as the download is read
+type decryptReader struct {
+	src     *bufio.Reader
+	closer  io.Closer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	plain   []byte
+	done    bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) nextChunk() error {
+	n, err := io.ReadFull(d.src, d.buf)
+	last := err == io.ErrUnexpectedEOF || err == io.EOF
+	if err != nil && !last {
+		return err
+	}
+	if !last {
+		if _, err := d.src.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+	plain, err := d.aead.Open(d.buf[:0], chunkNonce(d.prefix, d.counter, last), d.buf[:n], nil)
+	if err != nil {
+		return fmt.Errorf("encrypted object is corrupt or truncated at chunk %d", d.counter)
+	}
+	d.plain = plain
+	d.counter++
+	d.done = last
+	return nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.closer.Close()
+}
+
+// Rotation
+
+type RotationReport struct {
+	Location  string
+	Rewrapped int
+	Encrypted int
+	Current   int
+	Failed    int
+}
+
+// RotateKeys re-wraps the data key of every object not already under the current master key, and
+// encrypts objects stored before encryption was turned on. Re-wrapping only rewrites the header,
+// the sealed chunks are copied across as they are. Once it has run, older master keys can be dropped.
+func (e *EncryptedStorage) RotateKeys(pgContext *pg.PostgresContext, dryRun bool, out io.Writer) (RotationReport, error) {
+	report := RotationReport{Location: e.GetLocation()}
+
+	// collected up front, rotating writes new objects that a walk in progress could pick up
+	var keys []string
+	err := e.Filesystem.Walk(func(object StoredObject) error {
+		// in-flight uploads, which are moved or removed by whoever is writing them
+		if strings.HasPrefix(object.Key, "staging/") || strings.HasPrefix(path.Base(object.Key), ".upload-") {
+			return nil
+		}
+		keys = append(keys, object.Key)
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("error walking %s storage: %w", report.Location, err)
+	}
+
+	for _, key := range keys {
+		action, err := e.rotateObject(pgContext, key, dryRun)
+		switch {
+		case err != nil:
+			report.Failed++
+			fmt.Fprintf(out, "%s: %v\n", key, err)
+		case action == "":
+			report.Current++
+		default:
+			if action == "rewrapped" {
+				report.Rewrapped++
+			} else {
+				report.Encrypted++
+			}
+			if dryRun {
+				action = "would be " + action
+			}
+			fmt.Fprintf(out, "%s: %s\n", key, action)
+		}
+	}
+	return report, nil
+}
+
+func (e *EncryptedStorage) rotateObject(pgContext *pg.PostgresContext, key string, dryRun bool) (string, error) {
+	stored, err := e.Filesystem.Read(key)
+	if err != nil {
+		return "", err
+	}
+	defer stored.Close()
+	r := bufio.NewReaderSize(stored, encChunkSize+64)
+	header, encrypted, err := readEncHeader(r)
+	if err != nil {
+		return "", err
+	}
+
+	action := "encrypted"
+	var body io.Reader
+	if encrypted {
+		if header.KeyID == e.Keys.Current {
+			return "", nil
+		}
+		action = "rewrapped"
+		dataKey, err := e.Keys.unwrap(header.KeyID, header.WrappedKey)
+		if err != nil {
+			return "", err
+		}
+		if header.WrappedKey, err = e.Keys.wrap(e.Keys.Current, dataKey); err != nil {
+			return "", err
+		}
+		header.KeyID = e.Keys.Current
+		body = io.MultiReader(bytes.NewReader(header.marshal()), r)
+	}
+	if dryRun {
+		return action, nil
+	}
+
+	// written beside the original and moved over it, so a failure part way leaves the original intact
+	staging := stagingKey()
+	if encrypted {
+		err = e.Filesystem.Write(body, staging)
+	} else {
+		err = e.Write(r, staging)
+	}
+	if err == nil {
+		err = e.Filesystem.Move(staging, key)
+	}
+	if err != nil {
+		e.Filesystem.Delete(staging)
+		return "", err
+	}
+	return action, setStoredKeyID(pgContext, e.GetLocation(), key, e.Keys.Current)
+}
+
+func setStoredKeyID(pgContext *pg.PostgresContext, location string, key string, keyID string) error {
+	for _, sqlStatement := range []string{
+		`UPDATE blobs SET key_id = $3 WHERE location = $1 AND storage_key = $2`,
+		`UPDATE files SET key_id = $3 WHERE location = $1 AND filepath = $2`,
+		`UPDATE file_versions SET key_id = $3 WHERE location = $1 AND filepath = $2`,
+	} {
+		if _, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, location, key, keyID); err != nil {
+			return fmt.Errorf("error recording key %s for %s: %w", keyID, key, err)
+		}
+	}
+	return nil
+}
+
+// runRotateKeysCommand is the `rotate-keys` subcommand
+func runRotateKeysCommand(pgContext *pg.PostgresContext, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("rotate-keys", flag.ContinueOnError)
+	flags.SetOutput(out)
+	backend := flags.String("backend", "", "storage backend to rotate (default: every configured backend)")
+	dryRun := flags.Bool("dry-run", false, "show what would be re-wrapped or encrypted without changing anything")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var errs []error
+	rotated := 0
+	for location, fs := range filesystems {
+		if *backend != "" && location != *backend {
+			continue
+		}
+		encrypted, ok := fs.(*EncryptedStorage)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s storage isn't encrypted, set ENCRYPTION_KEYS", location))
+			continue
+		}
+		report, err := encrypted.RotateKeys(pgContext, *dryRun, out)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rotated++
+		fmt.Fprintf(out, "%s: %d re-wrapped, %d encrypted, %d already under %s, %d failed\n",
+			report.Location, report.Rewrapped, report.Encrypted, report.Current, encrypted.Keys.Current, report.Failed)
+		if report.Failed > 0 {
+			errs = append(errs, fmt.Errorf("%d objects in %s storage could not be rotated", report.Failed, report.Location))
+		}
+	}
+	// two-factor secrets are sealed with the same keys
+	if *backend == "" {
+		resealed, err := resealTwoFactorSecrets(pgContext, *dryRun)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		verb := "re-sealed"
+		if *dryRun {
+			verb = "would be re-sealed"
+		}
+		fmt.Fprintf(out, "two-factor secrets: %d %s\n", resealed, verb)
+	}
+	if rotated == 0 && len(errs) == 0 {
+		errs = append(errs, fmt.Errorf("storage backend %q is not configured", *backend))
+	}
+	return errors.Join(errs...)
+}
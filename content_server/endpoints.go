@@ -1,18 +1,26 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"goserve/charts"
+	pg "goserve/postgres"
+	"goserve/tables"
+	"goserve/tables/cells"
+	"goserve/tables/rows"
+	"goserve/templating/components"
 	"html/template"
 	"log"
-	"main/charts"
-	pg "main/postgres"
-	"main/tables"
-	"main/tables/rows"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 )
 
@@ -22,20 +30,60 @@ type HandlerContext struct {
 }
 
 var homeDir string
-var filesystem *LocalStorage
+var filesystem Filesystem
 
+// encryptionKeys is nil unless ENCRYPTION_KEYS is set
+var encryptionKeys *Keyring
+
+// initFilesystem picks the storage backend for new uploads from STORAGE_BACKEND ("local" or "s3").
+// Local storage is always registered so files uploaded before a switch to s3 stay readable.
 func initFilesystem() {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		panic(err)
 	}
 
-	filesystem = &LocalStorage{
+	keyring, err := GetDefaultKeyring()
+	if err != nil {
+		panic(err)
+	}
+	encryptionKeys = keyring
+	// with ENCRYPTION_KEYS set, every backend encrypts what it stores
+	withEncryption := func(fs Filesystem) Filesystem {
+		if keyring == nil {
+			return fs
+		}
+		return NewEncryptedStorage(fs, keyring)
+	}
+
+	localStorage := withEncryption(&LocalStorage{
 		StorageClass{
 			Config: FileSystemConfig{
 				BucketDir: filepath.Join(homeDir, "/Documents/GoServer/filesystem"),
 			},
 		},
+	})
+	registerFilesystem(localStorage)
+	filesystem = localStorage
+
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+	case "s3":
+		config, err := GetDefaultS3Config()
+		if err != nil {
+			panic(err)
+		}
+		s3Storage, err := NewS3Storage(config)
+		if err != nil {
+			panic(err)
+		}
+		if err := s3Storage.CheckBucket(context.Background()); err != nil {
+			panic(err)
+		}
+		registerFilesystem(withEncryption(s3Storage))
+		filesystem = filesystems[s3Storage.GetLocation()]
+	default:
+		panic(fmt.Sprintf("unknown STORAGE_BACKEND %q", backend))
 	}
 }
 
@@ -49,6 +97,15 @@ func errorDiv(c echo.Context, message string) error {
 	return c.HTML(http.StatusOK, errorMessage)
 }
 
+// noticeDiv is a confirmation that doesn't read as an error
+func noticeDiv(c echo.Context, message string) error {
+	noticeTemplate := `
+    <div class="bg-green-100 border text-green-700 px-4 py-3 rounded relative" role="status">
+        <span class="block sm:inline">%s</span>
+    </div>`
+	return c.HTML(http.StatusOK, fmt.Sprintf(noticeTemplate, message))
+}
+
 func successDiv(c echo.Context, message string) error {
 	errorMessageTemplate := `
     <div class="bg-red-100 border border-red-400 text-red-700 px-4 py-3 rounded relative" role="alert">
@@ -66,12 +123,29 @@ func (hCtx *HandlerContext) createAccount() error {
 		return errorDiv(hCtx.EchoCtx, msg)
 	}
 
-	err := insertAccount(hCtx.PGCtx, user, passHash)
+	// without a way to send the email nobody could verify, so accounts start out verified
+	var verifiedAt *time.Time
+	if !verificationRequired() {
+		now := time.Now().UTC()
+		verifiedAt = &now
+	}
+	uid, err := insertAccount(hCtx.PGCtx, user, passHash, verifiedAt)
 	if err != nil {
 		log.Print(err)
 		return errorDiv(hCtx.EchoCtx, "Failed to create new account")
 	}
+	if verifiedAt == nil {
+		if err := sendVerificationEmail(hCtx.PGCtx, uid); err != nil {
+			log.Printf("Failed to send verification email to account %v: %v", uid, err)
+		}
+	}
 
+	// signed straight in, but an unverified account only gets as far as the verify page
+	if err := startSession(hCtx.PGCtx, hCtx.EchoCtx, uid); err != nil {
+		log.Printf("Failed to start session for user %v: %v", uid, err)
+		hCtx.EchoCtx.Response().Header().Set("HX-Redirect", "/login/")
+		return nil
+	}
 	hCtx.EchoCtx.Response().Header().Set("HX-Redirect", "/app/")
 	return nil
 }
@@ -83,8 +157,23 @@ func (hCtx *HandlerContext) loginEndpoint() error {
 		return errorDiv(hCtx.EchoCtx, errMsg)
 	}
 
-	ok := setCookie(hCtx.EchoCtx, uid)
-	if !ok {
+	// with two-factor on, the password only gets as far as asking for a code
+	twoFactor, err := twoFactorEnabled(hCtx.PGCtx, uid)
+	if err != nil {
+		log.Print(err)
+		return errorDiv(hCtx.EchoCtx, "Internal server error")
+	}
+	if twoFactor {
+		if err := startLoginChallenge(hCtx.PGCtx, hCtx.EchoCtx, uid); err != nil {
+			log.Printf("Failed to start login challenge for user %v: %v", uid, err)
+			return errorDiv(hCtx.EchoCtx, "Internal server error")
+		}
+		hCtx.EchoCtx.Response().Header().Set("HX-Redirect", "/login/two-factor/")
+		return nil
+	}
+
+	if err := startSession(hCtx.PGCtx, hCtx.EchoCtx, uid); err != nil {
+		log.Printf("Failed to start session for user %v: %v", uid, err)
 		return errorDiv(hCtx.EchoCtx, "Internal server error")
 	}
 
@@ -94,12 +183,19 @@ func (hCtx *HandlerContext) loginEndpoint() error {
 }
 
 func FileUpload(hCtx HandlerContext) error {
-	fileInput, err := _createFileInput(hCtx.EchoCtx)
-	if err != nil {
-		log.Printf("Failed to parse file upload: %v", err)
+	_, err := _readFileUploads(hCtx.EchoCtx, func(fileInput FileInput) error {
+		return SaveFile(hCtx.PGCtx, filesystem, fileInput)
+	})
+	if errors.Is(err, ErrFileTooLarge) {
+		return errorDiv(hCtx.EchoCtx, fmt.Sprintf("File is larger than the %d MB upload limit", maxUploadBytes>>20))
+	}
+	if errors.Is(err, ErrQuotaExceeded) {
+		uuid, _ := hCtx.EchoCtx.Get("ID").(string)
+		return errorDiv(hCtx.EchoCtx, quotaExceededMessage(hCtx.PGCtx, uuid))
+	}
+	if errors.Is(err, ErrFolderNotFound) {
+		return errorDiv(hCtx.EchoCtx, "Folder not found")
 	}
-
-	err = SaveFile(hCtx.PGCtx, filesystem, fileInput)
 	if err != nil {
 		log.Printf("Failed to save file; %v", err)
 		return errorDiv(hCtx.EchoCtx, "Failed to upload file")
@@ -107,19 +203,50 @@ func FileUpload(hCtx HandlerContext) error {
 	return successDiv(hCtx.EchoCtx, "Successfully uploaded file")
 }
 
-func FileDelete(hCtx HandlerContext) error {
+func FileExtractionStatus(hCtx HandlerContext, tmpl *template.Template) error {
 	fileId := hCtx.EchoCtx.QueryParam("file_id")
 
 	uuid, ok := hCtx.EchoCtx.Get("ID").(string)
 	if !ok {
 		return fmt.Errorf("Could not cast ID claim to string")
 	}
-	fileObject := FileObject{
-		FileId:      fileId,
-		AccountUUID: uuid,
+
+	var status, errMsg string
+	sqlStatement := `SELECT extraction_status, COALESCE(extraction_error, '') FROM files WHERE id = $1 AND account_uuid = $2`
+	err := hCtx.PGCtx.Pool.QueryRow(hCtx.PGCtx.Ctx, sqlStatement, fileId, uuid).Scan(&status, &errMsg)
+	if err != nil {
+		log.Printf("Failed to get extraction status for file %s: %v", fileId, err)
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	return renderExtractionCell(hCtx.EchoCtx, tmpl, cells.NewExtractionCell(fileId, status, errMsg))
+}
+
+func FileExtractionRetry(hCtx HandlerContext, tmpl *template.Template) error {
+	fileId := hCtx.EchoCtx.QueryParam("file_id")
+
+	uuid, ok := hCtx.EchoCtx.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	retried, err := extractionQueue.Retry(hCtx.PGCtx, fileId, uuid)
+	if err != nil {
+		log.Printf("Failed to retry extraction for file %s: %v", fileId, err)
+		return errorDiv(hCtx.EchoCtx, "Failed to retry text extraction")
+	}
+	if !retried {
+		return FileExtractionStatus(hCtx, tmpl)
 	}
+	return renderExtractionCell(hCtx.EchoCtx, tmpl, cells.NewExtractionCell(fileId, ExtractionPending, ""))
+}
 
-	return fileObject.Delete(hCtx.PGCtx, filesystem, false)
+func renderExtractionCell(c echo.Context, tmpl *template.Template, cell cells.ExtractionCell) error {
+	component := components.DivComponent{Data: cell}
+	rendered, err := component.RenderComponent(tmpl)
+	if err != nil {
+		return err
+	}
+	return c.HTML(http.StatusOK, string(rendered))
 }
 
 func serveTable[R rows.Row](hCtx *HandlerContext, tmpl *template.Template, tableName string, processor rows.RowProcessor[R]) error {
@@ -164,10 +291,31 @@ func serveTable[R rows.Row](hCtx *HandlerContext, tmpl *template.Template, table
 		uint32(itemsPerPage),
 		7,
 	)
+	table.Pagination.Data.Filter = tableFilter(hCtx.EchoCtx.QueryParams())
 
 	return table.RenderTable(hCtx.EchoCtx, hCtx.PGCtx, tmpl, processor)
 }
 
+// tableFilter keeps a table's query params other than its name and page, for the pagination links
+func tableFilter(params url.Values) string {
+	filter := url.Values{}
+	for key, values := range params {
+		switch key {
+		case "tableName", "page":
+			continue
+		}
+		for _, value := range values {
+			if value != "" {
+				filter.Add(key, value)
+			}
+		}
+	}
+	if len(filter) == 0 {
+		return ""
+	}
+	return "&" + filter.Encode()
+}
+
 func Table(hCtx *HandlerContext, tmpl *template.Template) error {
 	tableName := hCtx.EchoCtx.QueryParam("tableName")
 
@@ -176,9 +324,23 @@ func Table(hCtx *HandlerContext, tmpl *template.Template) error {
 		return serveTable[rows.AccountRow](hCtx, tmpl, tableName, processor)
 	}
 	if tableName == "Files" {
-		processor := rows.FileRowProcessor{}
+		processor := rows.FileRowProcessor{
+			FolderId: hCtx.EchoCtx.QueryParam("folder_id"),
+			Tag:      strings.ToLower(hCtx.EchoCtx.QueryParam("tag")),
+		}
+		if _, err := uuid.Parse(processor.FolderId); err != nil {
+			processor.FolderId = ""
+		}
 		return serveTable[rows.FileRow](hCtx, tmpl, tableName, processor)
 	}
+	if tableName == "Shared with me" {
+		processor := rows.SharedRowProcessor{}
+		return serveTable[rows.SharedRow](hCtx, tmpl, tableName, processor)
+	}
+	if tableName == "Trash" {
+		processor := rows.TrashRowProcessor{Retention: trashConfig.Retention}
+		return serveTable[rows.TrashRow](hCtx, tmpl, tableName, processor)
+	}
 	fmt.Printf("Invlaid table name: %s\n", tableName)
 	return nil
 }
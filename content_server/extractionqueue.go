@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Extraction statuses, shared by files.extraction_status and extraction_jobs.status
+const (
+	ExtractionPending = "pending"
+	ExtractionRunning = "running"
+	ExtractionDone    = "done"
+	ExtractionFailed  = "failed"
+)
+
+type ExtractionQueueConfig struct {
+	Workers      int
+	MaxAttempts  int
+	PollInterval time.Duration
+	// A running job whose lease expires (worker crashed mid-extraction) is picked up again
+	Lease       time.Duration
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+}
+
+func GetDefaultExtractionQueueConfig() ExtractionQueueConfig {
+	workers, err := strconv.Atoi(os.Getenv("EXTRACT_WORKERS"))
+	if err != nil || workers < 1 {
+		workers = 2
+	}
+	maxAttempts, err := strconv.Atoi(os.Getenv("EXTRACT_MAX_ATTEMPTS"))
+	if err != nil || maxAttempts < 1 {
+		maxAttempts = 5
+	}
+	return ExtractionQueueConfig{
+		Workers:      workers,
+		MaxAttempts:  maxAttempts,
+		PollInterval: 5 * time.Second,
+		Lease:        5 * time.Minute,
+		BaseBackoff:  10 * time.Second,
+		MaxBackoff:   10 * time.Minute,
+	}
+}
+
+// ExtractionQueue fills in files.raw_text in the background so uploads don't wait on extraction
+type ExtractionQueue struct {
+	Config ExtractionQueueConfig
+	PGCtx  *pg.PostgresContext
+	wake   chan struct{}
+}
+
+var extractionQueue *ExtractionQueue
+
+func NewExtractionQueue(pgContext *pg.PostgresContext, config ExtractionQueueConfig) *ExtractionQueue {
+	return &ExtractionQueue{
+		Config: config,
+		PGCtx:  pgContext,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+var errExtractionLeaseExpired = errors.New("extraction did not finish before its lease expired on the last attempt")
+
+type extractionJob struct {
+	ID          int64
+	FileId      string
+	Attempts    int
+	MaxAttempts int
+	Filepath    string
+	FileExt     string
+	// the storage backend holding the file, which may not be the one new uploads go to
+	Location string
+}
+
+// Enqueue schedules extraction for a file, or re-queues it if it already has a job
+func (q *ExtractionQueue) Enqueue(pgContext *pg.PostgresContext, fileId string) error {
+	sqlStatement := `
+	INSERT INTO extraction_jobs (file_id, max_attempts)
+	VALUES ($1, $2)
+	ON CONFLICT (file_id) DO UPDATE
+	SET status = 'pending', attempts = 0, run_after = now(), last_error = NULL, updated_at = now()`
+	_, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, fileId, q.Config.MaxAttempts)
+	if err != nil {
+		return fmt.Errorf("error enqueueing extraction job: %w", err)
+	}
+	q.notify()
+	return nil
+}
+
+// Retry re-queues a failed extraction. Returns false if the file isn't the account's or hasn't failed.
+func (q *ExtractionQueue) Retry(pgContext *pg.PostgresContext, fileId string, accountUUID string) (bool, error) {
+	sqlStatement := `
+	UPDATE files SET extraction_status = 'pending', extraction_error = NULL
+	WHERE id = $1 AND account_uuid = $2 AND extraction_status = 'failed' AND scan_status <> 'infected'`
+	tag, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, fileId, accountUUID)
+	if err != nil {
+		return false, fmt.Errorf("error resetting extraction status: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+	return true, q.Enqueue(pgContext, fileId)
+}
+
+func (q *ExtractionQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts the worker pool and blocks until ctx is cancelled
+func (q *ExtractionQueue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < q.Config.Workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			q.work(ctx, worker)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (q *ExtractionQueue) work(ctx context.Context, worker int) {
+	for {
+		processed, err := q.processNext(ctx)
+		if err != nil {
+			log.Printf("Extraction worker %d: %v", worker, err)
+		}
+		if processed {
+			// keep draining while there's work
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-time.After(q.Config.PollInterval):
+		}
+	}
+}
+
+func (q *ExtractionQueue) processNext(ctx context.Context) (bool, error) {
+	pgContext := &pg.PostgresContext{Pool: q.PGCtx.Pool, Ctx: ctx}
+	job, err := q.claim(pgContext)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	rawText, extractErr := q.extract(job)
+	if extractErr != nil {
+		log.Printf("Extraction attempt %d/%d failed for file %s: %v", job.Attempts, job.MaxAttempts, job.FileId, extractErr)
+		return true, q.fail(pgContext, job, extractErr)
+	}
+	return true, q.complete(pgContext, job, rawText)
+}
+
+func (q *ExtractionQueue) claim(pgContext *pg.PostgresContext) (extractionJob, error) {
+	job := extractionJob{}
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return job, err
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	// A worker that died on its last attempt leaves nothing to retry, so the job and its file
+	// are failed here rather than handed out again past max_attempts
+	expiredSql := `
+	WITH expired AS (
+		UPDATE extraction_jobs
+		SET status = 'failed', locked_until = NULL, last_error = $1, updated_at = now()
+		WHERE id IN (
+			SELECT id FROM extraction_jobs
+			WHERE status = 'running' AND locked_until < now() AND attempts >= max_attempts
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING file_id
+	)
+	UPDATE files SET extraction_status = 'failed', extraction_error = $1
+	WHERE id IN (SELECT file_id FROM expired)`
+	if _, err := tx.Exec(pgContext.Ctx, expiredSql, errExtractionLeaseExpired.Error()); err != nil {
+		return job, fmt.Errorf("error failing expired extraction jobs: %w", err)
+	}
+
+	sqlStatement := `
+	UPDATE extraction_jobs
+	SET status = 'running', attempts = attempts + 1, locked_until = now() + make_interval(secs => $1), updated_at = now()
+	WHERE id = (
+		SELECT id FROM extraction_jobs
+		WHERE (status = 'pending' AND run_after <= now())
+			OR (status = 'running' AND locked_until < now() AND attempts < max_attempts)
+		ORDER BY run_after
+		FOR UPDATE SKIP LOCKED
+		LIMIT 1
+	)
+	RETURNING id, file_id, attempts, max_attempts`
+	err = tx.QueryRow(pgContext.Ctx, sqlStatement, q.Config.Lease.Seconds()).Scan(
+		&job.ID, &job.FileId, &job.Attempts, &job.MaxAttempts,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// still commit any expired jobs failed above
+		if err := tx.Commit(pgContext.Ctx); err != nil {
+			return job, err
+		}
+		return job, pgx.ErrNoRows
+	}
+	if err != nil {
+		return job, err
+	}
+
+	fileSql := `
+	UPDATE files SET extraction_status = 'running'
+	WHERE id = $1
+	RETURNING filepath, file_ext, location`
+	err = tx.QueryRow(pgContext.Ctx, fileSql, job.FileId).Scan(&job.Filepath, &job.FileExt, &job.Location)
+	if err != nil {
+		return job, fmt.Errorf("error loading file %s for extraction job %d: %w", job.FileId, job.ID, err)
+	}
+	return job, tx.Commit(pgContext.Ctx)
+}
+
+func (q *ExtractionQueue) extract(job extractionJob) (rawText string, err error) {
+	// an extractor that panics on a malformed upload fails this attempt rather than the server,
+	// which would otherwise crash again on every worker that reclaims the job
+	defer func() {
+		if r := recover(); r != nil {
+			rawText = ""
+			err = fmt.Errorf("panic extracting text: %v", r)
+		}
+	}()
+
+	filesystem, err := getFilesystem(job.Location)
+	if err != nil {
+		return "", err
+	}
+	file, err := filesystem.Read(job.Filepath)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s from %s storage: %w", job.Filepath, job.Location, err)
+	}
+	defer file.Close()
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(file); err != nil {
+		return "", fmt.Errorf("error reading file into buffer: %w", err)
+	}
+	return extractText(buf, job.FileExt)
+}
+
+func (q *ExtractionQueue) complete(pgContext *pg.PostgresContext, job extractionJob, rawText string) error {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	// A new version uploaded mid-extraction re-queues the job and changes the filepath, so this
+	// result is stale and the queue has already moved on
+	fileSql := `
+	UPDATE files SET raw_text = $2, extraction_status = 'done', extraction_error = NULL
+	WHERE id = $1 AND filepath = $3`
+	if _, err := tx.Exec(pgContext.Ctx, fileSql, job.FileId, rawText, job.Filepath); err != nil {
+		return fmt.Errorf("error saving extracted text for file %s: %w", job.FileId, err)
+	}
+	jobSql := `
+	UPDATE extraction_jobs SET status = 'done', locked_until = NULL, last_error = NULL, updated_at = now()
+	WHERE id = $1 AND status = 'running'`
+	if _, err := tx.Exec(pgContext.Ctx, jobSql, job.ID); err != nil {
+		return fmt.Errorf("error completing extraction job %d: %w", job.ID, err)
+	}
+	return tx.Commit(pgContext.Ctx)
+}
+
+func (q *ExtractionQueue) fail(pgContext *pg.PostgresContext, job extractionJob, extractErr error) error {
+	status := ExtractionPending
+	if job.Attempts >= job.MaxAttempts {
+		status = ExtractionFailed
+	}
+	retryIn := q.backoff(job.Attempts)
+
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	jobSql := `
+	UPDATE extraction_jobs
+	SET status = $2, last_error = $3, locked_until = NULL, run_after = now() + make_interval(secs => $4), updated_at = now()
+	WHERE id = $1 AND status = 'running'`
+	if _, err := tx.Exec(pgContext.Ctx, jobSql, job.ID, status, extractErr.Error(), retryIn.Seconds()); err != nil {
+		return fmt.Errorf("error failing extraction job %d: %w", job.ID, err)
+	}
+	fileSql := `
+	UPDATE files SET extraction_status = $2, extraction_error = $3
+	WHERE id = $1 AND filepath = $4`
+	if _, err := tx.Exec(pgContext.Ctx, fileSql, job.FileId, status, extractErr.Error(), job.Filepath); err != nil {
+		return fmt.Errorf("error updating extraction status for file %s: %w", job.FileId, err)
+	}
+	return tx.Commit(pgContext.Ctx)
+}
+
+// backoff doubles the wait after each failed attempt, up to MaxBackoff
+func (q *ExtractionQueue) backoff(attempts int) time.Duration {
+	wait := q.Config.BaseBackoff
+	for i := 1; i < attempts && wait < q.Config.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, q.Config.MaxBackoff)
+}
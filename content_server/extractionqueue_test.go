@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	pg "goserve/postgres"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+func TestExtractionBackoffDoublesUpToTheCap(t *testing.T) {
+	q := &ExtractionQueue{Config: ExtractionQueueConfig{BaseBackoff: 10 * time.Second, MaxBackoff: time.Minute}}
+	want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for i, w := range want {
+		if got := q.backoff(i + 1); got != w {
+			t.Errorf("backoff after %d attempts = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+// indexTestFile records a file stored under filepath as an upload waiting for extraction
+func indexTestFile(t *testing.T, pgContext *pg.PostgresContext, filesystem Filesystem, accountUUID string, filepath string) string {
+	t.Helper()
+	fo := FileObject{
+		Filepath:         filepath,
+		AccountUUID:      accountUUID,
+		UploadTime:       time.Now(),
+		Filename:         filepath,
+		FileExt:          ".txt",
+		ExtractionStatus: ExtractionPending,
+	}
+	if err := fo.Index(pgContext, filesystem); err != nil {
+		t.Fatalf("indexing %s: %v", filepath, err)
+	}
+	return fo.FileId
+}
+
+func extractionStatus(t *testing.T, pgContext *pg.PostgresContext, fileId string) (string, string) {
+	t.Helper()
+	var status, rawText string
+	sqlStatement := `SELECT extraction_status, coalesce(raw_text, '') FROM files WHERE id = $1`
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, fileId).Scan(&status, &rawText); err != nil {
+		t.Fatalf("loading file %s: %v", fileId, err)
+	}
+	return status, rawText
+}
+
+func TestExtractionQueueRetriesUntilItGivesUp(t *testing.T) {
+	pgContext := newTestPG(t)
+	filesystem := newMemoryFilesystem("test")
+	account := createTestAccount(t, pgContext, "queue@example.com")
+	q := NewExtractionQueue(pgContext, ExtractionQueueConfig{Workers: 1, MaxAttempts: 2, Lease: time.Minute})
+
+	// the bytes aren't there yet, so every attempt fails
+	fileId := indexTestFile(t, pgContext, filesystem, account, "notes.txt")
+	if err := q.Enqueue(pgContext, fileId); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	for attempt := 1; attempt <= 2; attempt++ {
+		if processed, err := q.processNext(pgContext.Ctx); !processed || err != nil {
+			t.Fatalf("attempt %d = %v, %v; want it processed", attempt, processed, err)
+		}
+	}
+	if status, _ := extractionStatus(t, pgContext, fileId); status != ExtractionFailed {
+		t.Errorf("status after %d failed attempts = %q, want failed", 2, status)
+	}
+	if processed, err := q.processNext(pgContext.Ctx); processed || err != nil {
+		t.Errorf("a job that used up its attempts was picked up again: %v, %v", processed, err)
+	}
+
+	// retrying after the bytes turn up extracts them
+	filesystem.objects["notes.txt"] = []byte("hello from the queue")
+	if ok, err := q.Retry(pgContext, fileId, createTestAccount(t, pgContext, "other@example.com")); ok || err != nil {
+		t.Errorf("another account's retry = %v, %v; want it refused", ok, err)
+	}
+	if ok, err := q.Retry(pgContext, fileId, account); !ok || err != nil {
+		t.Fatalf("Retry = %v, %v", ok, err)
+	}
+	if processed, err := q.processNext(pgContext.Ctx); !processed || err != nil {
+		t.Fatalf("processNext after retry = %v, %v", processed, err)
+	}
+	if status, rawText := extractionStatus(t, pgContext, fileId); status != ExtractionDone || rawText != "hello from the queue" {
+		t.Errorf("after retry the file is %q with text %q", status, rawText)
+	}
+}
+
+func TestExtractionQueueReclaimsExpiredLeases(t *testing.T) {
+	pgContext := newTestPG(t)
+	filesystem := newMemoryFilesystem("test")
+	account := createTestAccount(t, pgContext, "lease@example.com")
+	q := NewExtractionQueue(pgContext, ExtractionQueueConfig{Workers: 1, MaxAttempts: 5, Lease: time.Minute})
+
+	fileId := indexTestFile(t, pgContext, filesystem, account, "lease.txt")
+	if err := q.Enqueue(pgContext, fileId); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	job, err := q.claim(pgContext)
+	if err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if _, err := q.claim(pgContext); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("claiming a leased job = %v, want no rows", err)
+	}
+
+	// the worker holding it died and the lease ran out
+	sqlStatement := `UPDATE extraction_jobs SET locked_until = now() - interval '1 second' WHERE id = $1`
+	if _, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, job.ID); err != nil {
+		t.Fatalf("expiring the lease: %v", err)
+	}
+	again, err := q.claim(pgContext)
+	if err != nil {
+		t.Fatalf("claim after the lease expired: %v", err)
+	}
+	if again.ID != job.ID || again.Attempts != 2 {
+		t.Errorf("reclaimed job %d on attempt %d, want job %d on attempt 2", again.ID, again.Attempts, job.ID)
+	}
+}
+
+func TestExtractionQueueFailsExpiredLeasesOnTheLastAttempt(t *testing.T) {
+	pgContext := newTestPG(t)
+	filesystem := newMemoryFilesystem("test")
+	account := createTestAccount(t, pgContext, "last-lease@example.com")
+	q := NewExtractionQueue(pgContext, ExtractionQueueConfig{Workers: 1, MaxAttempts: 1, Lease: time.Minute})
+
+	fileId := indexTestFile(t, pgContext, filesystem, account, "last-lease.txt")
+	if err := q.Enqueue(pgContext, fileId); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	job, err := q.claim(pgContext)
+	if err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+
+	// the worker died on the only attempt the job had
+	sqlStatement := `UPDATE extraction_jobs SET locked_until = now() - interval '1 second' WHERE id = $1`
+	if _, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, job.ID); err != nil {
+		t.Fatalf("expiring the lease: %v", err)
+	}
+	if again, err := q.claim(pgContext); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("claim after the last lease expired = job %d on attempt %d, %v; want no rows", again.ID, again.Attempts, err)
+	}
+
+	var jobStatus string
+	jobSql := `SELECT status FROM extraction_jobs WHERE id = $1`
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, jobSql, job.ID).Scan(&jobStatus); err != nil {
+		t.Fatalf("loading job %d: %v", job.ID, err)
+	}
+	if jobStatus != ExtractionFailed {
+		t.Errorf("job status = %q, want failed", jobStatus)
+	}
+	if status, _ := extractionStatus(t, pgContext, fileId); status != ExtractionFailed {
+		t.Errorf("file status = %q, want failed", status)
+	}
+}
+
+func TestExtractRecoversPanics(t *testing.T) {
+	newPanickingFilesystem("test-panicking")
+	q := NewExtractionQueue(nil, GetDefaultExtractionQueueConfig())
+
+	_, err := q.extract(extractionJob{FileId: "f", Filepath: "bad.txt", FileExt: ".txt", Location: "test-panicking"})
+	if err == nil || !strings.Contains(err.Error(), "panic") {
+		t.Fatalf("extract = %v, want the panic as an error", err)
+	}
+}
+
+func TestExtractReadsFromTheFilesBackend(t *testing.T) {
+	other := newMemoryFilesystem("test-other-backend")
+	other.objects["notes.txt"] = []byte("stored on the other backend")
+	q := NewExtractionQueue(nil, GetDefaultExtractionQueueConfig())
+
+	text, err := q.extract(extractionJob{FileId: "f", Filepath: "notes.txt", FileExt: ".txt", Location: "test-other-backend"})
+	if err != nil {
+		t.Fatalf("extract: %v", err)
+	}
+	if text != "stored on the other backend" {
+		t.Errorf("extract = %q", text)
+	}
+
+	if _, err := q.extract(extractionJob{FileId: "f", Filepath: "notes.txt", FileExt: ".txt", Location: "unconfigured"}); err == nil {
+		t.Error("extract from an unconfigured backend succeeded")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TextExtractor pulls plain text out of an uploaded file for files.raw_text
+type TextExtractor interface {
+	Name() string
+	Extract(buf bytes.Buffer) (string, error)
+}
+
+type extractorFunc struct {
+	name string
+	fn   func(bytes.Buffer) (string, error)
+}
+
+func (e extractorFunc) Name() string { return e.name }
+
+func (e extractorFunc) Extract(buf bytes.Buffer) (string, error) { return e.fn(buf) }
+
+// NewExtractor adapts a plain reader function to the TextExtractor interface
+func NewExtractor(name string, fn func(bytes.Buffer) (string, error)) TextExtractor {
+	return extractorFunc{name: name, fn: fn}
+}
+
+const (
+	mimePdf      = "application/pdf"
+	mimeDocx     = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	mimeOdt      = "application/vnd.oasis.opendocument.text"
+	mimeDoc      = "application/msword"
+	mimeRtf      = "application/rtf"
+	mimeHtml     = "text/html"
+	mimeMarkdown = "text/markdown"
+	mimeText     = "text/plain"
+	mimeZip      = "application/zip"
+	mimeUnknown  = "application/octet-stream"
+)
+
+type registeredExtractor struct {
+	Extractor TextExtractor
+	Priority  int
+	order     int // registration order breaks priority ties
+}
+
+// ExtractorRegistry maps sniffed MIME types and filename extensions to extractors.
+// Several extractors may claim the same type; they're tried highest priority first
+// until one succeeds.
+type ExtractorRegistry struct {
+	mu     sync.RWMutex
+	byMime map[string][]registeredExtractor
+	byExt  map[string][]registeredExtractor
+	count  int
+}
+
+func NewExtractorRegistry() *ExtractorRegistry {
+	return &ExtractorRegistry{
+		byMime: map[string][]registeredExtractor{},
+		byExt:  map[string][]registeredExtractor{},
+	}
+}
+
+var extractorRegistry = NewExtractorRegistry()
+
+// RegisterExtractor adds an extractor to the default registry, typically from an init func
+func RegisterExtractor(extractor TextExtractor, priority int, mimeTypes []string, exts []string) {
+	extractorRegistry.Register(extractor, priority, mimeTypes, exts)
+}
+
+func (r *ExtractorRegistry) Register(extractor TextExtractor, priority int, mimeTypes []string, exts []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry := registeredExtractor{Extractor: extractor, Priority: priority, order: r.count}
+	r.count++
+	for _, mimeType := range mimeTypes {
+		r.byMime[mimeType] = insertByPriority(r.byMime[mimeType], entry)
+	}
+	for _, ext := range exts {
+		ext = strings.ToLower(ext)
+		r.byExt[ext] = insertByPriority(r.byExt[ext], entry)
+	}
+}
+
+func insertByPriority(entries []registeredExtractor, entry registeredExtractor) []registeredExtractor {
+	entries = append(entries, entry)
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Priority != entries[j].Priority {
+			return entries[i].Priority > entries[j].Priority
+		}
+		return entries[i].order < entries[j].order
+	})
+	return entries
+}
+
+// Chain returns the extractors to try for a file, in order.
+// A specific sniffed MIME type decides on its own, so a pdf renamed to .docx still goes to the
+// pdf reader and a png renamed to .txt gets no extractor at all. Plain text and unknown content
+// can't be told apart by sniffing (markdown vs txt), so those fall back on the extension first.
+func (r *ExtractorRegistry) Chain(mimeType string, ext string) []TextExtractor {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var entries []registeredExtractor
+	generic := mimeType == mimeText || mimeType == mimeUnknown
+	if !generic {
+		entries = r.byMime[mimeType]
+	} else {
+		entries = append(entries, r.byExt[strings.ToLower(ext)]...)
+		entries = append(entries, r.byMime[mimeType]...)
+	}
+
+	seen := map[int]bool{}
+	chain := []TextExtractor{}
+	for _, entry := range entries {
+		if seen[entry.order] {
+			continue
+		}
+		seen[entry.order] = true
+		chain = append(chain, entry.Extractor)
+	}
+	return chain
+}
+
+func (r *ExtractorRegistry) Extract(buf bytes.Buffer, ext string) (string, error) {
+	mimeType := sniffMimeType(buf.Bytes())
+	chain := r.Chain(mimeType, ext)
+	if len(chain) == 0 {
+		return "", fmt.Errorf("unsupported file type %s (%s)", mimeType, ext)
+	}
+
+	var errs []error
+	for _, extractor := range chain {
+		text, err := extractor.Extract(buf)
+		if err == nil {
+			return text, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", extractor.Name(), err))
+	}
+	return "", fmt.Errorf("all extractors failed for %s: %w", mimeType, errors.Join(errs...))
+}
+
+// sniffMimeType identifies a file from its content. net/http covers the common web types;
+// office formats are zips or OLE containers that it can't tell apart.
+func sniffMimeType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte(`{\rtf`)):
+		return mimeRtf
+	case bytes.HasPrefix(data, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}):
+		return mimeDoc
+	}
+
+	mimeType, _, _ := strings.Cut(http.DetectContentType(data), ";")
+	if mimeType == mimeZip {
+		return sniffZipMimeType(data)
+	}
+	return mimeType
+}
+
+func sniffZipMimeType(data []byte) string {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return mimeZip
+	}
+	for _, entry := range archive.File {
+		switch entry.Name {
+		case "word/document.xml":
+			return mimeDocx
+		case "mimetype":
+			// OpenDocument stores its MIME type uncompressed as the first entry
+			rc, err := entry.Open()
+			if err != nil {
+				return mimeZip
+			}
+			declared, err := io.ReadAll(io.LimitReader(rc, 128))
+			rc.Close()
+			if err != nil {
+				return mimeZip
+			}
+			return strings.TrimSpace(string(declared))
+		}
+	}
+	return mimeZip
+}
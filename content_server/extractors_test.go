@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func namedExtractor(name string) TextExtractor {
+	return NewExtractor(name, func(bytes.Buffer) (string, error) { return name, nil })
+}
+
+func chainNames(chain []TextExtractor) []string {
+	names := []string{}
+	for _, extractor := range chain {
+		names = append(names, extractor.Name())
+	}
+	return names
+}
+
+func TestExtractorRegistryChain(t *testing.T) {
+	r := NewExtractorRegistry()
+	r.Register(namedExtractor("pdf-fallback"), 10, []string{mimePdf}, []string{".pdf"})
+	r.Register(namedExtractor("pdf"), 100, []string{mimePdf}, []string{".pdf"})
+	r.Register(namedExtractor("docx"), 100, []string{mimeDocx}, []string{".docx"})
+	r.Register(namedExtractor("markdown"), 100, []string{mimeMarkdown}, []string{".md"})
+	r.Register(namedExtractor("txt"), 0, []string{mimeText}, []string{".txt"})
+	r.Register(namedExtractor("txt-too"), 0, []string{mimeText}, nil)
+
+	tests := []struct {
+		name     string
+		mimeType string
+		ext      string
+		want     []string
+	}{
+		{"sniffed type beats the extension", mimePdf, ".docx", []string{"pdf", "pdf-fallback"}},
+		{"extension of generic text comes first", mimeText, ".md", []string{"markdown", "txt", "txt-too"}},
+		{"registered under both only once", mimeText, ".txt", []string{"txt", "txt-too"}},
+		{"unknown content goes by extension", mimeUnknown, ".docx", []string{"docx"}},
+		{"extensions ignore case", mimeUnknown, ".PDF", []string{"pdf", "pdf-fallback"}},
+		{"nothing registered", mimeUnknown, ".exe", []string{}},
+		{"specific type with nothing registered ignores the extension", "image/png", ".txt", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chainNames(r.Chain(tt.mimeType, tt.ext)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Chain(%s, %s) = %v, want %v", tt.mimeType, tt.ext, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractorRegistryExtractTriesTheChainInOrder(t *testing.T) {
+	r := NewExtractorRegistry()
+	var tried []string
+	fails := func(name string) TextExtractor {
+		return NewExtractor(name, func(bytes.Buffer) (string, error) {
+			tried = append(tried, name)
+			return "", errors.New(name + " can't read it")
+		})
+	}
+	r.Register(fails("first"), 100, []string{mimeText}, nil)
+	r.Register(fails("second"), 50, []string{mimeText}, nil)
+	r.Register(NewExtractor("last", func(buf bytes.Buffer) (string, error) {
+		tried = append(tried, "last")
+		return buf.String(), nil
+	}), 0, []string{mimeText}, nil)
+
+	text, err := r.Extract(*bytes.NewBufferString("plain words"), ".txt")
+	if err != nil || text != "plain words" {
+		t.Errorf("Extract = %q, %v", text, err)
+	}
+	if !reflect.DeepEqual(tried, []string{"first", "second", "last"}) {
+		t.Errorf("tried %v, want highest priority first until one succeeds", tried)
+	}
+
+	if _, err := r.Extract(*bytes.NewBufferString("plain words"), ".exe"); err != nil {
+		t.Errorf("Extract by sniffed type = %v", err)
+	}
+	if _, err := NewExtractorRegistry().Extract(*bytes.NewBufferString("plain words"), ".txt"); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Errorf("Extract with nothing registered = %v, want unsupported file type", err)
+	}
+}
+
+func TestSniffMimeType(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"pdf", readTestdata(t, "two-pages.pdf"), mimePdf},
+		{"docx", zipWithEntry(t, "word/document.xml", "<w:document/>"), mimeDocx},
+		{"odt", zipWithEntry(t, "mimetype", mimeOdt), mimeOdt},
+		{"other zip", zipWithEntry(t, "notes.txt", "hi"), mimeZip},
+		{"rtf", []byte(`{\rtf1 hello}`), mimeRtf},
+		{"html", []byte("<!DOCTYPE html><p>hi</p>"), mimeHtml},
+		{"text", []byte("just text"), mimeText},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffMimeType(tt.data); got != tt.want {
+				t.Errorf("sniffMimeType = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
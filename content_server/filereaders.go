@@ -1,16 +1,48 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dslipak/pdf"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"golang.org/x/net/html"
+	"golang.org/x/text/encoding/charmap"
 )
 
+func init() {
+	// pdfcpu otherwise writes a config.yml into the user's config dir on first use
+	api.DisableConfigDir()
+
+	RegisterExtractor(NewExtractor("txt", readTxt), 0, []string{mimeText}, []string{".txt", ".text"})
+	RegisterExtractor(NewExtractor("pdf", readPdf), 100, []string{mimePdf}, []string{".pdf"})
+	if extractPdfAPIEndpoint != "" {
+		RegisterExtractor(NewExtractor("pdf-sidecar", readPdfSidecar), 10, []string{mimePdf}, []string{".pdf"})
+	}
+	RegisterExtractor(NewExtractor("docx", readDocx), 100, []string{mimeDocx}, []string{".docx"})
+	RegisterExtractor(NewExtractor("odt", readOdt), 100, []string{mimeOdt}, []string{".odt"})
+	RegisterExtractor(NewExtractor("rtf", readRtf), 100, []string{mimeRtf}, []string{".rtf"})
+	RegisterExtractor(NewExtractor("html", readHtml), 100, []string{mimeHtml}, []string{".html", ".htm"})
+	RegisterExtractor(NewExtractor("markdown", readMarkdown), 100, []string{mimeMarkdown}, []string{".md", ".markdown"})
+}
+
 func readTxt(buf bytes.Buffer) (string, error) {
 	reader := bytes.NewReader(buf.Bytes())
 	writer := new(strings.Builder)
@@ -21,16 +53,190 @@ func readTxt(buf bytes.Buffer) (string, error) {
 	return buf.String(), nil
 }
 
-const extractPdfAPIEndpoint = "http://localhost:8000/extract/text"
+// pdfPageBreak separates pages in extracted pdf text, same as pdftotext
+const pdfPageBreak = "\f"
+
+// Optional fallback to the pdfreader sidecar, only registered when PDF_EXTRACT_ENDPOINT is set
+// e.g. PDF_EXTRACT_ENDPOINT=http://localhost:8000/extract/text
+var extractPdfAPIEndpoint = os.Getenv("PDF_EXTRACT_ENDPOINT")
 
 func readPdf(buf bytes.Buffer) (string, error) {
+	text, err := readPdfNative(buf.Bytes())
+	if err == nil {
+		return text, nil
+	}
+	log.Printf("Native pdf extraction failed: %v", err)
+
+	// pdfcpu can repair broken xref tables and strip empty-password encryption,
+	// both of which trip up the native reader
+	normalized, normErr := normalizePdf(buf.Bytes())
+	if normErr != nil {
+		log.Printf("Failed to normalize pdf: %v", normErr)
+		return "", err
+	}
+	return readPdfNative(normalized)
+}
+
+func readPdfNative(data []byte) (text string, err error) {
+	// the pdf package panics on malformed content streams
+	defer func() {
+		if r := recover(); r != nil {
+			text = ""
+			err = fmt.Errorf("panic reading pdf: %v", r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("error opening pdf: %w", err)
+	}
+
+	pages := make([]string, 0, reader.NumPage())
+	hasText := false
+	for pageNum := 1; pageNum <= reader.NumPage(); pageNum++ {
+		page := reader.Page(pageNum)
+		if page.V.IsNull() {
+			pages = append(pages, "")
+			continue
+		}
+		pageText := pdfPageText(page.Content().Text)
+		if strings.TrimSpace(pageText) != "" {
+			hasText = true
+		}
+		pages = append(pages, pageText)
+	}
+
+	if !hasText {
+		return "", fmt.Errorf("no extractable text in pdf (scanned document?)")
+	}
+	return strings.Join(pages, pdfPageBreak), nil
+}
+
+// pdfLine is a run of glyphs sharing a baseline
+type pdfLine struct {
+	Y      float64
+	Size   float64
+	Glyphs []pdf.Text
+}
+
+func pdfPageText(glyphs []pdf.Text) string {
+	// Group glyphs into lines by baseline, top to bottom, then left to right within a line
+	sorted := make([]pdf.Text, len(glyphs))
+	copy(sorted, glyphs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Y != sorted[j].Y {
+			return sorted[i].Y > sorted[j].Y
+		}
+		return sorted[i].X < sorted[j].X
+	})
+
+	var lines []*pdfLine
+	for _, glyph := range sorted {
+		if glyph.S == "" {
+			continue
+		}
+		var line *pdfLine
+		if len(lines) > 0 {
+			last := lines[len(lines)-1]
+			tolerance := math.Max(math.Min(last.Size, glyph.FontSize)*0.4, 1)
+			if math.Abs(last.Y-glyph.Y) <= tolerance {
+				line = last
+			}
+		}
+		if line == nil {
+			line = &pdfLine{Y: glyph.Y, Size: glyph.FontSize}
+			lines = append(lines, line)
+		}
+		line.Glyphs = append(line.Glyphs, glyph)
+	}
+
+	var text strings.Builder
+	var prev *pdfLine
+	for _, line := range lines {
+		if prev != nil {
+			text.WriteString("\n")
+			// keep paragraph breaks where the vertical gap is well beyond normal leading
+			if prev.Y-line.Y > math.Max(prev.Size, line.Size)*2 {
+				text.WriteString("\n")
+			}
+		}
+		text.WriteString(pdfLineText(line.Glyphs))
+		prev = line
+	}
+	return text.String()
+}
+
+func pdfLineText(glyphs []pdf.Text) string {
+	sort.SliceStable(glyphs, func(i, j int) bool {
+		return glyphs[i].X < glyphs[j].X
+	})
+
+	var text strings.Builder
+	var lastEnd float64
+	for idx, glyph := range glyphs {
+		if idx > 0 {
+			gap := glyph.X - lastEnd
+			// the pdf rarely encodes spaces explicitly, infer them from the horizontal gap
+			if gap > glyph.FontSize*0.15 && !strings.HasSuffix(text.String(), " ") && glyph.S != " " {
+				text.WriteString(" ")
+			}
+		}
+		text.WriteString(glyph.S)
+		lastEnd = glyph.X + pdfGlyphWidth(glyph)
+	}
+	return strings.TrimRight(text.String(), " ")
+}
+
+func pdfGlyphWidth(glyph pdf.Text) float64 {
+	if glyph.W > 0 {
+		return glyph.W
+	}
+	// The reader only knows simple font width tables, so composite (Type0) fonts come back
+	// with no width. Fall back to Helvetica metrics, close enough to place word gaps.
+	var width float64
+	for _, ch := range glyph.S {
+		w := 556
+		if ch >= ' ' && int(ch-' ') < len(helveticaWidths) {
+			w = helveticaWidths[ch-' ']
+		}
+		width += float64(w) / 1000 * glyph.FontSize
+	}
+	return width
+}
+
+// Glyph widths of the standard Helvetica font for ' ' through '~', in 1/1000 em
+var helveticaWidths = []int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278, // ' ' - '/'
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556, // '0' - '?'
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778, // '@' - 'O'
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556, // 'P' - '_'
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556, // '`' - 'o'
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584, // 'p' - '~'
+}
+
+func normalizePdf(data []byte) ([]byte, error) {
+	// written back with a classic xref table, the reader finds no pages behind an xref stream
+	conf := model.NewDefaultConfiguration()
+	conf.WriteObjectStream = false
+	conf.WriteXRefStream = false
+
+	var out bytes.Buffer
+	err := api.Decrypt(bytes.NewReader(data), &out, conf)
+	if err == nil {
+		return out.Bytes(), nil
+	}
+
+	out.Reset()
+	if err := api.Optimize(bytes.NewReader(data), &out, conf); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func readPdfSidecar(buf bytes.Buffer) (string, error) {
 	// Prepare a form that you will submit to your FastAPI server
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
-	// part, err := writer.CreateFormFile("file", "filename.pdf")
-	// if err != nil {
-	// 	return "", err
-	// }
 	h := make(textproto.MIMEHeader)
 	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, "filename.pdf"))
 	h.Set("Content-Type", "application/pdf")
@@ -48,7 +254,7 @@ func readPdf(buf bytes.Buffer) (string, error) {
 	writer.Close()
 
 	// Create a HTTP client and post the request
-	client := &http.Client{}
+	client := &http.Client{Timeout: 30 * time.Second}
 	req, err := http.NewRequest("POST", extractPdfAPIEndpoint, body)
 	if err != nil {
 		return "", err
@@ -86,3 +292,472 @@ func readPdf(buf bytes.Buffer) (string, error) {
 
 	return extractedText, nil
 }
+
+// Office documents
+
+// maxArchiveEntrySize caps how much of a single zip entry we'll inflate, so a zip bomb
+// disguised as a .docx can't exhaust memory
+const maxArchiveEntrySize = 64 << 20
+
+func readZipEntry(buf bytes.Buffer, name string) ([]byte, error) {
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		return nil, fmt.Errorf("error opening archive: %w", err)
+	}
+	for _, entry := range archive.File {
+		if entry.Name != name {
+			continue
+		}
+		rc, err := entry.Open()
+		if err != nil {
+			return nil, fmt.Errorf("error opening %s: %w", name, err)
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(io.LimitReader(rc, maxArchiveEntrySize+1))
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", name, err)
+		}
+		if len(data) > maxArchiveEntrySize {
+			return nil, fmt.Errorf("%s exceeds %d bytes uncompressed", name, maxArchiveEntrySize)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("archive has no %s", name)
+}
+
+func readDocx(buf bytes.Buffer) (string, error) {
+	data, err := readZipEntry(buf, "word/document.xml")
+	if err != nil {
+		return "", fmt.Errorf("error reading .docx file: %w", err)
+	}
+
+	var text strings.Builder
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	inText := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("error parsing .docx xml: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				text.WriteString("\t")
+			case "br", "cr":
+				text.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				text.WriteString("\n")
+			case "tc":
+				text.WriteString("\t")
+			}
+		case xml.CharData:
+			if inText {
+				text.Write(t)
+			}
+		}
+	}
+	return cleanText(text.String()), nil
+}
+
+// maxOdtSpaceRun caps <text:s text:c=…>, so a huge count in a crafted file can't exhaust memory
+const maxOdtSpaceRun = 1024
+
+func readOdt(buf bytes.Buffer) (string, error) {
+	data, err := readZipEntry(buf, "content.xml")
+	if err != nil {
+		return "", fmt.Errorf("error reading .odt file: %w", err)
+	}
+
+	var text strings.Builder
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	bodyDepth := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("error parsing .odt xml: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "body" {
+				bodyDepth++
+			}
+			switch t.Name.Local {
+			case "s":
+				// <text:s text:c="3"/> is a run of spaces
+				count := 1
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "c" {
+						if n, err := strconv.Atoi(attr.Value); err == nil {
+							count = min(max(n, 1), maxOdtSpaceRun)
+						}
+					}
+				}
+				text.WriteString(strings.Repeat(" ", count))
+			case "tab":
+				text.WriteString("\t")
+			case "line-break":
+				text.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "body":
+				bodyDepth--
+			case "p", "h":
+				text.WriteString("\n")
+			}
+		case xml.CharData:
+			if bodyDepth > 0 {
+				text.Write(t)
+			}
+		}
+	}
+	return cleanText(text.String()), nil
+}
+
+// RTF
+
+// Destinations whose contents are metadata or binary rather than document text
+var rtfSkipDestinations = map[string]bool{
+	"fonttbl": true, "colortbl": true, "stylesheet": true, "info": true, "pict": true,
+	"object": true, "header": true, "footer": true, "headerl": true, "headerr": true,
+	"footerl": true, "footerr": true, "themedata": true, "colorschememapping": true,
+	"datastore": true, "latentstyles": true, "listtable": true, "listoverridetable": true,
+	"rsidtbl": true, "generator": true, "xmlnstbl": true, "mmathPr": true,
+}
+
+func readRtf(buf bytes.Buffer) (string, error) {
+	data := buf.Bytes()
+	if !bytes.HasPrefix(data, []byte("{\\rtf")) {
+		return "", fmt.Errorf("error reading .rtf file: missing {\\rtf header")
+	}
+
+	type rtfGroup struct {
+		skip      bool
+		ucSkip    int
+		firstWord bool
+	}
+	stack := []rtfGroup{{ucSkip: 1}}
+	var text strings.Builder
+	pendingSkip := 0 // characters to drop after a \u escape
+	decoder := charmap.Windows1252.NewDecoder()
+
+	emit := func(s string) {
+		if stack[len(stack)-1].skip {
+			return
+		}
+		for _, r := range s {
+			if pendingSkip > 0 {
+				pendingSkip--
+				continue
+			}
+			text.WriteRune(r)
+		}
+	}
+
+	for i := 0; i < len(data); i++ {
+		ch := data[i]
+		group := &stack[len(stack)-1]
+		switch ch {
+		case '{':
+			stack = append(stack, rtfGroup{skip: group.skip, ucSkip: group.ucSkip, firstWord: true})
+		case '}':
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case '\\':
+			if i+1 >= len(data) {
+				break
+			}
+			next := data[i+1]
+			switch {
+			case next == '\'':
+				// \'hh is a code page 1252 byte
+				if i+3 < len(data) {
+					if b, err := strconv.ParseUint(string(data[i+2:i+4]), 16, 8); err == nil {
+						decoded, _ := decoder.Bytes([]byte{byte(b)})
+						emit(string(decoded))
+					}
+				}
+				i += 3
+			case next == '*':
+				// \* marks an optional destination we don't understand
+				group.skip = true
+				i++
+			case next == '\\' || next == '{' || next == '}':
+				emit(string(next))
+				i++
+			case next == '~':
+				emit("\u00a0")
+				i++
+			case next == '-' || next == '_':
+				i++
+			case next == '\n' || next == '\r':
+				emit("\n")
+				i++
+			case isAsciiLetter(next):
+				j := i + 1
+				for j < len(data) && isAsciiLetter(data[j]) {
+					j++
+				}
+				word := string(data[i+1 : j])
+				k := j
+				if k < len(data) && (data[k] == '-' || (data[k] >= '0' && data[k] <= '9')) {
+					k++
+					for k < len(data) && data[k] >= '0' && data[k] <= '9' {
+						k++
+					}
+				}
+				param, hasParam := 0, k > j
+				if hasParam {
+					param, _ = strconv.Atoi(string(data[j:k]))
+				}
+				if k < len(data) && data[k] == ' ' {
+					k++ // the delimiting space belongs to the control word
+				}
+				i = k - 1
+
+				if group.firstWord && rtfSkipDestinations[word] {
+					group.skip = true
+				}
+				group.firstWord = false
+				switch word {
+				case "par", "line", "sect", "page", "row":
+					emit("\n")
+				case "tab", "cell":
+					emit("\t")
+				case "emdash":
+					emit("\u2014")
+				case "endash":
+					emit("\u2013")
+				case "bullet":
+					emit("\u2022")
+				case "lquote":
+					emit("\u2018")
+				case "rquote":
+					emit("\u2019")
+				case "ldblquote":
+					emit("\u201c")
+				case "rdblquote":
+					emit("\u201d")
+				case "uc":
+					group.ucSkip = param
+				case "u":
+					if param < 0 {
+						param += 65536
+					}
+					emit(string(rune(param)))
+					if !group.skip {
+						pendingSkip = group.ucSkip
+					}
+				case "bin":
+					// \binN is followed by N raw bytes; a length that doesn't fit the data is the end of it
+					if param < 0 || param > len(data)-1-i {
+						i = len(data)
+					} else {
+						i += param
+					}
+				}
+				continue
+			default:
+				i++
+			}
+			group.firstWord = false
+		case '\r', '\n':
+			// raw line breaks are insignificant in rtf
+		default:
+			group.firstWord = false
+			emit(string(ch))
+		}
+	}
+	return cleanText(text.String()), nil
+}
+
+func isAsciiLetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// HTML
+
+var htmlBlockElements = map[string]bool{
+	"p": true, "div": true, "section": true, "article": true, "header": true, "footer": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "ul": true, "ol": true,
+	"table": true, "tr": true, "blockquote": true, "pre": true, "hr": true, "dl": true,
+	"dt": true, "dd": true, "main": true, "nav": true, "aside": true, "address": true, "form": true,
+}
+
+var htmlSkipElements = map[string]bool{
+	"script": true, "style": true, "head": true, "noscript": true, "template": true, "svg": true,
+}
+
+var htmlWhitespace = regexp.MustCompile(`[ \t\r\n\f]+`)
+
+func readHtml(buf bytes.Buffer) (string, error) {
+	tokenizer := html.NewTokenizer(bytes.NewReader(buf.Bytes()))
+	var text strings.Builder
+	skipDepth := 0
+	preDepth := 0
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			if tokenizer.Err() == io.EOF {
+				return cleanText(text.String()), nil
+			}
+			return "", fmt.Errorf("error parsing html: %w", tokenizer.Err())
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			tag := string(name)
+			if htmlSkipElements[tag] && tokenType == html.StartTagToken {
+				skipDepth++
+			}
+			switch {
+			case tag == "br":
+				text.WriteString("\n")
+			case tag == "img":
+				// keep alt text, it's often the only label on logos and icons
+				for {
+					key, val, more := tokenizer.TagAttr()
+					if string(key) == "alt" && len(val) > 0 {
+						text.WriteString(" " + string(val) + " ")
+					}
+					if !more {
+						break
+					}
+				}
+			case tag == "li":
+				text.WriteString("\n- ")
+			case tag == "td" || tag == "th":
+				text.WriteString("\t")
+			case tag == "pre":
+				preDepth++
+				text.WriteString("\n")
+			case htmlBlockElements[tag]:
+				text.WriteString("\n")
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			tag := string(name)
+			if htmlSkipElements[tag] && skipDepth > 0 {
+				skipDepth--
+			}
+			if tag == "pre" && preDepth > 0 {
+				preDepth--
+			}
+			if htmlBlockElements[tag] {
+				text.WriteString("\n")
+			}
+		case html.TextToken:
+			if skipDepth > 0 {
+				continue
+			}
+			chunk := string(tokenizer.Text())
+			if preDepth == 0 {
+				chunk = htmlWhitespace.ReplaceAllString(chunk, " ")
+				if strings.HasSuffix(text.String(), " ") || strings.HasSuffix(text.String(), "\n") {
+					chunk = strings.TrimLeft(chunk, " ")
+				}
+			}
+			text.WriteString(chunk)
+		}
+	}
+}
+
+// Markdown
+
+var (
+	mdFence        = regexp.MustCompile("^\\s*(```|~~~)")
+	mdHeading      = regexp.MustCompile(`^\s{0,3}#{1,6}\s+(.*?)\s*#*\s*$`)
+	mdSetextUnder  = regexp.MustCompile(`^\s{0,3}(=+|-+)\s*$`)
+	mdRule         = regexp.MustCompile(`^\s{0,3}([-*_])(\s*[-*_]){2,}\s*$`)
+	mdBlockquote   = regexp.MustCompile(`^\s{0,3}>\s?`)
+	mdBullet       = regexp.MustCompile(`^(\s*)[-*+]\s+(\[[ xX]\]\s+)?`)
+	mdImage        = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	mdLink         = regexp.MustCompile(`\[([^\]]+)\](\([^)]*\)|\[[^\]]*\])`)
+	mdLinkDef      = regexp.MustCompile(`^\s{0,3}\[[^\]]+\]:\s+\S+`)
+	mdAutolink     = regexp.MustCompile(`<((https?|mailto):[^>]+)>`)
+	mdInlineCode   = regexp.MustCompile("`+([^`]+)`+")
+	mdStrong       = regexp.MustCompile(`(\*\*|__)(\S(.*?\S)?)(\*\*|__)`)
+	mdEmphasis     = regexp.MustCompile(`(^|[^\w*])[*_](\S(.*?\S)?)[*_]($|[^\w*])`)
+	mdStrike       = regexp.MustCompile(`~~(.+?)~~`)
+	mdHtmlTag      = regexp.MustCompile(`</?[a-zA-Z][^>]*>`)
+	mdTableDivider = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+)
+
+func readMarkdown(buf bytes.Buffer) (string, error) {
+	if !utf8.Valid(buf.Bytes()) {
+		return "", fmt.Errorf("error reading .md file: not valid utf-8")
+	}
+
+	var text strings.Builder
+	inFence := false
+	for _, line := range strings.Split(buf.String(), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if mdFence.MatchString(line) {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			// code blocks are kept verbatim
+			text.WriteString(line + "\n")
+			continue
+		}
+		if mdTableDivider.MatchString(line) || mdLinkDef.MatchString(line) {
+			continue
+		}
+		if mdSetextUnder.MatchString(line) || mdRule.MatchString(line) {
+			text.WriteString("\n")
+			continue
+		}
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			line = m[1]
+		}
+		for mdBlockquote.MatchString(line) {
+			line = mdBlockquote.ReplaceAllString(line, "")
+		}
+		line = mdBullet.ReplaceAllString(line, "$1- ")
+		line = mdImage.ReplaceAllString(line, "$1")
+		line = mdLink.ReplaceAllString(line, "$1")
+		line = mdAutolink.ReplaceAllString(line, "$1")
+		line = mdInlineCode.ReplaceAllString(line, "$1")
+		line = mdStrong.ReplaceAllString(line, "$2")
+		line = mdEmphasis.ReplaceAllString(line, "$1$2$4")
+		line = mdStrike.ReplaceAllString(line, "$1")
+		line = mdHtmlTag.ReplaceAllString(line, "")
+		if strings.Contains(line, "|") && strings.HasPrefix(strings.TrimSpace(line), "|") {
+			cells := strings.Split(strings.Trim(strings.TrimSpace(line), "|"), "|")
+			for idx := range cells {
+				cells[idx] = strings.TrimSpace(cells[idx])
+			}
+			line = strings.Join(cells, "\t")
+		}
+		text.WriteString(html.UnescapeString(line) + "\n")
+	}
+	return cleanText(text.String()), nil
+}
+
+var (
+	trailingSpace = regexp.MustCompile(`[ \t\x{a0}]+\n`)
+	blankLines    = regexp.MustCompile(`\n{3,}`)
+)
+
+// cleanText normalizes whitespace in extracted text so it reads well in files.raw_text
+func cleanText(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = trailingSpace.ReplaceAllString(text, "\n")
+	text = blankLines.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dslipak/pdf"
+)
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatalf("reading fixture: %v", err)
+	}
+	return data
+}
+
+func TestReadPdfNativeSeparatesPagesInOrder(t *testing.T) {
+	text, err := readPdfNative(readTestdata(t, "two-pages.pdf"))
+	if err != nil {
+		t.Fatalf("readPdfNative: %v", err)
+	}
+	pages := strings.Split(text, pdfPageBreak)
+	want := []string{"First page, first line\nFirst page, second line", "Second page"}
+	if len(pages) != len(want) {
+		t.Fatalf("got %d pages in %q, want %d", len(pages), text, len(want))
+	}
+	for i := range want {
+		if pages[i] != want[i] {
+			t.Errorf("page %d = %q, want %q", i+1, pages[i], want[i])
+		}
+	}
+}
+
+func TestReadPdfFallsBackToNormalizing(t *testing.T) {
+	// AES-256 with an empty user password, which the native reader can't open
+	data := readTestdata(t, "encrypted.pdf")
+	if _, err := readPdfNative(data); err == nil {
+		t.Fatal("the native reader opened encrypted.pdf, the fixture no longer covers the fallback")
+	}
+
+	text, err := readPdf(*bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatalf("readPdf: %v", err)
+	}
+	want := "First page, first line\nFirst page, second line" + pdfPageBreak + "Second page"
+	if text != want {
+		t.Errorf("readPdf = %q, want %q", text, want)
+	}
+}
+
+func TestPdfPageTextOrdersGlyphs(t *testing.T) {
+	// glyphs arrive in content stream order, not reading order
+	glyphs := []pdf.Text{
+		{S: "world", X: 110, Y: 700, FontSize: 12},
+		{S: "below", X: 72, Y: 686, FontSize: 12},
+		{S: "hello", X: 72, Y: 700, FontSize: 12},
+		{S: "far below", X: 72, Y: 600, FontSize: 12},
+	}
+	want := "hello world\nbelow\n\nfar below"
+	if got := pdfPageText(glyphs); got != want {
+		t.Errorf("pdfPageText = %q, want %q", got, want)
+	}
+}
+
+// zipWithEntry makes an archive holding one file, the way .docx and .odt package their xml
+func zipWithEntry(t *testing.T, name string, content string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	w, err := archive.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(content))
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadDocx(t *testing.T) {
+	document := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:r><w:t>Hello</w:t></w:r><w:r><w:tab/><w:t xml:space="preserve">world &amp; co</w:t></w:r></w:p>
+<w:p><w:r><w:instrText>PAGE</w:instrText><w:t>split</w:t><w:br/><w:t>lines</w:t></w:r></w:p>
+</w:body></w:document>`
+	got, err := readDocx(*bytes.NewBuffer(zipWithEntry(t, "word/document.xml", document)))
+	if err != nil {
+		t.Fatalf("readDocx: %v", err)
+	}
+	// field codes like PAGE aren't text
+	want := "Hello\tworld & co\nsplit\nlines"
+	if got != want {
+		t.Errorf("readDocx = %q, want %q", got, want)
+	}
+
+	if _, err := readDocx(*bytes.NewBuffer(zipWithEntry(t, "content.xml", document))); err == nil {
+		t.Error("readDocx accepted an archive without word/document.xml")
+	}
+	if _, err := readDocx(*bytes.NewBufferString("not a zip")); err == nil {
+		t.Error("readDocx accepted something that isn't an archive")
+	}
+}
+
+func odtWithBody(t *testing.T, body string) []byte {
+	t.Helper()
+	return zipWithEntry(t, "content.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+<office:body><office:text>`+body+`</office:text></office:body></office:document-content>`)
+}
+
+func TestReadOdt(t *testing.T) {
+	input := odtWithBody(t, `<text:h>Title</text:h><text:p>a<text:s text:c="3"/>b<text:tab/>c<text:line-break/>d</text:p>`)
+	got, err := readOdt(*bytes.NewBuffer(input))
+	if err != nil {
+		t.Fatalf("readOdt: %v", err)
+	}
+	if want := "Title\na   b\tc\nd"; got != want {
+		t.Errorf("readOdt = %q, want %q", got, want)
+	}
+}
+
+func TestReadHtml(t *testing.T) {
+	input := `<!DOCTYPE html>
+<html><head><title>Page title</title><style>body { color: red }</style></head>
+<body>
+<script>var secret = "not text";</script>
+<h1>Heading</h1>
+<p>Some   <b>bold</b>
+text &amp; more.</p>
+<ul><li>one</li><li>two</li></ul>
+<img src="logo.png" alt="Company logo">
+<noscript>Enable JavaScript</noscript>
+<pre>  keep
+    spacing</pre>
+<table><tr><td>a</td><td>b</td></tr></table>
+</body></html>`
+	got, err := readHtml(*bytes.NewBufferString(input))
+	if err != nil {
+		t.Fatalf("readHtml: %v", err)
+	}
+	for _, gone := range []string{"Page title", "color: red", "secret", "Enable JavaScript"} {
+		if strings.Contains(got, gone) {
+			t.Errorf("readHtml kept %q from a head, script, style or noscript element: %q", gone, got)
+		}
+	}
+	for _, kept := range []string{"Heading\n", "Some bold text & more.", "- one\n- two", "Company logo", "  keep\n    spacing", "a\tb"} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("readHtml = %q, want it to contain %q", got, kept)
+		}
+	}
+}
+
+func TestReadMarkdown(t *testing.T) {
+	input := "# Title #\n\nSome **bold**, *emphasis*, ~~struck~~ and `code` with a [link](https://example.com) and ![an image](pic.png).\n\n" +
+		"> quoted\n\n- [x] done\n* item\n\n| a | b |\n|---|---|\n| 1 | 2 |\n\n```\n**not** [parsed](here)\n```\n\n[ref]: https://example.com\n"
+	got, err := readMarkdown(*bytes.NewBufferString(input))
+	if err != nil {
+		t.Fatalf("readMarkdown: %v", err)
+	}
+	want := "Title\n\nSome bold, emphasis, struck and code with a link and an image.\n\nquoted\n\n- done\n- item\n\na\tb\n1\t2\n\n**not** [parsed](here)"
+	if got != want {
+		t.Errorf("readMarkdown = %q, want %q", got, want)
+	}
+
+	if _, err := readMarkdown(*bytes.NewBuffer([]byte{0xff, 0xfe, 'a'})); err == nil {
+		t.Error("readMarkdown accepted invalid utf-8")
+	}
+}
+
+// runReader fails the test if a reader panics or doesn't return promptly
+func runReader(t *testing.T, read func(bytes.Buffer) (string, error), input []byte) (string, error) {
+	t.Helper()
+	type result struct {
+		text  string
+		err   error
+		panic interface{}
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{panic: r}
+			}
+		}()
+		text, err := read(*bytes.NewBuffer(input))
+		done <- result{text: text, err: err}
+	}()
+	select {
+	case r := <-done:
+		if r.panic != nil {
+			t.Fatalf("reader panicked: %v", r.panic)
+		}
+		return r.text, r.err
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader didn't finish")
+	}
+	return "", nil
+}
+
+func TestReadRtfBin(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"negative length", `{\rtf1 \bin-100 x}`, ""},
+		{"negative length after text", `{\rtf1 ` + strings.Repeat("a", 50) + `\bin-9 x}`, strings.Repeat("a", 50)},
+		{"length past the end", `{\rtf1 before\bin1000 xyz}`, "before"},
+		{"skips the binary data", `{\rtf1 before\bin3 xyzafter}`, "beforeafter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runReader(t, readRtf, []byte(tt.input))
+			if err != nil {
+				t.Fatalf("readRtf: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("readRtf(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadOdtSpaceRuns(t *testing.T) {
+	tests := []struct {
+		name   string
+		count  string
+		spaces int
+	}{
+		{"normal", "3", 3},
+		{"negative", "-1", 1},
+		{"zero", "0", 1},
+		{"huge", "2000000000", maxOdtSpaceRun},
+		{"overflows int", "99999999999999999999999", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := odtWithBody(t, `<text:p>a<text:s text:c="`+tt.count+`"/>b</text:p>`)
+			got, err := runReader(t, readOdt, input)
+			if err != nil {
+				t.Fatalf("readOdt: %v", err)
+			}
+			if !strings.HasPrefix(got, "a") || !strings.HasSuffix(got, "b") {
+				t.Fatalf("readOdt = %q, want text around the spaces", got)
+			}
+			if spaces := len(got) - 2; spaces > tt.spaces {
+				t.Errorf("readOdt produced %d spaces, want at most %d", spaces, tt.spaces)
+			}
+		})
+	}
+}
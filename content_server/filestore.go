@@ -2,15 +2,19 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	pg "goserve/postgres"
 	"io"
+	"io/fs"
 	"log"
-	pg "main/postgres"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/labstack/echo/v4"
 )
 
@@ -18,11 +22,37 @@ import (
 
 type Filesystem interface {
 	Write(file io.Reader, filename string) error
+	Read(filename string) (io.ReadCloser, error)
+	Move(src string, dst string) error
 	Delete(filename string) error
+	// Walk calls fn for every stored object, e.g. to reconcile storage against the files table
+	Walk(fn func(StoredObject) error) error
 	GetStorageClass() *StorageClass
 	GetLocation() string
 }
 
+type StoredObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// filesystems holds every configured backend by location, so a row is always read back from
+// the backend it was written to, even after STORAGE_BACKEND changes
+var filesystems = map[string]Filesystem{}
+
+func registerFilesystem(fs Filesystem) {
+	filesystems[fs.GetLocation()] = fs
+}
+
+func getFilesystem(location string) (Filesystem, error) {
+	fs, ok := filesystems[location]
+	if !ok {
+		return nil, fmt.Errorf("storage backend %q is not configured", location)
+	}
+	return fs, nil
+}
+
 type StorageClass struct {
 	Config FileSystemConfig
 }
@@ -35,166 +65,310 @@ type FileInput struct {
 	Filename    string
 	AccountUUID string
 	RawText     string
+	FolderId    string    // optional, the top level if empty
 	File        io.Reader // optional, can be empty
 }
 
 type FileObject struct {
-	FileId      string
-	Filepath    string
-	AccountUUID string
-	UploadTime  time.Time
-	Filename    string
-	FileExt     string
-	RawText     string
+	FileId           string
+	Filepath         string
+	AccountUUID      string
+	UploadTime       time.Time
+	Filename         string
+	FileExt          string
+	RawText          string
+	ExtractionStatus string
+	SHA256           string
+	Size             int64
+	Location         string
+	KeyID            string // master key the stored bytes' data key is wrapped with, if encrypted
+	ScanStatus       string
+	ScanSignature    string
+	FolderId         string
 }
 
-func _createFileInput(c echo.Context) (FileInput, error) {
-	fileInput := FileInput{}
+// Uploads larger than this are rejected mid-stream. Set with MAX_UPLOAD_BYTES.
+var maxUploadBytes = getMaxUploadBytes()
 
-	file, err := c.FormFile("file")
-	if err != nil {
-		return fileInput, err
+func getMaxUploadBytes() int64 {
+	maxBytes, err := strconv.ParseInt(os.Getenv("MAX_UPLOAD_BYTES"), 10, 64)
+	if err != nil || maxBytes <= 0 {
+		return 100 << 20
+	}
+	return maxBytes
+}
+
+var ErrFileTooLarge = errors.New("file exceeds the maximum upload size")
+
+// sizeLimitReader counts bytes as they stream past and fails once the limit is crossed,
+// with Err if set and ErrFileTooLarge otherwise
+type sizeLimitReader struct {
+	Reader io.Reader
+	Limit  int64
+	N      int64
+	Err    error
+}
+
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.N += int64(n)
+	if r.N > r.Limit {
+		if r.Err != nil {
+			return n, r.Err
+		}
+		return n, ErrFileTooLarge
 	}
-	if file == nil {
-		return fileInput, echo.NewHTTPError(http.StatusBadRequest, "No file in request")
+	return n, err
+}
+
+// _readFileUploads walks a multipart upload part by part, handing each file part to save while
+// it's still streaming off the socket. echo's FormFile would buffer the whole form first.
+// raw_text and folder_id fields only apply to files that come after them in the form.
+func _readFileUploads(c echo.Context, save func(FileInput) error) (int, error) {
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return 0, echo.NewHTTPError(http.StatusUnauthorized, "User UUID not found in JWT claims")
 	}
-	fileInput.Filename = file.Filename
 
-	src, err := file.Open()
+	// leave some room for the multipart boundaries and other fields
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxUploadBytes+1<<20)
+	reader, err := c.Request().MultipartReader()
 	if err != nil {
-		return fileInput, err
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "Expected a multipart upload")
 	}
-	defer src.Close()
 
-	fileInput.File = src
+	rawText := ""
+	folderId := ""
+	saved := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return saved, asUploadErr(err)
+		}
 
-	fileInput.RawText = c.FormValue("raw_text")
+		switch part.FormName() {
+		case "raw_text":
+			text, err := io.ReadAll(part)
+			if err != nil {
+				return saved, asUploadErr(err)
+			}
+			rawText = string(text)
+		case "folder_id":
+			id, err := io.ReadAll(part)
+			if err != nil {
+				return saved, asUploadErr(err)
+			}
+			folderId = string(id)
+		case "file":
+			if part.FileName() == "" {
+				continue
+			}
+			err = save(FileInput{
+				Filename:    filepath.Base(part.FileName()),
+				AccountUUID: uuid,
+				RawText:     rawText,
+				FolderId:    folderId,
+				File:        part,
+			})
+			if err != nil {
+				return saved, err
+			}
+			saved++
+		}
+		part.Close()
+	}
 
-	uuid, ok := c.Get("ID").(string)
-	if !ok {
-		return fileInput, echo.NewHTTPError(http.StatusUnauthorized, "User UUID not found in JWT claims")
+	if saved == 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "No file in request")
 	}
-	fileInput.AccountUUID = uuid
-	return fileInput, nil
+	return saved, nil
+}
+
+func asUploadErr(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return ErrFileTooLarge
+	}
+	return err
 }
 
 // Saving files
 func SaveFile(pgContext *pg.PostgresContext, filesystem Filesystem, fileInput FileInput) error {
-	// Saves the file to disk on the filesystem of your choice, then indexes the result in postgres
-	fileOutput, buf, err := fileInput.createFileOutput()
+	_, err := saveFileObject(pgContext, filesystem, fileInput)
+	return err
+}
+
+// saveFileObject is SaveFile for callers that need the saved row, e.g. to report its id back
+func saveFileObject(pgContext *pg.PostgresContext, filesystem Filesystem, fileInput FileInput) (FileObject, error) {
+	// Streams the file to the filesystem of your choice, indexing the result in postgres
+	fileOutput, err := fileInput.createFileOutput()
 	if err != nil {
 		log.Printf("Failed to create FileOutput: %v", err)
-		return err
+		return fileOutput, err
 	}
 
-	return fileOutput.writeFile(pgContext, filesystem, buf)
+	file, err := limitToQuota(pgContext, fileInput.AccountUUID, fileInput.File)
+	if err != nil {
+		return fileOutput, err
+	}
+	err = fileOutput.writeFile(pgContext, filesystem, file)
+	return fileOutput, err
 }
 
-func (input FileInput) createFileOutput() (FileObject, bytes.Buffer, error) {
+func (input FileInput) createFileOutput() (FileObject, error) {
 	fileOutput := FileObject{
 		AccountUUID: input.AccountUUID,
+		FolderId:    input.FolderId,
 	}
 
 	fileOutput.Filename = input.Filename
 	fileOutput.UploadTime = time.Now()
-	fileOutput.Filepath = constructUniqueFilename(input.AccountUUID, fileOutput.UploadTime, input.Filename)
-
-	var buf bytes.Buffer
-	_, err := buf.ReadFrom(input.File)
-	if err != nil && err != io.EOF {
-		return fileOutput, buf, fmt.Errorf("error reading file into buffer: %w", err)
-	}
 
 	ext, err := getFileExt(input.Filename)
 	if err != nil {
-		return fileOutput, buf, err
+		return fileOutput, err
 	}
 	fileOutput.FileExt = ext
 
-	rawText := input.RawText
-	if rawText == "" {
-		if buf.Len() > 0 {
-			rawText, err = extractText(buf, ext)
-			if err != nil {
-				return fileOutput, buf, err
-			}
-		} else {
-			return fileOutput, buf, fmt.Errorf("empty file and no raw text? There's nothing here!")
+	// Text extraction runs later on the extraction queue, unless the client already sent it
+	fileOutput.RawText = input.RawText
+	fileOutput.ExtractionStatus = ExtractionDone
+	if input.RawText == "" {
+		if input.File == nil {
+			return fileOutput, fmt.Errorf("empty file and no raw text? There's nothing here!")
 		}
+		fileOutput.ExtractionStatus = ExtractionPending
 	}
-	fileOutput.RawText = rawText
-	return fileOutput, buf, nil
+	return fileOutput, nil
 }
 
-func (fo FileObject) writeFile(pgContext *pg.PostgresContext, filesystem Filesystem, buf bytes.Buffer) error {
-	err := fo.Index(pgContext, filesystem)
+func (fo *FileObject) writeFile(pgContext *pg.PostgresContext, filesystem Filesystem, file io.Reader) error {
+	// Hash and scan the stream on its way to storage rather than holding the file in memory.
+	// Identical content is only stored once, see blobstore.go
+	file, finishScan := scanUpload(file)
+	blob, err := putBlob(pgContext, filesystem, file)
+	fo.setScanResult(finishScan())
 	if err != nil {
-		log.Printf("Error inserting file to table %v, %v", fo, err)
+		log.Printf("Failed to store upload %s: %v", fo.Filename, err)
 		return err
 	}
+	fo.Filepath = blob.Key
+	fo.SHA256 = blob.SHA256
+	fo.Size = blob.Size
+	fo.KeyID = blob.KeyID
 
-	err = filesystem.Write(bytes.NewReader(buf.Bytes()), fo.Filepath)
+	if blob.Size == 0 && fo.RawText == "" {
+		err = fmt.Errorf("empty file and no raw text? There's nothing here!")
+	} else {
+		err = fo.Index(pgContext, filesystem)
+	}
 	if err != nil {
-		return fo.Delete(pgContext, filesystem, true)
+		log.Printf("Error inserting file to table %v, %v", fo, err)
+		if relErr := releaseBlob(pgContext, filesystem, blob); relErr != nil {
+			log.Printf("Failed to release blob after index failure: %v", relErr)
+		}
+		return err
 	}
 
-	return nil
+	return queueExtraction(pgContext, *fo)
+}
+
+// setScanResult records a scan verdict. An infected file stays stored, quarantined, so it can be
+// looked at later, but its text isn't extracted.
+func (fo *FileObject) setScanResult(status string, signature string) {
+	fo.ScanStatus = status
+	fo.ScanSignature = signature
+	if status == ScanInfected {
+		fo.ExtractionStatus = ExtractionFailed
+	}
 }
 
+// Delete removes a files row, its earlier versions, and their references on the stored content.
+// The bytes themselves are only deleted with the last reference, and only once the rows are gone;
+// bytes that fail to delete are left to the reconciler. With force, the rows go even if a
+// reference can't be released.
 func (fo FileObject) Delete(pgContext *pg.PostgresContext, filesystem Filesystem, force bool) error {
-	if fo.Filepath == "" {
-		sqlStatement := `SELECT filepath FROM files WHERE id = $1`
+	return fo.delete(pgContext, filesystem, force, false)
+}
 
-		rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, fo.FileId)
-		if err != nil {
-			return fmt.Errorf("query execution error: %w", err)
-		}
-		defer rows.Close()
+// deleteTrashed is Delete for a file that must still be in fo.AccountUUID's trash. A file restored
+// after it was picked for purging is left alone.
+func (fo FileObject) deleteTrashed(pgContext *pg.PostgresContext, filesystem Filesystem) error {
+	return fo.delete(pgContext, filesystem, false, true)
+}
 
-		var filepath string
-		if rows.Next() {
-			err = rows.Scan(&filepath)
-			if err != nil {
-				log.Printf("Failed to scan row: %v", err)
-				return err
-			}
-		}
-		fo.Filepath = filepath
+func (fo FileObject) delete(pgContext *pg.PostgresContext, filesystem Filesystem, force bool, trashedOnly bool) error {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return err
 	}
-	var delErr error
-	if fo.Filepath == "" {
-		delErr = fmt.Errorf("No filepath specified, cannot delete file %s", fo.Filename)
-	} else {
-		delErr = filesystem.Delete(fo.Filepath)
+	defer tx.Rollback(pgContext.Ctx)
+
+	var stored []storedRef
+	versionSql := `
+	DELETE FROM file_versions WHERE file_id = $1
+	RETURNING filepath, COALESCE(sha256, ''), COALESCE(location, '')`
+	rows, err := tx.Query(pgContext.Ctx, versionSql, fo.FileId)
+	if err != nil {
+		return fmt.Errorf("error deleting file versions: %w", err)
 	}
-	if delErr != nil {
-		log.Printf("Failed to delete file from disk: %v", delErr)
-		if !force {
-			return delErr
+	for rows.Next() {
+		var ref storedRef
+		if err := rows.Scan(&ref.Filepath, &ref.SHA256, &ref.Location); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning file version: %w", err)
 		}
+		stored = append(stored, ref)
 	}
-	dbErr := deleteFileRecord(pgContext, fo.FileId)
-	if dbErr != nil {
-		log.Printf("Failed to delete database record: %v", dbErr)
-		return dbErr
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error deleting file versions: %w", err)
 	}
-	if delErr != nil && force {
-		return delErr
-	}
-	return nil
-}
 
-func deleteFileRecord(pgContext *pg.PostgresContext, fileId string) error {
-	sqlStatement := `DELETE FROM files WHERE id = $1`
-	_, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, fileId)
+	var current storedRef
+	sqlStatement := `
+	DELETE FROM files WHERE id = $1
+	RETURNING filepath, COALESCE(sha256, ''), COALESCE(location, '')`
+	args := []interface{}{fo.FileId}
+	if trashedOnly {
+		sqlStatement = `
+		DELETE FROM files WHERE id = $1 AND account_uuid = $2 AND deleted_at IS NOT NULL
+		RETURNING filepath, COALESCE(sha256, ''), COALESCE(location, '')`
+		args = append(args, fo.AccountUUID)
+	}
+	err = tx.QueryRow(pgContext.Ctx, sqlStatement, args...).Scan(&current.Filepath, &current.SHA256, &current.Location)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: cannot delete file %s", ErrFileNotFound, fo.FileId)
+	}
 	if err != nil {
 		return fmt.Errorf("error deleting file record: %w", err)
 	}
-	return nil
-}
+	stored = append(stored, current)
+
+	cleanup := &storageCleanup{}
+	var delErrs []error
+	for _, ref := range stored {
+		if err := releaseStored(pgContext, tx, cleanup, filesystem, ref); err != nil {
+			delErrs = append(delErrs, err)
+		}
+	}
+	delErr := errors.Join(delErrs...)
+	if delErr != nil {
+		log.Printf("Failed to release stored file: %v", delErr)
+		if !force {
+			return delErr
+		}
+	}
 
-func constructUniqueFilename(accountUUID string, uploadTime time.Time, filename string) string {
-	return fmt.Sprintf("%s-%v-%s", accountUUID, uploadTime, filename)
+	if err := tx.Commit(pgContext.Ctx); err != nil {
+		log.Printf("Failed to delete database record: %v", err)
+		return err
+	}
+	cleanup.run(pgContext)
+	return delErr
 }
 
 func getFileExt(filename string) (string, error) {
@@ -206,20 +380,27 @@ func getFileExt(filename string) (string, error) {
 }
 
 func extractText(buf bytes.Buffer, ext string) (string, error) {
-	switch ext {
-	case ".txt":
-		return readTxt(buf)
-	case ".pdf":
-		return readPdf(buf)
-	case ".doc", ".docx":
-		// Use a library or microservice to extract text from Word documents
-	default:
-		return "", fmt.Errorf("unsupported file extension")
-	}
-	return "Extracted text", nil
+	// Extractors register themselves by MIME type and extension, see extractors.go
+	return extractorRegistry.Extract(buf, ext)
 }
 
-func (fo FileObject) Index(pgContext *pg.PostgresContext, filesystem Filesystem) error {
+// Index records the file in postgres, refusing it if it would put the account over quota
+func (fo *FileObject) Index(pgContext *pg.PostgresContext, filesystem Filesystem) error {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	if err := checkQuotaTx(pgContext, tx, fo.AccountUUID, fo.Size); err != nil {
+		return err
+	}
+	if fo.FolderId != "" {
+		if err := checkFolderTx(pgContext, tx, fo.AccountUUID, fo.FolderId); err != nil {
+			return err
+		}
+	}
+
 	storageClass := filesystem.GetStorageClass()
 	sqlStatement := `
 	INSERT INTO files (
@@ -230,9 +411,17 @@ func (fo FileObject) Index(pgContext *pg.PostgresContext, filesystem Filesystem)
 		file_ext, 
 		raw_text, 
 		bucket_dir, 
-		location
-	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
-	_, err := pgContext.Pool.Exec(
+		location,
+		extraction_status,
+		sha256,
+		size,
+		key_id,
+		scan_status,
+		scan_signature,
+		folder_id
+	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULLIF($12, ''), $13, NULLIF($14, ''), NULLIF($15, '')::uuid)
+	RETURNING id`
+	err = tx.QueryRow(
 		pgContext.Ctx,
 		sqlStatement,
 		fo.Filename,
@@ -243,8 +432,18 @@ func (fo FileObject) Index(pgContext *pg.PostgresContext, filesystem Filesystem)
 		fo.RawText,
 		storageClass.Config.BucketDir,
 		filesystem.GetLocation(),
-	)
-	return err
+		fo.ExtractionStatus,
+		fo.SHA256,
+		fo.Size,
+		fo.KeyID,
+		fo.ScanStatus,
+		fo.ScanSignature,
+		fo.FolderId,
+	).Scan(&fo.FileId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(pgContext.Ctx)
 }
 
 type LocalStorage struct {
@@ -255,14 +454,37 @@ var _ Filesystem = (*LocalStorage)(nil)
 
 func (l *LocalStorage) Write(file io.Reader, filename string) error {
 	fullPath := filepath.Join(l.StorageClass.Config.BucketDir, filename)
-	outFile, err := os.Create(fullPath)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+		return err
+	}
+	// Stream into a temp file and rename, so a failed upload never leaves a truncated blob behind
+	outFile, err := os.CreateTemp(filepath.Dir(fullPath), ".upload-*")
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
+	defer os.Remove(outFile.Name())
 
 	_, err = io.Copy(outFile, file)
-	return err
+	if closeErr := outFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(outFile.Name(), fullPath)
+}
+
+func (l *LocalStorage) Read(filename string) (io.ReadCloser, error) {
+	fullPath := filepath.Join(l.StorageClass.Config.BucketDir, filename)
+	return os.Open(fullPath)
+}
+
+func (l *LocalStorage) Move(src string, dst string) error {
+	dstPath := filepath.Join(l.StorageClass.Config.BucketDir, dst)
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(l.StorageClass.Config.BucketDir, src), dstPath)
 }
 
 func (l *LocalStorage) Delete(filename string) error {
@@ -270,6 +492,29 @@ func (l *LocalStorage) Delete(filename string) error {
 	return os.Remove(fullPath)
 }
 
+func (l *LocalStorage) Walk(fn func(StoredObject) error) error {
+	root := l.StorageClass.Config.BucketDir
+	err := filepath.WalkDir(root, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		key, err := filepath.Rel(root, fullPath)
+		if err != nil {
+			return err
+		}
+		return fn(StoredObject{Key: filepath.ToSlash(key), Size: info.Size(), ModTime: info.ModTime()})
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		// nothing has been written yet
+		return nil
+	}
+	return err
+}
+
 func (l *LocalStorage) GetStorageClass() *StorageClass {
 	return &l.StorageClass
 }
@@ -277,12 +522,3 @@ func (l *LocalStorage) GetStorageClass() *StorageClass {
 func (l *LocalStorage) GetLocation() string {
 	return "local"
 }
-
-type S3Storage struct {
-	StorageClass
-}
-
-func (s *S3Storage) Write(file io.Reader, filename string) error {
-	// Logic to save file to S3
-	return nil
-}
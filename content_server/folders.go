@@ -0,0 +1,547 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"goserve/tables/cells"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+)
+
+// Folders nest through parent_id, with "" (NULL in postgres) as the top level. A file is in at most
+// one folder, files.folder_id, and carries any number of free-form tags in file_tags.
+
+var (
+	ErrFolderNotFound = errors.New("folder not found")
+	ErrFolderExists   = errors.New("a folder with that name already exists here")
+	ErrFolderCycle    = errors.New("a folder can't be moved into itself")
+	ErrFolderNotEmpty = errors.New("folder isn't empty")
+	ErrInvalidName    = errors.New("invalid name")
+)
+
+const maxTagLength = 64
+
+type Folder struct {
+	Id       string
+	ParentId string
+	Name     string
+	// Path is the folder's names from the top level down, e.g. "Hiring / 2024", for pickers
+	Path string
+}
+
+func validateFolderName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 255 || strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+		return "", fmt.Errorf("%w: folder names can't be empty or contain slashes", ErrInvalidName)
+	}
+	return name, nil
+}
+
+// normalizeTag lowercases a tag so "Urgent" and "urgent" are the same tag
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || len(tag) > maxTagLength || strings.ContainsAny(tag, ",&?#") {
+		return "", fmt.Errorf("%w: tags are 1-%d characters without , & ? or #", ErrInvalidName, maxTagLength)
+	}
+	return tag, nil
+}
+
+// asFolderErr maps the unique name indexes to ErrFolderExists
+func asFolderErr(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return ErrFolderExists
+	}
+	return err
+}
+
+// checkFolderTx makes sure folderId is one of the account's folders, e.g. before filing something in it
+func checkFolderTx(pgContext *pg.PostgresContext, tx pgx.Tx, accountUUID string, folderId string) error {
+	var exists bool
+	sqlStatement := `SELECT EXISTS (SELECT 1 FROM folders WHERE id = $1 AND account_uuid = $2)`
+	if err := tx.QueryRow(pgContext.Ctx, sqlStatement, folderId, accountUUID).Scan(&exists); err != nil {
+		// a malformed id fails uuid parsing in postgres, which is just another missing folder
+		log.Printf("Failed to look up folder %s: %v", folderId, err)
+		return ErrFolderNotFound
+	}
+	if !exists {
+		return ErrFolderNotFound
+	}
+	return nil
+}
+
+func createFolder(pgContext *pg.PostgresContext, accountUUID string, parentId string, name string) (Folder, error) {
+	folder := Folder{ParentId: parentId}
+	name, err := validateFolderName(name)
+	if err != nil {
+		return folder, err
+	}
+	folder.Name = name
+
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return folder, err
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	if parentId != "" {
+		if err := checkFolderTx(pgContext, tx, accountUUID, parentId); err != nil {
+			return folder, err
+		}
+	}
+	sqlStatement := `INSERT INTO folders (account_uuid, parent_id, name) VALUES ($1, NULLIF($2, '')::uuid, $3) RETURNING id`
+	if err := tx.QueryRow(pgContext.Ctx, sqlStatement, accountUUID, parentId, name).Scan(&folder.Id); err != nil {
+		return folder, asFolderErr(err)
+	}
+	return folder, tx.Commit(pgContext.Ctx)
+}
+
+func renameFolder(pgContext *pg.PostgresContext, accountUUID string, folderId string, name string) error {
+	name, err := validateFolderName(name)
+	if err != nil {
+		return err
+	}
+	sqlStatement := `UPDATE folders SET name = $3 WHERE id = $1 AND account_uuid = $2`
+	tag, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, folderId, accountUUID, name)
+	if err != nil {
+		return asFolderErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrFolderNotFound
+	}
+	return nil
+}
+
+// moveFolder re-parents a folder, refusing to put it inside itself or one of its own subfolders
+func moveFolder(pgContext *pg.PostgresContext, accountUUID string, folderId string, parentId string) error {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	// Two moves that each look fine on their own, a into b and b into a, make a cycle together, so
+	// an account's moves take turns. The lock is held until commit.
+	if _, err := tx.Exec(pgContext.Ctx, `SELECT pg_advisory_xact_lock(hashtext('folders/' || $1))`, accountUUID); err != nil {
+		return fmt.Errorf("error locking folders of account %s: %w", accountUUID, err)
+	}
+	if err := checkFolderTx(pgContext, tx, accountUUID, folderId); err != nil {
+		return err
+	}
+	if parentId != "" {
+		if err := checkFolderTx(pgContext, tx, accountUUID, parentId); err != nil {
+			return err
+		}
+		var cycle bool
+		sqlStatement := `
+		WITH RECURSIVE subtree AS (
+			SELECT id FROM folders WHERE id = $1
+			UNION
+			SELECT f.id FROM folders f JOIN subtree s ON f.parent_id = s.id
+		)
+		SELECT EXISTS (SELECT 1 FROM subtree WHERE id = $2)`
+		if err := tx.QueryRow(pgContext.Ctx, sqlStatement, folderId, parentId).Scan(&cycle); err != nil {
+			return err
+		}
+		if cycle {
+			return ErrFolderCycle
+		}
+	}
+
+	sqlStatement := `UPDATE folders SET parent_id = NULLIF($3, '')::uuid WHERE id = $1 AND account_uuid = $2`
+	if _, err := tx.Exec(pgContext.Ctx, sqlStatement, folderId, accountUUID, parentId); err != nil {
+		return asFolderErr(err)
+	}
+	return tx.Commit(pgContext.Ctx)
+}
+
+// deleteFolder removes an empty folder. Files in the trash don't count; they're restored to the
+// top level instead.
+func deleteFolder(pgContext *pg.PostgresContext, accountUUID string, folderId string) error {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	if err := checkFolderTx(pgContext, tx, accountUUID, folderId); err != nil {
+		return err
+	}
+	var inUse bool
+	sqlStatement := `
+	SELECT EXISTS (SELECT 1 FROM folders WHERE parent_id = $1)
+		OR EXISTS (SELECT 1 FROM files WHERE folder_id = $1 AND deleted_at IS NULL)`
+	if err := tx.QueryRow(pgContext.Ctx, sqlStatement, folderId).Scan(&inUse); err != nil {
+		return err
+	}
+	if inUse {
+		return ErrFolderNotEmpty
+	}
+	if _, err := tx.Exec(pgContext.Ctx, `UPDATE files SET folder_id = NULL WHERE folder_id = $1`, folderId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(pgContext.Ctx, `DELETE FROM folders WHERE id = $1`, folderId); err != nil {
+		return err
+	}
+	return tx.Commit(pgContext.Ctx)
+}
+
+// folderBreadcrumbs lists the folders from the top level down to folderId, inclusive.
+// Like the other walks of the folder tree, it keeps track of where it's been so a cycle, which
+// moveFolder never makes, still couldn't keep it going forever.
+func folderBreadcrumbs(pgContext *pg.PostgresContext, accountUUID string, folderId string) ([]Folder, error) {
+	if folderId == "" {
+		return nil, nil
+	}
+	sqlStatement := `
+	WITH RECURSIVE ancestors AS (
+		SELECT id, parent_id, name, 0 AS depth, ARRAY[id] AS seen FROM folders WHERE id = $1 AND account_uuid = $2
+		UNION ALL
+		SELECT f.id, f.parent_id, f.name, a.depth + 1, a.seen || f.id FROM folders f JOIN ancestors a ON f.id = a.parent_id
+		WHERE f.id <> ALL(a.seen)
+	)
+	SELECT id::text, COALESCE(parent_id::text, ''), name FROM ancestors ORDER BY depth DESC`
+	folders, err := queryFolders(pgContext, sqlStatement, folderId, accountUUID)
+	if err != nil {
+		// a malformed id fails uuid parsing in postgres, which is just another missing folder
+		log.Printf("Failed to load breadcrumbs for folder %s: %v", folderId, err)
+		return nil, ErrFolderNotFound
+	}
+	if len(folders) == 0 {
+		return nil, ErrFolderNotFound
+	}
+	return folders, nil
+}
+
+func listSubfolders(pgContext *pg.PostgresContext, accountUUID string, parentId string) ([]Folder, error) {
+	sqlStatement := `
+	SELECT id::text, COALESCE(parent_id::text, ''), name FROM folders
+	WHERE account_uuid = $1 AND parent_id IS NOT DISTINCT FROM NULLIF($2, '')::uuid
+	ORDER BY lower(name)`
+	return queryFolders(pgContext, sqlStatement, accountUUID, parentId)
+}
+
+// listFolderTree lists every folder of the account with its full path, depth first, for pickers.
+// Folders under excludeId, and excludeId itself, are left out.
+func listFolderTree(pgContext *pg.PostgresContext, accountUUID string, excludeId string) ([]Folder, error) {
+	sqlStatement := `
+	WITH RECURSIVE tree AS (
+		SELECT id, parent_id, name, name::text AS path, ARRAY[id] AS seen FROM folders
+		WHERE account_uuid = $1 AND parent_id IS NULL AND id IS DISTINCT FROM NULLIF($2, '')::uuid
+		UNION ALL
+		SELECT f.id, f.parent_id, f.name, t.path || ' / ' || f.name, t.seen || f.id FROM folders f JOIN tree t ON f.parent_id = t.id
+		WHERE f.id IS DISTINCT FROM NULLIF($2, '')::uuid AND f.id <> ALL(t.seen)
+	)
+	SELECT id::text, COALESCE(parent_id::text, ''), name, path FROM tree ORDER BY lower(path)`
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, accountUUID, excludeId)
+	if err != nil {
+		return nil, fmt.Errorf("error listing folders: %w", err)
+	}
+	defer rows.Close()
+
+	var folders []Folder
+	for rows.Next() {
+		var folder Folder
+		if err := rows.Scan(&folder.Id, &folder.ParentId, &folder.Name, &folder.Path); err != nil {
+			return nil, fmt.Errorf("error scanning folder: %w", err)
+		}
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+func queryFolders(pgContext *pg.PostgresContext, sqlStatement string, args ...interface{}) ([]Folder, error) {
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing folders: %w", err)
+	}
+	defer rows.Close()
+
+	var folders []Folder
+	for rows.Next() {
+		var folder Folder
+		if err := rows.Scan(&folder.Id, &folder.ParentId, &folder.Name); err != nil {
+			return nil, fmt.Errorf("error scanning folder: %w", err)
+		}
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+// moveFileToFolder files a file in folderId, or at the top level if folderId is ""
+func moveFileToFolder(pgContext *pg.PostgresContext, accountUUID string, fileId string, folderId string) error {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	if folderId != "" {
+		if err := checkFolderTx(pgContext, tx, accountUUID, folderId); err != nil {
+			return err
+		}
+	}
+	sqlStatement := `
+	UPDATE files SET folder_id = NULLIF($3, '')::uuid
+	WHERE id = $1 AND account_uuid = $2 AND deleted_at IS NULL`
+	tag, err := tx.Exec(pgContext.Ctx, sqlStatement, fileId, accountUUID, folderId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrFileNotFound
+	}
+	return tx.Commit(pgContext.Ctx)
+}
+
+// Tags
+
+func addFileTag(pgContext *pg.PostgresContext, accountUUID string, fileId string, tag string) error {
+	tag, err := normalizeTag(tag)
+	if err != nil {
+		return err
+	}
+	sqlStatement := `
+	INSERT INTO file_tags (file_id, tag)
+	SELECT id, $3 FROM files WHERE id = $1 AND account_uuid = $2 AND deleted_at IS NULL
+	ON CONFLICT DO NOTHING`
+	if _, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, fileId, accountUUID, tag); err != nil {
+		return err
+	}
+	return nil
+}
+
+func removeFileTag(pgContext *pg.PostgresContext, accountUUID string, fileId string, tag string) error {
+	sqlStatement := `
+	DELETE FROM file_tags t USING files f
+	WHERE t.file_id = f.id AND f.id = $1 AND f.account_uuid = $2 AND t.tag = $3`
+	_, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, fileId, accountUUID, strings.ToLower(tag))
+	return err
+}
+
+func listFileTags(pgContext *pg.PostgresContext, accountUUID string, fileId string) ([]string, error) {
+	sqlStatement := `
+	SELECT t.tag FROM file_tags t JOIN files f ON f.id = t.file_id
+	WHERE f.id = $1 AND f.account_uuid = $2 AND f.deleted_at IS NULL
+	ORDER BY t.tag`
+	return queryTags(pgContext, sqlStatement, fileId, accountUUID)
+}
+
+// listAccountTags lists every tag in use on the account's files, for the filter
+func listAccountTags(pgContext *pg.PostgresContext, accountUUID string) ([]string, error) {
+	sqlStatement := `
+	SELECT DISTINCT t.tag FROM file_tags t JOIN files f ON f.id = t.file_id
+	WHERE f.account_uuid = $1 AND f.deleted_at IS NULL
+	ORDER BY t.tag`
+	return queryTags(pgContext, sqlStatement, accountUUID)
+}
+
+func queryTags(pgContext *pg.PostgresContext, sqlStatement string, args ...interface{}) ([]string, error) {
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tags: %w", err)
+	}
+	defer rows.Close()
+
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, fmt.Errorf("error scanning tag: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// Endpoints
+
+// FileBrowser is what the Files page renders around the Files table: where you are, the folders
+// here, and the tag filter
+type FileBrowser struct {
+	FolderId    string
+	Tag         string
+	Breadcrumbs []Folder
+	Subfolders  []Folder
+	Tags        []string
+}
+
+func FileBrowse(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	browser := FileBrowser{
+		FolderId: c.QueryParam("folder_id"),
+		Tag:      strings.ToLower(c.QueryParam("tag")),
+	}
+	var err error
+	browser.Breadcrumbs, err = folderBreadcrumbs(hCtx.PGCtx, uuid, browser.FolderId)
+	if err != nil {
+		// e.g. a folder deleted in another tab, fall back to the top level
+		browser.FolderId = ""
+	}
+	if browser.Subfolders, err = listSubfolders(hCtx.PGCtx, uuid, browser.FolderId); err != nil {
+		log.Printf("Failed to load folders: %v", err)
+		return errorDiv(c, "Failed to load folders")
+	}
+	if browser.Tags, err = listAccountTags(hCtx.PGCtx, uuid); err != nil {
+		log.Printf("Failed to load tags: %v", err)
+		return errorDiv(c, "Failed to load tags")
+	}
+	return c.Render(http.StatusOK, "files/browser", browser)
+}
+
+// folderErrorDiv explains the errors a person can fix, and logs the rest
+func folderErrorDiv(c echo.Context, err error, action string) error {
+	switch {
+	case errors.Is(err, ErrInvalidName):
+		return errorDiv(c, strings.TrimPrefix(err.Error(), ErrInvalidName.Error()+": "))
+	case errors.Is(err, ErrFolderNotFound), errors.Is(err, ErrFolderExists),
+		errors.Is(err, ErrFolderCycle), errors.Is(err, ErrFolderNotEmpty):
+		msg := err.Error()
+		return errorDiv(c, strings.ToUpper(msg[:1])+msg[1:])
+	case errors.Is(err, ErrFileNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	log.Printf("Failed to %s: %v", action, err)
+	return errorDiv(c, "Failed to "+action)
+}
+
+func FolderCreate(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	_, err := createFolder(hCtx.PGCtx, uuid, c.QueryParam("parent_id"), c.FormValue("name"))
+	if err != nil {
+		return folderErrorDiv(c, err, "create folder")
+	}
+	c.Response().Header().Set("HX-Trigger", "foldersChanged")
+	return c.NoContent(http.StatusOK)
+}
+
+func FolderRename(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	if err := renameFolder(hCtx.PGCtx, uuid, c.QueryParam("folder_id"), c.FormValue("name")); err != nil {
+		return folderErrorDiv(c, err, "rename folder")
+	}
+	c.Response().Header().Set("HX-Trigger", "foldersChanged")
+	return c.NoContent(http.StatusOK)
+}
+
+func FolderMove(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	if err := moveFolder(hCtx.PGCtx, uuid, c.QueryParam("folder_id"), c.QueryParam("parent_id")); err != nil {
+		return folderErrorDiv(c, err, "move folder")
+	}
+	c.Response().Header().Set("HX-Trigger", "foldersChanged")
+	return c.NoContent(http.StatusOK)
+}
+
+func FolderDelete(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	if err := deleteFolder(hCtx.PGCtx, uuid, c.QueryParam("folder_id")); err != nil {
+		return folderErrorDiv(c, err, "delete folder")
+	}
+	c.Response().Header().Set("HX-Trigger", "foldersChanged")
+	return c.NoContent(http.StatusOK)
+}
+
+// FolderPicker lists where a file (file_id) or a folder (folder_id) can be moved to
+type FolderPicker struct {
+	FileId   string
+	FolderId string
+	Folders  []Folder
+}
+
+func FolderPickerList(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	picker := FolderPicker{FileId: c.QueryParam("file_id"), FolderId: c.QueryParam("folder_id")}
+	folders, err := listFolderTree(hCtx.PGCtx, uuid, picker.FolderId)
+	if err != nil {
+		log.Printf("Failed to list folders: %v", err)
+		return errorDiv(c, "Failed to load folders")
+	}
+	picker.Folders = folders
+	return c.Render(http.StatusOK, "folders/picker", picker)
+}
+
+func FileMove(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	if err := moveFileToFolder(hCtx.PGCtx, uuid, c.QueryParam("file_id"), c.QueryParam("folder_id")); err != nil {
+		return folderErrorDiv(c, err, "move file")
+	}
+	c.Response().Header().Set("HX-Trigger", "filesChanged")
+	return successDiv(c, "Moved file")
+}
+
+// FileTags adds the tag form field to file_id, or with remove=true takes tag off it, then
+// re-renders the file's tags cell
+func FileTags(hCtx HandlerContext, remove bool) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+	fileId := c.QueryParam("file_id")
+
+	var err error
+	if remove {
+		err = removeFileTag(hCtx.PGCtx, uuid, fileId, c.QueryParam("tag"))
+	} else {
+		err = addFileTag(hCtx.PGCtx, uuid, fileId, c.FormValue("tag"))
+	}
+	var tagErr string
+	if errors.Is(err, ErrInvalidName) {
+		tagErr = strings.TrimPrefix(err.Error(), ErrInvalidName.Error()+": ")
+	} else if err != nil {
+		log.Printf("Failed to update tags of file %s: %v", fileId, err)
+		tagErr = "Failed to update tags"
+	}
+
+	tags, err := listFileTags(hCtx.PGCtx, uuid, fileId)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	return renderTagsCell(c, fileId, tags, tagErr)
+}
+
+func renderTagsCell(c echo.Context, fileId string, tags []string, tagErr string) error {
+	return c.Render(http.StatusOK, "tableCell/tags", cells.TagsCell{FileId: fileId, Tags: tags, Error: tagErr})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	pg "goserve/postgres"
+	"strings"
+	"testing"
+)
+
+func TestValidateFolderNameAndTags(t *testing.T) {
+	for _, name := range []string{"", "   ", ".", "..", "a/b", `a\b`, strings.Repeat("x", 256)} {
+		if _, err := validateFolderName(name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("validateFolderName(%q) = %v, want ErrInvalidName", name, err)
+		}
+	}
+	if name, err := validateFolderName("  Hiring 2024 "); err != nil || name != "Hiring 2024" {
+		t.Errorf("validateFolderName = %q, %v; want it trimmed", name, err)
+	}
+
+	for _, tag := range []string{"", "a,b", "a&b", "a?b", "#a", strings.Repeat("x", maxTagLength+1)} {
+		if _, err := normalizeTag(tag); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("normalizeTag(%q) = %v, want ErrInvalidName", tag, err)
+		}
+	}
+	if tag, err := normalizeTag(" Urgent "); err != nil || tag != "urgent" {
+		t.Errorf("normalizeTag = %q, %v; want it lowercased and trimmed", tag, err)
+	}
+}
+
+func mustCreateFolder(t *testing.T, pgContext *pg.PostgresContext, accountUUID string, parentId string, name string) Folder {
+	t.Helper()
+	folder, err := createFolder(pgContext, accountUUID, parentId, name)
+	if err != nil {
+		t.Fatalf("createFolder(%q): %v", name, err)
+	}
+	return folder
+}
+
+func TestFolderTree(t *testing.T) {
+	pgContext := newTestPG(t)
+	account := createTestAccount(t, pgContext, "folders@example.com")
+	other := createTestAccount(t, pgContext, "other-folders@example.com")
+
+	hiring := mustCreateFolder(t, pgContext, account, "", "Hiring")
+	year := mustCreateFolder(t, pgContext, account, hiring.Id, "2024")
+	offers := mustCreateFolder(t, pgContext, account, year.Id, "Offers")
+	if _, err := createFolder(pgContext, account, hiring.Id, "2024"); !errors.Is(err, ErrFolderExists) {
+		t.Errorf("second 2024 under Hiring = %v, want ErrFolderExists", err)
+	}
+	// names are unique per parent, not per account
+	mustCreateFolder(t, pgContext, account, "", "2024")
+	if _, err := createFolder(pgContext, other, hiring.Id, "Mine now"); !errors.Is(err, ErrFolderNotFound) {
+		t.Errorf("creating in another account's folder = %v, want ErrFolderNotFound", err)
+	}
+
+	crumbs, err := folderBreadcrumbs(pgContext, account, offers.Id)
+	if err != nil {
+		t.Fatalf("folderBreadcrumbs: %v", err)
+	}
+	names := []string{}
+	for _, crumb := range crumbs {
+		names = append(names, crumb.Name)
+	}
+	if strings.Join(names, " / ") != "Hiring / 2024 / Offers" {
+		t.Errorf("breadcrumbs = %v, want Hiring / 2024 / Offers", names)
+	}
+	if _, err := folderBreadcrumbs(pgContext, other, offers.Id); !errors.Is(err, ErrFolderNotFound) {
+		t.Errorf("another account's breadcrumbs = %v, want ErrFolderNotFound", err)
+	}
+
+	for _, parent := range []Folder{hiring, offers} {
+		if err := moveFolder(pgContext, account, hiring.Id, parent.Id); !errors.Is(err, ErrFolderCycle) {
+			t.Errorf("moving Hiring into %s = %v, want ErrFolderCycle", parent.Name, err)
+		}
+	}
+	if err := moveFolder(pgContext, account, offers.Id, ""); err != nil {
+		t.Fatalf("moving Offers to the top level: %v", err)
+	}
+	tree, err := listFolderTree(pgContext, account, year.Id)
+	if err != nil {
+		t.Fatalf("listFolderTree: %v", err)
+	}
+	paths := []string{}
+	for _, folder := range tree {
+		paths = append(paths, folder.Path)
+	}
+	if strings.Join(paths, ", ") != "2024, Hiring, Offers" {
+		t.Errorf("folder tree without Hiring / 2024 = %v", paths)
+	}
+
+	if err := deleteFolder(pgContext, account, hiring.Id); !errors.Is(err, ErrFolderNotEmpty) {
+		t.Errorf("deleting Hiring with 2024 in it = %v, want ErrFolderNotEmpty", err)
+	}
+	if err := deleteFolder(pgContext, other, year.Id); !errors.Is(err, ErrFolderNotFound) {
+		t.Errorf("deleting another account's folder = %v, want ErrFolderNotFound", err)
+	}
+	if err := deleteFolder(pgContext, account, year.Id); err != nil {
+		t.Errorf("deleting the empty 2024: %v", err)
+	}
+}
+
+func TestFileFoldersAndTags(t *testing.T) {
+	pgContext := newTestPG(t)
+	filesystem := newMemoryFilesystem("folders-test")
+	account := createTestAccount(t, pgContext, "tags@example.com")
+	other := createTestAccount(t, pgContext, "other-tags@example.com")
+	folder := mustCreateFolder(t, pgContext, account, "", "Invoices")
+	fileId := indexTestFile(t, pgContext, filesystem, account, "march.txt")
+
+	if err := moveFileToFolder(pgContext, other, fileId, ""); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("moving another account's file = %v, want ErrFileNotFound", err)
+	}
+	if err := moveFileToFolder(pgContext, account, fileId, folder.Id); err != nil {
+		t.Fatalf("moveFileToFolder: %v", err)
+	}
+	if err := deleteFolder(pgContext, account, folder.Id); !errors.Is(err, ErrFolderNotEmpty) {
+		t.Errorf("deleting a folder with a file in it = %v, want ErrFolderNotEmpty", err)
+	}
+
+	for _, tag := range []string{"Paid", "paid", "q1"} {
+		if err := addFileTag(pgContext, account, fileId, tag); err != nil {
+			t.Fatalf("addFileTag(%q): %v", tag, err)
+		}
+	}
+	// tagging someone else's file does nothing
+	if err := addFileTag(pgContext, other, fileId, "mine"); err != nil {
+		t.Fatalf("addFileTag from another account: %v", err)
+	}
+	tags, err := listFileTags(pgContext, account, fileId)
+	if err != nil || strings.Join(tags, ",") != "paid,q1" {
+		t.Errorf("file tags = %v, %v; want paid,q1", tags, err)
+	}
+	if err := removeFileTag(pgContext, account, fileId, "Q1"); err != nil {
+		t.Fatalf("removeFileTag: %v", err)
+	}
+	if tags, err := listAccountTags(pgContext, account); err != nil || strings.Join(tags, ",") != "paid" {
+		t.Errorf("account tags = %v, %v; want paid", tags, err)
+	}
+	if tags, err := listAccountTags(pgContext, other); err != nil || len(tags) != 0 {
+		t.Errorf("the other account's tags = %v, %v; want none", tags, err)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	pg "goserve/postgres"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestPG gives a test the tables from postgres/sql in a schema of its own, dropped when it
+// ends. Tests that need postgres are skipped unless TEST_PG_CONN points at a database they can
+// create schemas in.
+func newTestPG(t *testing.T) *pg.PostgresContext {
+	t.Helper()
+	conn := os.Getenv("TEST_PG_CONN")
+	if conn == "" {
+		t.Skip("TEST_PG_CONN isn't set")
+	}
+	ctx := context.Background()
+
+	admin, err := pgxpool.Connect(ctx, conn)
+	if err != nil {
+		t.Fatalf("connecting to TEST_PG_CONN: %v", err)
+	}
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	schema := "test_" + hex.EncodeToString(suffix)
+	// the table scripts create uuid-ossp in whatever schema comes first, which must outlive the test's
+	if _, err := admin.Exec(ctx, `CREATE EXTENSION IF NOT EXISTS "uuid-ossp" SCHEMA public`); err != nil {
+		t.Fatalf("creating uuid-ossp: %v", err)
+	}
+	if _, err := admin.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatalf("creating schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE")
+		admin.Close()
+	})
+
+	config, err := pgxpool.ParseConfig(conn)
+	if err != nil {
+		t.Fatalf("parsing TEST_PG_CONN: %v", err)
+	}
+	config.ConnConfig.RuntimeParams["search_path"] = schema + ",public"
+	pool, err := pgxpool.ConnectConfig(ctx, config)
+	if err != nil {
+		t.Fatalf("connecting to TEST_PG_CONN: %v", err)
+	}
+	t.Cleanup(pool.Close)
+
+	scripts, err := filepath.Glob("postgres/sql/01Table-*.sql")
+	if err != nil || len(scripts) == 0 {
+		t.Fatalf("finding table scripts: %v", err)
+	}
+	sort.Strings(scripts)
+	psqlCommand := regexp.MustCompile(`(?m)^\\.*$`)
+	for _, script := range scripts {
+		sql, err := os.ReadFile(script)
+		if err != nil {
+			t.Fatalf("reading %s: %v", script, err)
+		}
+		if _, err := pool.Exec(ctx, psqlCommand.ReplaceAllString(string(sql), "")); err != nil {
+			t.Fatalf("running %s: %v", script, err)
+		}
+	}
+	return &pg.PostgresContext{Pool: pool, Ctx: ctx}
+}
+
+// createTestAccount inserts a verified account with the password "password"
+func createTestAccount(t *testing.T, pgContext *pg.PostgresContext, email string) string {
+	t.Helper()
+	id := uuid.New().String()
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hashing password: %v", err)
+	}
+	sqlStatement := `INSERT INTO users (id, email, password, verified_at) VALUES ($1, $2, $3, now())`
+	if _, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, id, strings.ToLower(email), string(hash)); err != nil {
+		t.Fatalf("creating account %s: %v", email, err)
+	}
+	return id
+}
+
+// withTestJWTKeys signs access tokens with a fixed HS256 key for the rest of the test
+func withTestJWTKeys(t *testing.T) *JWTKeyring {
+	t.Helper()
+	key, err := parseJWTKey(jwtKeySpec{Kid: "test", Alg: jwtAlgHS256, Key: "dGVzdC1zZWNyZXQtdGhhdC1pcy1hdC1sZWFzdC0zMi1ieXRlcy1sb25n"}, "")
+	if err != nil {
+		t.Fatalf("parsing test JWT key: %v", err)
+	}
+	previous := jwtKeys
+	jwtKeys = &JWTKeyring{Grace: time.Hour, keys: []JWTKey{key}}
+	t.Cleanup(func() { jwtKeys = previous })
+	return jwtKeys
+}
+
+// memoryFilesystem is a Filesystem held in a map, registered under its own location
+type memoryFilesystem struct {
+	location string
+	mu       sync.Mutex
+	objects  map[string][]byte
+	// makes Delete fail for these keys
+	failDelete map[string]bool
+}
+
+var _ Filesystem = (*memoryFilesystem)(nil)
+
+func newMemoryFilesystem(location string) *memoryFilesystem {
+	fs := &memoryFilesystem{location: location, objects: map[string][]byte{}, failDelete: map[string]bool{}}
+	registerFilesystem(fs)
+	return fs
+}
+
+func (m *memoryFilesystem) Write(file io.Reader, filename string) error {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[filename] = data
+	return nil
+}
+
+func (m *memoryFilesystem) Read(filename string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[filename]
+	if !ok {
+		return nil, fmt.Errorf("%s: no such object", filename)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memoryFilesystem) Move(src string, dst string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[src]
+	if !ok {
+		return fmt.Errorf("%s: no such object", src)
+	}
+	m.objects[dst] = data
+	delete(m.objects, src)
+	return nil
+}
+
+func (m *memoryFilesystem) Delete(filename string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failDelete[filename] {
+		return fmt.Errorf("%s: delete failed", filename)
+	}
+	delete(m.objects, filename)
+	return nil
+}
+
+func (m *memoryFilesystem) Walk(fn func(StoredObject) error) error {
+	m.mu.Lock()
+	objects := make([]StoredObject, 0, len(m.objects))
+	for key, data := range m.objects {
+		objects = append(objects, StoredObject{Key: key, Size: int64(len(data)), ModTime: time.Now()})
+	}
+	m.mu.Unlock()
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	for _, object := range objects {
+		if err := fn(object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryFilesystem) GetStorageClass() *StorageClass {
+	return &StorageClass{}
+}
+
+func (m *memoryFilesystem) GetLocation() string {
+	return m.location
+}
+
+func (m *memoryFilesystem) has(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.objects[key]
+	return ok
+}
+
+// panicReader stands in for a reader or extractor that blows up on malformed input
+type panicReader struct{}
+
+func (panicReader) Read([]byte) (int, error) {
+	panic("malformed input")
+}
+
+func (panicReader) Close() error {
+	return nil
+}
+
+// panickingFilesystem serves every object through a panicReader
+type panickingFilesystem struct {
+	*memoryFilesystem
+}
+
+func (p panickingFilesystem) Read(filename string) (io.ReadCloser, error) {
+	return panicReader{}, nil
+}
+
+func newPanickingFilesystem(location string) panickingFilesystem {
+	fs := panickingFilesystem{&memoryFilesystem{location: location, objects: map[string][]byte{}}}
+	registerFilesystem(fs)
+	return fs
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Access tokens are signed with a key from a key ring and name it in their kid header. Each key
+// can be scheduled to take over signing at a time; the key it replaces keeps verifying tokens for
+// a grace period before it's retired. The public halves of RS256 and EdDSA keys are published at
+// /.well-known/jwks.json for other services to verify tokens with.
+
+var (
+	ErrUnknownJWTKey   = errors.New("token signed with an unknown or retired key")
+	ErrNoJWTSigningKey = errors.New("no JWT key is active yet")
+)
+
+const (
+	jwtAlgHS256 = "HS256"
+	jwtAlgRS256 = "RS256"
+	jwtAlgEdDSA = "EdDSA"
+)
+
+var jwtAlgs = []string{jwtAlgHS256, jwtAlgRS256, jwtAlgEdDSA}
+
+type JWTKey struct {
+	Kid string
+	Alg string
+	// When the key takes over signing. Zero means it's in effect from the start.
+	ActiveFrom time.Time
+	// When the key stops verifying, the grace period after its successor took over. Zero while
+	// nothing is scheduled to replace it.
+	RetireAt time.Time
+	signing  interface{}
+	verify   interface{}
+}
+
+func (k JWTKey) retired(now time.Time) bool {
+	return !k.RetireAt.IsZero() && !now.Before(k.RetireAt)
+}
+
+// jwtKeySpec is a key in the JWT_KEYS_FILE JSON file:
+//
+//	{"keys": [{"kid": "2024-06", "alg": "EdDSA", "key_file": "2024-06.pem"},
+//	          {"kid": "2024-12", "alg": "EdDSA", "key_file": "2024-12.pem", "active_from": "2024-12-01T00:00:00Z"}]}
+//
+// key is the PEM private key inline, or the base64 secret for HS256; key_file is read instead,
+// relative to the key file.
+type jwtKeySpec struct {
+	Kid        string     `json:"kid"`
+	Alg        string     `json:"alg"`
+	Key        string     `json:"key"`
+	KeyFile    string     `json:"key_file"`
+	ActiveFrom *time.Time `json:"active_from"`
+}
+
+type JWTKeyring struct {
+	// How long a replaced key keeps verifying tokens
+	Grace time.Duration
+	// Reloads of the key file are checked this often
+	ReloadInterval time.Duration
+
+	mu      sync.RWMutex
+	keys    []JWTKey
+	path    string
+	modTime time.Time
+}
+
+// GetDefaultJWTKeyring loads the key ring from JWT_KEYS_FILE, or from JWT_KEYS, a comma-separated
+// list of kid:base64 HS256 secrets with JWT_KEY_ID the one to sign with (default the first
+// listed). Without either, it makes up an Ed25519 key that lasts until the server restarts.
+func GetDefaultJWTKeyring() (*JWTKeyring, error) {
+	hours, err := strconv.Atoi(os.Getenv("JWT_KEY_GRACE_HOURS"))
+	if err != nil || hours < 0 {
+		hours = 24
+	}
+	keyring := &JWTKeyring{
+		Grace:          time.Duration(hours) * time.Hour,
+		ReloadInterval: time.Minute,
+	}
+
+	if path := os.Getenv("JWT_KEYS_FILE"); path != "" {
+		keyring.path = path
+		if err := keyring.reload(); err != nil {
+			return nil, err
+		}
+		return keyring, nil
+	}
+
+	var keys []JWTKey
+	if spec := os.Getenv("JWT_KEYS"); spec != "" {
+		current := os.Getenv("JWT_KEY_ID")
+		for _, entry := range strings.Split(spec, ",") {
+			kid, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+			if !ok || kid == "" {
+				return nil, fmt.Errorf("JWT_KEYS entries must be kid:base64secret")
+			}
+			key, err := parseJWTKey(jwtKeySpec{Kid: kid, Alg: jwtAlgHS256, Key: encoded}, "")
+			if err != nil {
+				return nil, err
+			}
+			if current == "" {
+				current = kid
+			}
+			keys = append(keys, key)
+		}
+		// keys in effect together sign with the last one, so move the current key there
+		found := false
+		for i, key := range keys {
+			if key.Kid == current {
+				keys = append(append(keys[:i:i], keys[i+1:]...), key)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("JWT_KEY_ID %q isn't in JWT_KEYS", current)
+		}
+	} else {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("error generating JWT key: %w", err)
+		}
+		kid := make([]byte, 6)
+		rand.Read(kid)
+		keys = []JWTKey{{
+			Kid:     "ephemeral-" + base64.RawURLEncoding.EncodeToString(kid),
+			Alg:     jwtAlgEdDSA,
+			signing: priv,
+			verify:  pub,
+		}}
+		log.Printf("JWT_KEYS_FILE and JWT_KEYS aren't set, signing with a temporary key: sessions refresh after a restart and other servers can't verify tokens")
+	}
+	keyring.keys = scheduleJWTKeys(keys, keyring.Grace)
+	return keyring, nil
+}
+
+// scheduleJWTKeys orders keys by when they take over signing, ties keeping their order, and sets
+// when each one that's been scheduled to be replaced retires
+func scheduleJWTKeys(keys []JWTKey, grace time.Duration) []JWTKey {
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].ActiveFrom.Before(keys[j].ActiveFrom) })
+	for i := range keys {
+		keys[i].RetireAt = time.Time{}
+		// keys in effect from the start stay valid alongside each other
+		if i+1 < len(keys) && !keys[i+1].ActiveFrom.IsZero() {
+			keys[i].RetireAt = keys[i+1].ActiveFrom.Add(grace)
+		}
+	}
+	return keys
+}
+
+func loadJWTKeyFile(path string, grace time.Duration) ([]JWTKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JWT key file: %w", err)
+	}
+	var file struct {
+		Keys []jwtKeySpec `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error parsing JWT key file %s: %w", path, err)
+	}
+	if len(file.Keys) == 0 {
+		return nil, fmt.Errorf("JWT key file %s has no keys", path)
+	}
+
+	seen := map[string]bool{}
+	keys := make([]JWTKey, 0, len(file.Keys))
+	for _, spec := range file.Keys {
+		if seen[spec.Kid] {
+			return nil, fmt.Errorf("JWT key file %s lists kid %q twice", path, spec.Kid)
+		}
+		seen[spec.Kid] = true
+		key, err := parseJWTKey(spec, filepath.Dir(path))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return scheduleJWTKeys(keys, grace), nil
+}
+
+func parseJWTKey(spec jwtKeySpec, dir string) (JWTKey, error) {
+	key := JWTKey{Kid: spec.Kid, Alg: spec.Alg}
+	if spec.Kid == "" || len(spec.Kid) > 64 {
+		return key, fmt.Errorf("JWT key ids must be 1-64 characters")
+	}
+	if spec.ActiveFrom != nil {
+		key.ActiveFrom = *spec.ActiveFrom
+	}
+	material := []byte(spec.Key)
+	if spec.KeyFile != "" {
+		path := spec.KeyFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return key, fmt.Errorf("error reading JWT key %q: %w", spec.Kid, err)
+		}
+		material = data
+	}
+
+	switch spec.Alg {
+	case jwtAlgHS256:
+		secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(material)))
+		if err != nil || len(secret) < 32 {
+			return key, fmt.Errorf("JWT key %q must be a base64 secret of at least 32 bytes", spec.Kid)
+		}
+		key.signing, key.verify = secret, secret
+	case jwtAlgRS256:
+		priv, err := jwt.ParseRSAPrivateKeyFromPEM(material)
+		if err != nil {
+			return key, fmt.Errorf("JWT key %q isn't an RSA private key: %w", spec.Kid, err)
+		}
+		if priv.N.BitLen() < 2048 {
+			return key, fmt.Errorf("JWT key %q must be at least 2048 bits", spec.Kid)
+		}
+		key.signing, key.verify = priv, &priv.PublicKey
+	case jwtAlgEdDSA:
+		priv, err := jwt.ParseEdPrivateKeyFromPEM(material)
+		if err != nil {
+			return key, fmt.Errorf("JWT key %q isn't an Ed25519 private key: %w", spec.Kid, err)
+		}
+		edPriv := priv.(ed25519.PrivateKey)
+		key.signing, key.verify = edPriv, edPriv.Public()
+	default:
+		return key, fmt.Errorf("JWT key %q has alg %q, expected one of %s", spec.Kid, spec.Alg, strings.Join(jwtAlgs, ", "))
+	}
+	return key, nil
+}
+
+// reload re-reads the key file if it changed since it was last loaded
+func (k *JWTKeyring) reload() error {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return fmt.Errorf("error reading JWT key file: %w", err)
+	}
+	k.mu.RLock()
+	unchanged := info.ModTime().Equal(k.modTime)
+	k.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	keys, err := loadJWTKeyFile(k.path, k.Grace)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.keys = keys
+	k.modTime = info.ModTime()
+	k.mu.Unlock()
+	return nil
+}
+
+// Run reloads the key file whenever it changes, so keys can be added without a restart. A file
+// that doesn't load leaves the keys as they were.
+func (k *JWTKeyring) Run(ctx context.Context) {
+	if k.path == "" {
+		return
+	}
+	ticker := time.NewTicker(k.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.reload(); err != nil {
+				log.Printf("Failed to reload JWT keys, keeping the current ones: %v", err)
+			}
+		}
+	}
+}
+
+// signingKey is the key in effect: the last one whose time to take over has come
+func (k *JWTKeyring) signingKey(now time.Time) (JWTKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		if !now.Before(k.keys[i].ActiveFrom) {
+			return k.keys[i], nil
+		}
+	}
+	return JWTKey{}, ErrNoJWTSigningKey
+}
+
+// Sign signs claims with the current key, naming it in the kid header
+func (k *JWTKeyring) Sign(claims jwt.Claims) (string, error) {
+	key, err := k.signingKey(time.Now())
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Alg), claims)
+	token.Header["kid"] = key.Kid
+	return token.SignedString(key.signing)
+}
+
+// Keyfunc finds the key a token names for jwt.Parse. Keys that haven't taken over yet or have
+// retired don't verify anything.
+func (k *JWTKeyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	now := time.Now()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.Kid != kid {
+			continue
+		}
+		if now.Before(key.ActiveFrom) || key.retired(now) {
+			break
+		}
+		if token.Method.Alg() != key.Alg {
+			return nil, fmt.Errorf("unexpected signing method %v for key %q", token.Header["alg"], kid)
+		}
+		return key.verify, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownJWTKey, kid)
+}
+
+// JWK is a public key in a JSON Web Key Set (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWKS lists the public keys that aren't retired, including those yet to take over so verifiers
+// have them ahead of time. HS256 secrets are never published.
+func (k *JWTKeyring) JWKS() []JWK {
+	now := time.Now()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	jwks := []JWK{}
+	for _, key := range k.keys {
+		if key.retired(now) {
+			continue
+		}
+		switch pub := key.verify.(type) {
+		case ed25519.PublicKey:
+			jwks = append(jwks, JWK{
+				Kty: "OKP", Kid: key.Kid, Alg: key.Alg, Use: "sig",
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		case *rsa.PublicKey:
+			jwks = append(jwks, JWK{
+				Kty: "RSA", Kid: key.Kid, Alg: key.Alg, Use: "sig",
+				N: base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		}
+	}
+	return jwks
+}
+
+// Endpoints
+
+func JWKSEndpoint(c echo.Context) error {
+	c.Response().Header().Set("Cache-Control", "public, max-age=300")
+	return c.JSON(http.StatusOK, map[string][]JWK{"keys": jwtKeys.JWKS()})
+}
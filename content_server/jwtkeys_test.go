@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newTestEdKey(t *testing.T, kid string, activeFrom time.Time) JWTKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	return JWTKey{Kid: kid, Alg: jwtAlgEdDSA, ActiveFrom: activeFrom, signing: priv, verify: pub}
+}
+
+func signWith(t *testing.T, key JWTKey, method jwt.SigningMethod, signingKey interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, jwt.MapClaims{"ID": "account", "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = key.Kid
+	signed, err := token.SignedString(signingKey)
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+	return signed
+}
+
+// parseWith verifies a token the way the auth middleware does
+func parseWith(keyring *JWTKeyring, signed string) error {
+	_, err := jwt.Parse(signed, keyring.Keyfunc, jwt.WithValidMethods(jwtAlgs))
+	return err
+}
+
+func TestKeyringVerifiesTokensFromItsSigningKey(t *testing.T) {
+	keyring := &JWTKeyring{keys: scheduleJWTKeys([]JWTKey{newTestEdKey(t, "current", time.Time{})}, time.Hour)}
+	signed, err := keyring.Sign(jwt.MapClaims{"ID": "account", "exp": time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := parseWith(keyring, signed); err != nil {
+		t.Errorf("token from the signing key was rejected: %v", err)
+	}
+}
+
+func TestKeyringRejectsUnknownKid(t *testing.T) {
+	keyring := &JWTKeyring{keys: scheduleJWTKeys([]JWTKey{newTestEdKey(t, "current", time.Time{})}, time.Hour)}
+	stranger := newTestEdKey(t, "someone-elses", time.Time{})
+
+	err := parseWith(keyring, signWith(t, stranger, jwt.SigningMethodEdDSA, stranger.signing))
+	if !errors.Is(err, ErrUnknownJWTKey) {
+		t.Errorf("token with an unknown kid = %v, want ErrUnknownJWTKey", err)
+	}
+
+	// nor does leaving the kid out fall back to some key
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{"ID": "account"})
+	signed, _ := token.SignedString(keyring.keys[0].signing)
+	if err := parseWith(keyring, signed); !errors.Is(err, ErrUnknownJWTKey) {
+		t.Errorf("token without a kid = %v, want ErrUnknownJWTKey", err)
+	}
+}
+
+func TestKeyringRejectsMismatchedAlg(t *testing.T) {
+	key := newTestEdKey(t, "current", time.Time{})
+	keyring := &JWTKeyring{keys: scheduleJWTKeys([]JWTKey{key}, time.Hour)}
+
+	// the public key is no secret, so an HS256 token keyed with it must not pass as the EdDSA key's
+	public := []byte(key.verify.(ed25519.PublicKey))
+	err := parseWith(keyring, signWith(t, key, jwt.SigningMethodHS256, public))
+	if err == nil || !strings.Contains(err.Error(), "unexpected signing method") {
+		t.Errorf("HS256 token naming an EdDSA key = %v, want the key ring to refuse the alg", err)
+	}
+}
+
+func TestKeyringRejectsRetiredAndPendingKeys(t *testing.T) {
+	now := time.Now()
+	// "old" was replaced two hours ago and its one hour of grace is over
+	old := newTestEdKey(t, "old", time.Time{})
+	current := newTestEdKey(t, "current", now.Add(-2*time.Hour))
+	next := newTestEdKey(t, "next", now.Add(time.Hour))
+	keyring := &JWTKeyring{keys: scheduleJWTKeys([]JWTKey{old, current, next}, time.Hour)}
+
+	if err := parseWith(keyring, signWith(t, old, jwt.SigningMethodEdDSA, old.signing)); !errors.Is(err, ErrUnknownJWTKey) {
+		t.Errorf("token from a retired key = %v, want ErrUnknownJWTKey", err)
+	}
+	if err := parseWith(keyring, signWith(t, next, jwt.SigningMethodEdDSA, next.signing)); !errors.Is(err, ErrUnknownJWTKey) {
+		t.Errorf("token from a key that hasn't taken over = %v, want ErrUnknownJWTKey", err)
+	}
+	if err := parseWith(keyring, signWith(t, current, jwt.SigningMethodEdDSA, current.signing)); err != nil {
+		t.Errorf("token from the current key = %v, want it accepted", err)
+	}
+
+	// within the grace period the replaced key still verifies
+	graceful := &JWTKeyring{keys: scheduleJWTKeys([]JWTKey{old, current}, 3*time.Hour)}
+	if err := parseWith(graceful, signWith(t, old, jwt.SigningMethodEdDSA, old.signing)); err != nil {
+		t.Errorf("token from a key in its grace period = %v, want it accepted", err)
+	}
+
+	for _, jwk := range keyring.JWKS() {
+		if jwk.Kid == "old" {
+			t.Error("JWKS still publishes the retired key")
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrMailNotConfigured = errors.New("outgoing mail isn't configured")
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// mailer is nil unless SMTP_ADDRESS is set, in which case nothing that needs email is offered.
+// Set at startup by getDefaultMailer.
+var mailer Mailer
+
+// getDefaultMailer sets up SMTP from the environment. Mail needs PUBLIC_BASE_URL too, since the
+// links it carries mustn't be built from a request's Host header, which the requester picks.
+func getDefaultMailer() (Mailer, error) {
+	address := os.Getenv("SMTP_ADDRESS")
+	if address == "" {
+		return nil, nil
+	}
+	if publicBaseURL == "" {
+		return nil, fmt.Errorf("SMTP_ADDRESS is set but PUBLIC_BASE_URL isn't, and emailed links are built on it")
+	}
+	base, err := url.Parse(publicBaseURL)
+	if err != nil || (base.Scheme != "https" && base.Scheme != "http") || base.Host == "" || base.RawQuery != "" || base.Fragment != "" {
+		return nil, fmt.Errorf("PUBLIC_BASE_URL %q must be an absolute http(s) URL like https://files.example.com", publicBaseURL)
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "GoServe <no-reply@localhost>"
+	}
+	return &SMTPMailer{
+		Address:  address,
+		From:     from,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		Timeout:  30 * time.Second,
+	}, nil
+}
+
+// emailLink makes an absolute link to path for an email, always on PUBLIC_BASE_URL
+func emailLink(path string, query url.Values) string {
+	return publicBaseURL + path + "?" + query.Encode()
+}
+
+// SMTPMailer delivers through an SMTP relay, upgrading to TLS with STARTTLS when the server offers
+// it. Credentials are only sent over TLS, or to a relay on localhost.
+type SMTPMailer struct {
+	Address  string
+	From     string
+	Username string
+	Password string
+	Timeout  time.Duration
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP_FROM %q: %w", m.From, err)
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient %q: %w", msg.To, err)
+	}
+	data, err := buildMessage(from, to, msg)
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(m.Address)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP_ADDRESS %q: %w", m.Address, err)
+	}
+	conn, err := net.DialTimeout("tcp", m.Address, m.Timeout)
+	if err != nil {
+		return fmt.Errorf("error connecting to SMTP server at %s: %w", m.Address, err)
+	}
+	// covers the whole conversation, not each step
+	conn.SetDeadline(time.Now().Add(m.Timeout))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error greeting SMTP server: %w", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("error starting TLS with SMTP server: %w", err)
+		}
+	}
+	if m.Username != "" {
+		// PlainAuth refuses to send the password unencrypted to anything but localhost
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return fmt.Errorf("error authenticating with SMTP server: %w", err)
+		}
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return fmt.Errorf("SMTP server refused sender: %w", err)
+	}
+	if err := client.Rcpt(to.Address); err != nil {
+		return fmt.Errorf("SMTP server refused recipient: %w", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("error starting SMTP data: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("SMTP server refused message: %w", err)
+	}
+	return client.Quit()
+}
+
+// buildMessage renders the headers and quoted-printable body
+func buildMessage(from *mail.Address, to *mail.Address, msg Message) ([]byte, error) {
+	if strings.ContainsAny(msg.Subject, "\r\n") {
+		return nil, fmt.Errorf("subject can't contain line breaks")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+
+	var buf bytes.Buffer
+	headers := [][2]string{
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), domain)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(msg.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
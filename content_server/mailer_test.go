@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpDelivery is one message a fakeSMTP accepted
+type smtpDelivery struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTP is a local SMTP sink. It offers AUTH but not STARTTLS, which PlainAuth only puts up
+// with because the sink is on localhost.
+type fakeSMTP struct {
+	listener net.Listener
+
+	mu         sync.Mutex
+	deliveries []smtpDelivery
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	f := &fakeSMTP{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go f.serve()
+	return f
+}
+
+func (f *fakeSMTP) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeSMTP) handle(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost fake SMTP")
+	var delivery smtpDelivery
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250-localhost")
+			text.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			_, initial, _ := strings.Cut(arg, " ")
+			decoded, _ := base64.StdEncoding.DecodeString(initial)
+			delivery.auth = string(decoded)
+			text.PrintfLine("235 accepted")
+		case "MAIL":
+			delivery.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			text.PrintfLine("250 ok")
+		case "RCPT":
+			delivery.to = append(delivery.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			text.PrintfLine("250 ok")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			data, err := io.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			delivery.data = string(data)
+			f.mu.Lock()
+			f.deliveries = append(f.deliveries, delivery)
+			f.mu.Unlock()
+			delivery = smtpDelivery{}
+			text.PrintfLine("250 queued")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func (f *fakeSMTP) mailer() *SMTPMailer {
+	return &SMTPMailer{Address: f.listener.Addr().String(), From: "GoServe <no-reply@example.com>", Timeout: 5 * time.Second}
+}
+
+func TestSMTPMailerDelivers(t *testing.T) {
+	sink := newFakeSMTP(t)
+	m := sink.mailer()
+	m.Username = "relay-user"
+	m.Password = "relay-pass"
+	body := "Reset it here:\n\nhttps://files.example.com/reset-password/?token=" + strings.Repeat("x", 90) + "\n"
+
+	if err := m.Send(Message{To: "Someone <someone@example.com>", Subject: "Reset your password", Body: body}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.deliveries) != 1 {
+		t.Fatalf("sink got %d messages, want 1", len(sink.deliveries))
+	}
+	got := sink.deliveries[0]
+	if got.auth != "\x00relay-user\x00relay-pass" {
+		t.Errorf("AUTH PLAIN sent %q, want the configured credentials", got.auth)
+	}
+	if got.from != "no-reply@example.com" || len(got.to) != 1 || got.to[0] != "someone@example.com" {
+		t.Errorf("envelope from %q to %q, want no-reply@example.com to someone@example.com", got.from, got.to)
+	}
+
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(got.data)))
+	if err != nil {
+		t.Fatalf("parsing the delivered message: %v", err)
+	}
+	if subject := msg.Header.Get("Subject"); subject != "Reset your password" {
+		t.Errorf("Subject = %q", subject)
+	}
+	if to := msg.Header.Get("To"); !strings.Contains(to, "someone@example.com") {
+		t.Errorf("To = %q", to)
+	}
+	decoded, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatalf("decoding the body: %v", err)
+	}
+	// the long link is wrapped by quoted-printable and must come back whole. The sink's DotReader
+	// has already turned CRLFs back into newlines.
+	if string(decoded) != body {
+		t.Errorf("body = %q, want %q", decoded, body)
+	}
+}
+
+func TestSMTPMailerRefusesHeaderInjection(t *testing.T) {
+	sink := newFakeSMTP(t)
+	err := sink.mailer().Send(Message{To: "someone@example.com", Subject: "Hi\r\nBcc: everyone@example.com", Body: "hello"})
+	if err == nil {
+		t.Error("a subject with a line break was sent")
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.deliveries) != 0 {
+		t.Errorf("sink got %d messages, want none", len(sink.deliveries))
+	}
+}
+
+func TestMailNeedsPublicBaseURL(t *testing.T) {
+	previous := publicBaseURL
+	t.Cleanup(func() { publicBaseURL = previous })
+	t.Setenv("SMTP_ADDRESS", "127.0.0.1:25")
+
+	for _, base := range []string{"", "files.example.com", "https://", "https://files.example.com?x=1"} {
+		publicBaseURL = base
+		if m, err := getDefaultMailer(); err == nil || m != nil {
+			t.Errorf("mailer with PUBLIC_BASE_URL %q = %v, %v; want an error", base, m, err)
+		}
+	}
+
+	publicBaseURL = "https://files.example.com"
+	if m, err := getDefaultMailer(); err != nil || m == nil {
+		t.Errorf("mailer with PUBLIC_BASE_URL set = %v, %v", m, err)
+	}
+	if link := emailLink("/reset-password/", map[string][]string{"token": {"abc"}}); link != "https://files.example.com/reset-password/?token=abc" {
+		t.Errorf("emailLink = %q", link)
+	}
+
+	// without SMTP there's no mail to link from, so no base URL is needed
+	t.Setenv("SMTP_ADDRESS", "")
+	publicBaseURL = ""
+	if m, err := getDefaultMailer(); err != nil || m != nil {
+		t.Errorf("mailer without SMTP_ADDRESS = %v, %v; want none and no error", m, err)
+	}
+}
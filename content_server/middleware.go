@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	pg "goserve/postgres"
+	"goserve/templating"
 	"html/template"
-	pg "main/postgres"
-	"main/templating"
+	"log"
 	"net/http"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -38,37 +41,61 @@ func NewClaimsError(key string, message string) error {
 	return fmt.Errorf("JWT claims error. Key: %v. Message: %v", key, message)
 }
 
-func JWTFromCookie() echo.MiddlewareFunc {
+// JWTFromCookie checks the access token in the auth_token cookie. When it's missing or expired,
+// the refresh_token cookie is exchanged for a new pair before the request goes on.
+func JWTFromCookie(pool *pgxpool.Pool) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			cookie, err := c.Cookie("auth_token")
-			if err != nil {
-				return c.Redirect(http.StatusFound, "/login")
+			pgContext := &pg.PostgresContext{Pool: pool, Ctx: context.Background()}
+			if cookie, err := c.Cookie(accessCookie); err == nil {
+				if token, err := parseAccessToken(cookie.Value); err == nil {
+					// a revoked session's access tokens are still signed and unexpired
+					sid, _ := token.Claims.(jwt.MapClaims)["sid"].(string)
+					active, err := sessionActive(pgContext, sid)
+					if err != nil {
+						log.Printf("Failed to check session: %v", err)
+						return echo.NewHTTPError(http.StatusInternalServerError)
+					}
+					if active {
+						c.Set("user", token)
+						return next(c)
+					}
+				}
 			}
 
-			tokenString := cookie.Value
-			token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-				// Don't forget to validate the alg is what you expect:
-				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			token, err := refreshSession(pgContext, c)
+			if errors.Is(err, ErrRefreshTokenRaced) {
+				// the request that won has set new cookies, so the browser can try again with them
+				if c.Request().Method == http.MethodGet && c.Request().Header.Get("HX-Request") == "" {
+					return c.Redirect(http.StatusFound, c.Request().RequestURI)
 				}
-				return jwtSecret, nil
-			})
-
-			if err != nil {
-				return c.Redirect(http.StatusFound, "/login")
+				return c.NoContent(http.StatusUnauthorized)
 			}
-
-			if _, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-				c.Set("user", token)
-				return next(c)
-			} else {
+			if err != nil {
+				if !errors.Is(err, ErrInvalidRefreshToken) && !errors.Is(err, ErrSessionEnded) {
+					log.Printf("Failed to refresh session: %v", err)
+				}
+				clearAuthCookies(c)
 				return c.Redirect(http.StatusFound, "/login")
 			}
+			c.Set("user", token)
+			return next(c)
 		}
 	}
 }
 
+func parseAccessToken(tokenString string) (*jwt.Token, error) {
+	// the key ring checks the alg matches the key the kid names
+	token, err := jwt.Parse(tokenString, jwtKeys.Keyfunc, jwt.WithValidMethods(jwtAlgs))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := token.Claims.(jwt.MapClaims); !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid access token")
+	}
+	return token, nil
+}
+
 // jwtClaimsMiddleware handles the JWT claims validation using a ValidationMap.
 func jwtClaimsMiddleware(sMap ValidationMap[string], fMap ValidationMap[float64]) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
@@ -127,6 +154,7 @@ func jwtClaimsMiddleware(sMap ValidationMap[string], fMap ValidationMap[float64]
 var strClaimsValidation = ValidationMap[string]{
 	"ID":     {Func: validateUUID, Required: true},
 	"Issuer": {Func: validateIssuer, Required: true},
+	"sid":    {Func: validateUUID, Required: true},
 }
 
 var f64ClaimsValidation = ValidationMap[float64]{
@@ -195,6 +223,56 @@ func PgxPoolMiddleware(pool *pgxpool.Pool) echo.MiddlewareFunc {
 	}
 }
 
+// requireAdmin only lets through accounts with users.is_admin set. Checked against the database on
+// every request rather than carried in the JWT, so revoking admin takes effect immediately.
+func requireAdmin(pool *pgxpool.Pool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			uuid, ok := c.Get("ID").(string)
+			if !ok {
+				return echo.NewHTTPError(http.StatusForbidden)
+			}
+
+			var isAdmin bool
+			err := pool.QueryRow(context.Background(), `SELECT is_admin FROM users WHERE id = $1`, uuid).Scan(&isAdmin)
+			if err != nil || !isAdmin {
+				return echo.NewHTTPError(http.StatusForbidden)
+			}
+			return next(c)
+		}
+	}
+}
+
+// requireVerified keeps accounts that haven't confirmed their email on the page asking them to.
+// Checked against the database like requireAdmin, so following the link takes effect at once.
+func requireVerified(pool *pgxpool.Pool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !verificationRequired() || strings.HasPrefix(c.Path(), "/app/verify/") || strings.HasPrefix(c.Path(), "/app/assets") {
+				return next(c)
+			}
+			uuid, ok := c.Get("ID").(string)
+			if !ok {
+				return echo.NewHTTPError(http.StatusForbidden)
+			}
+
+			var verified bool
+			err := pool.QueryRow(context.Background(), `SELECT verified_at IS NOT NULL FROM users WHERE id = $1`, uuid).Scan(&verified)
+			if err != nil {
+				return fmt.Errorf("error checking verification of account %s: %w", uuid, err)
+			}
+			if verified {
+				return next(c)
+			}
+			if c.Request().Header.Get("HX-Request") != "" {
+				c.Response().Header().Set("HX-Redirect", "/app/verify/")
+				return c.NoContent(http.StatusOK)
+			}
+			return c.Redirect(http.StatusFound, "/app/verify/")
+		}
+	}
+}
+
 func customHTTPErrorHandler(tmpl *template.Template) echo.HTTPErrorHandler {
 	return func(err error, c echo.Context) {
 		code := http.StatusInternalServerError
@@ -203,8 +281,9 @@ func customHTTPErrorHandler(tmpl *template.Template) echo.HTTPErrorHandler {
 		}
 		c.Logger().Error(err)
 
-		_, cookieErr := c.Cookie("auth_token")
-		if cookieErr != nil {
+		_, cookieErr := c.Cookie(accessCookie)
+		_, refreshErr := c.Cookie(refreshCookie)
+		if cookieErr != nil && refreshErr != nil {
 			c.Redirect(http.StatusFound, "/login")
 			return
 		}
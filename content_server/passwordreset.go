@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Forgotten passwords are reset through an emailed link carrying a single-use token. Resetting
+// signs the account out everywhere.
+
+var ErrInvalidResetToken = errors.New("reset link is invalid or has expired")
+
+type PasswordResetConfig struct {
+	// How long a reset link works
+	TTL time.Duration
+	// Another link isn't sent for an account until this long after the last
+	Throttle time.Duration
+}
+
+func GetDefaultPasswordResetConfig() PasswordResetConfig {
+	minutes, err := strconv.Atoi(os.Getenv("PASSWORD_RESET_MINUTES"))
+	if err != nil || minutes <= 0 {
+		minutes = 60
+	}
+	return PasswordResetConfig{
+		TTL:      time.Duration(minutes) * time.Minute,
+		Throttle: time.Minute,
+	}
+}
+
+var passwordResetConfig = GetDefaultPasswordResetConfig()
+
+// requestPasswordReset makes a reset token for the account registered to email, replacing any
+// earlier one. The token is empty, without an error, when there's no such account or one was sent
+// moments ago, so callers behave the same either way.
+func requestPasswordReset(pgContext *pg.PostgresContext, email string, remoteIP string) (string, error) {
+	accountUUID, err := accountByEmail(pgContext, email)
+	if errors.Is(err, ErrGranteeNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return "", fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	var recent bool
+	sqlStatement := `SELECT EXISTS (SELECT 1 FROM password_resets WHERE account_uuid = $1 AND created_at > $2)`
+	if err := tx.QueryRow(pgContext.Ctx, sqlStatement, accountUUID, now.Add(-passwordResetConfig.Throttle)).Scan(&recent); err != nil {
+		return "", fmt.Errorf("error checking recent password resets: %w", err)
+	}
+	if recent {
+		return "", nil
+	}
+	sqlStatement = `DELETE FROM password_resets WHERE account_uuid = $1`
+	if _, err := tx.Exec(pgContext.Ctx, sqlStatement, accountUUID); err != nil {
+		return "", fmt.Errorf("error clearing password resets: %w", err)
+	}
+	sqlStatement = `
+	INSERT INTO password_resets (token_hash, account_uuid, created_at, expires_at, requested_ip)
+	VALUES ($1, $2, $3, $4, $5)`
+	_, err = tx.Exec(pgContext.Ctx, sqlStatement, tokenHash, accountUUID, now, now.Add(passwordResetConfig.TTL), remoteIP)
+	if err != nil {
+		return "", fmt.Errorf("error storing password reset: %w", err)
+	}
+	if err := tx.Commit(pgContext.Ctx); err != nil {
+		return "", fmt.Errorf("error committing password reset: %w", err)
+	}
+	return token, nil
+}
+
+func checkResetToken(pgContext *pg.PostgresContext, token string) bool {
+	var valid bool
+	sqlStatement := `
+	SELECT EXISTS (SELECT 1 FROM password_resets WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2)`
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, hashOpaqueToken(token), time.Now().UTC()).Scan(&valid); err != nil {
+		log.Printf("Failed to check password reset token: %v", err)
+		return false
+	}
+	return valid
+}
+
+// resetPassword uses up a reset token to set a new password, and revokes every session the
+// account has. Returns the account's email.
+func resetPassword(pgContext *pg.PostgresContext, token string, password string) (string, error) {
+	passHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("error hashing password: %w", err)
+	}
+	now := time.Now().UTC()
+
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return "", fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	var accountUUID, email string
+	sqlStatement := `
+	UPDATE password_resets SET used_at = $2
+	WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2
+	RETURNING account_uuid`
+	if err := tx.QueryRow(pgContext.Ctx, sqlStatement, hashOpaqueToken(token), now).Scan(&accountUUID); err != nil {
+		return "", ErrInvalidResetToken
+	}
+	// following the emailed link proves the address is theirs too
+	sqlStatement = `UPDATE users SET password = $2, verified_at = COALESCE(verified_at, $3) WHERE id = $1 RETURNING email`
+	err = tx.QueryRow(pgContext.Ctx, sqlStatement, accountUUID, base64.StdEncoding.EncodeToString(passHash), now).Scan(&email)
+	if err != nil {
+		return "", fmt.Errorf("error updating password: %w", err)
+	}
+	sqlStatement = `
+	UPDATE sessions SET revoked_at = $2, revoked_reason = 'password_reset'
+	WHERE account_uuid = $1 AND revoked_at IS NULL`
+	if _, err := tx.Exec(pgContext.Ctx, sqlStatement, accountUUID, now); err != nil {
+		return "", fmt.Errorf("error revoking sessions: %w", err)
+	}
+	if err := tx.Commit(pgContext.Ctx); err != nil {
+		return "", fmt.Errorf("error committing password reset: %w", err)
+	}
+	return email, nil
+}
+
+// sendMail sends in the background, so how long a request takes doesn't give away whether an
+// email went out
+func sendMail(msg Message) {
+	go func() {
+		if err := mailer.Send(msg); err != nil {
+			log.Printf("Failed to email %s: %v", msg.To, err)
+		}
+	}()
+}
+
+// Endpoints
+
+func ForgotPasswordPage(c echo.Context) error {
+	return c.Render(http.StatusOK, "forgot-password", map[string]interface{}{
+		"MailEnabled": mailer != nil,
+	})
+}
+
+func ForgotPassword(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	if mailer == nil {
+		return errorDiv(c, "Password reset by email isn't set up on this server")
+	}
+	email := c.FormValue("email")
+	if !govalidator.IsEmail(email) {
+		return errorDiv(c, "Invalid email address")
+	}
+
+	token, err := requestPasswordReset(hCtx.PGCtx, email, c.RealIP())
+	if err != nil {
+		log.Printf("Failed to start password reset: %v", err)
+		return errorDiv(c, "Internal server error")
+	}
+	if token != "" {
+		link := emailLink("/reset-password/", url.Values{"token": {token}})
+		sendMail(Message{
+			To:      email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Someone asked to reset the password for your account. If it was you, set a new one here:\n\n%s\n\n"+
+				"The link works once and expires in %d minutes. If you didn't ask, ignore this email and your password stays as it is.\n",
+				link, int(passwordResetConfig.TTL.Minutes())),
+		})
+	}
+	return noticeDiv(c, "If an account exists for that email, a reset link is on its way.")
+}
+
+func ResetPasswordPage(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	token := c.QueryParam("token")
+	return c.Render(http.StatusOK, "reset-password", map[string]interface{}{
+		"Token": token,
+		"Valid": token != "" && checkResetToken(hCtx.PGCtx, token),
+	})
+}
+
+func ResetPassword(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	password := c.FormValue("password")
+	if msg := validatePassword(password, c.FormValue("confirm-password")); msg != "" {
+		return errorDiv(c, msg)
+	}
+
+	email, err := resetPassword(hCtx.PGCtx, c.FormValue("token"), password)
+	if errors.Is(err, ErrInvalidResetToken) {
+		return errorDiv(c, "This reset link is invalid or has expired")
+	}
+	if err != nil {
+		log.Printf("Failed to reset password: %v", err)
+		return errorDiv(c, "Internal server error")
+	}
+
+	if mailer != nil {
+		sendMail(Message{
+			To:      email,
+			Subject: "Your password was changed",
+			Body:    "The password for your account was just reset, and every device signed in to it was signed out.\n\nIf you didn't do this, reset it again right away.\n",
+		})
+	}
+	clearAuthCookies(c)
+	return noticeDiv(c, `Your password is changed and you've been signed out everywhere. <a class="underline" href="/login">Log in</a>`)
+}
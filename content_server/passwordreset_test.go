@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// recordingMailer hands every message it's given to sent
+type recordingMailer struct {
+	sent chan Message
+}
+
+func (m *recordingMailer) Send(msg Message) error {
+	m.sent <- msg
+	return nil
+}
+
+func withRecordingMailer(t *testing.T, base string) *recordingMailer {
+	previousMailer, previousBase := mailer, publicBaseURL
+	m := &recordingMailer{sent: make(chan Message, 10)}
+	mailer, publicBaseURL = m, base
+	t.Cleanup(func() { mailer, publicBaseURL = previousMailer, previousBase })
+	return m
+}
+
+func TestForgotPasswordAnswersTheSameForEveryEmail(t *testing.T) {
+	pgContext := newTestPG(t)
+	sent := withRecordingMailer(t, "https://files.example.com")
+	createTestAccount(t, pgContext, "known@example.com")
+
+	forgot := func(email string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/forgot-password/", strings.NewReader(url.Values{"email": {email}}.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		// a forged Host mustn't end up in the emailed link
+		req.Host = "attacker.example"
+		rec := httptest.NewRecorder()
+		if err := ForgotPassword(HandlerContext{echo.New().NewContext(req, rec), pgContext}); err != nil {
+			t.Fatalf("ForgotPassword(%s): %v", email, err)
+		}
+		return rec
+	}
+
+	known := forgot("known@example.com")
+	select {
+	case msg := <-sent.sent:
+		if msg.To != "known@example.com" || !strings.Contains(msg.Body, "https://files.example.com/reset-password/?token=") {
+			t.Errorf("reset email to %q reads %q, want a link on PUBLIC_BASE_URL", msg.To, msg.Body)
+		}
+		if strings.Contains(msg.Body, "attacker.example") {
+			t.Error("the reset link was built from the request's Host header")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reset email was sent for a known account")
+	}
+
+	unknown := forgot("nobody@example.com")
+	throttled := forgot("known@example.com")
+	for name, rec := range map[string]*httptest.ResponseRecorder{"unknown": unknown, "throttled": throttled} {
+		if rec.Code != known.Code || rec.Body.String() != known.Body.String() {
+			t.Errorf("%s email answered %d %q, want the same as a known one: %d %q", name, rec.Code, rec.Body, known.Code, known.Body)
+		}
+	}
+	select {
+	case msg := <-sent.sent:
+		t.Errorf("emailed %q for an unknown or throttled request", msg.To)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -1,9 +1,28 @@
 \c server_db
 
+-- Storage plans. A NULL quota means no limit.
+CREATE TABLE plans (
+    name VARCHAR(32) PRIMARY KEY,
+    quota_bytes BIGINT CHECK (quota_bytes >= 0)
+);
+
+INSERT INTO plans (name, quota_bytes) VALUES
+    ('free', 1073741824),
+    ('pro', 107374182400),
+    ('unlimited', NULL);
+
 CREATE TABLE users (
     id UUID PRIMARY KEY,
     email VARCHAR(32) UNIQUE NOT NULL,
-    password VARCHAR(100)
+    password VARCHAR(100),
+    is_admin BOOLEAN NOT NULL DEFAULT false,
+    plan VARCHAR(32) NOT NULL DEFAULT 'free' REFERENCES plans(name),
+    -- overrides the plan's quota for this account when set
+    quota_bytes BIGINT CHECK (quota_bytes >= 0),
+    -- set once the account has followed the link emailed to it, proving it owns the address
+    verified_at TIMESTAMP,
+    -- when the last verification email went out, for throttling resends
+    verification_sent_at TIMESTAMP
 );
 
 CREATE INDEX idx_users_email ON users(email);
\ No newline at end of file
@@ -2,6 +2,19 @@
 
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 
+-- Folders nest through parent_id, a NULL parent being the top level
+CREATE TABLE folders (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    account_uuid UUID NOT NULL,
+    parent_id UUID REFERENCES folders(id),
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX idx_folders_parent_id ON folders(parent_id);
+CREATE UNIQUE INDEX idx_folders_unique_name ON folders(account_uuid, parent_id, name) WHERE parent_id IS NOT NULL;
+CREATE UNIQUE INDEX idx_folders_unique_top_name ON folders(account_uuid, name) WHERE parent_id IS NULL;
+
 CREATE TABLE files (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     account_uuid UUID NOT NULL,
@@ -11,7 +24,36 @@ CREATE TABLE files (
     file_ext VARCHAR(10),
     raw_text TEXT,
     bucket_dir VARCHAR(255),
-    location VARCHAR(100)
+    location VARCHAR(100),
+    sha256 CHAR(64),
+    size BIGINT,
+    key_id VARCHAR(64),
+    version INT NOT NULL DEFAULT 1,
+    extraction_status VARCHAR(16) NOT NULL DEFAULT 'pending'
+        CHECK (extraction_status IN ('pending', 'running', 'done', 'failed')),
+    extraction_error TEXT,
+    scan_status VARCHAR(16) NOT NULL DEFAULT 'unscanned'
+        CHECK (scan_status IN ('unscanned', 'clean', 'infected', 'error')),
+    scan_signature TEXT,
+    -- first-page PNGs under previews/<filepath>/, rendered in the background
+    preview_status VARCHAR(16) NOT NULL DEFAULT 'pending'
+        CHECK (preview_status IN ('pending', 'ready', 'none', 'failed')),
+    -- NULL is the top level
+    folder_id UUID REFERENCES folders(id),
+    deleted_at TIMESTAMP,
+    -- set by storage reconciliation when the stored bytes can't be found
+    missing_at TIMESTAMP
+);
+
+CREATE INDEX idx_files_account_uuid ON files(account_uuid);
+CREATE INDEX idx_files_deleted_at ON files(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX idx_files_folder_id ON files(folder_id);
+
+-- Free-form labels, stored lowercased
+CREATE TABLE file_tags (
+    file_id UUID NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    tag VARCHAR(64) NOT NULL,
+    PRIMARY KEY (file_id, tag)
 );
 
-CREATE INDEX idx_files_account_uuid ON files(account_uuid);
\ No newline at end of file
+CREATE INDEX idx_file_tags_tag ON file_tags(tag);
@@ -0,0 +1,18 @@
+\c server_db
+
+-- Text extraction queue, one job per file. Workers claim rows with FOR UPDATE SKIP LOCKED.
+CREATE TABLE extraction_jobs (
+    id BIGSERIAL PRIMARY KEY,
+    file_id UUID NOT NULL UNIQUE REFERENCES files(id) ON DELETE CASCADE,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'running', 'done', 'failed')),
+    attempts INT NOT NULL DEFAULT 0,
+    max_attempts INT NOT NULL DEFAULT 5,
+    run_after TIMESTAMP NOT NULL DEFAULT now(),
+    locked_until TIMESTAMP,
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    updated_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX idx_extraction_jobs_runnable ON extraction_jobs(run_after) WHERE status IN ('pending', 'running');
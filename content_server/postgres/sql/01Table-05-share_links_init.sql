@@ -0,0 +1,28 @@
+\c server_db
+
+-- Signed, expiring download links for people without an account
+CREATE TABLE share_links (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    file_id UUID NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    account_uuid UUID NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    single_use BOOLEAN NOT NULL DEFAULT false,
+    access_count INT NOT NULL DEFAULT 0,
+    last_accessed_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX idx_share_links_file_id ON share_links(file_id);
+
+-- Every hit on a share URL, including rejected ones. link_id is NULL when the signature didn't check out.
+CREATE TABLE share_link_accesses (
+    id BIGSERIAL PRIMARY KEY,
+    link_id UUID REFERENCES share_links(id) ON DELETE CASCADE,
+    accessed_at TIMESTAMP NOT NULL DEFAULT now(),
+    outcome VARCHAR(16) NOT NULL,
+    remote_ip VARCHAR(64),
+    user_agent TEXT
+);
+
+CREATE INDEX idx_share_link_accesses_link_id ON share_link_accesses(link_id);
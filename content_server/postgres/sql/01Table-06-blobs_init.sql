@@ -0,0 +1,15 @@
+\c server_db
+
+-- Content-addressed storage. Each distinct file body is stored once per backend under its
+-- sha256, and ref_count tracks how many files rows point at it.
+CREATE TABLE blobs (
+    sha256 CHAR(64) NOT NULL,
+    location VARCHAR(100) NOT NULL,
+    storage_key VARCHAR(255) NOT NULL,
+    size BIGINT NOT NULL,
+    -- master key wrapping the data key the stored bytes are encrypted with, NULL if stored in plaintext
+    key_id VARCHAR(64),
+    ref_count INT NOT NULL DEFAULT 1 CHECK (ref_count >= 0),
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    PRIMARY KEY (sha256, location)
+);
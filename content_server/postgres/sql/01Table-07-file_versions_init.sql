@@ -0,0 +1,24 @@
+\c server_db
+
+-- Earlier versions of a files row. The files row always holds the current version; uploading a
+-- new one or restoring an old one first copies the current state here.
+CREATE TABLE file_versions (
+    id BIGSERIAL PRIMARY KEY,
+    file_id UUID NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    version INT NOT NULL,
+    filename VARCHAR(255),
+    filepath VARCHAR(255) NOT NULL,
+    file_ext VARCHAR(10),
+    upload_time TIMESTAMP NOT NULL,
+    raw_text TEXT,
+    sha256 CHAR(64),
+    size BIGINT,
+    key_id VARCHAR(64),
+    scan_status VARCHAR(16) NOT NULL DEFAULT 'unscanned',
+    scan_signature TEXT,
+    bucket_dir VARCHAR(255),
+    location VARCHAR(100),
+    archived_at TIMESTAMP NOT NULL DEFAULT now(),
+    missing_at TIMESTAMP,
+    UNIQUE (file_id, version)
+);
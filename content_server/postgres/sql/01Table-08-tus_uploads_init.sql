@@ -0,0 +1,25 @@
+\c server_db
+
+-- Resumable uploads in progress over the tus protocol. Received bytes are kept as parts in the
+-- storage backend until the upload completes and is saved as a file.
+CREATE TABLE tus_uploads (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    account_uuid UUID NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    raw_text TEXT,
+    length BIGINT NOT NULL CHECK (length >= 0),
+    "offset" BIGINT NOT NULL DEFAULT 0,
+    location VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_tus_uploads_expires_at ON tus_uploads(expires_at);
+
+CREATE TABLE tus_upload_parts (
+    upload_id UUID NOT NULL REFERENCES tus_uploads(id) ON DELETE CASCADE,
+    "offset" BIGINT NOT NULL,
+    size BIGINT NOT NULL,
+    storage_key VARCHAR(255) NOT NULL,
+    PRIMARY KEY (upload_id, "offset")
+);
@@ -0,0 +1,38 @@
+\c server_db
+
+-- Teams files and folders can be shared with. The owner manages the members.
+CREATE TABLE teams (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    owner_uuid UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE TABLE team_members (
+    team_id UUID NOT NULL REFERENCES teams(id) ON DELETE CASCADE,
+    account_uuid UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    PRIMARY KEY (team_id, account_uuid)
+);
+
+CREATE INDEX idx_team_members_account_uuid ON team_members(account_uuid);
+
+-- Access to another account's file, or to everything in a folder and its subfolders, for one
+-- account or every member of a team. Editors can also delete.
+CREATE TABLE file_permissions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    file_id UUID REFERENCES files(id) ON DELETE CASCADE,
+    folder_id UUID REFERENCES folders(id) ON DELETE CASCADE,
+    grantee_account UUID REFERENCES users(id) ON DELETE CASCADE,
+    grantee_team UUID REFERENCES teams(id) ON DELETE CASCADE,
+    role VARCHAR(16) NOT NULL CHECK (role IN ('viewer', 'editor')),
+    granted_by UUID NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CHECK ((file_id IS NULL) <> (folder_id IS NULL)),
+    CHECK ((grantee_account IS NULL) <> (grantee_team IS NULL))
+);
+
+CREATE UNIQUE INDEX idx_file_permissions_unique ON file_permissions(
+    COALESCE(file_id, folder_id), COALESCE(grantee_account, grantee_team)
+);
+CREATE INDEX idx_file_permissions_grantee_account ON file_permissions(grantee_account);
+CREATE INDEX idx_file_permissions_grantee_team ON file_permissions(grantee_team);
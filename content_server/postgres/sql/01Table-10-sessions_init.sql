@@ -0,0 +1,30 @@
+\c server_db
+
+-- One row per login on a device. The access JWT is short-lived and carries the session id; the
+-- session lives on through its refresh tokens until it expires from disuse or is revoked.
+CREATE TABLE sessions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    account_uuid UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    user_agent TEXT,
+    remote_ip VARCHAR(64),
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMP NOT NULL DEFAULT now(),
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    -- logout, revoked (from the sessions page), reuse (a rotated refresh token came back) or
+    -- password_reset
+    revoked_reason VARCHAR(16)
+);
+
+CREATE INDEX idx_sessions_account_uuid ON sessions(account_uuid);
+
+-- Refresh tokens are single use: each refresh marks the presented token used and issues the next
+-- one in the same session. Only the SHA-256 of a token is stored.
+CREATE TABLE refresh_tokens (
+    token_hash CHAR(64) PRIMARY KEY,
+    session_id UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    used_at TIMESTAMP
+);
+
+CREATE INDEX idx_refresh_tokens_session_id ON refresh_tokens(session_id);
@@ -0,0 +1,13 @@
+\c server_db
+
+-- Emailed password reset links. Only the SHA-256 of a token is stored, and a token works once.
+CREATE TABLE password_resets (
+    token_hash CHAR(64) PRIMARY KEY,
+    account_uuid UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    requested_ip VARCHAR(64)
+);
+
+CREATE INDEX idx_password_resets_account_uuid ON password_resets(account_uuid);
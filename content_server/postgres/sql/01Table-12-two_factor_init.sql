@@ -0,0 +1,40 @@
+\c server_db
+
+-- TOTP (RFC 6238) second factor, opt-in per account. The row exists from the start of enrollment;
+-- two-factor is only on once enabled_at is set, after the first code checks out.
+CREATE TABLE two_factor (
+    account_uuid UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    -- the shared secret, sealed with ENCRYPTION_KEYS when they're configured
+    secret BYTEA NOT NULL,
+    -- the ENCRYPTION_KEYS id secret is sealed with, NULL when it's stored as is
+    key_id VARCHAR(64),
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    enabled_at TIMESTAMP,
+    -- the time step of the last code accepted, so a code can't be used twice
+    last_step BIGINT NOT NULL DEFAULT 0,
+    -- wrong codes since the last right one, across login challenges; past a few, codes are refused
+    -- until locked_until
+    failed_attempts INT NOT NULL DEFAULT 0,
+    locked_until TIMESTAMP
+);
+
+-- One-time codes for signing in without the authenticator. Only the SHA-256 of a code is stored.
+CREATE TABLE recovery_codes (
+    account_uuid UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash CHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    used_at TIMESTAMP,
+    PRIMARY KEY (account_uuid, code_hash)
+);
+
+-- A password checked out for an account with two-factor on; the browser holds the token until it
+-- sends a code. Only the SHA-256 of a token is stored.
+CREATE TABLE login_challenges (
+    token_hash CHAR(64) PRIMARY KEY,
+    account_uuid UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    expires_at TIMESTAMP NOT NULL,
+    attempts INT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX idx_login_challenges_account_uuid ON login_challenges(account_uuid);
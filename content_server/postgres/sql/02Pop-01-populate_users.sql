@@ -1,3 +1,3 @@
 \c server_db
 
-insert into "users" (id, email, password) values ('f67ca3ac-5f43-4d37-a553-e477c25272b6', 'fake@email.com', 'JDJhJDEwJHNUT3VjQkdVSjh4bjI3WS5qM0NJNmVnZ3hBbmdaMkRWVGtaZnFKOS5HalIxWUVoVnRlbkpD');
+insert into "users" (id, email, password, verified_at) values ('f67ca3ac-5f43-4d37-a553-e477c25272b6', 'fake@email.com', 'JDJhJDEwJHNUT3VjQkdVSjh4bjI3WS5qM0NJNmVnZ3hBbmdaMkRWVGtaZnFKOS5HalIxWUVoVnRlbkpD', now());
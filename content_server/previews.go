@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/dslipak/pdf"
+	"github.com/labstack/echo/v4"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// Previews are PNGs of a file's first page, for PDFs, or of the image itself. Each stored object
+// gets a page-sized preview for the file's modal and a thumbnail for the Files table, written
+// next to it through the same Filesystem under previews/<storage key>/, so they're encrypted and
+// deduplicated along with the bytes they show.
+
+// Preview statuses, files.preview_status
+const (
+	PreviewPending = "pending"
+	PreviewReady   = "ready"
+	PreviewNone    = "none" // not a type we can preview
+	PreviewFailed  = "failed"
+)
+
+const (
+	previewPage  = "page"
+	previewThumb = "thumb"
+)
+
+var ErrNoPreview = errors.New("no preview for this file type")
+
+var previewExts = map[string]bool{
+	".pdf":  true,
+	".png":  true,
+	".jpg":  true,
+	".jpeg": true,
+	".gif":  true,
+	".webp": true,
+	".bmp":  true,
+	".tif":  true,
+	".tiff": true,
+}
+
+type PreviewConfig struct {
+	PageWidth  int
+	ThumbWidth int
+	// Sources with more pixels than this aren't decoded, a guard against decompression bombs
+	MaxPixels int
+	// Files are rendered in memory, so bigger ones go without
+	MaxSourceBytes int64
+	PollInterval   time.Duration
+	Batch          int
+}
+
+func GetDefaultPreviewConfig() PreviewConfig {
+	pageWidth, err := strconv.Atoi(os.Getenv("PREVIEW_WIDTH"))
+	if err != nil || pageWidth < 100 {
+		pageWidth = 800
+	}
+	return PreviewConfig{
+		PageWidth:      pageWidth,
+		ThumbWidth:     64,
+		MaxPixels:      50_000_000,
+		MaxSourceBytes: 64 << 20,
+		PollInterval:   10 * time.Second,
+		Batch:          20,
+	}
+}
+
+var previewConfig = GetDefaultPreviewConfig()
+
+func previewKey(storageKey string, kind string) string {
+	return path.Join("previews", storageKey, kind+".png")
+}
+
+// previewSource is the storage key a preview was rendered from
+func previewSource(key string) (string, bool) {
+	if !strings.HasPrefix(key, "previews/") {
+		return "", false
+	}
+	source := path.Dir(strings.TrimPrefix(key, "previews/"))
+	return source, source != "."
+}
+
+// deletePreviews removes an object's previews along with it. Most objects never had any.
+func deletePreviews(filesystem Filesystem, storageKey string) {
+	for _, kind := range []string{previewPage, previewThumb} {
+		key := previewKey(storageKey, kind)
+		if err := filesystem.Delete(key); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to remove preview %s: %v", key, err)
+		}
+	}
+}
+
+// Previewer renders previews for new uploads and versions in the background
+type Previewer struct {
+	Config PreviewConfig
+	PGCtx  *pg.PostgresContext
+}
+
+func NewPreviewer(pgContext *pg.PostgresContext, config PreviewConfig) *Previewer {
+	return &Previewer{
+		Config: config,
+		PGCtx:  pgContext,
+	}
+}
+
+// Run renders pending previews on every PollInterval until ctx is cancelled
+func (p *Previewer) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Config.PollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := p.RenderPending(ctx); err != nil {
+			log.Printf("Previews: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type pendingPreview struct {
+	FileId     string
+	Filepath   string
+	FileExt    string
+	Location   string
+	ScanStatus string
+	Size       int64
+}
+
+// RenderPending works through files waiting on a preview in batches. A file that can't be
+// rendered is marked failed rather than retried, a broken PDF won't render any better next time.
+func (p *Previewer) RenderPending(ctx context.Context) (int, error) {
+	pgContext := &pg.PostgresContext{Pool: p.PGCtx.Pool, Ctx: ctx}
+	rendered := 0
+	for {
+		sqlStatement := `
+		SELECT id, filepath, file_ext, location, scan_status, COALESCE(size, 0) FROM files
+		WHERE preview_status = 'pending' AND deleted_at IS NULL
+		ORDER BY upload_time
+		LIMIT $1`
+		rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, p.Config.Batch)
+		if err != nil {
+			return rendered, fmt.Errorf("error listing pending previews: %w", err)
+		}
+		var pending []pendingPreview
+		for rows.Next() {
+			var pp pendingPreview
+			if err := rows.Scan(&pp.FileId, &pp.Filepath, &pp.FileExt, &pp.Location, &pp.ScanStatus, &pp.Size); err != nil {
+				rows.Close()
+				return rendered, fmt.Errorf("error scanning pending preview: %w", err)
+			}
+			pending = append(pending, pp)
+		}
+		rows.Close()
+
+		for _, pp := range pending {
+			status := p.render(pp)
+			if status == PreviewReady {
+				rendered++
+			}
+			// a new version uploaded meanwhile changes the filepath and needs its own preview
+			updateSql := `UPDATE files SET preview_status = $2 WHERE id = $1 AND filepath = $3`
+			if _, err := pgContext.Pool.Exec(pgContext.Ctx, updateSql, pp.FileId, status, pp.Filepath); err != nil {
+				return rendered, fmt.Errorf("error saving preview status for file %s: %w", pp.FileId, err)
+			}
+		}
+		if len(pending) < p.Config.Batch {
+			return rendered, nil
+		}
+	}
+}
+
+func (p *Previewer) render(pp pendingPreview) string {
+	if pp.ScanStatus == ScanInfected || !previewExts[strings.ToLower(pp.FileExt)] || pp.Size > p.Config.MaxSourceBytes {
+		return PreviewNone
+	}
+	filesystem, err := getFilesystem(pp.Location)
+	if err != nil {
+		log.Printf("Cannot preview file %s: %v", pp.FileId, err)
+		return PreviewFailed
+	}
+	file, err := filesystem.Read(pp.Filepath)
+	if err != nil {
+		log.Printf("Failed to read file %s for preview: %v", pp.FileId, err)
+		return PreviewFailed
+	}
+	data, err := io.ReadAll(io.LimitReader(file, p.Config.MaxSourceBytes))
+	file.Close()
+	if err != nil {
+		log.Printf("Failed to read file %s for preview: %v", pp.FileId, err)
+		return PreviewFailed
+	}
+
+	page, err := renderPreview(data, pp.FileExt, p.Config)
+	if errors.Is(err, ErrNoPreview) {
+		return PreviewNone
+	}
+	if err != nil {
+		log.Printf("Failed to render preview of file %s: %v", pp.FileId, err)
+		return PreviewFailed
+	}
+	if err := storePreviews(filesystem, pp.Filepath, page, p.Config); err != nil {
+		log.Printf("Failed to store preview of file %s: %v", pp.FileId, err)
+		return PreviewFailed
+	}
+	return PreviewReady
+}
+
+func storePreviews(filesystem Filesystem, storageKey string, page image.Image, config PreviewConfig) error {
+	previews := map[string]image.Image{
+		previewPage:  fitWithin(page, config.PageWidth, config.PageWidth*2),
+		previewThumb: fitWithin(page, config.ThumbWidth, config.ThumbWidth),
+	}
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	for kind, img := range previews {
+		var buf bytes.Buffer
+		if err := encoder.Encode(&buf, img); err != nil {
+			return fmt.Errorf("error encoding %s preview: %w", kind, err)
+		}
+		if err := filesystem.Write(&buf, previewKey(storageKey, kind)); err != nil {
+			return fmt.Errorf("error writing %s preview: %w", kind, err)
+		}
+	}
+	return nil
+}
+
+// renderPreview draws a file's first page, or the image it is
+func renderPreview(data []byte, ext string, config PreviewConfig) (image.Image, error) {
+	switch strings.ToLower(ext) {
+	case ".pdf":
+		return renderPdfPreview(data, config)
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp", ".bmp", ".tif", ".tiff":
+		return decodePreviewImage(bytes.NewReader(data), config.MaxPixels)
+	}
+	return nil, ErrNoPreview
+}
+
+func decodePreviewImage(r io.ReadSeeker, maxPixels int) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading image header: %w", err)
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, fmt.Errorf("image is %dx%d, too large to preview", cfg.Width, cfg.Height)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+	return img, nil
+}
+
+// fitWithin scales img down, never up, to fit a width x height box, flattened onto white so
+// transparent images stay readable in dark mode
+func fitWithin(img image.Image, width int, height int) image.Image {
+	bounds := img.Bounds()
+	scale := math.Min(1, math.Min(float64(width)/float64(bounds.Dx()), float64(height)/float64(bounds.Dy())))
+	w := max(1, int(math.Round(float64(bounds.Dx())*scale)))
+	h := max(1, int(math.Round(float64(bounds.Dy())*scale)))
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
+
+// PDF first pages
+//
+// There's no pure-Go PDF renderer, so this lays the page out from what the text reader already
+// understands: every piece of text at its position and size in a stock font, and the rectangles
+// drawn on the page (table borders, rules, boxes). It's not a faithful render, but it keeps the
+// layout the raw text loses. A page without text, i.e. a scan, shows its largest embedded image.
+
+const (
+	pdfDefaultWidth  = 612 // US Letter, in points
+	pdfDefaultHeight = 792
+)
+
+var (
+	previewFontOnce sync.Once
+	previewFont     *opentype.Font
+	previewFontErr  error
+	previewFaces    = map[int]font.Face{}
+	previewFacesMu  sync.Mutex
+)
+
+// previewFace returns the preview font at a pixel size, cached since rendering a page asks for the
+// same few sizes thousands of times
+func previewFace(size int) (font.Face, error) {
+	previewFontOnce.Do(func() {
+		previewFont, previewFontErr = opentype.Parse(goregular.TTF)
+	})
+	if previewFontErr != nil {
+		return nil, previewFontErr
+	}
+	previewFacesMu.Lock()
+	defer previewFacesMu.Unlock()
+	if face, ok := previewFaces[size]; ok {
+		return face, nil
+	}
+	face, err := opentype.NewFace(previewFont, &opentype.FaceOptions{Size: float64(size), DPI: 72, Hinting: font.HintingNone})
+	if err != nil {
+		return nil, err
+	}
+	previewFaces[size] = face
+	return face, nil
+}
+
+func renderPdfPreview(data []byte, config PreviewConfig) (image.Image, error) {
+	img, err := renderPdfPage(data, config)
+	if err == nil {
+		return img, nil
+	}
+	// same fallback as text extraction, pdfcpu can repair what trips up the reader
+	normalized, normErr := normalizePdf(data)
+	if normErr != nil {
+		return nil, err
+	}
+	return renderPdfPage(normalized, config)
+}
+
+func renderPdfPage(data []byte, config PreviewConfig) (img image.Image, err error) {
+	// the pdf package panics on malformed content streams
+	defer func() {
+		if r := recover(); r != nil {
+			img = nil
+			err = fmt.Errorf("panic reading pdf: %v", r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("error opening pdf: %w", err)
+	}
+	if reader.NumPage() < 1 {
+		return nil, fmt.Errorf("pdf has no pages")
+	}
+	page := reader.Page(1)
+	if page.V.IsNull() {
+		return nil, fmt.Errorf("pdf has no first page")
+	}
+
+	box := pdfPageBox(page)
+	scale := float64(config.PageWidth) / box.Dx()
+	width := config.PageWidth
+	height := max(1, int(math.Round(box.Dy()*scale)))
+	// e.g. a very long receipt, the bottom is cut off rather than rendering a huge canvas
+	height = min(height, config.PageWidth*4)
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+
+	// maps PDF user space, origin bottom left, to canvas pixels, origin top left
+	toCanvas := func(x float64, y float64) (float64, float64) {
+		return (x - box.Min.X) * scale, float64(height) - (y-box.Min.Y)*scale
+	}
+
+	// A scan is shown as its page image, including one with an OCR text layer on top: that text
+	// is invisible in a viewer and usually comes out garbled when drawn
+	content := page.Content()
+	hasText := pdfHasText(content.Text)
+	scan, scanErr := pdfFirstPageImage(data, config.MaxPixels)
+	if scanErr == nil && (!hasText || pdfIsPageShaped(scan.Bounds(), box)) {
+		draw.CatmullRom.Scale(canvas, fitRect(scan.Bounds(), canvas.Bounds()), scan, scan.Bounds(), draw.Over, nil)
+		return canvas, nil
+	}
+	if !hasText {
+		return nil, scanErr
+	}
+
+	border := image.NewUniform(color.Gray{Y: 0xbb})
+	for _, rect := range content.Rect {
+		x0, y0 := toCanvas(rect.Min.X, rect.Max.Y)
+		x1, y1 := toCanvas(rect.Max.X, rect.Min.Y)
+		drawOutline(canvas, image.Rect(int(x0), int(y0), int(x1), int(y1)), border)
+	}
+
+	ink := image.NewUniform(color.Gray{Y: 0x22})
+	for _, text := range content.Text {
+		if strings.TrimSpace(text.S) == "" {
+			continue
+		}
+		size := int(math.Round(text.FontSize * scale))
+		if size < 1 || size > height {
+			continue
+		}
+		face, err := previewFace(size)
+		if err != nil {
+			return nil, fmt.Errorf("error loading preview font: %w", err)
+		}
+		x, y := toCanvas(text.X, text.Y)
+		drawer := font.Drawer{Dst: canvas, Src: ink, Face: face, Dot: fixed.P(int(x), int(y))}
+		drawer.DrawString(drawableText(face, text.S))
+	}
+	return canvas, nil
+}
+
+// drawableText drops what the font would draw as a box: control characters, and codes from fonts
+// without a unicode mapping that the reader passes through as they are
+func drawableText(face font.Face, s string) string {
+	return strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		if _, ok := face.GlyphAdvance(r); !ok {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+type pdfBox struct {
+	Min, Max pdf.Point
+}
+
+func (b pdfBox) Dx() float64 { return b.Max.X - b.Min.X }
+func (b pdfBox) Dy() float64 { return b.Max.Y - b.Min.Y }
+
+// pdfPageBox is the page's crop box, what a viewer shows, falling back to its media box
+func pdfPageBox(page pdf.Page) pdfBox {
+	for _, name := range []string{"CropBox", "MediaBox"} {
+		value := pdfInherited(page, name)
+		if value.Len() != 4 {
+			continue
+		}
+		box := pdfBox{
+			Min: pdf.Point{X: math.Min(value.Index(0).Float64(), value.Index(2).Float64()), Y: math.Min(value.Index(1).Float64(), value.Index(3).Float64())},
+			Max: pdf.Point{X: math.Max(value.Index(0).Float64(), value.Index(2).Float64()), Y: math.Max(value.Index(1).Float64(), value.Index(3).Float64())},
+		}
+		if box.Dx() >= 1 && box.Dy() >= 1 {
+			return box
+		}
+	}
+	return pdfBox{Max: pdf.Point{X: pdfDefaultWidth, Y: pdfDefaultHeight}}
+}
+
+// pdfInherited looks a page attribute up on the page or, failing that, the page tree above it
+func pdfInherited(page pdf.Page, key string) pdf.Value {
+	for v := page.V; !v.IsNull(); v = v.Key("Parent") {
+		if r := v.Key(key); !r.IsNull() {
+			return r
+		}
+	}
+	return pdf.Value{}
+}
+
+func pdfHasText(glyphs []pdf.Text) bool {
+	for _, glyph := range glyphs {
+		if strings.TrimSpace(glyph.S) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// pdfIsPageShaped is whether an image has the page's aspect ratio, as a scanned page does
+func pdfIsPageShaped(img image.Rectangle, box pdfBox) bool {
+	imgRatio := float64(img.Dx()) / float64(img.Dy())
+	pageRatio := box.Dx() / box.Dy()
+	return math.Abs(imgRatio-pageRatio)/pageRatio < 0.03
+}
+
+// fitRect is the largest rectangle with src's aspect ratio centered in dst
+func fitRect(src image.Rectangle, dst image.Rectangle) image.Rectangle {
+	scale := math.Min(float64(dst.Dx())/float64(src.Dx()), float64(dst.Dy())/float64(src.Dy()))
+	w := max(1, int(float64(src.Dx())*scale))
+	h := max(1, int(float64(src.Dy())*scale))
+	x := dst.Min.X + (dst.Dx()-w)/2
+	y := dst.Min.Y + (dst.Dy()-h)/2
+	return image.Rect(x, y, x+w, y+h)
+}
+
+// pdfFirstPageImage decodes the largest image on the first page, which on a scan is the page
+func pdfFirstPageImage(data []byte, maxPixels int) (image.Image, error) {
+	pages, err := api.ExtractImagesRaw(bytes.NewReader(data), []string{"1"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error extracting page images: %w", err)
+	}
+	var largest image.Image
+	largestPixels := 0
+	for _, images := range pages {
+		for _, embedded := range images {
+			if embedded.IsImgMask {
+				continue
+			}
+			// pdfcpu doesn't fill in Width and Height, the decoded bounds are what we have
+			encoded, err := io.ReadAll(embedded)
+			if err != nil {
+				continue
+			}
+			img, err := decodePreviewImage(bytes.NewReader(encoded), maxPixels)
+			if err != nil {
+				log.Printf("Skipping unreadable pdf image %s: %v", embedded.Name, err)
+				continue
+			}
+			if pixels := img.Bounds().Dx() * img.Bounds().Dy(); pixels > largestPixels {
+				largest, largestPixels = img, pixels
+			}
+		}
+	}
+	if largest == nil {
+		return nil, fmt.Errorf("first page has no text or images to preview")
+	}
+	return largest, nil
+}
+
+func drawOutline(dst draw.Image, r image.Rectangle, src image.Image) {
+	r = r.Canon()
+	if r.Dx() == 0 && r.Dy() == 0 {
+		return
+	}
+	// thin filled rectangles (rules, underlines) are drawn whole, anything bigger as a border
+	if r.Dx() <= 2 || r.Dy() <= 2 {
+		draw.Draw(dst, r, src, image.Point{}, draw.Src)
+		return
+	}
+	draw.Draw(dst, image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+1), src, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(r.Min.X, r.Max.Y-1, r.Max.X, r.Max.Y), src, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(r.Min.X, r.Min.Y, r.Min.X+1, r.Max.Y), src, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(r.Max.X-1, r.Min.Y, r.Max.X, r.Max.Y), src, image.Point{}, draw.Src)
+}
+
+// Endpoints
+
+// FilePreview serves a file's page preview, or its thumbnail with size=thumb, to anyone who can
+// download the file
+func FilePreview(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	fo, _, err := getAccessibleFileObject(hCtx.PGCtx, c.Param("id"), uuid)
+	if err != nil {
+		if !errors.Is(err, ErrFileNotFound) {
+			log.Printf("Failed to look up file for preview: %v", err)
+		}
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	if fo.ScanStatus == ScanInfected {
+		return echo.NewHTTPError(http.StatusForbidden, "File is quarantined")
+	}
+	kind := previewPage
+	if c.QueryParam("size") == previewThumb {
+		kind = previewThumb
+	}
+
+	filesystem, err := getFilesystem(fo.Location)
+	if err != nil {
+		log.Printf("Cannot serve preview of file %s: %v", fo.FileId, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "File storage unavailable")
+	}
+	file, err := filesystem.Read(previewKey(fo.Filepath, kind))
+	if errors.Is(err, os.ErrNotExist) {
+		return echo.NewHTTPError(http.StatusNotFound, "No preview")
+	}
+	if err != nil {
+		log.Printf("Failed to read preview of file %s: %v", fo.FileId, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to read preview")
+	}
+	defer file.Close()
+
+	// the URL stays the same across versions, the ETag doesn't
+	etag := fmt.Sprintf(`"%s-%s"`, strings.Trim(fileETag(fo), `W/"`), kind)
+	header := c.Response().Header()
+	header.Set("ETag", etag)
+	header.Set("Cache-Control", "private, no-cache")
+	header.Set(echo.HeaderXContentTypeOptions, "nosniff")
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Stream(http.StatusOK, "image/png", file)
+}
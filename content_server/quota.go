@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+)
+
+var ErrQuotaExceeded = errors.New("upload would exceed the account's storage quota")
+
+// Quota is an account's storage allowance and what it's using.
+// Usage counts every files row and kept version, including the trash, at its full size, even where
+// identical content is only stored once.
+type Quota struct {
+	Plan       string `json:"plan"`
+	LimitBytes *int64 `json:"limit_bytes"` // nil for no limit
+	UsedBytes  int64  `json:"used_bytes"`
+}
+
+func (q Quota) Unlimited() bool {
+	return q.LimitBytes == nil
+}
+
+func (q Quota) Remaining() int64 {
+	if q.Unlimited() {
+		return -1
+	}
+	return max(0, *q.LimitBytes-q.UsedBytes)
+}
+
+func (q Quota) Percent() int {
+	if q.Unlimited() || *q.LimitBytes <= 0 {
+		return 0
+	}
+	return int(min(100, q.UsedBytes*100 / *q.LimitBytes))
+}
+
+func (q Quota) UsedLabel() string {
+	return formatBytes(q.UsedBytes)
+}
+
+func (q Quota) LimitLabel() string {
+	if q.Unlimited() {
+		return "unlimited"
+	}
+	return formatBytes(*q.LimitBytes)
+}
+
+// An account's own quota_bytes overrides its plan's
+const quotaSql = `
+SELECT u.plan, COALESCE(u.quota_bytes, p.quota_bytes),
+	(SELECT COALESCE(SUM(f.size), 0) FROM files f WHERE f.account_uuid = u.id)
+	+ (SELECT COALESCE(SUM(v.size), 0) FROM file_versions v JOIN files f ON f.id = v.file_id WHERE f.account_uuid = u.id)
+FROM users u JOIN plans p ON p.name = u.plan
+WHERE u.id = $1`
+
+func getQuota(pgContext *pg.PostgresContext, accountUUID string) (Quota, error) {
+	var q Quota
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, quotaSql, accountUUID).Scan(&q.Plan, &q.LimitBytes, &q.UsedBytes)
+	if err != nil {
+		return q, fmt.Errorf("error loading quota for account %s: %w", accountUUID, err)
+	}
+	return q, nil
+}
+
+// checkQuotaTx fails with ErrQuotaExceeded if adding bytes would take the account over its quota.
+// It locks the users row first, so concurrent uploads by one account are checked one at a time and
+// can't each fit on their own but overshoot together.
+func checkQuotaTx(pgContext *pg.PostgresContext, tx pgx.Tx, accountUUID string, adding int64) error {
+	var locked string
+	if err := tx.QueryRow(pgContext.Ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, accountUUID).Scan(&locked); err != nil {
+		return fmt.Errorf("error locking account %s: %w", accountUUID, err)
+	}
+
+	var q Quota
+	if err := tx.QueryRow(pgContext.Ctx, quotaSql, accountUUID).Scan(&q.Plan, &q.LimitBytes, &q.UsedBytes); err != nil {
+		return fmt.Errorf("error loading quota for account %s: %w", accountUUID, err)
+	}
+	if !q.Unlimited() && q.UsedBytes+adding > *q.LimitBytes {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// limitToQuota refuses an upload outright once the account is full, and otherwise cuts the
+// stream off as soon as it passes what's left, rather than storing it only to refuse the row
+func limitToQuota(pgContext *pg.PostgresContext, accountUUID string, file io.Reader) (io.Reader, error) {
+	q, err := getQuota(pgContext, accountUUID)
+	if err != nil {
+		return nil, err
+	}
+	if q.Unlimited() || file == nil {
+		return file, nil
+	}
+	if q.Remaining() == 0 {
+		return nil, ErrQuotaExceeded
+	}
+	return &sizeLimitReader{Reader: file, Limit: q.Remaining(), Err: ErrQuotaExceeded}, nil
+}
+
+// setAccountQuota changes an account's plan and its own quota override. A nil limit clears the
+// override so the plan's quota applies.
+func setAccountQuota(pgContext *pg.PostgresContext, accountUUID string, plan string, limitBytes *int64) error {
+	sqlStatement := `
+	UPDATE users SET plan = COALESCE(NULLIF($2, ''), plan), quota_bytes = $3
+	WHERE id = $1`
+	tag, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, accountUUID, plan, limitBytes)
+	if err != nil {
+		return fmt.Errorf("error setting quota for account %s: %w", accountUUID, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func quotaExceededMessage(pgContext *pg.PostgresContext, accountUUID string) string {
+	q, err := getQuota(pgContext, accountUUID)
+	if err != nil || q.Unlimited() {
+		return "Upload would exceed your storage quota"
+	}
+	return fmt.Sprintf("Upload would exceed your storage quota, %s of %s is in use", q.UsedLabel(), q.LimitLabel())
+}
+
+// Endpoints
+
+func FileUsage(hCtx HandlerContext) error {
+	uuid, ok := hCtx.EchoCtx.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	q, err := getQuota(hCtx.PGCtx, uuid)
+	if err != nil {
+		log.Printf("Failed to load storage usage: %v", err)
+		return errorDiv(hCtx.EchoCtx, "Failed to load storage usage")
+	}
+	return hCtx.EchoCtx.Render(http.StatusOK, "files/usage", q)
+}
+
+// AdminSetQuota sets an account's plan and/or quota override.
+// quota_bytes left empty goes back to the plan's quota.
+func AdminSetQuota(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	accountUUID := c.QueryParam("account_id")
+	plan := c.QueryParam("plan")
+
+	var limitBytes *int64
+	if raw := c.QueryParam("quota_bytes"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "quota_bytes must be a non-negative number of bytes")
+		}
+		limitBytes = &n
+	}
+
+	err := setAccountQuota(hCtx.PGCtx, accountUUID, plan, limitBytes)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "Account not found")
+	}
+	if err != nil {
+		// most likely an unknown plan, which the foreign key rejects
+		log.Printf("Failed to set quota for account %s: %v", accountUUID, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Could not set quota")
+	}
+
+	q, err := getQuota(hCtx.PGCtx, accountUUID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	adminUUID, _ := c.Get("ID").(string)
+	log.Printf("Admin %s set account %s to plan %s, quota %s", adminUUID, accountUUID, q.Plan, q.LimitLabel())
+	return c.JSON(http.StatusOK, q)
+}
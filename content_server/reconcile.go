@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	pg "goserve/postgres"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Kinds of inconsistency between the files index and a storage backend
+const (
+	// stored bytes that no files, file_versions or blobs row points at
+	OrphanObject = "orphan_object"
+	// a files or file_versions row whose bytes are gone
+	MissingObject = "missing_object"
+	// a row whose bytes turned up again after it was marked missing
+	FoundObject = "found_object"
+	// content-addressed bytes that rows point at but that have no blobs row to count their references
+	UnindexedBlob = "unindexed_blob"
+	// a blobs row whose bytes are gone
+	MissingBlob = "missing_blob"
+	// a blobs row that no files or file_versions row points at any more
+	UnreferencedBlob = "unreferenced_blob"
+)
+
+type ReconcileConfig struct {
+	// Anything newer than this is skipped, it may belong to an upload that's still in flight
+	MinAge time.Duration
+	// Repair marks rows missing, re-indexes blobs and, with DeleteOrphans, removes orphan objects
+	Repair        bool
+	DeleteOrphans bool
+	// DryRun reports the repairs Repair would make without making them
+	DryRun   bool
+	Interval time.Duration
+}
+
+func GetDefaultReconcileConfig() ReconcileConfig {
+	config := ReconcileConfig{
+		MinAge:   time.Hour,
+		Repair:   os.Getenv("RECONCILE_REPAIR") == "true",
+		Interval: 24 * time.Hour,
+	}
+	// RECONCILE_INTERVAL_HOURS=0 turns the background job off
+	if hours, err := strconv.Atoi(os.Getenv("RECONCILE_INTERVAL_HOURS")); err == nil && hours >= 0 {
+		config.Interval = time.Duration(hours) * time.Hour
+	}
+	return config
+}
+
+type ReconcileFinding struct {
+	Kind string
+	Key  string
+	// "file" or "version" and its id, for findings about a row
+	RowKind string
+	RowId   string
+	SHA256  string
+	Size    int64
+	// what repair did, or would do in a dry run; empty if left alone
+	Action string
+}
+
+func (f ReconcileFinding) String() string {
+	s := fmt.Sprintf("%-17s %s", f.Kind, f.Key)
+	if f.RowId != "" {
+		s += fmt.Sprintf(" (%s %s)", f.RowKind, f.RowId)
+	}
+	if f.Action != "" {
+		s += " -> " + f.Action
+	}
+	return s
+}
+
+type ReconcileReport struct {
+	Location string
+	Objects  int
+	Rows     int
+	Blobs    int
+	Findings []ReconcileFinding
+}
+
+func (r *ReconcileReport) Count(kind string) int {
+	n := 0
+	for _, f := range r.Findings {
+		if f.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *ReconcileReport) Summary() string {
+	return fmt.Sprintf("%s: %d objects, %d rows, %d blobs; %d orphan objects, %d missing objects, %d found again, %d unindexed blobs, %d missing blobs, %d unreferenced blobs",
+		r.Location, r.Objects, r.Rows, r.Blobs,
+		r.Count(OrphanObject), r.Count(MissingObject), r.Count(FoundObject),
+		r.Count(UnindexedBlob), r.Count(MissingBlob), r.Count(UnreferencedBlob))
+}
+
+// Reconciler walks a storage backend and the rows that point into it, and reports where they disagree.
+// writeFile stores bytes before indexing them and Delete drops rows before their bytes, which may
+// then fail to be removed, so either side can end up with something the other doesn't know about.
+type Reconciler struct {
+	Config     ReconcileConfig
+	PGCtx      *pg.PostgresContext
+	Filesystem Filesystem
+}
+
+func NewReconciler(pgContext *pg.PostgresContext, filesystem Filesystem, config ReconcileConfig) *Reconciler {
+	return &Reconciler{
+		Config:     config,
+		PGCtx:      pgContext,
+		Filesystem: filesystem,
+	}
+}
+
+type indexedRow struct {
+	Kind       string
+	Id         string
+	Key        string
+	SHA256     string
+	UploadTime time.Time
+	Missing    bool
+}
+
+type indexedBlob struct {
+	SHA256    string
+	Key       string
+	Size      int64
+	CreatedAt time.Time
+}
+
+// Run reconciles on every Interval until ctx is cancelled
+func (r *Reconciler) Run(ctx context.Context) {
+	if r.Config.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.Config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		report, err := r.Reconcile(ctx)
+		if err != nil {
+			log.Printf("Storage reconciliation: %v", err)
+			continue
+		}
+		log.Printf("Storage reconciliation: %s", report.Summary())
+		for _, finding := range report.Findings {
+			log.Printf("Storage reconciliation: %s", finding)
+		}
+	}
+}
+
+func (r *Reconciler) Reconcile(ctx context.Context) (*ReconcileReport, error) {
+	pgContext := &pg.PostgresContext{Pool: r.PGCtx.Pool, Ctx: ctx}
+	location := r.Filesystem.GetLocation()
+	report := &ReconcileReport{Location: location}
+	cutoff := time.Now().Add(-r.Config.MinAge)
+
+	// Rows are loaded after the walk, so an object written mid-walk may have a row but not have been
+	// seen. MinAge keeps those rows from being reported missing.
+	objects := map[string]StoredObject{}
+	err := r.Filesystem.Walk(func(object StoredObject) error {
+		objects[object.Key] = object
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking %s storage: %w", location, err)
+	}
+	report.Objects = len(objects)
+
+	rows, err := loadIndexedRows(pgContext, location)
+	if err != nil {
+		return nil, err
+	}
+	report.Rows = len(rows)
+	blobs, err := loadIndexedBlobs(pgContext, location)
+	if err != nil {
+		return nil, err
+	}
+	report.Blobs = len(blobs)
+	tusParts, err := loadTusPartKeys(pgContext, location)
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := map[string][]indexedRow{}
+	for _, row := range rows {
+		referenced[row.Key] = append(referenced[row.Key], row)
+		_, stored := objects[row.Key]
+		switch {
+		case stored && row.Missing:
+			r.repair(pgContext, report, ReconcileFinding{Kind: FoundObject, Key: row.Key, RowKind: row.Kind, RowId: row.Id})
+		case !stored && !row.Missing && row.UploadTime.Before(cutoff):
+			r.repair(pgContext, report, ReconcileFinding{Kind: MissingObject, Key: row.Key, RowKind: row.Kind, RowId: row.Id})
+		}
+	}
+
+	blobsByKey := map[string]indexedBlob{}
+	for _, blob := range blobs {
+		blobsByKey[blob.Key] = blob
+		if blob.CreatedAt.After(cutoff) {
+			continue
+		}
+		if _, stored := objects[blob.Key]; !stored {
+			report.Findings = append(report.Findings, ReconcileFinding{Kind: MissingBlob, Key: blob.Key, SHA256: blob.SHA256})
+		} else if len(referenced[blob.Key]) == 0 {
+			// left for a person to look at: the reference an upload takes before its row is written
+			// isn't visible here, so removing these automatically could race with that upload
+			report.Findings = append(report.Findings, ReconcileFinding{Kind: UnreferencedBlob, Key: blob.Key, SHA256: blob.SHA256, Size: blob.Size})
+		}
+	}
+
+	for key, object := range objects {
+		if object.ModTime.After(cutoff) {
+			continue
+		}
+		if _, indexed := blobsByKey[key]; indexed {
+			continue
+		}
+		// parts of resumable uploads in progress, removed by the tus cleanup once they expire
+		if tusParts[key] {
+			continue
+		}
+		// previews belong to the object they were rendered from, and go when it does
+		if source, ok := previewSource(key); ok {
+			if _, indexed := blobsByKey[source]; indexed || len(referenced[source]) > 0 {
+				continue
+			}
+		}
+		refs := referenced[key]
+		if len(refs) == 0 {
+			r.repair(pgContext, report, ReconcileFinding{Kind: OrphanObject, Key: key, Size: object.Size})
+			continue
+		}
+		// only content-addressed keys are counted in blobs, legacy files belong to their one row
+		if sum := refs[0].SHA256; sum != "" && key == blobKey(sum) {
+			r.repair(pgContext, report, ReconcileFinding{Kind: UnindexedBlob, Key: key, SHA256: sum, Size: object.Size})
+		}
+	}
+	return report, nil
+}
+
+// repair records a finding, fixing it first if the config says to
+func (r *Reconciler) repair(pgContext *pg.PostgresContext, report *ReconcileReport, finding ReconcileFinding) {
+	var action string
+	var fix func() error
+	switch finding.Kind {
+	case MissingObject:
+		action = "marked missing"
+		fix = func() error { return setRowMissing(pgContext, finding.RowKind, finding.RowId, true) }
+	case FoundObject:
+		action = "cleared missing"
+		fix = func() error { return setRowMissing(pgContext, finding.RowKind, finding.RowId, false) }
+	case UnindexedBlob:
+		action = "re-indexed"
+		fix = func() error { return reindexBlob(pgContext, r.Filesystem.GetLocation(), finding) }
+	case OrphanObject:
+		if !r.Config.DeleteOrphans {
+			break
+		}
+		action = "deleted"
+		fix = func() error { return r.Filesystem.Delete(finding.Key) }
+	}
+
+	switch {
+	case !r.Config.Repair || fix == nil:
+	case r.Config.DryRun:
+		finding.Action = "would be " + action
+	default:
+		if err := fix(); err != nil {
+			finding.Action = fmt.Sprintf("repair failed: %v", err)
+		} else {
+			finding.Action = action
+		}
+	}
+	report.Findings = append(report.Findings, finding)
+}
+
+func loadIndexedRows(pgContext *pg.PostgresContext, location string) ([]indexedRow, error) {
+	sqlStatement := `
+	SELECT 'file', id::text, filepath, COALESCE(sha256, ''), upload_time, missing_at IS NOT NULL
+	FROM files WHERE location = $1
+	UNION ALL
+	SELECT 'version', id::text, filepath, COALESCE(sha256, ''), upload_time, missing_at IS NOT NULL
+	FROM file_versions WHERE location = $1`
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, location)
+	if err != nil {
+		return nil, fmt.Errorf("error loading indexed files: %w", err)
+	}
+	defer rows.Close()
+
+	var results []indexedRow
+	for rows.Next() {
+		var row indexedRow
+		if err := rows.Scan(&row.Kind, &row.Id, &row.Key, &row.SHA256, &row.UploadTime, &row.Missing); err != nil {
+			return nil, fmt.Errorf("error scanning indexed file: %w", err)
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+func loadIndexedBlobs(pgContext *pg.PostgresContext, location string) ([]indexedBlob, error) {
+	sqlStatement := `SELECT sha256, storage_key, size, created_at FROM blobs WHERE location = $1`
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, location)
+	if err != nil {
+		return nil, fmt.Errorf("error loading blobs: %w", err)
+	}
+	defer rows.Close()
+
+	var results []indexedBlob
+	for rows.Next() {
+		var blob indexedBlob
+		if err := rows.Scan(&blob.SHA256, &blob.Key, &blob.Size, &blob.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning blob: %w", err)
+		}
+		results = append(results, blob)
+	}
+	return results, rows.Err()
+}
+
+func loadTusPartKeys(pgContext *pg.PostgresContext, location string) (map[string]bool, error) {
+	sqlStatement := `
+	SELECT p.storage_key FROM tus_upload_parts p
+	JOIN tus_uploads u ON u.id = p.upload_id
+	WHERE u.location = $1`
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, location)
+	if err != nil {
+		return nil, fmt.Errorf("error loading upload parts: %w", err)
+	}
+	defer rows.Close()
+
+	keys := map[string]bool{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("error scanning upload part: %w", err)
+		}
+		keys[key] = true
+	}
+	return keys, rows.Err()
+}
+
+func setRowMissing(pgContext *pg.PostgresContext, rowKind string, rowId string, missing bool) error {
+	table := "files"
+	if rowKind == "version" {
+		table = "file_versions"
+	}
+	sqlStatement := fmt.Sprintf(`UPDATE %s SET missing_at = CASE WHEN $2 THEN now() END WHERE id = $1`, table)
+	_, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, rowId, missing)
+	return err
+}
+
+// reindexBlob recreates the blobs row for content that rows still point at, counting its references
+// from those rows. The size comes from the rows too, an encrypted object is larger than its content.
+func reindexBlob(pgContext *pg.PostgresContext, location string, finding ReconcileFinding) error {
+	sqlStatement := `
+	INSERT INTO blobs (sha256, location, storage_key, size, ref_count)
+	SELECT $1, $2, $3, COALESCE(MAX(refs.size), $4), COUNT(*) FROM (
+		SELECT size FROM files WHERE sha256 = $1 AND location = $2 AND filepath = $3
+		UNION ALL
+		SELECT size FROM file_versions WHERE sha256 = $1 AND location = $2 AND filepath = $3
+	) refs
+	ON CONFLICT (sha256, location) DO NOTHING`
+	_, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, finding.SHA256, location, finding.Key, finding.Size)
+	return err
+}
+
+// runReconcileCommand is the `reconcile` subcommand, for running a reconciliation by hand
+func runReconcileCommand(pgContext *pg.PostgresContext, args []string, out io.Writer) error {
+	config := GetDefaultReconcileConfig()
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	flags.SetOutput(out)
+	backend := flags.String("backend", "", "storage backend to reconcile (default: every configured backend)")
+	flags.BoolVar(&config.Repair, "repair", false, "mark rows missing, re-index blobs, and clear rows whose bytes turned up again")
+	flags.BoolVar(&config.DeleteOrphans, "delete-orphans", false, "with -repair, also delete stored objects nothing points at")
+	flags.BoolVar(&config.DryRun, "dry-run", false, "show what -repair would do without doing it")
+	flags.DurationVar(&config.MinAge, "min-age", config.MinAge, "skip anything newer than this")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var backends []Filesystem
+	if *backend != "" {
+		fs, err := getFilesystem(*backend)
+		if err != nil {
+			return err
+		}
+		backends = append(backends, fs)
+	} else {
+		for _, fs := range filesystems {
+			backends = append(backends, fs)
+		}
+	}
+
+	var errs []error
+	for _, fs := range backends {
+		report, err := NewReconciler(pgContext, fs, config).Reconcile(pgContext.Ctx)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, finding := range report.Findings {
+			fmt.Fprintln(out, finding)
+		}
+		fmt.Fprintln(out, report.Summary())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// Server-side encryption modes for S3Config.SSE
+const (
+	SSENone = ""
+	SSES3   = "AES256"
+	SSEKMS  = "aws:kms"
+	SSEC    = "SSE-C"
+)
+
+type S3Config struct {
+	Endpoint  string // host[:port], e.g. s3.amazonaws.com or localhost:9000 for MinIO
+	Region    string
+	Bucket    string
+	Prefix    string // key prefix inside the bucket, no leading slash
+	AccessKey string // falls back to the AWS env vars, then the instance role
+	SecretKey string
+	UseSSL    bool
+	PathStyle bool // MinIO and most fakes want path-style bucket URLs
+
+	SSE      string
+	KMSKeyID string
+	SSECKey  []byte // 32 byte customer key for SSE-C
+
+	// Uploads of unknown length are sent as a multipart upload in parts of this size.
+	// Each in-flight part is buffered, so this bounds memory per upload.
+	PartSize   uint64
+	MaxRetries int
+}
+
+func GetDefaultS3Config() (S3Config, error) {
+	config := S3Config{
+		Endpoint:   os.Getenv("S3_ENDPOINT"),
+		Region:     os.Getenv("S3_REGION"),
+		Bucket:     os.Getenv("S3_BUCKET"),
+		Prefix:     strings.Trim(os.Getenv("S3_PREFIX"), "/"),
+		AccessKey:  os.Getenv("S3_ACCESS_KEY"),
+		SecretKey:  os.Getenv("S3_SECRET_KEY"),
+		UseSSL:     os.Getenv("S3_USE_SSL") != "false",
+		PathStyle:  os.Getenv("S3_PATH_STYLE") == "true",
+		SSE:        os.Getenv("S3_SSE"),
+		KMSKeyID:   os.Getenv("S3_SSE_KMS_KEY_ID"),
+		PartSize:   16 << 20,
+		MaxRetries: 5,
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "s3.amazonaws.com"
+	}
+	if config.Bucket == "" {
+		return config, fmt.Errorf("S3_BUCKET is required for the s3 storage backend")
+	}
+
+	if partSizeStr := os.Getenv("S3_PART_SIZE"); partSizeStr != "" {
+		partSize, err := strconv.ParseUint(partSizeStr, 10, 64)
+		if err != nil {
+			return config, fmt.Errorf("invalid S3_PART_SIZE: %w", err)
+		}
+		config.PartSize = partSize
+	}
+	if retriesStr := os.Getenv("S3_MAX_RETRIES"); retriesStr != "" {
+		retries, err := strconv.Atoi(retriesStr)
+		if err != nil {
+			return config, fmt.Errorf("invalid S3_MAX_RETRIES: %w", err)
+		}
+		config.MaxRetries = retries
+	}
+	if keyStr := os.Getenv("S3_SSE_C_KEY"); keyStr != "" {
+		key, err := base64.StdEncoding.DecodeString(keyStr)
+		if err != nil {
+			return config, fmt.Errorf("S3_SSE_C_KEY must be base64: %w", err)
+		}
+		config.SSECKey = key
+	}
+	return config, nil
+}
+
+type S3Storage struct {
+	StorageClass
+	S3     S3Config
+	client *minio.Client
+	sse    encrypt.ServerSide
+}
+
+var _ Filesystem = (*S3Storage)(nil)
+
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	if config.PartSize < 5<<20 {
+		// S3 rejects multipart parts under 5 MiB
+		return nil, fmt.Errorf("S3 part size must be at least 5 MiB, got %d", config.PartSize)
+	}
+
+	creds := credentials.NewStaticV4(config.AccessKey, config.SecretKey, "")
+	if config.AccessKey == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+		})
+	}
+	bucketLookup := minio.BucketLookupAuto
+	if config.PathStyle {
+		bucketLookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       config.UseSSL,
+		Region:       config.Region,
+		BucketLookup: bucketLookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating S3 client: %w", err)
+	}
+	// minio-go retries failed requests with backoff, including individual multipart parts
+	if config.MaxRetries > 0 {
+		minio.MaxRetry = config.MaxRetries
+	}
+
+	var sse encrypt.ServerSide
+	switch config.SSE {
+	case SSENone:
+	case SSES3:
+		sse = encrypt.NewSSE()
+	case SSEKMS:
+		sse, err = encrypt.NewSSEKMS(config.KMSKeyID, nil)
+	case SSEC:
+		sse, err = encrypt.NewSSEC(config.SSECKey)
+	default:
+		err = fmt.Errorf("unknown S3 server-side encryption mode %q", config.SSE)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error configuring S3 encryption: %w", err)
+	}
+
+	return &S3Storage{
+		StorageClass: StorageClass{
+			Config: FileSystemConfig{
+				BucketDir: path.Join(config.Bucket, config.Prefix),
+			},
+		},
+		S3:     config,
+		client: client,
+		sse:    sse,
+	}, nil
+}
+
+// CheckBucket fails fast at startup if the bucket is missing or the credentials can't see it
+func (s *S3Storage) CheckBucket(ctx context.Context) error {
+	exists, err := s.client.BucketExists(ctx, s.S3.Bucket)
+	if err != nil {
+		return fmt.Errorf("error checking bucket %s: %w", s.S3.Bucket, err)
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", s.S3.Bucket)
+	}
+	return nil
+}
+
+func (s *S3Storage) key(filename string) string {
+	return path.Join(s.S3.Prefix, filename)
+}
+
+func (s *S3Storage) Write(file io.Reader, filename string) error {
+	// Unknown length, so minio-go streams it as a multipart upload one PartSize chunk at a time
+	_, err := s.client.PutObject(context.Background(), s.S3.Bucket, s.key(filename), file, -1, minio.PutObjectOptions{
+		ContentType:          "application/octet-stream",
+		PartSize:             s.S3.PartSize,
+		ServerSideEncryption: s.sse,
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading %s to S3: %w", filename, err)
+	}
+	return nil
+}
+
+func (s *S3Storage) Read(filename string) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	if s.S3.SSE == SSEC {
+		// only customer keys have to be sent back on reads
+		opts.ServerSideEncryption = s.sse
+	}
+	object, err := s.client.GetObject(context.Background(), s.S3.Bucket, s.key(filename), opts)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s from S3: %w", filename, err)
+	}
+	// GetObject is lazy, stat so a missing key errors here instead of on first Read
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, fmt.Errorf("%s: %w", filename, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("error reading %s from S3: %w", filename, err)
+	}
+	return object, nil
+}
+
+// Move copies server-side and removes the source, S3 has no rename
+func (s *S3Storage) Move(src string, dst string) error {
+	srcOpts := minio.CopySrcOptions{Bucket: s.S3.Bucket, Object: s.key(src)}
+	if s.S3.SSE == SSEC {
+		srcOpts.Encryption = encrypt.SSECopy(s.sse)
+	}
+	dstOpts := minio.CopyDestOptions{Bucket: s.S3.Bucket, Object: s.key(dst), Encryption: s.sse}
+	// ComposeObject falls back to a multipart copy for objects over CopyObject's 5 GiB limit
+	if _, err := s.client.ComposeObject(context.Background(), dstOpts, srcOpts); err != nil {
+		return fmt.Errorf("error copying %s to %s in S3: %w", src, dst, err)
+	}
+	return s.Delete(src)
+}
+
+func (s *S3Storage) Delete(filename string) error {
+	err := s.client.RemoveObject(context.Background(), s.S3.Bucket, s.key(filename), minio.RemoveObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("error deleting %s from S3: %w", filename, err)
+	}
+	return nil
+}
+
+func (s *S3Storage) Walk(fn func(StoredObject) error) error {
+	prefix := ""
+	if s.S3.Prefix != "" {
+		prefix = strings.TrimSuffix(s.S3.Prefix, "/") + "/"
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	// stops the listing goroutine if fn bails out early
+	defer cancel()
+	for object := range s.client.ListObjects(ctx, s.S3.Bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return fmt.Errorf("error listing S3 bucket %s: %w", s.S3.Bucket, object.Err)
+		}
+		err := fn(StoredObject{Key: strings.TrimPrefix(object.Key, prefix), Size: object.Size, ModTime: object.LastModified})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3Storage) GetStorageClass() *StorageClass {
+	return &s.StorageClass
+}
+
+func (s *S3Storage) GetLocation() string {
+	return "s3"
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is just enough of the S3 API, path-style, for what S3Storage calls
+type fakeS3 struct {
+	bucket   string
+	pageSize int
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextID  int
+	// every ListObjectsV2 request, to check Walk followed the continuation tokens
+	listCalls int
+}
+
+func newFakeS3(bucket string, pageSize int) *fakeS3 {
+	return &fakeS3{bucket: bucket, pageSize: pageSize, objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	body, err := readS3Body(r)
+	if err != nil {
+		s3Error(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	query := r.URL.Query()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(parts) == 1 || parts[1] == "" {
+		switch {
+		case r.Method == http.MethodGet && query.Has("location"):
+			writeXML(w, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+			}{})
+		case r.Method == http.MethodGet && query.Get("list-type") == "2":
+			f.list(w, query)
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		default:
+			s3Error(w, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+
+	key := parts[1]
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		uploadID := strconv.Itoa(f.nextID)
+		f.uploads[uploadID] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: f.bucket, Key: key, UploadId: uploadID})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		if r.Header.Get("X-Amz-Copy-Source") == "" {
+			upload[partNumber] = body
+			w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, partNumber))
+			return
+		}
+		// UploadPartCopy, which ComposeObject uses to copy
+		data, ok := f.copySource(r)
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end); err == nil && start <= end && end < len(data) {
+			data = data[start : end+1]
+		}
+		upload[partNumber] = append([]byte(nil), data...)
+		writeXML(w, struct {
+			XMLName      xml.Name `xml:"CopyPartResult"`
+			LastModified string
+			ETag         string
+		}{LastModified: time.Now().UTC().Format(time.RFC3339), ETag: fmt.Sprintf(`"part-%d"`, partNumber)})
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		numbers := make([]int, 0, len(upload))
+		for n := range upload {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, upload[n]...)
+		}
+		f.objects[key] = data
+		delete(f.uploads, query.Get("uploadId"))
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: f.bucket, Key: key, ETag: `"complete"`})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		data, ok := f.copySource(r)
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		f.objects[key] = append([]byte(nil), data...)
+		writeXML(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			LastModified string
+			ETag         string
+		}{LastModified: time.Now().UTC().Format(time.RFC3339), ETag: `"copy"`})
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+		w.Header().Set("ETag", `"put"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", `"object"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) copySource(r *http.Request) ([]byte, bool) {
+	source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	data, ok := f.objects[strings.TrimPrefix(strings.TrimPrefix(source, "/"), f.bucket+"/")]
+	return data, ok
+}
+
+// list serves ListObjectsV2 at most pageSize keys at a time, the continuation token being the
+// last key of the previous page
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	f.listCalls++
+	prefix := query.Get("prefix")
+	after := query.Get("continuation-token")
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int64
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+	}{Name: f.bucket, Prefix: prefix, MaxKeys: f.pageSize, ContinuationToken: after}
+	if len(keys) > f.pageSize {
+		keys = keys[:f.pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: time.Now().UTC().Format(time.RFC3339),
+			ETag:         `"object"`,
+			Size:         int64(len(f.objects[key])),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+// readS3Body undoes the aws-chunked encoding minio-go uses for signed uploads over plain http
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	reader := bufio.NewReader(r.Body)
+	var data []byte
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			// trailing checksums, if any, don't matter here
+			io.Copy(io.Discard, reader)
+			return data, nil
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
+
+func newTestS3Storage(t *testing.T, fake *fakeS3, prefix string) *S3Storage {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	endpoint, _ := url.Parse(server.URL)
+	storage, err := NewS3Storage(S3Config{
+		Endpoint:   endpoint.Host,
+		Region:     "us-east-1",
+		Bucket:     fake.bucket,
+		Prefix:     prefix,
+		AccessKey:  "test-access",
+		SecretKey:  "test-secret",
+		PathStyle:  true,
+		SSE:        SSENone,
+		PartSize:   5 << 20,
+		MaxRetries: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewS3Storage: %v", err)
+	}
+	return storage
+}
+
+func readAllFrom(t *testing.T, fs Filesystem, key string) []byte {
+	t.Helper()
+	file, err := fs.Read(key)
+	if err != nil {
+		t.Fatalf("Read(%q): %v", key, err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("reading %q: %v", key, err)
+	}
+	return data
+}
+
+func TestS3StorageWriteReadMoveDelete(t *testing.T) {
+	fake := newFakeS3("files", 1000)
+	storage := newTestS3Storage(t, fake, "tenant")
+
+	small := []byte("hello from the fake bucket")
+	if err := storage.Write(bytes.NewReader(small), "a/small.txt"); err != nil {
+		t.Fatalf("Write small: %v", err)
+	}
+	// over one part, so the upload takes two
+	large := bytes.Repeat([]byte("0123456789abcdef"), (6<<20)/16)
+	if err := storage.Write(bytes.NewReader(large), "a/large.bin"); err != nil {
+		t.Fatalf("Write large: %v", err)
+	}
+	if _, ok := fake.objects["tenant/a/small.txt"]; !ok {
+		t.Fatalf("Write didn't store under the prefix, have %d objects", len(fake.objects))
+	}
+
+	if got := readAllFrom(t, storage, "a/small.txt"); !bytes.Equal(got, small) {
+		t.Errorf("Read small = %q, want %q", got, small)
+	}
+	if got := readAllFrom(t, storage, "a/large.bin"); !bytes.Equal(got, large) {
+		t.Errorf("Read large returned %d bytes, want %d", len(got), len(large))
+	}
+
+	if err := storage.Move("a/small.txt", "b/moved.txt"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if got := readAllFrom(t, storage, "b/moved.txt"); !bytes.Equal(got, small) {
+		t.Errorf("Read after Move = %q, want %q", got, small)
+	}
+	if _, err := storage.Read("a/small.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Read of moved source = %v, want os.ErrNotExist", err)
+	}
+
+	if err := storage.Delete("b/moved.txt"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := storage.Read("b/moved.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Read after Delete = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestS3StorageWalkPaginates(t *testing.T) {
+	fake := newFakeS3("files", 2)
+	storage := newTestS3Storage(t, fake, "tenant")
+
+	want := []string{}
+	for i := 0; i < 7; i++ {
+		key := fmt.Sprintf("dir/file-%d", i)
+		want = append(want, key)
+		if err := storage.Write(strings.NewReader(key), key); err != nil {
+			t.Fatalf("Write(%q): %v", key, err)
+		}
+	}
+	// outside the prefix, Walk mustn't see it
+	fake.objects["other/file"] = []byte("not ours")
+
+	got := []string{}
+	err := storage.Walk(func(object StoredObject) error {
+		if object.Size != int64(len(object.Key)) {
+			t.Errorf("%s: size %d, want %d", object.Key, object.Size, len(object.Key))
+		}
+		got = append(got, object.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Walk = %v, want %v", got, want)
+	}
+	if fake.listCalls < 4 {
+		t.Errorf("Walk made %d list requests, want one per page of 2", fake.listCalls)
+	}
+
+	// an error from fn stops the walk
+	stop := errors.New("stop")
+	seen := 0
+	err = storage.Walk(func(StoredObject) error {
+		seen++
+		return stop
+	})
+	if !errors.Is(err, stop) || seen != 1 {
+		t.Errorf("Walk returned %v after %d objects, want stop after 1", err, seen)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// files.scan_status values
+const (
+	ScanUnscanned = "unscanned"
+	ScanClean     = "clean"
+	ScanInfected  = "infected"
+	ScanError     = "error"
+)
+
+var ErrQuarantined = errors.New("file is quarantined")
+
+type ScanResult struct {
+	Infected  bool
+	Signature string
+}
+
+// Scanner inspects an upload as it streams into storage. Scan reads r to the end, or stops early
+// once it has a verdict or fails.
+type Scanner interface {
+	Scan(r io.Reader) (ScanResult, error)
+}
+
+// scanner is nil unless CLAMD_ADDRESS is set, in which case uploads are stored as unscanned
+var scanner Scanner = getDefaultScanner()
+
+func getDefaultScanner() Scanner {
+	address := os.Getenv("CLAMD_ADDRESS")
+	if address == "" {
+		return nil
+	}
+	return NewClamdScanner(address)
+}
+
+// ClamdScanner streams files to a clamd daemon with the INSTREAM command
+type ClamdScanner struct {
+	Network string
+	Address string
+	// Applies to each write and to waiting for the verdict, not the whole scan, which runs as
+	// long as the upload does
+	Timeout   time.Duration
+	ChunkSize int
+}
+
+// NewClamdScanner takes a unix socket path, "unix:///path/clamd.sock", "tcp://host:port" or "host:port"
+func NewClamdScanner(address string) *ClamdScanner {
+	s := &ClamdScanner{Network: "tcp", Address: address, Timeout: 30 * time.Second, ChunkSize: 64 << 10}
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		s.Network, s.Address = "unix", strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "tcp://"):
+		s.Address = strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "/"):
+		s.Network = "unix"
+	}
+	return s
+}
+
+func (s *ClamdScanner) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout(s.Network, s.Address, s.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to clamd at %s: %w", s.Address, err)
+	}
+	return conn, nil
+}
+
+// Ping checks clamd is reachable
+func (s *ClamdScanner) Ping() error {
+	conn, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.Timeout))
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return err
+	}
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected reply from clamd: %q", reply)
+	}
+	return nil
+}
+
+func (s *ClamdScanner) Scan(r io.Reader) (ScanResult, error) {
+	conn, err := s.dial()
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(s.Timeout))
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, fmt.Errorf("error starting clamd scan: %w", err)
+	}
+
+	// each chunk goes out as a 4 byte big-endian length and the bytes, and a zero length ends the stream
+	chunk := make([]byte, 4+s.ChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk[:4], uint32(n))
+			conn.SetWriteDeadline(time.Now().Add(s.Timeout))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				// clamd hangs up early when the stream passes its StreamMaxLength, and says why
+				if reply, replyErr := readClamdReply(conn); replyErr == nil && reply != "" {
+					return parseClamdReply(reply)
+				}
+				return ScanResult{}, fmt.Errorf("error streaming to clamd: %w", err)
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return ScanResult{}, readErr
+		}
+	}
+	conn.SetWriteDeadline(time.Now().Add(s.Timeout))
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return ScanResult{}, fmt.Errorf("error finishing clamd scan: %w", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(s.Timeout))
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("error reading clamd verdict: %w", err)
+	}
+	return parseClamdReply(reply)
+}
+
+// readClamdReply reads one null-terminated reply, as sent for z-prefixed commands
+func readClamdReply(conn net.Conn) (string, error) {
+	var reply bytes.Buffer
+	buf := make([]byte, 256)
+	for {
+		n, err := conn.Read(buf)
+		reply.Write(buf[:n])
+		if i := bytes.IndexByte(reply.Bytes(), 0); i >= 0 {
+			return strings.TrimSpace(string(reply.Bytes()[:i])), nil
+		}
+		if err == io.EOF {
+			return strings.TrimSpace(reply.String()), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// parseClamdReply reads "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+func parseClamdReply(reply string) (ScanResult, error) {
+	verdict := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case verdict == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// scanUpload tees file into the scanner as it streams to storage, so the upload is only read once.
+// finish must be called once storage is done with the stream, successful or not, and returns the
+// scan_status and signature to record.
+func scanUpload(file io.Reader) (io.Reader, func() (string, string)) {
+	if scanner == nil || file == nil {
+		return file, func() (string, string) { return ScanUnscanned, "" }
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	var result ScanResult
+	var scanErr error
+	go func() {
+		defer close(done)
+		result, scanErr = scanner.Scan(pr)
+		// keep taking the tee's writes if the scanner stopped reading early, or the upload would stall
+		io.Copy(io.Discard, pr)
+	}()
+
+	finish := func() (string, string) {
+		pw.Close()
+		<-done
+		switch {
+		case scanErr != nil:
+			log.Printf("Malware scan failed: %v", scanErr)
+			return ScanError, ""
+		case result.Infected:
+			return ScanInfected, result.Signature
+		}
+		return ScanClean, ""
+	}
+	return io.TeeReader(file, pw), finish
+}
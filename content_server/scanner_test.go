@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// fakeClamd answers INSTREAM on a local listener with whatever verdict returns for the bytes it got
+type fakeClamd struct {
+	listener net.Listener
+	verdict  func(data []byte) string
+
+	mu       sync.Mutex
+	received [][]byte
+}
+
+func newFakeClamd(t *testing.T, verdict func(data []byte) string) *fakeClamd {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	f := &fakeClamd{listener: listener, verdict: verdict}
+	t.Cleanup(func() { listener.Close() })
+	go f.serve()
+	return f
+}
+
+func (f *fakeClamd) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	command := make([]byte, len("zINSTREAM\x00"))
+	if _, err := io.ReadFull(conn, command); err != nil || string(command) != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+	var data bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&data, conn, int64(size)); err != nil {
+			return
+		}
+	}
+	f.mu.Lock()
+	f.received = append(f.received, data.Bytes())
+	f.mu.Unlock()
+	conn.Write([]byte(f.verdict(data.Bytes()) + "\x00"))
+}
+
+func (f *fakeClamd) scanner() *ClamdScanner {
+	s := NewClamdScanner("tcp://" + f.listener.Addr().String())
+	s.Timeout = 5 * time.Second
+	// small chunks so a test upload goes out as several
+	s.ChunkSize = 7
+	return s
+}
+
+// eicarVerdict flags anything containing "EICAR" and passes everything else
+func eicarVerdict(data []byte) string {
+	if bytes.Contains(data, []byte("EICAR")) {
+		return "stream: Eicar-Test-Signature FOUND"
+	}
+	return "stream: OK"
+}
+
+func TestClamdScannerVerdicts(t *testing.T) {
+	tests := []struct {
+		name          string
+		reply         string
+		wantInfected  bool
+		wantSignature string
+		wantErr       bool
+	}{
+		{name: "clean", reply: "stream: OK"},
+		{name: "infected", reply: "stream: Eicar-Test-Signature FOUND", wantInfected: true, wantSignature: "Eicar-Test-Signature"},
+		{name: "clamd error", reply: "INSTREAM size limit exceeded. ERROR", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clamd := newFakeClamd(t, func([]byte) string { return tt.reply })
+			content := strings.Repeat("some upload bytes ", 10)
+
+			result, err := clamd.scanner().Scan(strings.NewReader(content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Scan error = %v, want error %v", err, tt.wantErr)
+			}
+			if result.Infected != tt.wantInfected || result.Signature != tt.wantSignature {
+				t.Errorf("Scan = %+v, want infected %v signature %q", result, tt.wantInfected, tt.wantSignature)
+			}
+			clamd.mu.Lock()
+			defer clamd.mu.Unlock()
+			if len(clamd.received) != 1 || string(clamd.received[0]) != content {
+				t.Errorf("clamd received %q, want the whole upload", clamd.received)
+			}
+		})
+	}
+}
+
+// scanAndServe runs an upload through scanUpload as writeFile does, stores it, and tries to download it
+func scanAndServe(t *testing.T, content string) (FileObject, int) {
+	t.Helper()
+	fs := newMemoryFilesystem("scan-test")
+	stream, finish := scanUpload(strings.NewReader(content))
+	if err := fs.Write(stream, "upload"); err != nil {
+		t.Fatalf("storing the scanned stream: %v", err)
+	}
+	fo := FileObject{FileId: "file", Filename: "upload.txt", FileExt: ".txt", Filepath: "upload", Location: fs.GetLocation(), ExtractionStatus: ExtractionPending}
+	fo.setScanResult(finish())
+	if got := string(fs.objects["upload"]); got != content {
+		t.Fatalf("storage got %q through the scanner, want %q", got, content)
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	if err := serveFile(c, fo, false); err != nil {
+		var httpErr *echo.HTTPError
+		if !errors.As(err, &httpErr) {
+			t.Fatalf("serveFile: %v", err)
+		}
+		return fo, httpErr.Code
+	}
+	return fo, rec.Code
+}
+
+func withScanner(t *testing.T, s Scanner) {
+	previous := scanner
+	scanner = s
+	t.Cleanup(func() { scanner = previous })
+}
+
+func TestScanUploadQuarantinesInfectedFiles(t *testing.T) {
+	withScanner(t, newFakeClamd(t, eicarVerdict).scanner())
+
+	fo, status := scanAndServe(t, "X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*")
+	if fo.ScanStatus != ScanInfected || fo.ScanSignature != "Eicar-Test-Signature" {
+		t.Errorf("scan result = %q %q, want infected with the signature", fo.ScanStatus, fo.ScanSignature)
+	}
+	if fo.ExtractionStatus != ExtractionFailed {
+		t.Errorf("extraction status = %q, quarantined files aren't extracted", fo.ExtractionStatus)
+	}
+	if status != http.StatusForbidden {
+		t.Errorf("download of a quarantined file = %d, want %d", status, http.StatusForbidden)
+	}
+
+	fo, status = scanAndServe(t, "just some notes")
+	if fo.ScanStatus != ScanClean || fo.ExtractionStatus != ExtractionPending {
+		t.Errorf("clean upload recorded as %q, extraction %q", fo.ScanStatus, fo.ExtractionStatus)
+	}
+	if status != http.StatusOK {
+		t.Errorf("download of a clean file = %d, want %d", status, http.StatusOK)
+	}
+}
+
+// A failed scan doesn't refuse the upload: it's stored, recorded as an error and served like an
+// unscanned file, so clamd being down doesn't take uploads down with it
+func TestScanUploadFailsOpen(t *testing.T) {
+	tests := []struct {
+		name    string
+		scanner func(t *testing.T) *ClamdScanner
+	}{
+		{name: "clamd error", scanner: func(t *testing.T) *ClamdScanner {
+			return newFakeClamd(t, func([]byte) string { return "Can't allocate memory ERROR" }).scanner()
+		}},
+		{name: "clamd unreachable", scanner: func(t *testing.T) *ClamdScanner {
+			clamd := newFakeClamd(t, eicarVerdict)
+			clamd.listener.Close()
+			return clamd.scanner()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withScanner(t, tt.scanner(t))
+			fo, status := scanAndServe(t, strings.Repeat("a file clamd never gets to judge ", 100))
+			if fo.ScanStatus != ScanError {
+				t.Errorf("scan status = %q, want %q", fo.ScanStatus, ScanError)
+			}
+			if fo.ExtractionStatus != ExtractionPending {
+				t.Errorf("extraction status = %q, a failed scan isn't a quarantine", fo.ExtractionStatus)
+			}
+			if status != http.StatusOK {
+				t.Errorf("download after a failed scan = %d, want %d", status, http.StatusOK)
+			}
+		})
+	}
+}
@@ -4,17 +4,20 @@ import (
 	"context"
 	"log"
 
+	pg "goserve/postgres"
+	tp "goserve/templating"
 	"html/template"
-	pg "main/postgres"
-	tp "main/templating"
+	"io"
 	"net/http"
+	"os"
 	"path/filepath"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
-var jwtSecret = []byte("your_jwt_secret")
+// Signs and verifies access tokens, see jwtkeys.go
+var jwtKeys *JWTKeyring
 
 var StaticPath = "static/public"
 var AssetsPath = filepath.Join(StaticPath, "assets")
@@ -27,6 +30,33 @@ func main() {
 
 	initFilesystem()
 
+	keyring, err := GetDefaultJWTKeyring()
+	if err != nil {
+		log.Fatalf("Unable to load JWT keys: %v", err)
+	}
+	jwtKeys = keyring
+	shareLinkSecret, err = getShareLinkSecret()
+	if err != nil {
+		log.Fatalf("Unable to sign share links: %v", err)
+	}
+	mailer, err = getDefaultMailer()
+	if err != nil {
+		log.Fatalf("Unable to set up outgoing mail: %v", err)
+	}
+	if mailer != nil {
+		verificationSecret, err = getVerificationSecret()
+		if err != nil {
+			log.Fatalf("Unable to sign verification links: %v", err)
+		}
+	}
+
+	if clamd, ok := scanner.(*ClamdScanner); ok {
+		// not fatal, clamd may still be loading its signatures; scans fail until it's up
+		if err := clamd.Ping(); err != nil {
+			log.Printf("Malware scanner unreachable, uploads will be marked as scan errors: %v", err)
+		}
+	}
+
 	// setup
 	e := echo.New()
 
@@ -48,6 +78,58 @@ func main() {
 	}
 	defer pool.Close()
 
+	// maintenance subcommands run instead of the server:
+	// `./main reconcile [flags]` checks storage against the files table,
+	// `./main rotate-keys [flags]` re-wraps stored data keys under the current master key
+	if len(os.Args) > 1 {
+		subcommands := map[string]func(*pg.PostgresContext, []string, io.Writer) error{
+			"reconcile":   runReconcileCommand,
+			"rotate-keys": runRotateKeysCommand,
+		}
+		if run, ok := subcommands[os.Args[1]]; ok {
+			err := run(&pg.PostgresContext{Pool: pool, Ctx: context.Background()}, os.Args[2:], os.Stdout)
+			pool.Close()
+			if err != nil {
+				log.Fatalf("%s failed: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
+	extractionQueue = NewExtractionQueue(
+		&pg.PostgresContext{Pool: pool, Ctx: context.Background()},
+		GetDefaultExtractionQueueConfig(),
+	)
+	go extractionQueue.Run(context.Background())
+
+	purger := NewPurger(
+		&pg.PostgresContext{Pool: pool, Ctx: context.Background()},
+		filesystem,
+		trashConfig,
+	)
+	go purger.Run(context.Background())
+
+	reconciler := NewReconciler(
+		&pg.PostgresContext{Pool: pool, Ctx: context.Background()},
+		filesystem,
+		GetDefaultReconcileConfig(),
+	)
+	go reconciler.Run(context.Background())
+
+	tusCleaner := NewTusCleaner(
+		&pg.PostgresContext{Pool: pool, Ctx: context.Background()},
+		tusConfig,
+	)
+	go tusCleaner.Run(context.Background())
+
+	go jwtKeys.Run(context.Background())
+
+	previewer := NewPreviewer(
+		&pg.PostgresContext{Pool: pool, Ctx: context.Background()},
+		previewConfig,
+	)
+	go previewer.Run(context.Background())
+
 	// public endpoints
 	e.GET("/login/", func(c echo.Context) error {
 		return c.Render(http.StatusOK, "login", map[string]interface{}{})
@@ -55,13 +137,18 @@ func main() {
 
 	e.POST("/login/", func(c echo.Context) error {
 		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
-		err := hCtx.loginEndpoint()
-		if err != nil {
-			return err
-		}
+		return hCtx.loginEndpoint()
+	})
+
+	// second login step for accounts with two-factor on
+	e.GET("/login/two-factor/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TwoFactorLoginPage(hCtx)
+	}).Name = "two-factor-login"
 
-		c.Response().Header().Set("HX-Redirect", "/app/")
-		return c.NoContent(http.StatusOK)
+	e.POST("/login/two-factor/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TwoFactorLogin(hCtx)
 	})
 
 	e.GET("/create-account/", func(c echo.Context) error {
@@ -73,11 +160,48 @@ func main() {
 		return hCtx.createAccount()
 	})
 
+	e.GET("/forgot-password/", ForgotPasswordPage).Name = "forgot-password"
+
+	e.POST("/forgot-password/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return ForgotPassword(hCtx)
+	})
+
+	e.GET("/reset-password/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return ResetPasswordPage(hCtx)
+	}).Name = "reset-password"
+
+	e.POST("/reset-password/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return ResetPassword(hCtx)
+	})
+
+	e.GET("/verify-email/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return VerifyEmail(hCtx)
+	}).Name = "verify-email"
+
+	e.POST("/logout/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return Logout(hCtx)
+	})
+
+	// for other services to verify access tokens with
+	e.GET("/.well-known/jwks.json/", JWKSEndpoint)
+
+	// share links are public, the signature is the credential
+	e.GET("/share/:id/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return ShareDownload(hCtx)
+	}).Name = "share"
+
 	// private app group
 	app := e.Group("/app")
-	app.Use(JWTFromCookie())
+	app.Use(JWTFromCookie(pool))
 	app.Use(jwtClaimsMiddleware(strClaimsValidation, f64ClaimsValidation))
 	app.Use(PgxPoolMiddleware(pool))
+	app.Use(requireVerified(pool))
 
 	app.GET("/", func(c echo.Context) error {
 		data := map[string]interface{}{}
@@ -93,6 +217,18 @@ func main() {
 		return tp.ServeFile(c, tmpl, "files")
 	}).Name = "index"
 
+	app.GET("/trash/", func(c echo.Context) error {
+		return tp.ServeFile(c, tmpl, "trash")
+	}).Name = "index"
+
+	app.GET("/teams/", func(c echo.Context) error {
+		return tp.ServeFile(c, tmpl, "teams")
+	}).Name = "index"
+
+	app.GET("/sessions/", func(c echo.Context) error {
+		return tp.ServeFile(c, tmpl, "sessions")
+	}).Name = "index"
+
 	app.GET("/forms/", func(c echo.Context) error {
 		return tp.ServeFile(c, tmpl, "forms")
 	}).Name = "index"
@@ -123,11 +259,284 @@ func main() {
 		return FileUpload(hCtx)
 	}).Name = "index"
 
+	app.POST("/files/zip/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileZipUpload(hCtx)
+	}).Name = "index"
+
+	app.GET("/files/zip/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileZipExport(hCtx)
+	}).Name = "index"
+
+	app.GET("/files/usage/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileUsage(hCtx)
+	}).Name = "index"
+
+	app.GET("/files/extraction/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileExtractionStatus(hCtx, tmpl)
+	}).Name = "index"
+
+	app.POST("/files/extraction/retry/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileExtractionRetry(hCtx, tmpl)
+	}).Name = "index"
+
+	app.GET("/files/:id/download/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileDownload(hCtx)
+	}).Name = "index"
+
+	app.GET("/files/:id/preview/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FilePreview(hCtx)
+	}).Name = "index"
+
+	app.GET("/files/versions/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileVersions(hCtx)
+	}).Name = "index"
+
+	app.POST("/files/versions/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileVersionUpload(hCtx)
+	}).Name = "index"
+
+	app.POST("/files/versions/restore/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileVersionRestore(hCtx)
+	}).Name = "index"
+
+	app.GET("/files/versions/diff/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileVersionDiff(hCtx)
+	}).Name = "index"
+
+	app.GET("/files/:id/versions/:version/download/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileVersionDownload(hCtx)
+	}).Name = "index"
+
+	app.GET("/files/shares/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileShareLinks(hCtx)
+	}).Name = "index"
+
+	app.POST("/files/shares/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileShareCreate(hCtx)
+	}).Name = "index"
+
+	app.POST("/files/shares/revoke/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileShareRevoke(hCtx)
+	}).Name = "index"
+
 	app.POST("/files/delete/", func(c echo.Context) error {
 		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
 		return FileDelete(hCtx)
 	}).Name = "index"
 
+	app.POST("/files/trash/restore/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TrashRestore(hCtx)
+	}).Name = "index"
+
+	app.POST("/files/trash/purge/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TrashPurge(hCtx)
+	}).Name = "index"
+
+	app.GET("/files/browser/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileBrowse(hCtx)
+	}).Name = "index"
+
+	app.POST("/files/move/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileMove(hCtx)
+	}).Name = "index"
+
+	app.POST("/files/tags/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileTags(hCtx, false)
+	}).Name = "index"
+
+	app.POST("/files/tags/remove/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FileTags(hCtx, true)
+	}).Name = "index"
+
+	app.POST("/folders/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FolderCreate(hCtx)
+	}).Name = "index"
+
+	app.POST("/folders/rename/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FolderRename(hCtx)
+	}).Name = "index"
+
+	app.POST("/folders/move/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FolderMove(hCtx)
+	}).Name = "index"
+
+	app.POST("/folders/delete/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FolderDelete(hCtx)
+	}).Name = "index"
+
+	app.GET("/folders/picker/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return FolderPickerList(hCtx)
+	}).Name = "index"
+
+	// sharing with other accounts and teams
+	app.GET("/access/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return AccessList(hCtx)
+	}).Name = "index"
+
+	app.POST("/access/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return AccessGrant(hCtx)
+	}).Name = "index"
+
+	app.POST("/access/revoke/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return AccessRevoke(hCtx)
+	}).Name = "index"
+
+	app.GET("/teams/list/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TeamList(hCtx)
+	}).Name = "index"
+
+	app.POST("/teams/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TeamCreate(hCtx)
+	}).Name = "index"
+
+	app.POST("/teams/members/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TeamMemberAdd(hCtx)
+	}).Name = "index"
+
+	app.POST("/teams/members/remove/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TeamMemberRemove(hCtx)
+	}).Name = "index"
+
+	app.POST("/teams/delete/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TeamDelete(hCtx)
+	}).Name = "index"
+
+	// signed-in devices
+	app.GET("/sessions/list/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return SessionList(hCtx)
+	}).Name = "index"
+
+	app.POST("/sessions/revoke/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return SessionRevoke(hCtx)
+	}).Name = "index"
+
+	app.POST("/sessions/revoke-others/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return SessionRevokeOthers(hCtx)
+	}).Name = "index"
+
+	// email verification, reachable before the account is verified
+	app.GET("/verify/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return VerifyPendingPage(hCtx)
+	})
+
+	app.POST("/verify/resend/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return VerifyResend(hCtx)
+	})
+
+	// two-factor authentication
+	app.GET("/two-factor/", func(c echo.Context) error {
+		return tp.ServeFile(c, tmpl, "two-factor")
+	}).Name = "index"
+
+	app.GET("/two-factor/panel/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TwoFactorPanel(hCtx)
+	}).Name = "index"
+
+	app.POST("/two-factor/setup/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TwoFactorSetup(hCtx)
+	}).Name = "index"
+
+	app.POST("/two-factor/enable/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TwoFactorEnable(hCtx)
+	}).Name = "index"
+
+	app.POST("/two-factor/recovery-codes/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TwoFactorRecoveryCodes(hCtx)
+	}).Name = "index"
+
+	app.POST("/two-factor/disable/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TwoFactorDisable(hCtx)
+	}).Name = "index"
+
+	// resumable uploads (tus)
+	app.OPTIONS("/files/tus/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TusOptions(hCtx)
+	}).Name = "index"
+
+	app.POST("/files/tus/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TusCreate(hCtx)
+	}).Name = "index"
+
+	app.HEAD("/files/tus/:id/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TusHead(hCtx)
+	}).Name = "index"
+
+	app.PATCH("/files/tus/:id/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TusPatch(hCtx)
+	}).Name = "index"
+
+	app.DELETE("/files/tus/:id/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return TusDelete(hCtx)
+	}).Name = "index"
+
+	// admin endpoints
+	admin := app.Group("/admin")
+	admin.Use(requireAdmin(pool))
+
+	admin.POST("/files/purge/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return AdminPurge(hCtx)
+	}).Name = "index"
+
+	admin.POST("/accounts/quota/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return AdminSetQuota(hCtx)
+	}).Name = "index"
+
+	admin.POST("/accounts/two-factor/reset/", func(c echo.Context) error {
+		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
+		return AdminResetTwoFactor(hCtx)
+	}).Name = "index"
+
 	app.GET("/table/", func(c echo.Context) error {
 		hCtx := HandlerContext{c, &pg.PostgresContext{pool, context.Background()}}
 		return Table(&hCtx, tmpl)
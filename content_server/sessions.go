@@ -0,0 +1,473 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+)
+
+// A login starts a session. The browser holds a short-lived access JWT (auth_token) and a refresh
+// token (refresh_token) that's exchanged for a new pair whenever the access token has expired.
+// Refresh tokens are single use, so one coming back after it was exchanged means two parties hold
+// it, and the whole session is revoked.
+
+var (
+	ErrSessionEnded        = errors.New("session expired or revoked")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+	ErrRefreshTokenRaced   = errors.New("refresh token exchanged moments ago by another request")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrSessionNotFound     = errors.New("session not found")
+)
+
+const (
+	accessCookie  = "auth_token"
+	refreshCookie = "refresh_token"
+)
+
+type SessionConfig struct {
+	AccessTTL time.Duration
+	// How long a session lasts without being used; every refresh extends it
+	RefreshTTL time.Duration
+	// A refresh token presented again this soon after it was exchanged is taken to be the
+	// browser's own concurrent requests racing, not a replay. The session survives but the late
+	// request gets no tokens; the one that won the race has already set the new cookies.
+	ReuseGrace time.Duration
+}
+
+func GetDefaultSessionConfig() SessionConfig {
+	minutes, err := strconv.Atoi(os.Getenv("ACCESS_TOKEN_MINUTES"))
+	if err != nil || minutes <= 0 {
+		minutes = 15
+	}
+	days, err := strconv.Atoi(os.Getenv("REFRESH_TOKEN_DAYS"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+	return SessionConfig{
+		AccessTTL:  time.Duration(minutes) * time.Minute,
+		RefreshTTL: time.Duration(days) * 24 * time.Hour,
+		ReuseGrace: 30 * time.Second,
+	}
+}
+
+var sessionConfig = GetDefaultSessionConfig()
+
+type Session struct {
+	Id         string
+	UserAgent  string
+	RemoteIP   string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	Current    bool
+}
+
+// Device describes the browser and OS from the session's user agent
+func (s Session) Device() string {
+	ua := s.UserAgent
+	browser := ""
+	switch {
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	}
+	platform := ""
+	switch {
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		platform = "iOS"
+	case strings.Contains(ua, "Android"):
+		platform = "Android"
+	case strings.Contains(ua, "Windows"):
+		platform = "Windows"
+	case strings.Contains(ua, "Mac OS X"):
+		platform = "macOS"
+	case strings.Contains(ua, "Linux"):
+		platform = "Linux"
+	}
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "" || platform != "":
+		return browser + platform
+	case ua != "":
+		return ua
+	}
+	return "Unknown device"
+}
+
+// newOpaqueToken makes a random bearer token and the hash it's stored as
+func newOpaqueToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("error generating token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashOpaqueToken(token), nil
+}
+
+func hashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSession records a new session for a login and sets both cookies
+func startSession(pgContext *pg.PostgresContext, c echo.Context, accountUUID string) error {
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	expiry := time.Now().Add(sessionConfig.RefreshTTL)
+
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	// sessions that ran out are only kept until the account next logs in
+	sqlStatement := `DELETE FROM sessions WHERE account_uuid = $1 AND (expires_at < $2 OR revoked_at IS NOT NULL)`
+	if _, err := tx.Exec(pgContext.Ctx, sqlStatement, accountUUID, time.Now().UTC()); err != nil {
+		return fmt.Errorf("error clearing old sessions: %w", err)
+	}
+
+	var sessionId string
+	sqlStatement = `
+	INSERT INTO sessions (account_uuid, user_agent, remote_ip, expires_at)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id`
+	err = tx.QueryRow(pgContext.Ctx, sqlStatement, accountUUID, c.Request().UserAgent(), c.RealIP(), expiry.UTC()).Scan(&sessionId)
+	if err != nil {
+		return fmt.Errorf("error creating session: %w", err)
+	}
+	sqlStatement = `INSERT INTO refresh_tokens (token_hash, session_id) VALUES ($1, $2)`
+	if _, err := tx.Exec(pgContext.Ctx, sqlStatement, tokenHash, sessionId); err != nil {
+		return fmt.Errorf("error storing refresh token: %w", err)
+	}
+	if err := tx.Commit(pgContext.Ctx); err != nil {
+		return fmt.Errorf("error committing session: %w", err)
+	}
+
+	if _, ok := setCookie(c, accountUUID, sessionId); !ok {
+		return fmt.Errorf("error signing access token for session %s", sessionId)
+	}
+	setRefreshCookie(c, token, expiry)
+	return nil
+}
+
+// rotateRefreshToken exchanges a refresh token for the next one in its session, returning the
+// account and session it belongs to. A token exchanged moments ago by a concurrent request gets
+// ErrRefreshTokenRaced.
+func rotateRefreshToken(pgContext *pg.PostgresContext, token string, userAgent string, remoteIP string) (string, string, string, error) {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return "", "", "", fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	var sessionId, accountUUID string
+	var expiresAt time.Time
+	var revokedAt, usedAt *time.Time
+	sqlStatement := `
+	SELECT r.session_id, s.account_uuid, s.expires_at, s.revoked_at, r.used_at
+	FROM refresh_tokens r
+	JOIN sessions s ON s.id = r.session_id
+	WHERE r.token_hash = $1
+	FOR UPDATE`
+	err = tx.QueryRow(pgContext.Ctx, sqlStatement, hashOpaqueToken(token)).Scan(&sessionId, &accountUUID, &expiresAt, &revokedAt, &usedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", "", "", ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return "", "", "", fmt.Errorf("error looking up refresh token: %w", err)
+	}
+
+	now := time.Now().UTC()
+	if revokedAt != nil || now.After(expiresAt) {
+		return "", "", "", ErrSessionEnded
+	}
+	if usedAt != nil {
+		if now.Sub(*usedAt) < sessionConfig.ReuseGrace {
+			return "", "", "", ErrRefreshTokenRaced
+		}
+		sqlStatement = `UPDATE sessions SET revoked_at = $2, revoked_reason = 'reuse' WHERE id = $1`
+		if _, err := tx.Exec(pgContext.Ctx, sqlStatement, sessionId, now); err != nil {
+			return "", "", "", fmt.Errorf("error revoking session %s: %w", sessionId, err)
+		}
+		if err := tx.Commit(pgContext.Ctx); err != nil {
+			return "", "", "", fmt.Errorf("error committing session revocation: %w", err)
+		}
+		log.Printf("Refresh token reused in session %s of account %s from %s, session revoked", sessionId, accountUUID, remoteIP)
+		return "", "", "", ErrRefreshTokenReused
+	}
+
+	next, nextHash, err := newOpaqueToken()
+	if err != nil {
+		return "", "", "", err
+	}
+	sqlStatement = `UPDATE refresh_tokens SET used_at = $2 WHERE token_hash = $1`
+	if _, err := tx.Exec(pgContext.Ctx, sqlStatement, hashOpaqueToken(token), now); err != nil {
+		return "", "", "", fmt.Errorf("error marking refresh token used: %w", err)
+	}
+	sqlStatement = `INSERT INTO refresh_tokens (token_hash, session_id) VALUES ($1, $2)`
+	if _, err := tx.Exec(pgContext.Ctx, sqlStatement, nextHash, sessionId); err != nil {
+		return "", "", "", fmt.Errorf("error storing refresh token: %w", err)
+	}
+	sqlStatement = `
+	UPDATE sessions SET last_used_at = $2, expires_at = $3, user_agent = $4, remote_ip = $5
+	WHERE id = $1`
+	_, err = tx.Exec(pgContext.Ctx, sqlStatement, sessionId, now, now.Add(sessionConfig.RefreshTTL), userAgent, remoteIP)
+	if err != nil {
+		return "", "", "", fmt.Errorf("error updating session %s: %w", sessionId, err)
+	}
+	// a token older than the session's lifetime couldn't be used anyway, so it needn't be kept
+	// around for spotting reuse
+	sqlStatement = `DELETE FROM refresh_tokens WHERE session_id = $1 AND used_at < $2`
+	if _, err := tx.Exec(pgContext.Ctx, sqlStatement, sessionId, now.Add(-sessionConfig.RefreshTTL)); err != nil {
+		return "", "", "", fmt.Errorf("error clearing old refresh tokens: %w", err)
+	}
+	if err := tx.Commit(pgContext.Ctx); err != nil {
+		return "", "", "", fmt.Errorf("error committing refresh: %w", err)
+	}
+	return accountUUID, sessionId, next, nil
+}
+
+// refreshSession swaps the request's refresh token for new cookies, returning the new access token
+func refreshSession(pgContext *pg.PostgresContext, c echo.Context) (*jwt.Token, error) {
+	cookie, err := c.Cookie(refreshCookie)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	accountUUID, sessionId, next, err := rotateRefreshToken(pgContext, cookie.Value, c.Request().UserAgent(), c.RealIP())
+	if err != nil {
+		return nil, err
+	}
+	signed, ok := setCookie(c, accountUUID, sessionId)
+	if !ok {
+		return nil, fmt.Errorf("error signing access token for session %s", sessionId)
+	}
+	setRefreshCookie(c, next, time.Now().Add(sessionConfig.RefreshTTL))
+	return parseAccessToken(signed)
+}
+
+// Access tokens outlive a revoked session by up to AccessTTL, so each one is checked against its
+// session. The answer is cached for sessionCheckTTL to keep that off the database on every request,
+// which is as long as a revocation can take to lock out an access token.
+const sessionCheckTTL = 15 * time.Second
+
+type sessionCheck struct {
+	active    bool
+	checkedAt time.Time
+}
+
+var (
+	sessionChecks   = map[string]sessionCheck{}
+	sessionChecksMu sync.Mutex
+)
+
+// sessionActive reports whether a session is neither revoked nor expired
+func sessionActive(pgContext *pg.PostgresContext, sessionId string) (bool, error) {
+	if sessionId == "" {
+		return false, nil
+	}
+	sessionChecksMu.Lock()
+	check, ok := sessionChecks[sessionId]
+	sessionChecksMu.Unlock()
+	if ok && time.Since(check.checkedAt) < sessionCheckTTL {
+		return check.active, nil
+	}
+
+	var active bool
+	sqlStatement := `SELECT revoked_at IS NULL AND expires_at > $2 FROM sessions WHERE id = $1`
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, sessionId, time.Now().UTC()).Scan(&active)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return false, fmt.Errorf("error checking session %s: %w", sessionId, err)
+	}
+
+	now := time.Now()
+	sessionChecksMu.Lock()
+	defer sessionChecksMu.Unlock()
+	for id, check := range sessionChecks {
+		if now.Sub(check.checkedAt) >= sessionCheckTTL {
+			delete(sessionChecks, id)
+		}
+	}
+	sessionChecks[sessionId] = sessionCheck{active: active, checkedAt: now}
+	return active, nil
+}
+
+// revokeSession ends one of the account's sessions
+func revokeSession(pgContext *pg.PostgresContext, accountUUID string, sessionId string, reason string) error {
+	sqlStatement := `
+	UPDATE sessions SET revoked_at = $3, revoked_reason = $4
+	WHERE id = $1 AND account_uuid = $2 AND revoked_at IS NULL`
+	tag, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, sessionId, accountUUID, time.Now().UTC(), reason)
+	if err != nil {
+		// a malformed id fails uuid parsing in postgres, which is just another missing session
+		log.Printf("Failed to revoke session %s: %v", sessionId, err)
+		return ErrSessionNotFound
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// revokeOtherSessions ends every session of the account except the current one
+func revokeOtherSessions(pgContext *pg.PostgresContext, accountUUID string, currentId string) error {
+	sqlStatement := `
+	UPDATE sessions SET revoked_at = $3, revoked_reason = 'revoked'
+	WHERE account_uuid = $1 AND id <> $2 AND revoked_at IS NULL`
+	if _, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, accountUUID, currentId, time.Now().UTC()); err != nil {
+		return fmt.Errorf("error revoking sessions: %w", err)
+	}
+	return nil
+}
+
+// listSessions lists the account's active sessions, most recently used first
+func listSessions(pgContext *pg.PostgresContext, accountUUID string, currentId string) ([]Session, error) {
+	sqlStatement := `
+	SELECT id, COALESCE(user_agent, ''), COALESCE(remote_ip, ''), created_at, last_used_at
+	FROM sessions
+	WHERE account_uuid = $1 AND revoked_at IS NULL AND expires_at > $2
+	ORDER BY last_used_at DESC`
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, accountUUID, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("error listing sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.Id, &s.UserAgent, &s.RemoteIP, &s.CreatedAt, &s.LastUsedAt); err != nil {
+			return nil, fmt.Errorf("error scanning session: %w", err)
+		}
+		s.Current = s.Id == currentId
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+func setRefreshCookie(c echo.Context, token string, expiry time.Time) {
+	c.SetCookie(&http.Cookie{
+		Name:     refreshCookie,
+		Value:    token,
+		Expires:  expiry,
+		HttpOnly: true,
+		Path:     "/",
+		Secure:   false, // Set to true if using HTTPS, recommended for security
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearAuthCookies(c echo.Context) {
+	for _, name := range []string{accessCookie, refreshCookie} {
+		c.SetCookie(&http.Cookie{
+			Name:     name,
+			Value:    "",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Path:     "/",
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
+
+// redirectToLogin sends the browser to the login page, through HX-Redirect for htmx requests
+func redirectToLogin(c echo.Context) error {
+	if c.Request().Header.Get("HX-Request") != "" {
+		c.Response().Header().Set("HX-Redirect", "/login/")
+		return c.NoContent(http.StatusOK)
+	}
+	return c.Redirect(http.StatusFound, "/login/")
+}
+
+// Endpoints
+
+// Logout revokes the browser's session and clears its cookies. It works without a valid access
+// token, so it's outside the app group.
+func Logout(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	if cookie, err := c.Cookie(refreshCookie); err == nil {
+		sqlStatement := `
+		UPDATE sessions SET revoked_at = $2, revoked_reason = 'logout'
+		WHERE id = (SELECT session_id FROM refresh_tokens WHERE token_hash = $1) AND revoked_at IS NULL`
+		_, err := hCtx.PGCtx.Pool.Exec(hCtx.PGCtx.Ctx, sqlStatement, hashOpaqueToken(cookie.Value), time.Now().UTC())
+		if err != nil {
+			log.Printf("Failed to revoke session on logout: %v", err)
+		}
+	}
+	clearAuthCookies(c)
+	return redirectToLogin(c)
+}
+
+func SessionList(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+	sid, _ := c.Get("sid").(string)
+
+	sessions, err := listSessions(hCtx.PGCtx, uuid, sid)
+	if err != nil {
+		log.Printf("Failed to list sessions for account %s: %v", uuid, err)
+		return errorDiv(c, "Failed to load sessions")
+	}
+	return c.Render(http.StatusOK, "sessions/list", sessions)
+}
+
+func SessionRevoke(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+	sid, _ := c.Get("sid").(string)
+
+	sessionId := c.QueryParam("session_id")
+	if err := revokeSession(hCtx.PGCtx, uuid, sessionId, "revoked"); err != nil {
+		return errorDiv(c, "Session not found")
+	}
+	if sessionId == sid {
+		clearAuthCookies(c)
+		return redirectToLogin(c)
+	}
+	c.Response().Header().Set("HX-Trigger", "sessionsChanged")
+	return c.NoContent(http.StatusOK)
+}
+
+func SessionRevokeOthers(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+	sid, _ := c.Get("sid").(string)
+
+	if err := revokeOtherSessions(hCtx.PGCtx, uuid, sid); err != nil {
+		log.Printf("Failed to revoke sessions for account %s: %v", uuid, err)
+		return errorDiv(c, "Failed to sign out other devices")
+	}
+	c.Response().Header().Set("HX-Trigger", "sessionsChanged")
+	return c.NoContent(http.StatusOK)
+}
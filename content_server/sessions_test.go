@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	pg "goserve/postgres"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// startTestSessionCookies logs the account in and returns the cookies it was given by name
+func startTestSessionCookies(t *testing.T, pgContext *pg.PostgresContext, accountUUID string) map[string]string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/login/", nil), rec)
+	if err := startSession(pgContext, c, accountUUID); err != nil {
+		t.Fatalf("startSession: %v", err)
+	}
+	cookies := map[string]string{}
+	for _, cookie := range rec.Result().Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+	if cookies[accessCookie] == "" || cookies[refreshCookie] == "" {
+		t.Fatalf("startSession set cookies %v, want both", cookies)
+	}
+	return cookies
+}
+
+// startTestSession logs the account in and returns the refresh token it was given
+func startTestSession(t *testing.T, pgContext *pg.PostgresContext, accountUUID string) string {
+	t.Helper()
+	return startTestSessionCookies(t, pgContext, accountUUID)[refreshCookie]
+}
+
+func withSessionConfig(t *testing.T, config SessionConfig) {
+	previous := sessionConfig
+	sessionConfig = config
+	t.Cleanup(func() { sessionConfig = previous })
+}
+
+func TestRefreshTokenRotates(t *testing.T) {
+	pgContext := newTestPG(t)
+	withTestJWTKeys(t)
+	account := createTestAccount(t, pgContext, "rotate@example.com")
+	first := startTestSession(t, pgContext, account)
+
+	gotAccount, sessionId, second, err := rotateRefreshToken(pgContext, first, "agent", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("first refresh: %v", err)
+	}
+	if gotAccount != account || sessionId == "" {
+		t.Errorf("refresh returned account %q session %q, want %q and the session", gotAccount, sessionId, account)
+	}
+	if second == "" || second == first {
+		t.Fatalf("refresh issued %q, want a new token", second)
+	}
+
+	// the browser's own requests racing the rotation get nothing, but don't end the session
+	if _, _, raced, err := rotateRefreshToken(pgContext, first, "agent", "127.0.0.1"); !errors.Is(err, ErrRefreshTokenRaced) {
+		t.Errorf("refresh within the grace period = %q, %v; want ErrRefreshTokenRaced", raced, err)
+	}
+
+	_, nextSession, third, err := rotateRefreshToken(pgContext, second, "agent", "127.0.0.1")
+	if err != nil || third == "" || nextSession != sessionId {
+		t.Errorf("refresh with the rotated token = %q in %q, %v; want the next token in the same session", third, nextSession, err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesTheSession(t *testing.T) {
+	pgContext := newTestPG(t)
+	withTestJWTKeys(t)
+	config := sessionConfig
+	config.ReuseGrace = 0
+	withSessionConfig(t, config)
+	account := createTestAccount(t, pgContext, "reuse@example.com")
+	stolen := startTestSession(t, pgContext, account)
+	other := startTestSession(t, pgContext, account)
+
+	_, _, current, err := rotateRefreshToken(pgContext, stolen, "agent", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	if _, _, _, err := rotateRefreshToken(pgContext, stolen, "attacker", "10.0.0.1"); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("reusing an exchanged token = %v, want ErrRefreshTokenReused", err)
+	}
+	// the whole session is gone, including the token its rightful holder has now
+	if _, _, _, err := rotateRefreshToken(pgContext, current, "agent", "127.0.0.1"); !errors.Is(err, ErrSessionEnded) {
+		t.Errorf("refresh with the session's latest token = %v, want ErrSessionEnded", err)
+	}
+	// other sessions of the account aren't touched
+	if _, _, _, err := rotateRefreshToken(pgContext, other, "agent", "127.0.0.1"); err != nil {
+		t.Errorf("refresh in another session = %v, want it to still work", err)
+	}
+
+	var reason string
+	sqlStatement := `SELECT revoked_reason FROM sessions WHERE account_uuid = $1 AND revoked_at IS NOT NULL`
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, account).Scan(&reason); err != nil || reason != "reuse" {
+		t.Errorf("revoked session reason = %q, %v; want reuse", reason, err)
+	}
+}
+
+func TestAccessTokenOfARevokedSessionIsRefused(t *testing.T) {
+	pgContext := newTestPG(t)
+	withTestJWTKeys(t)
+	account := createTestAccount(t, pgContext, "revoked-access@example.com")
+	kept := startTestSessionCookies(t, pgContext, account)
+	revoked := startTestSessionCookies(t, pgContext, account)
+
+	token, err := parseAccessToken(revoked[accessCookie])
+	if err != nil {
+		t.Fatalf("parseAccessToken: %v", err)
+	}
+	sid, _ := token.Claims.(jwt.MapClaims)["sid"].(string)
+	if err := revokeSession(pgContext, account, sid, "revoked"); err != nil {
+		t.Fatalf("revokeSession: %v", err)
+	}
+
+	authenticate := func(cookies map[string]string) (bool, *httptest.ResponseRecorder) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/app/", nil)
+		// only the access token, so a refused one can't be swapped for a new pair
+		req.AddCookie(&http.Cookie{Name: accessCookie, Value: cookies[accessCookie]})
+		rec := httptest.NewRecorder()
+		reached := false
+		handler := JWTFromCookie(pgContext.Pool)(func(c echo.Context) error {
+			reached = true
+			return c.NoContent(http.StatusOK)
+		})
+		if err := handler(echo.New().NewContext(req, rec)); err != nil {
+			t.Fatalf("JWTFromCookie: %v", err)
+		}
+		return reached, rec
+	}
+
+	if reached, rec := authenticate(kept); !reached {
+		t.Errorf("the live session's access token was refused with %d", rec.Code)
+	}
+	if reached, rec := authenticate(revoked); reached || rec.Code != http.StatusFound {
+		t.Errorf("the revoked session's access token got through = %v, answered %d; want a redirect to login", reached, rec.Code)
+	}
+}
+
+func TestLogoutRevokesTheRefreshToken(t *testing.T) {
+	pgContext := newTestPG(t)
+	withTestJWTKeys(t)
+	account := createTestAccount(t, pgContext, "logout@example.com")
+	token := startTestSession(t, pgContext, account)
+
+	req := httptest.NewRequest(http.MethodPost, "/logout/", nil)
+	req.AddCookie(&http.Cookie{Name: refreshCookie, Value: token})
+	rec := httptest.NewRecorder()
+	if err := Logout(HandlerContext{echo.New().NewContext(req, rec), pgContext}); err != nil {
+		t.Fatalf("Logout: %v", err)
+	}
+	if rec.Code != http.StatusFound {
+		t.Errorf("Logout answered %d, want a redirect to the login page", rec.Code)
+	}
+	cleared := map[string]bool{}
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			cleared[cookie.Name] = true
+		}
+	}
+	if !cleared[accessCookie] || !cleared[refreshCookie] {
+		t.Errorf("Logout cleared cookies %v, want both", cleared)
+	}
+
+	if _, _, _, err := rotateRefreshToken(pgContext, token, "agent", "127.0.0.1"); !errors.Is(err, ErrSessionEnded) {
+		t.Errorf("refresh after logout = %v, want ErrSessionEnded", err)
+	}
+	var revokedAt *time.Time
+	sqlStatement := `SELECT revoked_at FROM sessions WHERE account_uuid = $1`
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, account).Scan(&revokedAt); err != nil || revokedAt == nil {
+		t.Errorf("session after logout revoked at %v, %v; want it revoked", revokedAt, err)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+)
+
+// Outcomes recorded in share_link_accesses
+const (
+	ShareServed       = "served"
+	ShareBadSignature = "bad_signature"
+	ShareExpired      = "expired"
+	ShareRevoked      = "revoked"
+	ShareUsed         = "used"
+	ShareNotFound     = "not_found"
+	ShareQuarantined  = "quarantined"
+)
+
+type ShareLinkDuration struct {
+	Label string
+	Hours int
+}
+
+// How long a new link may live, offered in the share panel
+var shareLinkDurations = []ShareLinkDuration{
+	{"1 hour", 1},
+	{"1 day", 24},
+	{"7 days", 24 * 7},
+	{"30 days", 24 * 30},
+}
+
+// Share links are signed with their own key, SHARE_LINK_SECRET, so links outlive restarts and
+// JWT key rotations, and rotating it only invalidates links, not sessions
+var shareLinkSecret []byte
+
+func getShareLinkSecret() ([]byte, error) {
+	return secretFromEnv("SHARE_LINK_SECRET")
+}
+
+// secretFromEnv reads a signing secret that has to stay the same across restarts and servers,
+// so there's no made-up fallback
+func secretFromEnv(name string) ([]byte, error) {
+	secret := os.Getenv(name)
+	if secret == "" {
+		return nil, fmt.Errorf("%s isn't set, make one with `openssl rand -base64 32`", name)
+	}
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("%s must be at least 32 characters", name)
+	}
+	return []byte(secret), nil
+}
+
+// Base for the absolute URLs handed out, e.g. https://files.example.com. Share links default to the
+// request's host, but emailed links always use it; see getDefaultMailer.
+var publicBaseURL = strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/")
+
+type ShareLink struct {
+	ID          string
+	FileId      string
+	AccountUUID string
+	ExpiresAt   time.Time
+	SingleUse   bool
+	AccessCount int
+	RevokedAt   *time.Time
+	CreatedAt   time.Time
+	URL         string
+}
+
+func (sl ShareLink) Status() string {
+	switch {
+	case sl.RevokedAt != nil:
+		return "Revoked"
+	case time.Now().After(sl.ExpiresAt):
+		return "Expired"
+	case sl.SingleUse && sl.AccessCount > 0:
+		return "Used"
+	}
+	return "Active"
+}
+
+func (sl ShareLink) Active() bool {
+	return sl.Status() == "Active"
+}
+
+// ShareLinksPanel is the data for the share dropdown in the Files table
+type ShareLinksPanel struct {
+	FileId    string
+	Links     []ShareLink
+	Durations []ShareLinkDuration
+	NewURL    string
+	Error     string
+}
+
+func signShareLink(linkId string, expires int64) string {
+	mac := hmac.New(sha256.New, shareLinkSecret)
+	fmt.Fprintf(mac, "%s.%d", linkId, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyShareLink(linkId string, expires int64, sig string) bool {
+	given, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	expected, _ := base64.RawURLEncoding.DecodeString(signShareLink(linkId, expires))
+	return hmac.Equal(given, expected)
+}
+
+// publicBase is the scheme and host absolute URLs are built on
+func publicBase(c echo.Context) string {
+	if publicBaseURL != "" {
+		return publicBaseURL
+	}
+	return c.Scheme() + "://" + c.Request().Host
+}
+
+func shareLinkURL(c echo.Context, linkId string, expiresAt time.Time) string {
+	base := publicBase(c)
+	expires := expiresAt.Unix()
+	query := url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {signShareLink(linkId, expires)},
+	}
+	return fmt.Sprintf("%s/share/%s/?%s", base, linkId, query.Encode())
+}
+
+func createShareLink(pgContext *pg.PostgresContext, fileId string, accountUUID string, ttl time.Duration, singleUse bool) (ShareLink, error) {
+	// whole seconds, since the expiry is carried in the URL as a unix timestamp
+	link := ShareLink{
+		FileId:      fileId,
+		AccountUUID: accountUUID,
+		ExpiresAt:   time.Now().Add(ttl).Truncate(time.Second).UTC(),
+		SingleUse:   singleUse,
+	}
+	// the select doubles as the ownership check
+	sqlStatement := `
+	INSERT INTO share_links (file_id, account_uuid, expires_at, single_use)
+	SELECT id, account_uuid, $3, $4 FROM files WHERE id = $1 AND account_uuid = $2 AND deleted_at IS NULL
+	RETURNING id, created_at`
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, fileId, accountUUID, link.ExpiresAt, singleUse).Scan(&link.ID, &link.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return link, ErrFileNotFound
+	}
+	if err != nil {
+		return link, fmt.Errorf("error creating share link: %w", err)
+	}
+	return link, nil
+}
+
+func listShareLinks(pgContext *pg.PostgresContext, fileId string, accountUUID string) ([]ShareLink, error) {
+	sqlStatement := `
+	SELECT id, file_id, account_uuid, expires_at, single_use, access_count, revoked_at, created_at
+	FROM share_links
+	WHERE file_id = $1 AND account_uuid = $2
+	ORDER BY created_at DESC`
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, fileId, accountUUID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing share links: %w", err)
+	}
+	defer rows.Close()
+
+	var links []ShareLink
+	for rows.Next() {
+		var link ShareLink
+		err := rows.Scan(&link.ID, &link.FileId, &link.AccountUUID, &link.ExpiresAt, &link.SingleUse, &link.AccessCount, &link.RevokedAt, &link.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning share link: %w", err)
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+func revokeShareLink(pgContext *pg.PostgresContext, linkId string, accountUUID string) (string, error) {
+	var fileId string
+	sqlStatement := `
+	UPDATE share_links SET revoked_at = COALESCE(revoked_at, now())
+	WHERE id = $1 AND account_uuid = $2
+	RETURNING file_id`
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, linkId, accountUUID).Scan(&fileId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrFileNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("error revoking share link: %w", err)
+	}
+	return fileId, nil
+}
+
+// claimShareLink counts an access against a link and returns its file, in one statement so two
+// requests can't both get through on a single-use link. The outcome says why a link was refused.
+func claimShareLink(pgContext *pg.PostgresContext, linkId string) (FileObject, bool, string, error) {
+	fo := FileObject{}
+	var singleUse bool
+	sqlStatement := `
+	UPDATE share_links s
+	SET access_count = s.access_count + 1, last_accessed_at = now()
+	FROM files f
+	WHERE s.id = $1 AND f.id = s.file_id AND f.deleted_at IS NULL AND f.scan_status <> 'infected'
+		AND s.revoked_at IS NULL
+		AND s.expires_at > now()
+		AND (NOT s.single_use OR s.access_count = 0)
+	RETURNING f.id, f.account_uuid, f.filepath, f.filename, f.file_ext, f.upload_time, COALESCE(f.sha256, ''), f.location,
+		f.scan_status, s.single_use`
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, linkId).Scan(
+		&fo.FileId, &fo.AccountUUID, &fo.Filepath, &fo.Filename, &fo.FileExt, &fo.UploadTime, &fo.SHA256, &fo.Location,
+		&fo.ScanStatus, &singleUse,
+	)
+	if err == nil {
+		return fo, singleUse, ShareServed, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return fo, false, "", fmt.Errorf("error claiming share link %s: %w", linkId, err)
+	}
+
+	var revoked, expired, used, trashed, quarantined bool
+	reasonSql := `
+	SELECT s.revoked_at IS NOT NULL, s.expires_at <= now(), s.single_use AND s.access_count > 0, f.deleted_at IS NOT NULL,
+		f.scan_status = 'infected'
+	FROM share_links s JOIN files f ON f.id = s.file_id
+	WHERE s.id = $1`
+	err = pgContext.Pool.QueryRow(pgContext.Ctx, reasonSql, linkId).Scan(&revoked, &expired, &used, &trashed, &quarantined)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows) || trashed:
+		return fo, false, ShareNotFound, nil
+	case err != nil:
+		return fo, false, "", fmt.Errorf("error checking share link %s: %w", linkId, err)
+	case quarantined:
+		return fo, false, ShareQuarantined, nil
+	case revoked:
+		return fo, false, ShareRevoked, nil
+	case expired:
+		return fo, false, ShareExpired, nil
+	case used:
+		return fo, false, ShareUsed, nil
+	}
+	return fo, false, ShareNotFound, nil
+}
+
+func logShareAccess(pgContext *pg.PostgresContext, c echo.Context, linkId string, outcome string) {
+	log.Printf("Share link %s accessed from %s: %s", linkId, c.RealIP(), outcome)
+
+	// only links we know exist can be referenced
+	var linkRef *string
+	if outcome != ShareBadSignature && outcome != ShareNotFound {
+		linkRef = &linkId
+	}
+	sqlStatement := `
+	INSERT INTO share_link_accesses (link_id, outcome, remote_ip, user_agent)
+	VALUES ($1, $2, $3, $4)`
+	_, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, linkRef, outcome, c.RealIP(), c.Request().UserAgent())
+	if err != nil {
+		log.Printf("Failed to record share link access: %v", err)
+	}
+}
+
+// ShareDownload serves a file to anyone holding a valid share URL. It's outside the app group, so
+// failures are plain text rather than the app's error page, which would bounce them to the login.
+func ShareDownload(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	linkId := c.Param("id")
+
+	expires, err := strconv.ParseInt(c.QueryParam("expires"), 10, 64)
+	if err != nil || !verifyShareLink(linkId, expires, c.QueryParam("sig")) {
+		logShareAccess(hCtx.PGCtx, c, linkId, ShareBadSignature)
+		return c.String(http.StatusForbidden, "This link is not valid.")
+	}
+	fileObject, singleUse, outcome, err := claimShareLink(hCtx.PGCtx, linkId)
+	if err != nil {
+		log.Printf("Failed to resolve share link: %v", err)
+		return c.String(http.StatusInternalServerError, "Something went wrong, please try again later.")
+	}
+	logShareAccess(hCtx.PGCtx, c, linkId, outcome)
+
+	switch outcome {
+	case ShareExpired:
+		return c.String(http.StatusGone, "This link has expired.")
+	case ShareRevoked:
+		return c.String(http.StatusGone, "This link has been revoked.")
+	case ShareUsed:
+		return c.String(http.StatusGone, "This link has already been used.")
+	case ShareNotFound:
+		return c.String(http.StatusNotFound, "This file is no longer available.")
+	case ShareQuarantined:
+		return c.String(http.StatusForbidden, "This file was flagged by a malware scan and can't be downloaded.")
+	}
+
+	if singleUse {
+		// the one access has to deliver the whole file, a follow-up range request would be refused
+		c.Request().Header.Del("Range")
+		c.Request().Header.Del("If-None-Match")
+	}
+	inline := c.QueryParam("disposition") == "inline"
+	return serveFile(c, fileObject, inline)
+}
+
+func renderShareLinks(hCtx HandlerContext, fileId string, panel ShareLinksPanel) error {
+	uuid, ok := hCtx.EchoCtx.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	links, err := listShareLinks(hCtx.PGCtx, fileId, uuid)
+	if err != nil {
+		log.Printf("Failed to list share links for file %s: %v", fileId, err)
+		return errorDiv(hCtx.EchoCtx, "Failed to load share links")
+	}
+	for i := range links {
+		if links[i].Active() {
+			links[i].URL = shareLinkURL(hCtx.EchoCtx, links[i].ID, links[i].ExpiresAt)
+		}
+	}
+	panel.FileId = fileId
+	panel.Links = links
+	panel.Durations = shareLinkDurations
+	return hCtx.EchoCtx.Render(http.StatusOK, "share/links", panel)
+}
+
+func FileShareLinks(hCtx HandlerContext) error {
+	return renderShareLinks(hCtx, hCtx.EchoCtx.QueryParam("file_id"), ShareLinksPanel{})
+}
+
+func FileShareCreate(hCtx HandlerContext) error {
+	fileId := hCtx.EchoCtx.FormValue("file_id")
+
+	uuid, ok := hCtx.EchoCtx.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	hours, err := strconv.Atoi(hCtx.EchoCtx.FormValue("expires_in"))
+	validDuration := false
+	for _, duration := range shareLinkDurations {
+		validDuration = validDuration || duration.Hours == hours
+	}
+	if err != nil || !validDuration {
+		return renderShareLinks(hCtx, fileId, ShareLinksPanel{Error: "Pick how long the link should last"})
+	}
+	singleUse := hCtx.EchoCtx.FormValue("single_use") == "on"
+
+	link, err := createShareLink(hCtx.PGCtx, fileId, uuid, time.Duration(hours)*time.Hour, singleUse)
+	if errors.Is(err, ErrFileNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	if err != nil {
+		log.Printf("Failed to create share link for file %s: %v", fileId, err)
+		return renderShareLinks(hCtx, fileId, ShareLinksPanel{Error: "Failed to create share link"})
+	}
+	return renderShareLinks(hCtx, fileId, ShareLinksPanel{NewURL: shareLinkURL(hCtx.EchoCtx, link.ID, link.ExpiresAt)})
+}
+
+func FileShareRevoke(hCtx HandlerContext) error {
+	linkId := hCtx.EchoCtx.QueryParam("link_id")
+
+	uuid, ok := hCtx.EchoCtx.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	fileId, err := revokeShareLink(hCtx.PGCtx, linkId, uuid)
+	if errors.Is(err, ErrFileNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "Share link not found")
+	}
+	if err != nil {
+		log.Printf("Failed to revoke share link %s: %v", linkId, err)
+		return errorDiv(hCtx.EchoCtx, "Failed to revoke share link")
+	}
+	return renderShareLinks(hCtx, fileId, ShareLinksPanel{})
+}
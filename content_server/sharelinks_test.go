@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestSecretFromEnvHasNoFallback(t *testing.T) {
+	t.Setenv("TEST_SIGNING_SECRET", "")
+	if secret, err := secretFromEnv("TEST_SIGNING_SECRET"); err == nil || secret != nil {
+		t.Errorf("unset secret = %q, %v; want an error", secret, err)
+	}
+	t.Setenv("TEST_SIGNING_SECRET", "short")
+	if _, err := secretFromEnv("TEST_SIGNING_SECRET"); err == nil {
+		t.Error("a 5 character secret was accepted")
+	}
+	t.Setenv("TEST_SIGNING_SECRET", "0123456789abcdef0123456789abcdef")
+	if secret, err := secretFromEnv("TEST_SIGNING_SECRET"); err != nil || string(secret) != "0123456789abcdef0123456789abcdef" {
+		t.Errorf("secretFromEnv = %q, %v", secret, err)
+	}
+}
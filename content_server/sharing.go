@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"goserve/tables/rows"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+)
+
+// A file or folder can be shared with another account, or with everyone in a team, as a viewer
+// (download) or an editor (download and delete). Sharing a folder shares everything under it.
+// Only the owner can grant and revoke access.
+
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+var (
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrGranteeNotFound  = errors.New("no account with that email")
+	ErrShareWithSelf    = errors.New("you already own this")
+	ErrShareTarget      = errors.New("name either a file or a folder")
+)
+
+var accessRoles = []string{RoleViewer, RoleEditor}
+
+// Grant is one account's or team's access to a file or folder
+type Grant struct {
+	Id      string
+	Grantee string
+	IsTeam  bool
+	Role    string
+}
+
+type AccessPanel struct {
+	FileId   string
+	FolderId string
+	Grants   []Grant
+	Teams    []Team
+	Roles    []string
+	Error    string
+}
+
+// Target is the id of the element the panel renders into, for the file or folder it's about
+func (ap AccessPanel) Target() string {
+	if ap.FolderId != "" {
+		return "folder-access-panel"
+	}
+	return "access-panel-" + ap.FileId
+}
+
+// getAccessibleFileObject loads a file the account owns or has been granted, along with its role.
+// The returned FileObject's AccountUUID is the owner's.
+func getAccessibleFileObject(pgContext *pg.PostgresContext, fileId string, accountUUID string) (FileObject, string, error) {
+	fo := FileObject{FileId: fileId}
+	var role string
+	sqlStatement := `
+	SELECT f.account_uuid, f.filepath, f.filename, f.file_ext, f.upload_time, COALESCE(f.sha256, ''), f.location,
+		f.scan_status, CASE WHEN f.account_uuid = $1 THEN 'owner' ELSE r.role END
+	FROM files f
+	LEFT JOIN (` + rows.SharedRolesSql + `) r ON r.file_id = f.id
+	WHERE f.id = $2 AND f.deleted_at IS NULL AND (f.account_uuid = $1 OR r.role IS NOT NULL)`
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, accountUUID, fileId).Scan(
+		&fo.AccountUUID, &fo.Filepath, &fo.Filename, &fo.FileExt, &fo.UploadTime, &fo.SHA256, &fo.Location,
+		&fo.ScanStatus, &role,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fo, "", ErrFileNotFound
+	}
+	if err != nil {
+		return fo, "", fmt.Errorf("error loading file %s: %w", fileId, err)
+	}
+	return fo, role, nil
+}
+
+// checkShareTarget makes sure the account owns the file or folder being shared. Exactly one of
+// the two is named, so owning one can't vouch for the other.
+func checkShareTarget(pgContext *pg.PostgresContext, accountUUID string, fileId string, folderId string) error {
+	if (fileId == "") == (folderId == "") {
+		return ErrShareTarget
+	}
+	sqlStatement := `SELECT EXISTS (SELECT 1 FROM files WHERE id = $1 AND account_uuid = $2 AND deleted_at IS NULL)`
+	notFound := ErrFileNotFound
+	target := fileId
+	if folderId != "" {
+		sqlStatement = `SELECT EXISTS (SELECT 1 FROM folders WHERE id = $1 AND account_uuid = $2)`
+		notFound = ErrFolderNotFound
+		target = folderId
+	}
+	var exists bool
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, target, accountUUID).Scan(&exists); err != nil {
+		// a malformed id fails uuid parsing in postgres, which is just another missing target
+		log.Printf("Failed to look up share target %s: %v", target, err)
+		return notFound
+	}
+	if !exists {
+		return notFound
+	}
+	return nil
+}
+
+func listGrants(pgContext *pg.PostgresContext, accountUUID string, fileId string, folderId string) ([]Grant, error) {
+	if err := checkShareTarget(pgContext, accountUUID, fileId, folderId); err != nil {
+		return nil, err
+	}
+	// exactly one of them is set, checkShareTarget has made sure
+	target := fileId
+	if folderId != "" {
+		target = folderId
+	}
+	sqlStatement := `
+	SELECT p.id, COALESCE(u.email, t.name), p.grantee_team IS NOT NULL, p.role
+	FROM file_permissions p
+	LEFT JOIN users u ON u.id = p.grantee_account
+	LEFT JOIN teams t ON t.id = p.grantee_team
+	WHERE COALESCE(p.file_id, p.folder_id) = $1
+	ORDER BY p.created_at`
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, target)
+	if err != nil {
+		return nil, fmt.Errorf("error listing grants: %w", err)
+	}
+	defer rows.Close()
+
+	var grants []Grant
+	for rows.Next() {
+		var g Grant
+		if err := rows.Scan(&g.Id, &g.Grantee, &g.IsTeam, &g.Role); err != nil {
+			return nil, fmt.Errorf("error scanning grant: %w", err)
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// grantAccess shares a file or folder with the account registered to email, or with a team the
+// owner belongs to. Granting again changes the role.
+func grantAccess(pgContext *pg.PostgresContext, accountUUID string, fileId string, folderId string, email string, teamId string, role string) error {
+	if role != RoleViewer && role != RoleEditor {
+		return fmt.Errorf("%w: pick viewer or editor", ErrInvalidName)
+	}
+	if err := checkShareTarget(pgContext, accountUUID, fileId, folderId); err != nil {
+		return err
+	}
+
+	var granteeAccount, granteeTeam string
+	if teamId != "" {
+		if _, err := getTeam(pgContext, accountUUID, teamId, false); err != nil {
+			return err
+		}
+		granteeTeam = teamId
+	} else {
+		id, err := accountByEmail(pgContext, email)
+		if err != nil {
+			return err
+		}
+		if id == accountUUID {
+			return ErrShareWithSelf
+		}
+		granteeAccount = id
+	}
+
+	sqlStatement := `
+	INSERT INTO file_permissions (file_id, folder_id, grantee_account, grantee_team, role, granted_by)
+	VALUES (NULLIF($1, '')::uuid, NULLIF($2, '')::uuid, NULLIF($3, '')::uuid, NULLIF($4, '')::uuid, $5, $6)
+	ON CONFLICT ((COALESCE(file_id, folder_id)), (COALESCE(grantee_account, grantee_team)))
+	DO UPDATE SET role = EXCLUDED.role`
+	_, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, fileId, folderId, granteeAccount, granteeTeam, role, accountUUID)
+	if err != nil {
+		return fmt.Errorf("error granting access: %w", err)
+	}
+	return nil
+}
+
+// revokeAccess removes a grant on one of the account's files or folders, returning what it was on
+func revokeAccess(pgContext *pg.PostgresContext, accountUUID string, grantId string) (string, string, error) {
+	sqlStatement := `
+	DELETE FROM file_permissions
+	WHERE id = $1
+		AND (file_id IN (SELECT id FROM files WHERE account_uuid = $2)
+			OR folder_id IN (SELECT id FROM folders WHERE account_uuid = $2))
+	RETURNING COALESCE(file_id::text, ''), COALESCE(folder_id::text, '')`
+	var fileId, folderId string
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, grantId, accountUUID).Scan(&fileId, &folderId)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("Failed to revoke grant %s: %v", grantId, err)
+		}
+		return "", "", ErrPermissionDenied
+	}
+	return fileId, folderId, nil
+}
+
+func accountByEmail(pgContext *pg.PostgresContext, email string) (string, error) {
+	var id string
+	sqlStatement := `SELECT id FROM users WHERE email = $1`
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, strings.TrimSpace(email)).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrGranteeNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("error looking up account: %w", err)
+	}
+	return id, nil
+}
+
+// Endpoints
+
+func renderAccessPanel(hCtx HandlerContext, panel AccessPanel) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	grants, err := listGrants(hCtx.PGCtx, uuid, panel.FileId, panel.FolderId)
+	if errors.Is(err, ErrShareTarget) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Name either a file or a folder")
+	}
+	if errors.Is(err, ErrFileNotFound) || errors.Is(err, ErrFolderNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "Not found")
+	}
+	if err != nil {
+		log.Printf("Failed to list grants: %v", err)
+		return errorDiv(c, "Failed to load who has access")
+	}
+	teams, err := listTeams(hCtx.PGCtx, uuid)
+	if err != nil {
+		log.Printf("Failed to list teams for account %s: %v", uuid, err)
+	}
+	panel.Grants = grants
+	panel.Teams = teams
+	panel.Roles = accessRoles
+	return c.Render(http.StatusOK, "share/access", panel)
+}
+
+func AccessList(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	return renderAccessPanel(hCtx, AccessPanel{FileId: c.QueryParam("file_id"), FolderId: c.QueryParam("folder_id")})
+}
+
+func AccessGrant(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	panel := AccessPanel{FileId: c.FormValue("file_id"), FolderId: c.FormValue("folder_id")}
+	err := grantAccess(hCtx.PGCtx, uuid, panel.FileId, panel.FolderId, c.FormValue("email"), c.FormValue("team_id"), c.FormValue("role"))
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrShareTarget):
+		return echo.NewHTTPError(http.StatusBadRequest, "Name either a file or a folder")
+	case errors.Is(err, ErrFileNotFound), errors.Is(err, ErrFolderNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Not found")
+	case errors.Is(err, ErrInvalidName):
+		panel.Error = strings.TrimPrefix(err.Error(), ErrInvalidName.Error()+": ")
+	case errors.Is(err, ErrGranteeNotFound), errors.Is(err, ErrShareWithSelf), errors.Is(err, ErrTeamNotFound):
+		msg := err.Error()
+		panel.Error = strings.ToUpper(msg[:1]) + msg[1:]
+	default:
+		log.Printf("Failed to share: %v", err)
+		panel.Error = "Failed to share"
+	}
+	return renderAccessPanel(hCtx, panel)
+}
+
+func AccessRevoke(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	fileId, folderId, err := revokeAccess(hCtx.PGCtx, uuid, c.QueryParam("grant_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Grant not found")
+	}
+	return renderAccessPanel(hCtx, AccessPanel{FileId: fileId, FolderId: folderId})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	pg "goserve/postgres"
+	"testing"
+)
+
+// fileRole is the account's role on a file, or "" if it can't see it
+func fileRole(t *testing.T, pgContext *pg.PostgresContext, fileId string, accountUUID string) string {
+	t.Helper()
+	_, role, err := getAccessibleFileObject(pgContext, fileId, accountUUID)
+	if errors.Is(err, ErrFileNotFound) {
+		return ""
+	}
+	if err != nil {
+		t.Fatalf("getAccessibleFileObject: %v", err)
+	}
+	return role
+}
+
+func TestGrantAndRevokeFileAccess(t *testing.T) {
+	pgContext := newTestPG(t)
+	filesystem := newMemoryFilesystem("sharing-test")
+	owner := createTestAccount(t, pgContext, "owner@example.com")
+	bob := createTestAccount(t, pgContext, "bob@example.com")
+	stranger := createTestAccount(t, pgContext, "stranger@example.com")
+	fileId := indexTestFile(t, pgContext, filesystem, owner, "plan.txt")
+
+	if role := fileRole(t, pgContext, fileId, owner); role != RoleOwner {
+		t.Errorf("owner's role = %q, want owner", role)
+	}
+	if role := fileRole(t, pgContext, fileId, bob); role != "" {
+		t.Errorf("bob can see the file before it's shared, as %q", role)
+	}
+
+	if err := grantAccess(pgContext, owner, fileId, "", "bob@example.com", "", RoleViewer); err != nil {
+		t.Fatalf("grantAccess: %v", err)
+	}
+	fo, role, err := getAccessibleFileObject(pgContext, fileId, bob)
+	if err != nil || role != RoleViewer || fo.AccountUUID != owner {
+		t.Errorf("bob's view = owner %q as %q, %v; want the owner's file as a viewer", fo.AccountUUID, role, err)
+	}
+	// granting again changes the role rather than adding a second grant
+	if err := grantAccess(pgContext, owner, fileId, "", "bob@example.com", "", RoleEditor); err != nil {
+		t.Fatalf("grantAccess editor: %v", err)
+	}
+	grants, err := listGrants(pgContext, owner, fileId, "")
+	if err != nil || len(grants) != 1 || grants[0].Grantee != "bob@example.com" || grants[0].Role != RoleEditor {
+		t.Fatalf("grants = %+v, %v; want bob as the only editor", grants, err)
+	}
+	if role := fileRole(t, pgContext, fileId, stranger); role != "" {
+		t.Errorf("a stranger can see the file as %q", role)
+	}
+
+	for name, tt := range map[string]struct {
+		account, email, role string
+		want                 error
+	}{
+		"self":          {owner, "owner@example.com", RoleViewer, ErrShareWithSelf},
+		"unknown email": {owner, "nobody@example.com", RoleViewer, ErrGranteeNotFound},
+		"owner role":    {owner, "stranger@example.com", RoleOwner, ErrInvalidName},
+		"not the owner": {bob, "stranger@example.com", RoleViewer, ErrFileNotFound},
+	} {
+		if err := grantAccess(pgContext, tt.account, fileId, "", tt.email, "", tt.role); !errors.Is(err, tt.want) {
+			t.Errorf("%s: grantAccess = %v, want %v", name, err, tt.want)
+		}
+	}
+	if _, err := listGrants(pgContext, bob, fileId, ""); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("bob listing the owner's grants = %v, want ErrFileNotFound", err)
+	}
+
+	if _, _, err := revokeAccess(pgContext, bob, grants[0].Id); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("bob revoking a grant on the owner's file = %v, want ErrPermissionDenied", err)
+	}
+	if revokedFile, _, err := revokeAccess(pgContext, owner, grants[0].Id); err != nil || revokedFile != fileId {
+		t.Fatalf("revokeAccess = %q, %v; want the file", revokedFile, err)
+	}
+	if role := fileRole(t, pgContext, fileId, bob); role != "" {
+		t.Errorf("bob can still see the file as %q after the grant was revoked", role)
+	}
+}
+
+func TestFolderSharedWithATeamCoversSubfolders(t *testing.T) {
+	pgContext := newTestPG(t)
+	filesystem := newMemoryFilesystem("sharing-test")
+	owner := createTestAccount(t, pgContext, "team-owner@example.com")
+	member := createTestAccount(t, pgContext, "member@example.com")
+	outsider := createTestAccount(t, pgContext, "outsider@example.com")
+
+	top := mustCreateFolder(t, pgContext, owner, "", "Shared")
+	sub := mustCreateFolder(t, pgContext, owner, top.Id, "Deep")
+	fileId := indexTestFile(t, pgContext, filesystem, owner, "deep.txt")
+	if err := moveFileToFolder(pgContext, owner, fileId, sub.Id); err != nil {
+		t.Fatalf("moveFileToFolder: %v", err)
+	}
+
+	if err := createTeam(pgContext, owner, "Crew"); err != nil {
+		t.Fatalf("createTeam: %v", err)
+	}
+	teams, err := listTeams(pgContext, owner)
+	if err != nil || len(teams) != 1 {
+		t.Fatalf("listTeams = %+v, %v", teams, err)
+	}
+	if err := addTeamMember(pgContext, owner, teams[0].Id, "member@example.com"); err != nil {
+		t.Fatalf("addTeamMember: %v", err)
+	}
+	if err := addTeamMember(pgContext, member, teams[0].Id, "outsider@example.com"); !errors.Is(err, ErrTeamNotFound) {
+		t.Errorf("a member adding to the team = %v, want ErrTeamNotFound", err)
+	}
+
+	if err := grantAccess(pgContext, owner, "", top.Id, "", teams[0].Id, RoleViewer); err != nil {
+		t.Fatalf("sharing the folder with the team: %v", err)
+	}
+	if role := fileRole(t, pgContext, fileId, member); role != RoleViewer {
+		t.Errorf("team member's role on a file two folders down = %q, want viewer", role)
+	}
+	if role := fileRole(t, pgContext, fileId, outsider); role != "" {
+		t.Errorf("someone outside the team can see the file as %q", role)
+	}
+
+	if err := removeTeamMember(pgContext, owner, teams[0].Id, "member@example.com"); err != nil {
+		t.Fatalf("removeTeamMember: %v", err)
+	}
+	if role := fileRole(t, pgContext, fileId, member); role != "" {
+		t.Errorf("a removed member can still see the file as %q", role)
+	}
+}
+
+// Owning one of a file and a folder mustn't let a request see or change grants on the other
+func TestCheckShareTargetNeedsExactlyOneTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileId   string
+		folderId string
+	}{
+		{name: "both", fileId: "someone-elses-file", folderId: "my-folder"},
+		{name: "neither"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// refused before postgres is asked anything
+			err := checkShareTarget(nil, "account", tt.fileId, tt.folderId)
+			if !errors.Is(err, ErrShareTarget) {
+				t.Errorf("checkShareTarget = %v, want ErrShareTarget", err)
+			}
+			if _, err := listGrants(nil, "account", tt.fileId, tt.folderId); !errors.Is(err, ErrShareTarget) {
+				t.Errorf("listGrants = %v, want ErrShareTarget", err)
+			}
+			if err := grantAccess(nil, "account", tt.fileId, tt.folderId, "a@example.com", "", RoleViewer); !errors.Is(err, ErrShareTarget) {
+				t.Errorf("grantAccess = %v, want ErrShareTarget", err)
+			}
+		})
+	}
+}
@@ -38,10 +38,56 @@ function handleFiles(files) {
     ([...files]).forEach(uploadFile);
 }
 
-function uploadFile(file) {
-    var url = '/app/files/upload';
+function triggerZipInputClick() {
+    var zipInput = document.getElementById('zip-input');
+    if (zipInput) {
+        zipInput.click();
+    }
+}
+
+function zipHandler() {
+    ([...this.files]).forEach(uploadZip);
+    this.value = '';
+}
+
+// Each entry of the archive becomes its own file. The summary stays up, since extraction
+// results for each entry keep updating in it.
+// Uploads go into the folder the file browser has open
+function newUploadForm(file) {
     var formData = new FormData();
+    var browser = document.getElementById('file-browser');
+    if (browser && browser.dataset.folderId) {
+        formData.append('folder_id', browser.dataset.folderId);
+    }
     formData.append('file', file);
+    return formData;
+}
+
+function uploadZip(file) {
+    var formData = newUploadForm(file);
+
+    var uploadStatus = document.querySelector('#upload-status');
+    uploadStatus.innerHTML = '<p class="mt-4 text-sm text-gray-600 dark:text-gray-400">Unpacking ' + file.name.replace(/[<>&"]/g, '') + '...</p>';
+    fetch('/app/files/zip', {
+        method: 'POST',
+        body: formData
+    })
+    .then(response => {
+        if (!response.ok) {
+        throw new Error('Network response was not ok');
+    }
+    return response.text();
+    }).then(html => {
+        uploadStatus.innerHTML = html;
+        htmx.process(uploadStatus);
+        document.body.dispatchEvent(new Event('fileUploaded'));
+    })
+    .catch(error => console.error(error));
+}
+
+function uploadFile(file) {
+    var url = '/app/files/upload';
+    var formData = newUploadForm(file);
 
     console.log("Uploading file...")
     // Using Fetch API as an alternative to HTMX for the AJAX call
@@ -59,6 +105,8 @@ function uploadFile(file) {
         var uploadStatus = document.querySelector('#upload-status');
         uploadStatus.innerHTML = html;
         setTimeout(function() { uploadStatus.innerHTML=""; }, 5000);
+        // refresh the Files table so the new row's extraction status shows up
+        document.body.dispatchEvent(new Event('fileUploaded'));
     })
     .catch(error => console.error(error));
 }
@@ -74,13 +122,22 @@ function setupFileDropArea() {
         console.log("No file-input found")
         return
     }
-    var uploadButton = dropArea.querySelector('button');
+    var uploadButton = dropArea.querySelector('button[aria-label="Upload"]');
 
     uploadButton.removeEventListener('click', triggerFileInputClick);
     uploadButton.addEventListener('click', triggerFileInputClick);
 
     fileInput.removeEventListener('change', fileHandler);
     fileInput.addEventListener('change', fileHandler);
+
+    var zipInput = document.getElementById('zip-input');
+    var zipButton = document.getElementById('zip-upload-button');
+    if (zipInput && zipButton) {
+        zipButton.removeEventListener('click', triggerZipInputClick);
+        zipButton.addEventListener('click', triggerZipInputClick);
+        zipInput.removeEventListener('change', zipHandler);
+        zipInput.addEventListener('change', zipHandler);
+    }
     
 
     // Drag-over and drag-leave visualization
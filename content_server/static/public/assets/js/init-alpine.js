@@ -48,7 +48,9 @@ function data() {
       this.isPagesMenuOpen = !this.isPagesMenuOpen
     },
     // Modal
+    modalHeader: "",
     modalContent: true,
+    modalImage: "",
     modalTarget: "",
     isModalOpen: false,
     trapCleanup: null,
@@ -58,8 +60,10 @@ function data() {
       if (targetElement.tagName.toLowerCase() !== 'a') {
           targetElement = targetElement.closest('a');
       }
+      this.modalHeader = targetElement.getAttribute('data-modal-header') || '';
       var modalContentEscaped = targetElement.getAttribute('data-modal-content');
       this.modalContent = unescapeHtml(modalContentEscaped);
+      this.modalImage = targetElement.getAttribute('data-modal-image') || '';
 
       this.modalTarget = targetElement.getAttribute('data-modal-target');
 
@@ -68,9 +72,17 @@ function data() {
     },
     closeModal() {
       this.modalContent = ''
+      this.modalImage = ''
       this.isModalOpen = false
       this.trapCleanup()
     },
+    // Only an explicit Accept sends the request; the server's HX-Trigger refreshes whatever changed
+    confirmModal() {
+      if (this.modalTarget) {
+        htmx.ajax('POST', this.modalTarget, { swap: 'none' })
+      }
+      this.closeModal()
+    },
   }
 }
 
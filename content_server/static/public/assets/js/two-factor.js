@@ -0,0 +1,14 @@
+// Draws the QR code for an authenticator app when the two-factor setup panel is swapped in. The
+// secret never leaves the browser, the code is rendered locally by qrcode-generator.
+document.addEventListener('htmx:afterSwap', function () {
+    document.querySelectorAll('[data-totp-setup]').forEach(function (el) {
+        if (el.dataset.totpDrawn || typeof qrcode === 'undefined') {
+            return;
+        }
+        let qr = qrcode(0, 'M');
+        qr.addData(el.dataset.totpSetup);
+        qr.make();
+        el.innerHTML = qr.createSvgTag({ cellSize: 4, margin: 4, scalable: true });
+        el.dataset.totpDrawn = 'true';
+    });
+});
@@ -1,5 +1,7 @@
 package cells
 
+import "strings"
+
 type ProfileCell struct {
 	Avatar string
 	Name   string
@@ -24,6 +26,11 @@ var StatusColorMap = map[string]string{
 	"Pending":  "orange",
 	"Denied":   "red",
 	"Expired":  "grey",
+	"Running":  "blue",
+	"Done":     "green",
+	"Failed":   "red",
+	"Viewer":   "grey",
+	"Editor":   "blue",
 }
 
 var ColorCssMap = map[string]string{
@@ -31,6 +38,7 @@ var ColorCssMap = map[string]string{
 	"orange": "text-orange-700 bg-orange-100 dark:bg-orange-600 dark:text-white",
 	"red":    "text-red-700    bg-red-100    dark:bg-red-700    dark:text-red-100",
 	"grey":   "text-gray-700   bg-gray-100   dark:text-gray-100 dark:bg-gray-700",
+	"blue":   "text-blue-500   bg-blue-100   dark:bg-blue-500   dark:text-blue-100",
 	"purple": "text-white transition-colors bg-purple-600 active:bg-purple-600 hover:bg-purple-700 focus:outline-none focus:shadow-outline-purple",
 }
 
@@ -42,15 +50,28 @@ func (BasicCell) TemplateName() string {
 	return "tableCell/basic"
 }
 
+// ModalCell opens a file's extracted text in the modal, under its first-page preview once
+// PreviewURL is set
 type ModalCell struct {
 	LinkText     string
 	ModalContent string
+	PreviewURL   string
 }
 
 func (ModalCell) TemplateName() string {
 	return "tableCell/modal"
 }
 
+// ThumbnailCell shows a file's first-page thumbnail, or a placeholder until one is rendered
+type ThumbnailCell struct {
+	Filename string
+	URL      string
+}
+
+func (ThumbnailCell) TemplateName() string {
+	return "tableCell/thumbnail"
+}
+
 type TrashCell struct {
 	Filename string
 	FileId   string
@@ -60,6 +81,82 @@ func (TrashCell) TemplateName() string {
 	return "tableCell/trash"
 }
 
+// SelectCell is a checkbox picking the file for a ZIP export. It belongs to the page's
+// zip-export form, so selections aren't lost to the table being re-rendered around it.
+type SelectCell struct {
+	Filename string
+	FileId   string
+}
+
+func (SelectCell) TemplateName() string {
+	return "tableCell/select"
+}
+
+// TagsCell lists a file's tags, each filtering the table by it, with a form to add more
+type TagsCell struct {
+	FileId string
+	Tags   []string
+	Error  string
+}
+
+func (TagsCell) TemplateName() string {
+	return "tableCell/tags"
+}
+
+// FolderCell opens a picker for moving the file to another folder
+type FolderCell struct {
+	Filename string
+	FileId   string
+}
+
+func (FolderCell) TemplateName() string {
+	return "tableCell/folder"
+}
+
+// TrashActionsCell restores a file from the trash or deletes it for good
+type TrashActionsCell struct {
+	Filename string
+	FileId   string
+}
+
+func (TrashActionsCell) TemplateName() string {
+	return "tableCell/trashActions"
+}
+
+// DownloadCell links to a file's download endpoint, both as an attachment and opened in a new tab.
+// Files the malware scan flagged are shown as quarantined instead.
+type DownloadCell struct {
+	Filename      string
+	URL           string
+	ScanStatus    string
+	ScanSignature string
+}
+
+func (DownloadCell) TemplateName() string {
+	return "tableCell/download"
+}
+
+// ShareCell opens a dropdown for creating and revoking a file's share links
+type ShareCell struct {
+	Filename string
+	FileId   string
+}
+
+func (ShareCell) TemplateName() string {
+	return "tableCell/share"
+}
+
+// VersionsCell shows a file's current version and opens its history
+type VersionsCell struct {
+	Filename string
+	FileId   string
+	Version  int
+}
+
+func (VersionsCell) TemplateName() string {
+	return "tableCell/versions"
+}
+
 type HiddenCell struct {
 	Val string
 }
@@ -67,3 +164,38 @@ type HiddenCell struct {
 func (HiddenCell) TemplateName() string {
 	return "tableCell/hidden"
 }
+
+// ExtractionCell shows a file's text extraction status.
+// Polls for updates while extraction is in flight, and offers a retry once it has failed.
+type ExtractionCell struct {
+	FileId string
+	Status string
+	Color  string
+	Error  string
+}
+
+// NewExtractionCell builds the cell from the raw files.extraction_status value
+func NewExtractionCell(fileId string, status string, errMsg string) ExtractionCell {
+	display := status
+	if status != "" {
+		display = strings.ToUpper(status[:1]) + status[1:]
+	}
+	return ExtractionCell{
+		FileId: fileId,
+		Status: display,
+		Color:  ColorCssMap[StatusColorMap[display]],
+		Error:  errMsg,
+	}
+}
+
+func (ExtractionCell) TemplateName() string {
+	return "tableCell/extraction"
+}
+
+func (ec ExtractionCell) Polling() bool {
+	return ec.Status == "Pending" || ec.Status == "Running"
+}
+
+func (ec ExtractionCell) Retryable() bool {
+	return ec.Status == "Failed"
+}
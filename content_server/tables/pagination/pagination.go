@@ -13,6 +13,8 @@ type Pagination struct {
 type PaginData struct {
 	TableName string
 	ItemTotal uint32
+	// Filter is the table's other query params, e.g. "&folder_id=...", kept when changing pages
+	Filter string
 }
 type PaginConfig struct {
 	CurrentPage  uint32
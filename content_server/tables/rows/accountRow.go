@@ -5,11 +5,11 @@ import (
 	"log"
 	"time"
 
-	"main/tables/cells"
-	"main/tables/pagination"
-	"main/templating/components"
+	"goserve/tables/cells"
+	"goserve/tables/pagination"
+	"goserve/templating/components"
 
-	pg "main/postgres"
+	pg "goserve/postgres"
 )
 
 var _ RowProcessor[AccountRow] = AccountRowProcessor{}
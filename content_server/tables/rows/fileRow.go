@@ -2,38 +2,65 @@ package rows
 
 import (
 	"fmt"
+	pg "goserve/postgres"
+	"goserve/tables/cells"
+	"goserve/tables/pagination"
+	"goserve/templating/components"
 	"log"
-	pg "main/postgres"
-	"main/tables/cells"
-	"main/tables/pagination"
-	"main/templating/components"
-	"path/filepath"
 	"time"
 )
 
 type FileRow struct {
-	ID         string
-	Filename   string
-	UploadTime time.Time
-	FileExt    string
-	RawText    string
-	BucketDir  string
-	Location   string
-	FileURL    string
+	ID               string
+	Filename         string
+	UploadTime       time.Time
+	FileExt          string
+	RawText          string
+	BucketDir        string
+	Location         string
+	FileURL          string
+	Version          int
+	ExtractionStatus string
+	ExtractionError  string
+	ScanStatus       string
+	ScanSignature    string
+	PreviewStatus    string
+	Tags             []string
 }
 
 func (FileRow) _isRow() bool { return true }
 
-type FileRowProcessor struct{}
+// FileRowProcessor lists the files directly in FolderId, "" being the top level. With a Tag it
+// lists the files with that tag anywhere under FolderId instead.
+type FileRowProcessor struct {
+	FolderId string
+	Tag      string
+}
+
+// fileFilterSql narrows files f to the processor's folder and tag, with $1 the account, $2 the
+// folder and $3 the tag
+const fileFilterSql = `
+	f.account_uuid = $1 AND f.deleted_at IS NULL
+	AND ($3 = '' OR EXISTS (SELECT 1 FROM file_tags t WHERE t.file_id = f.id AND t.tag = $3))
+	AND (
+		($3 = '' AND f.folder_id IS NOT DISTINCT FROM NULLIF($2, '')::uuid)
+		OR ($3 <> '' AND ($2 = '' OR f.folder_id IN (
+			WITH RECURSIVE subtree AS (
+				SELECT id FROM folders WHERE id = NULLIF($2, '')::uuid
+				UNION
+				SELECT c.id FROM folders c JOIN subtree s ON c.parent_id = s.id
+			)
+			SELECT id FROM subtree
+		)))
+	)`
 
 func (frp FileRowProcessor) Count(pgContext *pg.PostgresContext, uuid string) (int, error) {
 	query := `
 	SELECT COUNT(*)
 	FROM "files" f
-	WHERE f.account_uuid = $1
-	`
+	WHERE ` + fileFilterSql
 	var count int
-	rows, err := pgContext.Pool.Query(pgContext.Ctx, query, uuid)
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, query, uuid, frp.FolderId, frp.Tag)
 	if err != nil {
 		return count, fmt.Errorf("query execution error: %w", err)
 	}
@@ -54,16 +81,18 @@ func (frp FileRowProcessor) Count(pgContext *pg.PostgresContext, uuid string) (i
 func (frp FileRowProcessor) QuerySQLToStructArray(pgContext *pg.PostgresContext, uuid string, pagination pagination.PaginConfig) ([]FileRow, error) {
 	// Do we need to generalize ORDER BY?
 	query := `
-	SELECT f.id, f.filename, f.upload_time, f.file_ext, f.raw_text, f.bucket_dir, f.location
+	SELECT f.id, f.filename, f.upload_time, f.file_ext, COALESCE(f.raw_text, ''), f.bucket_dir, f.location,
+		f.extraction_status, COALESCE(f.extraction_error, ''), f.version, f.scan_status, COALESCE(f.scan_signature, ''),
+		f.preview_status, COALESCE((SELECT array_agg(t.tag ORDER BY t.tag) FROM file_tags t WHERE t.file_id = f.id), '{}')
 	FROM "files" f
-	WHERE f.account_uuid = $3
-	LIMIT $1
-	OFFSET $2
+	WHERE ` + fileFilterSql + `
+	LIMIT $4
+	OFFSET $5
 	`
 
 	limit := pagination.ItemsPerPage
 	offset := (pagination.CurrentPage - 1) * pagination.ItemsPerPage
-	rows, err := pgContext.Pool.Query(pgContext.Ctx, query, limit, offset, uuid)
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, query, uuid, frp.FolderId, frp.Tag, limit, offset)
 	if err != nil {
 		return nil, fmt.Errorf("query execution error: %w", err)
 	}
@@ -72,11 +101,13 @@ func (frp FileRowProcessor) QuerySQLToStructArray(pgContext *pg.PostgresContext,
 	var results []FileRow
 	for rows.Next() {
 		var fr FileRow
-		if err := rows.Scan(&fr.ID, &fr.Filename, &fr.UploadTime, &fr.FileExt, &fr.RawText, &fr.BucketDir, &fr.Location); err != nil {
+		if err := rows.Scan(&fr.ID, &fr.Filename, &fr.UploadTime, &fr.FileExt, &fr.RawText, &fr.BucketDir, &fr.Location, &fr.ExtractionStatus, &fr.ExtractionError, &fr.Version,
+			&fr.ScanStatus, &fr.ScanSignature, &fr.PreviewStatus, &fr.Tags); err != nil {
 			log.Printf("Failed to scan row: %v", err)
 			continue
 		}
-		fr.FileURL = filepath.Join(fr.BucketDir, fr.Filename)
+		// relative to the <base href="/app/"> the table is rendered under
+		fr.FileURL = fmt.Sprintf("files/%s/download", fr.ID)
 		results = append(results, fr)
 	}
 
@@ -87,16 +118,41 @@ func (frp FileRowProcessor) QuerySQLToStructArray(pgContext *pg.PostgresContext,
 	return results, nil
 }
 
+// previewURL links a file's rendered preview of the given size, or is empty while there isn't one
+// to show. Quarantined files never get one.
+func previewURL(fileId string, previewStatus string, scanStatus string, size string) string {
+	if previewStatus != "ready" || scanStatus == "infected" {
+		return ""
+	}
+	if size == "thumb" {
+		return fmt.Sprintf("files/%s/preview?size=thumb", fileId)
+	}
+	return fmt.Sprintf("files/%s/preview", fileId)
+}
+
 func (frp FileRowProcessor) BuildRowCells(fr FileRow) []components.DivComponent {
 	id := components.DivComponent{
 		Data: cells.HiddenCell{
 			Val: fr.ID,
 		},
 	}
+	selected := components.DivComponent{
+		Data: cells.SelectCell{
+			Filename: fr.Filename,
+			FileId:   fr.ID,
+		},
+	}
+	thumbnail := components.DivComponent{
+		Data: cells.ThumbnailCell{
+			Filename: fr.Filename,
+			URL:      previewURL(fr.ID, fr.PreviewStatus, fr.ScanStatus, "thumb"),
+		},
+	}
 	filename := components.DivComponent{
 		Data: cells.ModalCell{
 			LinkText:     fr.Filename,
 			ModalContent: fr.RawText,
+			PreviewURL:   previewURL(fr.ID, fr.PreviewStatus, fr.ScanStatus, "page"),
 		},
 	}
 	extension := components.DivComponent{
@@ -109,15 +165,51 @@ func (frp FileRowProcessor) BuildRowCells(fr FileRow) []components.DivComponent
 			Val: fr.UploadTime.Format("2006-01-02 15:04:05"),
 		},
 	}
+	version := components.DivComponent{
+		Data: cells.VersionsCell{
+			Filename: fr.Filename,
+			FileId:   fr.ID,
+			Version:  fr.Version,
+		},
+	}
+	extraction := components.DivComponent{
+		Data: cells.NewExtractionCell(fr.ID, fr.ExtractionStatus, fr.ExtractionError),
+	}
+	tags := components.DivComponent{
+		Data: cells.TagsCell{
+			FileId: fr.ID,
+			Tags:   fr.Tags,
+		},
+	}
+	download := components.DivComponent{
+		Data: cells.DownloadCell{
+			Filename:      fr.Filename,
+			URL:           fr.FileURL,
+			ScanStatus:    fr.ScanStatus,
+			ScanSignature: fr.ScanSignature,
+		},
+	}
+	share := components.DivComponent{
+		Data: cells.ShareCell{
+			Filename: fr.Filename,
+			FileId:   fr.ID,
+		},
+	}
+	folder := components.DivComponent{
+		Data: cells.FolderCell{
+			Filename: fr.Filename,
+			FileId:   fr.ID,
+		},
+	}
 	trashCan := components.DivComponent{
 		Data: cells.TrashCell{
 			Filename: fr.Filename,
 			FileId:   fr.ID,
 		},
 	}
-	return []components.DivComponent{id, filename, extension, uploadTime, trashCan}
+	return []components.DivComponent{id, selected, thumbnail, filename, extension, uploadTime, version, extraction, tags, download, share, folder, trashCan}
 }
 
 func (frp FileRowProcessor) GetHeaders() []string {
-	return []string{"File", "Extension", "Upload Time", ""}
+	return []string{"", "", "File", "Extension", "Upload Time", "Version", "Text", "Tags", "", "", "", ""}
 }
@@ -1,11 +1,11 @@
 package rows
 
 import (
+	pg "goserve/postgres"
+	"goserve/tables/pagination"
+	"goserve/templating/components"
 	"html/template"
 	"log"
-	pg "main/postgres"
-	"main/tables/pagination"
-	"main/templating/components"
 	"strings"
 )
 
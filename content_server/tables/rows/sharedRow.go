@@ -0,0 +1,160 @@
+package rows
+
+import (
+	"fmt"
+	pg "goserve/postgres"
+	"goserve/tables/cells"
+	"goserve/tables/pagination"
+	"goserve/templating/components"
+	"log"
+	"strings"
+	"time"
+)
+
+// SharedRolesSql lists (file_id, role) for every file shared with account $1, directly or through
+// a team, and through folders down to their subfolders. A file shared more than one way gets the
+// highest role. UNION rather than UNION ALL stops the folder walk at folders it has already seen.
+const SharedRolesSql = `
+	WITH RECURSIVE grants AS (
+		SELECT p.file_id, p.folder_id, p.role FROM file_permissions p
+		WHERE p.grantee_account = $1
+			OR p.grantee_team IN (SELECT m.team_id FROM team_members m WHERE m.account_uuid = $1)
+	), shared_folders AS (
+		SELECT g.folder_id AS id, g.role FROM grants g WHERE g.folder_id IS NOT NULL
+		UNION
+		SELECT c.id, s.role FROM folders c JOIN shared_folders s ON c.parent_id = s.id
+	), shared AS (
+		SELECT g.file_id, g.role FROM grants g WHERE g.file_id IS NOT NULL
+		UNION ALL
+		SELECT fi.id, s.role FROM files fi JOIN shared_folders s ON fi.folder_id = s.id
+	)
+	SELECT file_id, CASE WHEN bool_or(role = 'editor') THEN 'editor' ELSE 'viewer' END AS role
+	FROM shared GROUP BY file_id`
+
+type SharedRow struct {
+	ID            string
+	Filename      string
+	FileExt       string
+	RawText       string
+	UploadTime    time.Time
+	Owner         string
+	Role          string
+	FileURL       string
+	ScanStatus    string
+	ScanSignature string
+	PreviewStatus string
+}
+
+func (SharedRow) _isRow() bool { return true }
+
+// SharedRowProcessor lists other accounts' files shared with this one
+type SharedRowProcessor struct{}
+
+func (srp SharedRowProcessor) Count(pgContext *pg.PostgresContext, uuid string) (int, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM (` + SharedRolesSql + `) r
+	JOIN "files" f ON f.id = r.file_id
+	WHERE f.account_uuid <> $1 AND f.deleted_at IS NULL
+	`
+	var count int
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, query, uuid).Scan(&count); err != nil {
+		return count, fmt.Errorf("query execution error: %w", err)
+	}
+	return count, nil
+}
+
+func (srp SharedRowProcessor) QuerySQLToStructArray(pgContext *pg.PostgresContext, uuid string, pagination pagination.PaginConfig) ([]SharedRow, error) {
+	query := `
+	SELECT f.id, f.filename, f.file_ext, COALESCE(f.raw_text, ''), f.upload_time, u.email, r.role,
+		f.scan_status, COALESCE(f.scan_signature, ''), f.preview_status
+	FROM (` + SharedRolesSql + `) r
+	JOIN "files" f ON f.id = r.file_id
+	JOIN users u ON u.id = f.account_uuid
+	WHERE f.account_uuid <> $1 AND f.deleted_at IS NULL
+	ORDER BY f.upload_time DESC
+	LIMIT $2
+	OFFSET $3
+	`
+
+	limit := pagination.ItemsPerPage
+	offset := (pagination.CurrentPage - 1) * pagination.ItemsPerPage
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, query, uuid, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("query execution error: %w", err)
+	}
+	defer rows.Close()
+
+	var results []SharedRow
+	for rows.Next() {
+		var sr SharedRow
+		if err := rows.Scan(&sr.ID, &sr.Filename, &sr.FileExt, &sr.RawText, &sr.UploadTime, &sr.Owner, &sr.Role,
+			&sr.ScanStatus, &sr.ScanSignature, &sr.PreviewStatus); err != nil {
+			log.Printf("Failed to scan row: %v", err)
+			continue
+		}
+		sr.FileURL = fmt.Sprintf("files/%s/download", sr.ID)
+		results = append(results, sr)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return results, nil
+}
+
+func (srp SharedRowProcessor) BuildRowCells(sr SharedRow) []components.DivComponent {
+	id := components.DivComponent{
+		Data: cells.HiddenCell{
+			Val: sr.ID,
+		},
+	}
+	filename := components.DivComponent{
+		Data: cells.ModalCell{
+			LinkText:     sr.Filename,
+			ModalContent: sr.RawText,
+			PreviewURL:   previewURL(sr.ID, sr.PreviewStatus, sr.ScanStatus, "page"),
+		},
+	}
+	extension := components.DivComponent{
+		Data: cells.BasicCell{
+			Val: sr.FileExt,
+		},
+	}
+	owner := components.DivComponent{
+		Data: cells.BasicCell{
+			Val: sr.Owner,
+		},
+	}
+	roleLabel := strings.ToUpper(sr.Role[:1]) + sr.Role[1:]
+	role := components.DivComponent{
+		Data: cells.StatusCell{
+			Status: roleLabel,
+			Color:  cells.ColorCssMap[cells.StatusColorMap[roleLabel]],
+		},
+	}
+	download := components.DivComponent{
+		Data: cells.DownloadCell{
+			Filename:      sr.Filename,
+			URL:           sr.FileURL,
+			ScanStatus:    sr.ScanStatus,
+			ScanSignature: sr.ScanSignature,
+		},
+	}
+	// only editors can delete, which moves the file to its owner's trash
+	trashCan := components.DivComponent{
+		Data: cells.BasicCell{},
+	}
+	if sr.Role == "editor" {
+		trashCan.Data = cells.TrashCell{
+			Filename: sr.Filename,
+			FileId:   sr.ID,
+		}
+	}
+	return []components.DivComponent{id, filename, extension, owner, role, download, trashCan}
+}
+
+func (srp SharedRowProcessor) GetHeaders() []string {
+	return []string{"File", "Extension", "Owner", "Access", "", ""}
+}
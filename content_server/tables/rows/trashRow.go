@@ -0,0 +1,114 @@
+package rows
+
+import (
+	"fmt"
+	pg "goserve/postgres"
+	"goserve/tables/cells"
+	"goserve/tables/pagination"
+	"goserve/templating/components"
+	"log"
+	"time"
+)
+
+type TrashRow struct {
+	ID        string
+	Filename  string
+	FileExt   string
+	DeletedAt time.Time
+}
+
+func (TrashRow) _isRow() bool { return true }
+
+// TrashRowProcessor lists an account's deleted files, which stay restorable for Retention
+type TrashRowProcessor struct {
+	Retention time.Duration
+}
+
+func (trp TrashRowProcessor) Count(pgContext *pg.PostgresContext, uuid string) (int, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM "files" f
+	WHERE f.account_uuid = $1 AND f.deleted_at IS NOT NULL
+	`
+	var count int
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, query, uuid).Scan(&count); err != nil {
+		return count, fmt.Errorf("query execution error: %w", err)
+	}
+	return count, nil
+}
+
+func (trp TrashRowProcessor) QuerySQLToStructArray(pgContext *pg.PostgresContext, uuid string, pagination pagination.PaginConfig) ([]TrashRow, error) {
+	query := `
+	SELECT f.id, f.filename, f.file_ext, f.deleted_at
+	FROM "files" f
+	WHERE f.account_uuid = $3 AND f.deleted_at IS NOT NULL
+	ORDER BY f.deleted_at DESC
+	LIMIT $1
+	OFFSET $2
+	`
+
+	limit := pagination.ItemsPerPage
+	offset := (pagination.CurrentPage - 1) * pagination.ItemsPerPage
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, query, limit, offset, uuid)
+	if err != nil {
+		return nil, fmt.Errorf("query execution error: %w", err)
+	}
+	defer rows.Close()
+
+	var results []TrashRow
+	for rows.Next() {
+		var tr TrashRow
+		if err := rows.Scan(&tr.ID, &tr.Filename, &tr.FileExt, &tr.DeletedAt); err != nil {
+			log.Printf("Failed to scan row: %v", err)
+			continue
+		}
+		results = append(results, tr)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return results, nil
+}
+
+func (trp TrashRowProcessor) BuildRowCells(tr TrashRow) []components.DivComponent {
+	id := components.DivComponent{
+		Data: cells.HiddenCell{
+			Val: tr.ID,
+		},
+	}
+	filename := components.DivComponent{
+		Data: cells.BasicCell{
+			Val: tr.Filename,
+		},
+	}
+	extension := components.DivComponent{
+		Data: cells.BasicCell{
+			Val: tr.FileExt,
+		},
+	}
+	deletedAt := components.DivComponent{
+		Data: cells.BasicCell{
+			Val: tr.DeletedAt.Format("2006-01-02 15:04:05"),
+		},
+	}
+	purgeAt := components.DivComponent{
+		Data: cells.BasicCell{
+			Val: tr.DeletedAt.Add(trp.Retention).Format("2006-01-02 15:04:05"),
+		},
+	}
+	actions := components.DivComponent{
+		Data: cells.TrashActionsCell{
+			Filename: tr.Filename,
+			FileId:   tr.ID,
+		},
+	}
+	return []components.DivComponent{id, filename, extension, deletedAt, purgeAt, actions}
+}
+
+func (trp TrashRowProcessor) GetHeaders() []string {
+	return []string{"File", "Extension", "Deleted", "Deleted Forever On", ""}
+}
+
+var _ RowProcessor[TrashRow] = TrashRowProcessor{}
@@ -2,11 +2,11 @@ package tables
 
 import (
 	"fmt"
+	pg "goserve/postgres"
+	page "goserve/tables/pagination"
+	"goserve/tables/rows"
 	"html/template"
 	"log"
-	pg "main/postgres"
-	page "main/tables/pagination"
-	"main/tables/rows"
 
 	"github.com/labstack/echo/v4"
 )
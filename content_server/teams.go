@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+)
+
+// Teams are named groups of accounts to share with in one go. The owner manages the members and
+// can share with the team; members can share their own files with it too.
+
+var (
+	ErrTeamNotFound      = errors.New("team not found")
+	ErrAlreadyTeamMember = errors.New("that account is already in the team")
+)
+
+type Team struct {
+	Id      string
+	Name    string
+	Owner   string
+	Owned   bool
+	Members []string
+}
+
+func validateTeamName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 255 {
+		return "", fmt.Errorf("%w: team names are 1-255 characters", ErrInvalidName)
+	}
+	return name, nil
+}
+
+// getTeam loads a team the account owns or, unless ownerOnly, belongs to
+func getTeam(pgContext *pg.PostgresContext, accountUUID string, teamId string, ownerOnly bool) (Team, error) {
+	team := Team{Id: teamId}
+	sqlStatement := `
+	SELECT t.name, t.owner_uuid = $2
+	FROM teams t
+	WHERE t.id = $1
+		AND (t.owner_uuid = $2
+			OR (NOT $3 AND EXISTS (SELECT 1 FROM team_members m WHERE m.team_id = t.id AND m.account_uuid = $2)))`
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, teamId, accountUUID, ownerOnly).Scan(&team.Name, &team.Owned)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			// a malformed id fails uuid parsing in postgres, which is just another missing team
+			log.Printf("Failed to look up team %s: %v", teamId, err)
+		}
+		return team, ErrTeamNotFound
+	}
+	return team, nil
+}
+
+// listTeams lists the teams the account owns or belongs to, with their members' emails
+func listTeams(pgContext *pg.PostgresContext, accountUUID string) ([]Team, error) {
+	sqlStatement := `
+	SELECT t.id, t.name, o.email, t.owner_uuid = $1,
+		COALESCE(array_agg(u.email ORDER BY u.email) FILTER (WHERE u.email IS NOT NULL), '{}')
+	FROM teams t
+	JOIN users o ON o.id = t.owner_uuid
+	LEFT JOIN team_members m ON m.team_id = t.id
+	LEFT JOIN users u ON u.id = m.account_uuid
+	WHERE t.owner_uuid = $1
+		OR t.id IN (SELECT team_id FROM team_members WHERE account_uuid = $1)
+	GROUP BY t.id, o.email
+	ORDER BY t.name`
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, accountUUID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing teams: %w", err)
+	}
+	defer rows.Close()
+
+	var teams []Team
+	for rows.Next() {
+		var t Team
+		if err := rows.Scan(&t.Id, &t.Name, &t.Owner, &t.Owned, &t.Members); err != nil {
+			return nil, fmt.Errorf("error scanning team: %w", err)
+		}
+		teams = append(teams, t)
+	}
+	return teams, rows.Err()
+}
+
+func createTeam(pgContext *pg.PostgresContext, accountUUID string, name string) error {
+	name, err := validateTeamName(name)
+	if err != nil {
+		return err
+	}
+	sqlStatement := `INSERT INTO teams (owner_uuid, name) VALUES ($1, $2)`
+	if _, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, accountUUID, name); err != nil {
+		return fmt.Errorf("error creating team: %w", err)
+	}
+	return nil
+}
+
+func addTeamMember(pgContext *pg.PostgresContext, accountUUID string, teamId string, email string) error {
+	if _, err := getTeam(pgContext, accountUUID, teamId, true); err != nil {
+		return err
+	}
+	memberId, err := accountByEmail(pgContext, email)
+	if err != nil {
+		return err
+	}
+	sqlStatement := `INSERT INTO team_members (team_id, account_uuid) VALUES ($1, $2)`
+	_, err = pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, teamId, memberId)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return ErrAlreadyTeamMember
+	}
+	if err != nil {
+		return fmt.Errorf("error adding team member: %w", err)
+	}
+	return nil
+}
+
+func removeTeamMember(pgContext *pg.PostgresContext, accountUUID string, teamId string, email string) error {
+	if _, err := getTeam(pgContext, accountUUID, teamId, true); err != nil {
+		return err
+	}
+	sqlStatement := `
+	DELETE FROM team_members
+	WHERE team_id = $1 AND account_uuid = (SELECT id FROM users WHERE email = $2)`
+	if _, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, teamId, email); err != nil {
+		return fmt.Errorf("error removing team member: %w", err)
+	}
+	return nil
+}
+
+// deleteTeam deletes a team and, through the cascade, everything shared with it
+func deleteTeam(pgContext *pg.PostgresContext, accountUUID string, teamId string) error {
+	if _, err := getTeam(pgContext, accountUUID, teamId, true); err != nil {
+		return err
+	}
+	sqlStatement := `DELETE FROM teams WHERE id = $1 AND owner_uuid = $2`
+	if _, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, teamId, accountUUID); err != nil {
+		return fmt.Errorf("error deleting team: %w", err)
+	}
+	return nil
+}
+
+// Endpoints
+
+func teamErrorDiv(c echo.Context, err error, action string) error {
+	switch {
+	case errors.Is(err, ErrInvalidName):
+		return errorDiv(c, strings.TrimPrefix(err.Error(), ErrInvalidName.Error()+": "))
+	case errors.Is(err, ErrTeamNotFound), errors.Is(err, ErrGranteeNotFound), errors.Is(err, ErrAlreadyTeamMember):
+		msg := err.Error()
+		return errorDiv(c, strings.ToUpper(msg[:1])+msg[1:])
+	}
+	log.Printf("Failed to %s: %v", action, err)
+	return errorDiv(c, "Failed to "+action)
+}
+
+func TeamList(hCtx HandlerContext) error {
+	uuid, ok := hCtx.EchoCtx.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	teams, err := listTeams(hCtx.PGCtx, uuid)
+	if err != nil {
+		log.Printf("Failed to list teams for account %s: %v", uuid, err)
+		return errorDiv(hCtx.EchoCtx, "Failed to load teams")
+	}
+	return hCtx.EchoCtx.Render(http.StatusOK, "teams/list", teams)
+}
+
+func TeamCreate(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	if err := createTeam(hCtx.PGCtx, uuid, c.FormValue("name")); err != nil {
+		return teamErrorDiv(c, err, "create team")
+	}
+	c.Response().Header().Set("HX-Trigger", "teamsChanged")
+	return c.NoContent(http.StatusOK)
+}
+
+func TeamMemberAdd(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	if err := addTeamMember(hCtx.PGCtx, uuid, c.QueryParam("team_id"), c.FormValue("email")); err != nil {
+		return teamErrorDiv(c, err, "add team member")
+	}
+	c.Response().Header().Set("HX-Trigger", "teamsChanged")
+	return c.NoContent(http.StatusOK)
+}
+
+func TeamMemberRemove(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	if err := removeTeamMember(hCtx.PGCtx, uuid, c.QueryParam("team_id"), c.QueryParam("email")); err != nil {
+		return teamErrorDiv(c, err, "remove team member")
+	}
+	c.Response().Header().Set("HX-Trigger", "teamsChanged")
+	return c.NoContent(http.StatusOK)
+}
+
+func TeamDelete(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	if err := deleteTeam(hCtx.PGCtx, uuid, c.QueryParam("team_id")); err != nil {
+		return teamErrorDiv(c, err, "delete team")
+	}
+	c.Response().Header().Set("HX-Trigger", "teamsChanged, filesChanged")
+	return c.NoContent(http.StatusOK)
+}
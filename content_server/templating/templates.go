@@ -2,9 +2,9 @@ package templating
 
 import (
 	"bytes"
+	"goserve/arithmetic"
 	"html"
 	"html/template"
-	"main/arithmetic"
 	"strings"
 	"unicode"
 
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Changed regions beyond this many lines aren't diffed, the LCS table grows with the product of both sides
+const maxDiffLines = 2000
+
+// Lines of unchanged context kept around each change; longer unchanged runs are collapsed
+const diffContext = 3
+
+type DiffLine struct {
+	Op   string // "+", "-", " ", or "…" for a collapsed run of unchanged lines
+	Text string
+}
+
+type TextDiff struct {
+	From    int
+	To      int
+	Lines   []DiffLine
+	Added   int
+	Removed int
+	TooLong bool
+}
+
+func (d TextDiff) Identical() bool {
+	return !d.TooLong && d.Added == 0 && d.Removed == 0
+}
+
+// DiffText compares two extracted texts line by line
+func DiffText(a string, b string) *TextDiff {
+	aLines := splitLines(a)
+	bLines := splitLines(b)
+	diff := &TextDiff{}
+	lines, ok := diffLines(aLines, bLines)
+	if !ok {
+		diff.TooLong = true
+		return diff
+	}
+	for _, line := range lines {
+		switch line.Op {
+		case "+":
+			diff.Added++
+		case "-":
+			diff.Removed++
+		}
+	}
+	diff.Lines = collapseUnchanged(lines, diffContext)
+	return diff
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimRight(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// diffLines walks a longest-common-subsequence table to produce a minimal edit script.
+// The common prefix and suffix are peeled off first, which is most of a resume between versions.
+func diffLines(a []string, b []string) ([]DiffLine, bool) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	middleA, middleB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(middleA) > maxDiffLines || len(middleB) > maxDiffLines {
+		return nil, false
+	}
+
+	lines := make([]DiffLine, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		lines = append(lines, DiffLine{" ", line})
+	}
+	lines = append(lines, diffMiddle(middleA, middleB)...)
+	for _, line := range a[len(a)-suffix:] {
+		lines = append(lines, DiffLine{" ", line})
+	}
+	return lines, true
+}
+
+func diffMiddle(a []string, b []string) []DiffLine {
+	n, m := len(a), len(b)
+	lcs := make([][]int32, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	lines := make([]DiffLine, 0, n+m)
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, DiffLine{" ", a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, DiffLine{"-", a[i]})
+			i++
+		default:
+			lines = append(lines, DiffLine{"+", b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		lines = append(lines, DiffLine{"-", a[i]})
+	}
+	for ; j < m; j++ {
+		lines = append(lines, DiffLine{"+", b[j]})
+	}
+	return lines
+}
+
+func collapseUnchanged(lines []DiffLine, context int) []DiffLine {
+	keep := make([]bool, len(lines))
+	for i, line := range lines {
+		if line.Op == " " {
+			continue
+		}
+		for k := max(0, i-context); k <= min(len(lines)-1, i+context); k++ {
+			keep[k] = true
+		}
+	}
+
+	collapsed := []DiffLine{}
+	for i := 0; i < len(lines); i++ {
+		if keep[i] {
+			collapsed = append(collapsed, lines[i])
+			continue
+		}
+		start := i
+		for i+1 < len(lines) && !keep[i+1] {
+			i++
+		}
+		collapsed = append(collapsed, DiffLine{"…", fmt.Sprintf("%d unchanged lines", i-start+1)})
+	}
+	return collapsed
+}
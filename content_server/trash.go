@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type TrashConfig struct {
+	// How long a deleted file stays restorable before the purger removes it for good
+	Retention     time.Duration
+	PurgeInterval time.Duration
+	PurgeBatch    int
+}
+
+func GetDefaultTrashConfig() TrashConfig {
+	days, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS"))
+	if err != nil || days < 0 {
+		days = 30
+	}
+	return TrashConfig{
+		Retention:     time.Duration(days) * 24 * time.Hour,
+		PurgeInterval: time.Hour,
+		PurgeBatch:    100,
+	}
+}
+
+var trashConfig = GetDefaultTrashConfig()
+
+// MoveToTrash soft-deletes a file. Nothing is removed from storage until it's purged.
+func MoveToTrash(pgContext *pg.PostgresContext, fileId string, accountUUID string) error {
+	sqlStatement := `
+	UPDATE files SET deleted_at = now()
+	WHERE id = $1 AND account_uuid = $2 AND deleted_at IS NULL`
+	tag, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, fileId, accountUUID)
+	if err != nil {
+		return fmt.Errorf("error moving file %s to trash: %w", fileId, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrFileNotFound
+	}
+	return nil
+}
+
+func RestoreFromTrash(pgContext *pg.PostgresContext, fileId string, accountUUID string) error {
+	sqlStatement := `
+	UPDATE files SET deleted_at = NULL
+	WHERE id = $1 AND account_uuid = $2 AND deleted_at IS NOT NULL`
+	tag, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, fileId, accountUUID)
+	if err != nil {
+		return fmt.Errorf("error restoring file %s from trash: %w", fileId, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrFileNotFound
+	}
+	return nil
+}
+
+// PurgeFromTrash deletes a trashed file for good, ahead of the retention period
+func PurgeFromTrash(pgContext *pg.PostgresContext, filesystem Filesystem, fileId string, accountUUID string) error {
+	return FileObject{FileId: fileId, AccountUUID: accountUUID}.deleteTrashed(pgContext, filesystem)
+}
+
+// Purger hard-deletes files that have been in the trash longer than the retention period
+type Purger struct {
+	Config     TrashConfig
+	PGCtx      *pg.PostgresContext
+	Filesystem Filesystem
+}
+
+func NewPurger(pgContext *pg.PostgresContext, filesystem Filesystem, config TrashConfig) *Purger {
+	return &Purger{
+		Config:     config,
+		PGCtx:      pgContext,
+		Filesystem: filesystem,
+	}
+}
+
+// Run purges on every PurgeInterval until ctx is cancelled
+func (p *Purger) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Config.PurgeInterval)
+	defer ticker.Stop()
+	for {
+		purged, err := p.PurgeExpired(ctx)
+		if err != nil {
+			log.Printf("Trash purge: %v", err)
+		}
+		if purged > 0 {
+			log.Printf("Trash purge: removed %d files", purged)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeExpired deletes expired files in batches. A file whose storage can't be cleaned up stays in
+// the trash and is retried on the next run.
+func (p *Purger) PurgeExpired(ctx context.Context) (int, error) {
+	pgContext := &pg.PostgresContext{Pool: p.PGCtx.Pool, Ctx: ctx}
+	cutoff := time.Now().Add(-p.Config.Retention).UTC()
+
+	purged := 0
+	var errs []error
+	for {
+		sqlStatement := `
+		SELECT id, account_uuid FROM files
+		WHERE deleted_at IS NOT NULL AND deleted_at < $1
+		ORDER BY deleted_at
+		LIMIT $2`
+		rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, cutoff, p.Config.PurgeBatch)
+		if err != nil {
+			return purged, fmt.Errorf("error listing expired trash: %w", err)
+		}
+		var expired []FileObject
+		for rows.Next() {
+			var fo FileObject
+			if err := rows.Scan(&fo.FileId, &fo.AccountUUID); err != nil {
+				rows.Close()
+				return purged, fmt.Errorf("error scanning expired trash: %w", err)
+			}
+			expired = append(expired, fo)
+		}
+		rows.Close()
+
+		batchPurged := 0
+		for _, fo := range expired {
+			err := fo.deleteTrashed(pgContext, p.Filesystem)
+			if errors.Is(err, ErrFileNotFound) {
+				// restored since the batch was listed
+				continue
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("file %s: %w", fo.FileId, err))
+				continue
+			}
+			batchPurged++
+		}
+		purged += batchPurged
+		// a short batch is the last one; a batch with no progress would only fail the same way again
+		if len(expired) < p.Config.PurgeBatch || batchPurged == 0 {
+			return purged, errors.Join(errs...)
+		}
+	}
+}
+
+// Endpoints
+
+func FileDelete(hCtx HandlerContext) error {
+	fileId := hCtx.EchoCtx.QueryParam("file_id")
+
+	uuid, ok := hCtx.EchoCtx.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	// editors of a shared file can delete it too, which moves it to its owner's trash
+	fo, role, err := getAccessibleFileObject(hCtx.PGCtx, fileId, uuid)
+	if err != nil {
+		if !errors.Is(err, ErrFileNotFound) {
+			log.Printf("Failed to look up file %s for delete: %v", fileId, err)
+		}
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	if role == RoleViewer {
+		return echo.NewHTTPError(http.StatusForbidden, "Only the owner or an editor can delete this file")
+	}
+
+	err = MoveToTrash(hCtx.PGCtx, fileId, fo.AccountUUID)
+	if errors.Is(err, ErrFileNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	if err != nil {
+		log.Printf("Failed to delete file %s: %v", fileId, err)
+		return errorDiv(hCtx.EchoCtx, "Failed to delete file")
+	}
+	hCtx.EchoCtx.Response().Header().Set("HX-Trigger", "filesChanged")
+	return noticeDiv(hCtx.EchoCtx, "Moved file to trash")
+}
+
+func TrashRestore(hCtx HandlerContext) error {
+	fileId := hCtx.EchoCtx.QueryParam("file_id")
+
+	uuid, ok := hCtx.EchoCtx.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	err := RestoreFromTrash(hCtx.PGCtx, fileId, uuid)
+	if errors.Is(err, ErrFileNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	if err != nil {
+		log.Printf("Failed to restore file %s: %v", fileId, err)
+		return errorDiv(hCtx.EchoCtx, "Failed to restore file")
+	}
+	hCtx.EchoCtx.Response().Header().Set("HX-Trigger", "filesChanged")
+	return noticeDiv(hCtx.EchoCtx, "Restored file")
+}
+
+func TrashPurge(hCtx HandlerContext) error {
+	fileId := hCtx.EchoCtx.QueryParam("file_id")
+
+	uuid, ok := hCtx.EchoCtx.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	err := PurgeFromTrash(hCtx.PGCtx, filesystem, fileId, uuid)
+	if errors.Is(err, ErrFileNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	if err != nil {
+		log.Printf("Failed to purge file %s: %v", fileId, err)
+		return errorDiv(hCtx.EchoCtx, "Failed to delete file")
+	}
+	hCtx.EchoCtx.Response().Header().Set("HX-Trigger", "filesChanged")
+	return noticeDiv(hCtx.EchoCtx, "Deleted file permanently")
+}
+
+// AdminPurge hard-deletes any file immediately, in the trash or not, e.g. for a takedown
+func AdminPurge(hCtx HandlerContext) error {
+	fileId := hCtx.EchoCtx.QueryParam("file_id")
+	adminUUID, _ := hCtx.EchoCtx.Get("ID").(string)
+
+	err := FileObject{FileId: fileId}.Delete(hCtx.PGCtx, filesystem, hCtx.EchoCtx.QueryParam("force") == "true")
+	if errors.Is(err, ErrFileNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	if err != nil {
+		log.Printf("Admin %s failed to purge file %s: %v", adminUUID, fileId, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	log.Printf("Admin %s purged file %s", adminUUID, fileId)
+	return hCtx.EchoCtx.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	pg "goserve/postgres"
+	"testing"
+)
+
+func fileExists(t *testing.T, pgContext *pg.PostgresContext, fileId string) bool {
+	t.Helper()
+	var exists bool
+	sqlStatement := `SELECT EXISTS(SELECT 1 FROM files WHERE id = $1)`
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, fileId).Scan(&exists); err != nil {
+		t.Fatalf("loading file %s: %v", fileId, err)
+	}
+	return exists
+}
+
+func TestPurgeFromTrashOnlyDeletesTheAccountsTrashedFiles(t *testing.T) {
+	pgContext := newTestPG(t)
+	filesystem := newMemoryFilesystem("trash-test")
+	account := createTestAccount(t, pgContext, "trash@example.com")
+	other := createTestAccount(t, pgContext, "other-trash@example.com")
+	fileId := indexTestFile(t, pgContext, filesystem, account, "draft.txt")
+
+	if err := PurgeFromTrash(pgContext, filesystem, fileId, account); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("purging a file that isn't in the trash = %v, want ErrFileNotFound", err)
+	}
+	if err := MoveToTrash(pgContext, fileId, account); err != nil {
+		t.Fatalf("MoveToTrash: %v", err)
+	}
+	if err := PurgeFromTrash(pgContext, filesystem, fileId, other); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("purging another account's trashed file = %v, want ErrFileNotFound", err)
+	}
+	if !fileExists(t, pgContext, fileId) {
+		t.Fatal("a refused purge deleted the file")
+	}
+
+	if err := PurgeFromTrash(pgContext, filesystem, fileId, account); err != nil {
+		t.Fatalf("PurgeFromTrash: %v", err)
+	}
+	if fileExists(t, pgContext, fileId) {
+		t.Error("the purged file is still there")
+	}
+}
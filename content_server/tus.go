@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+)
+
+// Resumable uploads over tus 1.0 (https://tus.io/protocols/resumable-upload), with the creation,
+// termination and expiration extensions. Received bytes are stored as parts in the storage backend
+// as they arrive, so a dropped connection only loses the part in flight. Once the last byte is in,
+// the parts are read back in order and saved like any other upload.
+
+const tusVersion = "1.0.0"
+
+var (
+	ErrTusUploadNotFound  = errors.New("upload not found or expired")
+	ErrTusOffsetConflict  = errors.New("upload offset doesn't match")
+	ErrTusInvalidMetadata = errors.New("invalid Upload-Metadata")
+)
+
+type TusConfig struct {
+	// How long an unfinished upload is kept after its last PATCH
+	Expiry time.Duration
+	// A PATCH body is stored in parts of at most this size, the most a dropped connection can lose
+	PartSize        int64
+	CleanupInterval time.Duration
+}
+
+func GetDefaultTusConfig() TusConfig {
+	hours, err := strconv.Atoi(os.Getenv("TUS_EXPIRY_HOURS"))
+	if err != nil || hours <= 0 {
+		hours = 24
+	}
+	return TusConfig{
+		Expiry:          time.Duration(hours) * time.Hour,
+		PartSize:        8 << 20,
+		CleanupInterval: time.Hour,
+	}
+}
+
+var tusConfig = GetDefaultTusConfig()
+
+type TusUpload struct {
+	Id          string
+	AccountUUID string
+	Filename    string
+	RawText     string
+	Length      int64
+	Offset      int64
+	Location    string
+	ExpiresAt   time.Time
+}
+
+type tusPart struct {
+	Offset int64
+	Size   int64
+	Key    string
+}
+
+// parseTusMetadata reads Upload-Metadata: comma-separated "key base64value" pairs, the value optional
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrTusInvalidMetadata, key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func createTusUpload(pgContext *pg.PostgresContext, upload *TusUpload) error {
+	upload.ExpiresAt = time.Now().Add(tusConfig.Expiry).UTC()
+	sqlStatement := `
+	INSERT INTO tus_uploads (account_uuid, filename, raw_text, length, location, expires_at)
+	VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6)
+	RETURNING id`
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, upload.AccountUUID, upload.Filename, upload.RawText,
+		upload.Length, upload.Location, upload.ExpiresAt).Scan(&upload.Id)
+	if err != nil {
+		return fmt.Errorf("error creating upload: %w", err)
+	}
+	return nil
+}
+
+func getTusUpload(pgContext *pg.PostgresContext, uploadId string, accountUUID string) (TusUpload, error) {
+	upload := TusUpload{Id: uploadId, AccountUUID: accountUUID}
+	sqlStatement := `
+	SELECT filename, COALESCE(raw_text, ''), length, "offset", location, expires_at
+	FROM tus_uploads
+	WHERE id = $1 AND account_uuid = $2 AND expires_at > now()`
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, uploadId, accountUUID).Scan(
+		&upload.Filename, &upload.RawText, &upload.Length, &upload.Offset, &upload.Location, &upload.ExpiresAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return upload, ErrTusUploadNotFound
+	}
+	if err != nil {
+		// a malformed id fails uuid parsing in postgres, which is just another unknown upload
+		log.Printf("Failed to load upload %s: %v", uploadId, err)
+		return upload, ErrTusUploadNotFound
+	}
+	return upload, nil
+}
+
+func listTusParts(pgContext *pg.PostgresContext, uploadId string) ([]tusPart, error) {
+	sqlStatement := `SELECT "offset", size, storage_key FROM tus_upload_parts WHERE upload_id = $1 ORDER BY "offset"`
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, uploadId)
+	if err != nil {
+		return nil, fmt.Errorf("error listing parts of upload %s: %w", uploadId, err)
+	}
+	defer rows.Close()
+
+	var parts []tusPart
+	for rows.Next() {
+		var part tusPart
+		if err := rows.Scan(&part.Offset, &part.Size, &part.Key); err != nil {
+			return nil, fmt.Errorf("error scanning upload part: %w", err)
+		}
+		parts = append(parts, part)
+	}
+	return parts, rows.Err()
+}
+
+// appendParts stores body from the upload's current offset, a part at a time. Each part is committed
+// as soon as it's stored, so the offset a client resumes from is everything up to the last whole part.
+// Returns the last part written, which completion undoes if saving the finished file fails.
+func (u *TusUpload) appendParts(pgContext *pg.PostgresContext, body io.Reader) (*tusPart, error) {
+	filesystem, err := getFilesystem(u.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(body)
+	var last *tusPart
+	for u.Offset < u.Length {
+		if _, err := reader.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			return last, err
+		}
+
+		part := tusPart{Offset: u.Offset, Key: path.Join("tus", u.Id, uuid.New().String())}
+		counter := &sizeLimitReader{Reader: io.LimitReader(reader, min(tusConfig.PartSize, u.Length-u.Offset)), Limit: maxUploadBytes}
+		if err := filesystem.Write(counter, part.Key); err != nil {
+			return last, err
+		}
+		part.Size = counter.N
+
+		if err := u.commitPart(pgContext, part); err != nil {
+			if delErr := filesystem.Delete(part.Key); delErr != nil {
+				log.Printf("Failed to remove rejected upload part %s: %v", part.Key, delErr)
+			}
+			return last, err
+		}
+		u.Offset += part.Size
+		last = &part
+	}
+	return last, nil
+}
+
+// commitPart records a stored part and moves the offset past it. Two PATCHes racing from the same
+// offset both store their part, but only one can move the offset; the other gets a conflict.
+func (u *TusUpload) commitPart(pgContext *pg.PostgresContext, part tusPart) error {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	sqlStatement := `
+	UPDATE tus_uploads SET "offset" = "offset" + $3, expires_at = $4
+	WHERE id = $1 AND "offset" = $2 AND expires_at > now()`
+	tag, err := tx.Exec(pgContext.Ctx, sqlStatement, u.Id, part.Offset, part.Size, time.Now().Add(tusConfig.Expiry).UTC())
+	if err != nil {
+		return fmt.Errorf("error advancing upload %s: %w", u.Id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTusOffsetConflict
+	}
+	partSql := `INSERT INTO tus_upload_parts (upload_id, "offset", size, storage_key) VALUES ($1, $2, $3, $4)`
+	if _, err := tx.Exec(pgContext.Ctx, partSql, u.Id, part.Offset, part.Size, part.Key); err != nil {
+		return fmt.Errorf("error recording upload part: %w", err)
+	}
+	return tx.Commit(pgContext.Ctx)
+}
+
+// undoPart takes the last part back off, so the client can send it again
+func (u *TusUpload) undoPart(pgContext *pg.PostgresContext, part tusPart) error {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	if _, err := tx.Exec(pgContext.Ctx, `DELETE FROM tus_upload_parts WHERE upload_id = $1 AND "offset" = $2`, u.Id, part.Offset); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(pgContext.Ctx, `UPDATE tus_uploads SET "offset" = $2 WHERE id = $1`, u.Id, part.Offset); err != nil {
+		return err
+	}
+	if err := tx.Commit(pgContext.Ctx); err != nil {
+		return err
+	}
+	u.Offset = part.Offset
+	if filesystem, err := getFilesystem(u.Location); err == nil {
+		return filesystem.Delete(part.Key)
+	}
+	return nil
+}
+
+// complete saves the finished upload as a file, then removes its parts
+func (u *TusUpload) complete(pgContext *pg.PostgresContext) error {
+	parts, err := listTusParts(pgContext, u.Id)
+	if err != nil {
+		return err
+	}
+	partsFilesystem, err := getFilesystem(u.Location)
+	if err != nil {
+		return err
+	}
+
+	err = SaveFile(pgContext, filesystem, FileInput{
+		Filename:    u.Filename,
+		AccountUUID: u.AccountUUID,
+		RawText:     u.RawText,
+		File:        &tusPartsReader{Filesystem: partsFilesystem, Parts: parts},
+	})
+	if err != nil {
+		return err
+	}
+	if err := deleteTusUpload(pgContext, u.Id); err != nil {
+		// the file is saved, leftover parts are cleaned up when the upload expires
+		log.Printf("Failed to remove parts of completed upload %s: %v", u.Id, err)
+	}
+	return nil
+}
+
+// tusPartsReader reads an upload's parts back as one stream, opening each only when it's reached
+type tusPartsReader struct {
+	Filesystem Filesystem
+	Parts      []tusPart
+	current    io.ReadCloser
+}
+
+func (r *tusPartsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.Parts) == 0 {
+				return 0, io.EOF
+			}
+			part, err := r.Filesystem.Read(r.Parts[0].Key)
+			if err != nil {
+				return 0, fmt.Errorf("error reading upload part %s: %w", r.Parts[0].Key, err)
+			}
+			r.current = part
+			r.Parts = r.Parts[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// deleteTusUpload removes an upload's stored parts and then its rows.
+// A part that can't be deleted keeps the rows around so the next cleanup tries again.
+func deleteTusUpload(pgContext *pg.PostgresContext, uploadId string) error {
+	var location string
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, `SELECT location FROM tus_uploads WHERE id = $1`, uploadId).Scan(&location)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrTusUploadNotFound
+	}
+	if err != nil {
+		return err
+	}
+	parts, err := listTusParts(pgContext, uploadId)
+	if err != nil {
+		return err
+	}
+	filesystem, err := getFilesystem(location)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, part := range parts {
+		if err := filesystem.Delete(part.Key); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	_, err = pgContext.Pool.Exec(pgContext.Ctx, `DELETE FROM tus_uploads WHERE id = $1`, uploadId)
+	return err
+}
+
+// TusCleaner removes uploads that were never finished once they expire
+type TusCleaner struct {
+	Config TusConfig
+	PGCtx  *pg.PostgresContext
+}
+
+func NewTusCleaner(pgContext *pg.PostgresContext, config TusConfig) *TusCleaner {
+	return &TusCleaner{
+		Config: config,
+		PGCtx:  pgContext,
+	}
+}
+
+// Run cleans up on every CleanupInterval until ctx is cancelled
+func (t *TusCleaner) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.Config.CleanupInterval)
+	defer ticker.Stop()
+	for {
+		removed, err := t.CleanupExpired(ctx)
+		if err != nil {
+			log.Printf("Upload cleanup: %v", err)
+		}
+		if removed > 0 {
+			log.Printf("Upload cleanup: removed %d expired uploads", removed)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *TusCleaner) CleanupExpired(ctx context.Context) (int, error) {
+	pgContext := &pg.PostgresContext{Pool: t.PGCtx.Pool, Ctx: ctx}
+	rows, err := pgContext.Pool.Query(ctx, `SELECT id FROM tus_uploads WHERE expires_at <= now()`)
+	if err != nil {
+		return 0, fmt.Errorf("error listing expired uploads: %w", err)
+	}
+	var uploadIds []string
+	for rows.Next() {
+		var uploadId string
+		if err := rows.Scan(&uploadId); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error scanning expired upload: %w", err)
+		}
+		uploadIds = append(uploadIds, uploadId)
+	}
+	rows.Close()
+
+	removed := 0
+	var errs []error
+	for _, uploadId := range uploadIds {
+		if err := deleteTusUpload(pgContext, uploadId); err != nil {
+			errs = append(errs, fmt.Errorf("upload %s: %w", uploadId, err))
+			continue
+		}
+		removed++
+	}
+	return removed, errors.Join(errs...)
+}
+
+// Endpoints
+// tus clients aren't HTMX, so failures are plain text with the status the protocol expects
+
+func tusHeaders(c echo.Context) {
+	c.Response().Header().Set("Tus-Resumable", tusVersion)
+	c.Response().Header().Set("Cache-Control", "no-store")
+}
+
+// tusCheckVersion rejects requests from clients speaking another protocol version
+func tusCheckVersion(c echo.Context) error {
+	tusHeaders(c)
+	if c.Request().Header.Get("Tus-Resumable") != tusVersion {
+		c.Response().Header().Set("Tus-Version", tusVersion)
+		return c.String(http.StatusPreconditionFailed, "Unsupported tus version")
+	}
+	return nil
+}
+
+func TusOptions(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	tusHeaders(c)
+	c.Response().Header().Set("Tus-Version", tusVersion)
+	c.Response().Header().Set("Tus-Extension", "creation,termination,expiration")
+	c.Response().Header().Set("Tus-Max-Size", strconv.FormatInt(maxUploadBytes, 10))
+	return c.NoContent(http.StatusNoContent)
+}
+
+func TusCreate(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	if err := tusCheckVersion(c); err != nil {
+		return err
+	}
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	length, err := strconv.ParseInt(c.Request().Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		// deferred lengths aren't supported
+		return c.String(http.StatusBadRequest, "Upload-Length is required")
+	}
+	if length > maxUploadBytes {
+		return c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("File is larger than the %d MB upload limit", maxUploadBytes>>20))
+	}
+	metadata, err := parseTusMetadata(c.Request().Header.Get("Upload-Metadata"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	filename = path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if _, err := getFileExt(filename); err != nil {
+		return c.String(http.StatusBadRequest, "Upload-Metadata needs a filename with an extension")
+	}
+
+	// refuse up front rather than after the whole file has been sent
+	quota, err := getQuota(hCtx.PGCtx, uuid)
+	if err != nil {
+		log.Printf("Failed to check quota for upload: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to create upload")
+	}
+	if !quota.Unlimited() && length > quota.Remaining() {
+		return c.String(http.StatusRequestEntityTooLarge, quotaExceededMessage(hCtx.PGCtx, uuid))
+	}
+
+	upload := TusUpload{
+		AccountUUID: uuid,
+		Filename:    filename,
+		RawText:     metadata["raw_text"],
+		Length:      length,
+		Location:    filesystem.GetLocation(),
+	}
+	if err := createTusUpload(hCtx.PGCtx, &upload); err != nil {
+		log.Printf("Failed to create upload: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to create upload")
+	}
+	c.Response().Header().Set("Location", fmt.Sprintf("/app/files/tus/%s/", upload.Id))
+	c.Response().Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+	return c.NoContent(http.StatusCreated)
+}
+
+func TusHead(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	if err := tusCheckVersion(c); err != nil {
+		return err
+	}
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	upload, err := getTusUpload(hCtx.PGCtx, c.Param("id"), uuid)
+	if err != nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	c.Response().Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Response().Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Response().Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+	return c.NoContent(http.StatusOK)
+}
+
+func TusPatch(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	if err := tusCheckVersion(c); err != nil {
+		return err
+	}
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+	if c.Request().Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return c.String(http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+	}
+	offset, err := strconv.ParseInt(c.Request().Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Upload-Offset is required")
+	}
+
+	upload, err := getTusUpload(hCtx.PGCtx, c.Param("id"), uuid)
+	if err != nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if offset != upload.Offset {
+		return c.String(http.StatusConflict, ErrTusOffsetConflict.Error())
+	}
+
+	last, err := upload.appendParts(hCtx.PGCtx, c.Request().Body)
+	if errors.Is(err, ErrTusOffsetConflict) {
+		return c.String(http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		// whatever was committed before the connection dropped is kept, the client resumes from there
+		log.Printf("Upload %s interrupted at offset %d: %v", upload.Id, upload.Offset, err)
+		return c.String(http.StatusInternalServerError, "Upload interrupted")
+	}
+
+	if upload.Offset == upload.Length {
+		if err := upload.complete(hCtx.PGCtx); err != nil {
+			log.Printf("Failed to save completed upload %s: %v", upload.Id, err)
+			// the last part is taken back so the client can retry it, and the upload doesn't look finished
+			if last != nil {
+				if undoErr := upload.undoPart(hCtx.PGCtx, *last); undoErr != nil {
+					log.Printf("Failed to undo last part of upload %s: %v", upload.Id, undoErr)
+				}
+			}
+			switch {
+			case errors.Is(err, ErrQuotaExceeded):
+				return c.String(http.StatusRequestEntityTooLarge, quotaExceededMessage(hCtx.PGCtx, uuid))
+			case errors.Is(err, ErrFileTooLarge):
+				return c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("File is larger than the %d MB upload limit", maxUploadBytes>>20))
+			}
+			return c.String(http.StatusInternalServerError, "Failed to save upload")
+		}
+	}
+	c.Response().Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Response().Header().Set("Upload-Expires", time.Now().Add(tusConfig.Expiry).UTC().Format(http.TimeFormat))
+	return c.NoContent(http.StatusNoContent)
+}
+
+func TusDelete(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	if err := tusCheckVersion(c); err != nil {
+		return err
+	}
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	upload, err := getTusUpload(hCtx.PGCtx, c.Param("id"), uuid)
+	if err != nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if err := deleteTusUpload(hCtx.PGCtx, upload.Id); err != nil {
+		log.Printf("Failed to terminate upload %s: %v", upload.Id, err)
+		return c.String(http.StatusInternalServerError, "Failed to terminate upload")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,852 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+)
+
+// Accounts can opt in to a second factor: TOTP codes (RFC 6238) from an authenticator app, with
+// one-time recovery codes for when the app is lost. With it on, a correct password only gets as far
+// as a login challenge, and the session starts once a code checks out.
+
+var (
+	ErrTwoFactorEnabled      = errors.New("two-factor authentication is already on")
+	ErrTwoFactorNotPending   = errors.New("two-factor setup hasn't been started")
+	ErrTwoFactorNotEnabled   = errors.New("two-factor authentication isn't on")
+	ErrInvalidTwoFactorCode  = errors.New("invalid two-factor code")
+	ErrLoginChallengeExpired = errors.New("login challenge is invalid or has expired")
+	ErrTwoFactorLocked       = errors.New("too many wrong two-factor codes, try again later")
+)
+
+const (
+	totpIssuer = "GoServe"
+	totpDigits = 6
+	totpPeriod = 30
+	// codes from this many steps either side of now are accepted, for clock drift
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	loginChallengeCookie   = "login_challenge"
+	loginChallengeTTL      = 5 * time.Minute
+	loginChallengeAttempts = 5
+
+	// wrong codes are counted per account too, so starting new login challenges doesn't buy more
+	// guesses. Past twoFactorFreeFailures in a row, codes are refused for a while.
+	twoFactorFreeFailures = 10
+	twoFactorBaseLockout  = time.Minute
+	twoFactorMaxLockout   = time.Hour
+)
+
+const twoFactorLockedMessage = "Too many invalid codes. Wait a few minutes and try again."
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode is the HOTP value (RFC 4226) for a time step
+func totpCode(secret []byte, step int64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// matchTOTP returns the step code is valid for, only accepting steps after lastStep so a code
+// can't be replayed
+func matchTOTP(secret []byte, code string, now time.Time, lastStep int64) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(code), []byte(totpCode(secret, step))) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is what the setup QR code encodes, in the format authenticator apps read
+func totpURI(email string, secret []byte) string {
+	query := url.Values{
+		"secret":    {totpEncoding.EncodeToString(secret)},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	label := url.PathEscape(totpIssuer + ":" + email)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// sealTOTPSecret encrypts a secret under the current ENCRYPTION_KEYS key, returning the key id,
+// or stores it as is when encryption isn't configured
+func sealTOTPSecret(secret []byte) ([]byte, *string, error) {
+	if encryptionKeys == nil {
+		return secret, nil, nil
+	}
+	id := encryptionKeys.Current
+	sealed, err := encryptionKeys.wrap(id, secret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error sealing two-factor secret: %w", err)
+	}
+	return sealed, &id, nil
+}
+
+func openTOTPSecret(stored []byte, keyId *string) ([]byte, error) {
+	if keyId == nil {
+		return stored, nil
+	}
+	if encryptionKeys == nil {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, *keyId)
+	}
+	return encryptionKeys.unwrap(*keyId, stored)
+}
+
+// newRecoveryCode is 50 random bits, written as two groups of five base32 characters
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating recovery code: %w", err)
+	}
+	code := strings.ToLower(totpEncoding.EncodeToString(b))
+	return code[:5] + "-" + code[5:], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
+
+func isTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func twoFactorEnabled(pgContext *pg.PostgresContext, accountUUID string) (bool, error) {
+	var enabled bool
+	sqlStatement := `SELECT EXISTS (SELECT 1 FROM two_factor WHERE account_uuid = $1 AND enabled_at IS NOT NULL)`
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, accountUUID).Scan(&enabled); err != nil {
+		return false, fmt.Errorf("error checking two-factor for account %s: %w", accountUUID, err)
+	}
+	return enabled, nil
+}
+
+// TwoFactorView is what the two-factor panel shows: setup in progress, freshly made recovery codes,
+// or the current status
+type TwoFactorView struct {
+	Enabled           bool
+	EnabledAt         time.Time
+	RecoveryCodesLeft int
+	SetupKey          string
+	SetupURI          string
+	RecoveryCodes     []string
+	Error             string
+}
+
+func getTwoFactorView(pgContext *pg.PostgresContext, accountUUID string) (TwoFactorView, error) {
+	var view TwoFactorView
+	var enabledAt *time.Time
+	sqlStatement := `
+	SELECT t.enabled_at,
+		(SELECT COUNT(*) FROM recovery_codes r WHERE r.account_uuid = $1 AND r.used_at IS NULL)
+	FROM users u LEFT JOIN two_factor t ON t.account_uuid = u.id
+	WHERE u.id = $1`
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, accountUUID).Scan(&enabledAt, &view.RecoveryCodesLeft)
+	if err != nil {
+		return view, fmt.Errorf("error loading two-factor status for account %s: %w", accountUUID, err)
+	}
+	if enabledAt != nil {
+		view.Enabled = true
+		view.EnabledAt = *enabledAt
+	}
+	return view, nil
+}
+
+// getSetupView loads the secret of a setup in progress for the QR code
+func getSetupView(pgContext *pg.PostgresContext, accountUUID string) (TwoFactorView, error) {
+	var view TwoFactorView
+	var email string
+	var stored []byte
+	var keyId *string
+	sqlStatement := `
+	SELECT u.email, t.secret, t.key_id FROM two_factor t JOIN users u ON u.id = t.account_uuid
+	WHERE t.account_uuid = $1 AND t.enabled_at IS NULL`
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, accountUUID).Scan(&email, &stored, &keyId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return view, ErrTwoFactorNotPending
+	}
+	if err != nil {
+		return view, fmt.Errorf("error loading two-factor setup for account %s: %w", accountUUID, err)
+	}
+	secret, err := openTOTPSecret(stored, keyId)
+	if err != nil {
+		return view, err
+	}
+	view.SetupKey = totpEncoding.EncodeToString(secret)
+	view.SetupURI = totpURI(email, secret)
+	return view, nil
+}
+
+// beginTwoFactorSetup makes a new secret for the account to scan, replacing any earlier setup that
+// wasn't finished
+func beginTwoFactorSetup(pgContext *pg.PostgresContext, accountUUID string) error {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return fmt.Errorf("error generating two-factor secret: %w", err)
+	}
+	sealed, keyId, err := sealTOTPSecret(secret)
+	if err != nil {
+		return err
+	}
+	sqlStatement := `
+	INSERT INTO two_factor (account_uuid, secret, key_id) VALUES ($1, $2, $3)
+	ON CONFLICT (account_uuid) DO UPDATE SET secret = $2, key_id = $3, created_at = now(), last_step = 0
+	WHERE two_factor.enabled_at IS NULL`
+	tag, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, accountUUID, sealed, keyId)
+	if err != nil {
+		return fmt.Errorf("error storing two-factor secret: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// replaceRecoveryCodesTx swaps the account's recovery codes for a new set, returned in the clear
+// this once
+func replaceRecoveryCodesTx(pgContext *pg.PostgresContext, tx pgx.Tx, accountUUID string) ([]string, error) {
+	if _, err := tx.Exec(pgContext.Ctx, `DELETE FROM recovery_codes WHERE account_uuid = $1`, accountUUID); err != nil {
+		return nil, fmt.Errorf("error clearing recovery codes: %w", err)
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for len(codes) < recoveryCodeCount {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		sqlStatement := `INSERT INTO recovery_codes (account_uuid, code_hash) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+		tag, err := tx.Exec(pgContext.Ctx, sqlStatement, accountUUID, hashOpaqueToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, fmt.Errorf("error storing recovery code: %w", err)
+		}
+		if tag.RowsAffected() == 1 {
+			codes = append(codes, code)
+		}
+	}
+	return codes, nil
+}
+
+// enableTwoFactor turns two-factor on once the first code from the app checks out, and makes the
+// recovery codes
+func enableTwoFactor(pgContext *pg.PostgresContext, accountUUID string, code string) ([]string, error) {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	var stored []byte
+	var keyId *string
+	sqlStatement := `SELECT secret, key_id FROM two_factor WHERE account_uuid = $1 AND enabled_at IS NULL FOR UPDATE`
+	err = tx.QueryRow(pgContext.Ctx, sqlStatement, accountUUID).Scan(&stored, &keyId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrTwoFactorNotPending
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading two-factor setup: %w", err)
+	}
+	secret, err := openTOTPSecret(stored, keyId)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	step, ok := matchTOTP(secret, strings.TrimSpace(code), now, 0)
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	sqlStatement = `UPDATE two_factor SET enabled_at = $2, last_step = $3 WHERE account_uuid = $1`
+	if _, err := tx.Exec(pgContext.Ctx, sqlStatement, accountUUID, now, step); err != nil {
+		return nil, fmt.Errorf("error enabling two-factor: %w", err)
+	}
+	codes, err := replaceRecoveryCodesTx(pgContext, tx, accountUUID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(pgContext.Ctx); err != nil {
+		return nil, fmt.Errorf("error committing two-factor setup: %w", err)
+	}
+	return codes, nil
+}
+
+// twoFactorLockout is how long codes are refused after failures wrong ones in a row: nothing for
+// the first few, then doubling up to twoFactorMaxLockout
+func twoFactorLockout(failures int) time.Duration {
+	if failures < twoFactorFreeFailures {
+		return 0
+	}
+	wait := twoFactorBaseLockout
+	for i := twoFactorFreeFailures; i < failures && wait < twoFactorMaxLockout; i++ {
+		wait *= 2
+	}
+	return min(wait, twoFactorMaxLockout)
+}
+
+// checkSecondFactorTx accepts either a current TOTP code or an unused recovery code, using it up.
+// A wrong code counts towards the account's lockout, which callers must commit.
+func checkSecondFactorTx(pgContext *pg.PostgresContext, tx pgx.Tx, accountUUID string, code string) error {
+	code = strings.TrimSpace(code)
+	now := time.Now().UTC()
+
+	var stored []byte
+	var keyId *string
+	var lastStep int64
+	var failures int
+	var lockedUntil *time.Time
+	sqlStatement := `
+	SELECT secret, key_id, last_step, failed_attempts, locked_until FROM two_factor
+	WHERE account_uuid = $1 AND enabled_at IS NOT NULL FOR UPDATE`
+	err := tx.QueryRow(pgContext.Ctx, sqlStatement, accountUUID).Scan(&stored, &keyId, &lastStep, &failures, &lockedUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrTwoFactorNotEnabled
+	}
+	if err != nil {
+		return fmt.Errorf("error loading two-factor secret: %w", err)
+	}
+	if lockedUntil != nil && now.Before(*lockedUntil) {
+		return ErrTwoFactorLocked
+	}
+
+	matched := false
+	if isTOTPCode(code) {
+		secret, err := openTOTPSecret(stored, keyId)
+		if err != nil {
+			return err
+		}
+		step, ok := matchTOTP(secret, code, now, lastStep)
+		if ok {
+			sqlStatement = `UPDATE two_factor SET last_step = $2 WHERE account_uuid = $1`
+			if _, err := tx.Exec(pgContext.Ctx, sqlStatement, accountUUID, step); err != nil {
+				return fmt.Errorf("error recording two-factor code: %w", err)
+			}
+		}
+		matched = ok
+	} else {
+		sqlStatement = `
+		UPDATE recovery_codes SET used_at = $3
+		WHERE account_uuid = $1 AND code_hash = $2 AND used_at IS NULL`
+		tag, err := tx.Exec(pgContext.Ctx, sqlStatement, accountUUID, hashOpaqueToken(normalizeRecoveryCode(code)), now)
+		if err != nil {
+			return fmt.Errorf("error using recovery code: %w", err)
+		}
+		matched = tag.RowsAffected() == 1
+	}
+
+	if !matched {
+		failures++
+		var until *time.Time
+		if wait := twoFactorLockout(failures); wait > 0 {
+			lockEnd := now.Add(wait)
+			until = &lockEnd
+		}
+		sqlStatement = `UPDATE two_factor SET failed_attempts = $2, locked_until = $3 WHERE account_uuid = $1`
+		if _, err := tx.Exec(pgContext.Ctx, sqlStatement, accountUUID, failures, until); err != nil {
+			return fmt.Errorf("error recording wrong two-factor code: %w", err)
+		}
+		return ErrInvalidTwoFactorCode
+	}
+	if failures > 0 {
+		sqlStatement = `UPDATE two_factor SET failed_attempts = 0, locked_until = NULL WHERE account_uuid = $1`
+		if _, err := tx.Exec(pgContext.Ctx, sqlStatement, accountUUID); err != nil {
+			return fmt.Errorf("error clearing two-factor failures: %w", err)
+		}
+	}
+	return nil
+}
+
+// regenerateRecoveryCodes replaces the recovery codes, after a code proves it's the account owner
+func regenerateRecoveryCodes(pgContext *pg.PostgresContext, accountUUID string, code string) ([]string, error) {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	if err := checkSecondFactorTx(pgContext, tx, accountUUID, code); err != nil {
+		return nil, commitWrongCode(pgContext, tx, err)
+	}
+	codes, err := replaceRecoveryCodesTx(pgContext, tx, accountUUID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(pgContext.Ctx); err != nil {
+		return nil, fmt.Errorf("error committing recovery codes: %w", err)
+	}
+	return codes, nil
+}
+
+// disableTwoFactor turns two-factor off, after a code proves it's the account owner
+func disableTwoFactor(pgContext *pg.PostgresContext, accountUUID string, code string) error {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	if err := checkSecondFactorTx(pgContext, tx, accountUUID, code); err != nil {
+		return commitWrongCode(pgContext, tx, err)
+	}
+	if err := clearTwoFactorTx(pgContext, tx, accountUUID); err != nil {
+		return err
+	}
+	if err := tx.Commit(pgContext.Ctx); err != nil {
+		return fmt.Errorf("error committing two-factor removal: %w", err)
+	}
+	return nil
+}
+
+// commitWrongCode keeps the failure checkSecondFactorTx counted for a wrong code, and returns its
+// error either way
+func commitWrongCode(pgContext *pg.PostgresContext, tx pgx.Tx, err error) error {
+	if !errors.Is(err, ErrInvalidTwoFactorCode) {
+		return err
+	}
+	if commitErr := tx.Commit(pgContext.Ctx); commitErr != nil {
+		return fmt.Errorf("error recording wrong two-factor code: %w", commitErr)
+	}
+	return err
+}
+
+// resetTwoFactor turns two-factor off for an account locked out of it. Returns false if it wasn't on.
+func resetTwoFactor(pgContext *pg.PostgresContext, accountUUID string) (bool, error) {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return false, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	var enabled bool
+	sqlStatement := `SELECT EXISTS (SELECT 1 FROM two_factor WHERE account_uuid = $1 AND enabled_at IS NOT NULL)`
+	if err := tx.QueryRow(pgContext.Ctx, sqlStatement, accountUUID).Scan(&enabled); err != nil {
+		return false, fmt.Errorf("error checking two-factor for account %s: %w", accountUUID, err)
+	}
+	if !enabled {
+		return false, nil
+	}
+	if err := clearTwoFactorTx(pgContext, tx, accountUUID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(pgContext.Ctx); err != nil {
+		return false, fmt.Errorf("error committing two-factor reset: %w", err)
+	}
+	return true, nil
+}
+
+func clearTwoFactorTx(pgContext *pg.PostgresContext, tx pgx.Tx, accountUUID string) error {
+	for _, sqlStatement := range []string{
+		`DELETE FROM two_factor WHERE account_uuid = $1`,
+		`DELETE FROM recovery_codes WHERE account_uuid = $1`,
+		`DELETE FROM login_challenges WHERE account_uuid = $1`,
+	} {
+		if _, err := tx.Exec(pgContext.Ctx, sqlStatement, accountUUID); err != nil {
+			return fmt.Errorf("error clearing two-factor for account %s: %w", accountUUID, err)
+		}
+	}
+	return nil
+}
+
+// resealTwoFactorSecrets moves secrets onto the current ENCRYPTION_KEYS key, and encrypts ones
+// stored before encryption was turned on. Returns how many it changed, or would change.
+func resealTwoFactorSecrets(pgContext *pg.PostgresContext, dryRun bool) (int, error) {
+	if encryptionKeys == nil {
+		return 0, nil
+	}
+	type storedSecret struct {
+		accountUUID string
+		secret      []byte
+		keyId       *string
+	}
+	var stale []storedSecret
+	sqlStatement := `SELECT account_uuid, secret, key_id FROM two_factor WHERE key_id IS DISTINCT FROM $1`
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, encryptionKeys.Current)
+	if err != nil {
+		return 0, fmt.Errorf("error listing two-factor secrets: %w", err)
+	}
+	for rows.Next() {
+		var s storedSecret
+		if err := rows.Scan(&s.accountUUID, &s.secret, &s.keyId); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error reading two-factor secret: %w", err)
+		}
+		stale = append(stale, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error listing two-factor secrets: %w", err)
+	}
+	if dryRun {
+		return len(stale), nil
+	}
+
+	for i, s := range stale {
+		secret, err := openTOTPSecret(s.secret, s.keyId)
+		if err != nil {
+			return i, fmt.Errorf("two-factor secret of account %s: %w", s.accountUUID, err)
+		}
+		sealed, keyId, err := sealTOTPSecret(secret)
+		if err != nil {
+			return i, err
+		}
+		sqlStatement := `UPDATE two_factor SET secret = $2, key_id = $3 WHERE account_uuid = $1`
+		if _, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, s.accountUUID, sealed, keyId); err != nil {
+			return i, fmt.Errorf("error resealing two-factor secret of account %s: %w", s.accountUUID, err)
+		}
+	}
+	return len(stale), nil
+}
+
+// startLoginChallenge holds a login with a correct password until a code is sent
+func startLoginChallenge(pgContext *pg.PostgresContext, c echo.Context, accountUUID string) error {
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	expiry := now.Add(loginChallengeTTL)
+
+	sqlStatement := `DELETE FROM login_challenges WHERE expires_at < $1`
+	if _, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, now); err != nil {
+		return fmt.Errorf("error clearing expired login challenges: %w", err)
+	}
+	sqlStatement = `INSERT INTO login_challenges (token_hash, account_uuid, created_at, expires_at) VALUES ($1, $2, $3, $4)`
+	if _, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, tokenHash, accountUUID, now, expiry); err != nil {
+		return fmt.Errorf("error storing login challenge: %w", err)
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     loginChallengeCookie,
+		Value:    token,
+		Expires:  expiry,
+		HttpOnly: true,
+		Path:     "/login",
+		Secure:   false, // Set to true if using HTTPS, recommended for security
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+func checkLoginChallenge(pgContext *pg.PostgresContext, token string) bool {
+	var valid bool
+	sqlStatement := `
+	SELECT EXISTS (SELECT 1 FROM login_challenges WHERE token_hash = $1 AND expires_at > $2 AND attempts < $3)`
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, hashOpaqueToken(token), time.Now().UTC(), loginChallengeAttempts).Scan(&valid)
+	if err != nil {
+		log.Printf("Failed to check login challenge: %v", err)
+		return false
+	}
+	return valid
+}
+
+// completeLoginChallenge checks the code for a login challenge, returning the account to start a
+// session for. A challenge allows loginChallengeAttempts codes, after which the password has to be
+// entered again.
+func completeLoginChallenge(pgContext *pg.PostgresContext, token string, code string) (string, error) {
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return "", fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	tokenHash := hashOpaqueToken(token)
+	var accountUUID string
+	var attempts int
+	sqlStatement := `
+	SELECT account_uuid, attempts FROM login_challenges
+	WHERE token_hash = $1 AND expires_at > $2 FOR UPDATE`
+	err = tx.QueryRow(pgContext.Ctx, sqlStatement, tokenHash, time.Now().UTC()).Scan(&accountUUID, &attempts)
+	if errors.Is(err, pgx.ErrNoRows) || attempts >= loginChallengeAttempts {
+		return "", ErrLoginChallengeExpired
+	}
+	if err != nil {
+		return "", fmt.Errorf("error loading login challenge: %w", err)
+	}
+
+	err = checkSecondFactorTx(pgContext, tx, accountUUID, code)
+	if errors.Is(err, ErrInvalidTwoFactorCode) {
+		sqlStatement = `UPDATE login_challenges SET attempts = attempts + 1 WHERE token_hash = $1`
+		if _, err := tx.Exec(pgContext.Ctx, sqlStatement, tokenHash); err != nil {
+			return "", fmt.Errorf("error recording login attempt: %w", err)
+		}
+		if err := tx.Commit(pgContext.Ctx); err != nil {
+			return "", fmt.Errorf("error committing login attempt: %w", err)
+		}
+		return "", ErrInvalidTwoFactorCode
+	}
+	if errors.Is(err, ErrTwoFactorNotEnabled) {
+		// reset by an admin since the password was entered
+		return "", ErrLoginChallengeExpired
+	}
+	if errors.Is(err, ErrTwoFactorLocked) {
+		// not the challenge's fault, so it doesn't use up one of its attempts
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tx.Exec(pgContext.Ctx, `DELETE FROM login_challenges WHERE token_hash = $1`, tokenHash); err != nil {
+		return "", fmt.Errorf("error clearing login challenge: %w", err)
+	}
+	if err := tx.Commit(pgContext.Ctx); err != nil {
+		return "", fmt.Errorf("error committing login: %w", err)
+	}
+	return accountUUID, nil
+}
+
+func clearLoginChallengeCookie(c echo.Context) {
+	c.SetCookie(&http.Cookie{
+		Name:     loginChallengeCookie,
+		Value:    "",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Path:     "/login",
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func notifyTwoFactorOff(pgContext *pg.PostgresContext, accountUUID string, by string) {
+	if mailer == nil {
+		return
+	}
+	var email string
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, `SELECT email FROM users WHERE id = $1`, accountUUID).Scan(&email); err != nil {
+		log.Printf("Failed to look up account %s to notify: %v", accountUUID, err)
+		return
+	}
+	sendMail(Message{
+		To:      email,
+		Subject: "Two-factor authentication was turned off",
+		Body: fmt.Sprintf("Two-factor authentication was just turned off for your account %s. Signing in now only takes your password.\n\n"+
+			"If this wasn't expected, reset your password and turn two-factor back on.\n", by),
+	})
+}
+
+// Endpoints
+
+func TwoFactorLoginPage(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	cookie, err := c.Cookie(loginChallengeCookie)
+	if err != nil || !checkLoginChallenge(hCtx.PGCtx, cookie.Value) {
+		return c.Redirect(http.StatusFound, "/login/")
+	}
+	return c.Render(http.StatusOK, "two-factor-login", map[string]interface{}{})
+}
+
+func TwoFactorLogin(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	expired := `Your sign-in has expired. <a class="underline" href="/login">Log in again</a>`
+	cookie, err := c.Cookie(loginChallengeCookie)
+	if err != nil {
+		return errorDiv(c, expired)
+	}
+
+	uid, err := completeLoginChallenge(hCtx.PGCtx, cookie.Value, c.FormValue("code"))
+	if errors.Is(err, ErrLoginChallengeExpired) {
+		clearLoginChallengeCookie(c)
+		return errorDiv(c, expired)
+	}
+	if errors.Is(err, ErrInvalidTwoFactorCode) {
+		return errorDiv(c, "Invalid code")
+	}
+	if errors.Is(err, ErrTwoFactorLocked) {
+		return errorDiv(c, twoFactorLockedMessage)
+	}
+	if err != nil {
+		log.Printf("Failed to check two-factor code: %v", err)
+		return errorDiv(c, "Internal server error")
+	}
+
+	if err := startSession(hCtx.PGCtx, c, uid); err != nil {
+		log.Printf("Failed to start session for user %v: %v", uid, err)
+		return errorDiv(c, "Internal server error")
+	}
+	clearLoginChallengeCookie(c)
+	log.Printf("Successful two-factor login for user %v", uid)
+	c.Response().Header().Set("HX-Redirect", "/app/")
+	return c.NoContent(http.StatusOK)
+}
+
+func TwoFactorPanel(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	view, err := getTwoFactorView(hCtx.PGCtx, uuid)
+	if err != nil {
+		log.Print(err)
+		return errorDiv(c, "Failed to load two-factor settings")
+	}
+	return c.Render(http.StatusOK, "twoFactor/panel", view)
+}
+
+func TwoFactorSetup(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	err := beginTwoFactorSetup(hCtx.PGCtx, uuid)
+	if errors.Is(err, ErrTwoFactorEnabled) {
+		return TwoFactorPanel(hCtx)
+	}
+	if err != nil {
+		log.Printf("Failed to start two-factor setup for account %s: %v", uuid, err)
+		return errorDiv(c, "Failed to start two-factor setup")
+	}
+	view, err := getSetupView(hCtx.PGCtx, uuid)
+	if err != nil {
+		log.Print(err)
+		return errorDiv(c, "Failed to start two-factor setup")
+	}
+	return c.Render(http.StatusOK, "twoFactor/panel", view)
+}
+
+func TwoFactorEnable(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+	sid, _ := c.Get("sid").(string)
+
+	codes, err := enableTwoFactor(hCtx.PGCtx, uuid, c.FormValue("code"))
+	if errors.Is(err, ErrInvalidTwoFactorCode) {
+		view, err := getSetupView(hCtx.PGCtx, uuid)
+		if err != nil {
+			log.Print(err)
+			return errorDiv(c, "Failed to load two-factor setup")
+		}
+		view.Error = "That code didn't match. Check the time on your device and try the next one."
+		return c.Render(http.StatusOK, "twoFactor/panel", view)
+	}
+	if errors.Is(err, ErrTwoFactorNotPending) {
+		return TwoFactorPanel(hCtx)
+	}
+	if err != nil {
+		log.Printf("Failed to enable two-factor for account %s: %v", uuid, err)
+		return errorDiv(c, "Failed to turn on two-factor")
+	}
+
+	// other devices signed in with just the password
+	if err := revokeOtherSessions(hCtx.PGCtx, uuid, sid); err != nil {
+		log.Printf("Failed to revoke other sessions of account %s: %v", uuid, err)
+	}
+	log.Printf("Account %s turned on two-factor", uuid)
+	return c.Render(http.StatusOK, "twoFactor/panel", TwoFactorView{Enabled: true, RecoveryCodes: codes})
+}
+
+func TwoFactorRecoveryCodes(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	codes, err := regenerateRecoveryCodes(hCtx.PGCtx, uuid, c.FormValue("code"))
+	if errors.Is(err, ErrInvalidTwoFactorCode) {
+		return twoFactorPanelError(hCtx, uuid, "Invalid code, recovery codes weren't changed")
+	}
+	if errors.Is(err, ErrTwoFactorLocked) {
+		return twoFactorPanelError(hCtx, uuid, twoFactorLockedMessage)
+	}
+	if errors.Is(err, ErrTwoFactorNotEnabled) {
+		return TwoFactorPanel(hCtx)
+	}
+	if err != nil {
+		log.Printf("Failed to regenerate recovery codes for account %s: %v", uuid, err)
+		return errorDiv(c, "Failed to make new recovery codes")
+	}
+	return c.Render(http.StatusOK, "twoFactor/panel", TwoFactorView{Enabled: true, RecoveryCodes: codes})
+}
+
+func TwoFactorDisable(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	err := disableTwoFactor(hCtx.PGCtx, uuid, c.FormValue("code"))
+	if errors.Is(err, ErrInvalidTwoFactorCode) {
+		return twoFactorPanelError(hCtx, uuid, "Invalid code, two-factor is still on")
+	}
+	if errors.Is(err, ErrTwoFactorLocked) {
+		return twoFactorPanelError(hCtx, uuid, twoFactorLockedMessage)
+	}
+	if err != nil && !errors.Is(err, ErrTwoFactorNotEnabled) {
+		log.Printf("Failed to turn off two-factor for account %s: %v", uuid, err)
+		return errorDiv(c, "Failed to turn off two-factor")
+	}
+	if err == nil {
+		log.Printf("Account %s turned off two-factor", uuid)
+		notifyTwoFactorOff(hCtx.PGCtx, uuid, "from its security settings")
+	}
+	return TwoFactorPanel(hCtx)
+}
+
+func twoFactorPanelError(hCtx HandlerContext, accountUUID string, message string) error {
+	view, err := getTwoFactorView(hCtx.PGCtx, accountUUID)
+	if err != nil {
+		log.Print(err)
+		return errorDiv(hCtx.EchoCtx, "Failed to load two-factor settings")
+	}
+	view.Error = message
+	return hCtx.EchoCtx.Render(http.StatusOK, "twoFactor/panel", view)
+}
+
+// AdminResetTwoFactor turns two-factor off for an account that's lost both its authenticator and
+// its recovery codes, so it can sign in with just the password
+func AdminResetTwoFactor(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	accountUUID := c.QueryParam("account_id")
+
+	reset, err := resetTwoFactor(hCtx.PGCtx, accountUUID)
+	if err != nil {
+		log.Printf("Failed to reset two-factor for account %s: %v", accountUUID, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Could not reset two-factor")
+	}
+	if !reset {
+		return echo.NewHTTPError(http.StatusNotFound, "Two-factor isn't on for this account")
+	}
+
+	adminUUID, _ := c.Get("ID").(string)
+	log.Printf("Admin %s reset two-factor for account %s", adminUUID, accountUUID)
+	notifyTwoFactorOff(hCtx.PGCtx, accountUUID, "by an administrator")
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"account_id": accountUUID,
+		"two_factor": false,
+	})
+}
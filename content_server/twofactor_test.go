@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	pg "goserve/postgres"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestMatchTOTPRejectsReplayedSteps(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1_700_000_000, 0)
+	current := now.Unix() / totpPeriod
+
+	step, ok := matchTOTP(secret, totpCode(secret, current), now, current-5)
+	if !ok || step != current {
+		t.Fatalf("current code = step %d, %v; want step %d", step, ok, current)
+	}
+	if _, ok := matchTOTP(secret, totpCode(secret, current), now, current); ok {
+		t.Error("a code for the last step used was accepted again")
+	}
+	// a code from the previous step is still good within the skew, unless a later one was used
+	if step, ok := matchTOTP(secret, totpCode(secret, current-1), now, current-2); !ok || step != current-1 {
+		t.Errorf("previous step's code = step %d, %v; want it accepted", step, ok)
+	}
+	if _, ok := matchTOTP(secret, totpCode(secret, current-1), now, current); ok {
+		t.Error("an older code was accepted after a newer one was used")
+	}
+	if _, ok := matchTOTP(secret, totpCode(secret, current-totpSkew-1), now, 0); ok {
+		t.Error("a code outside the skew window was accepted")
+	}
+}
+
+// enableTestTwoFactor turns two-factor on for the account, returning its secret and recovery codes
+func enableTestTwoFactor(t *testing.T, pgContext *pg.PostgresContext, accountUUID string) ([]byte, []string) {
+	t.Helper()
+	if err := beginTwoFactorSetup(pgContext, accountUUID); err != nil {
+		t.Fatalf("beginTwoFactorSetup: %v", err)
+	}
+	var stored []byte
+	var keyId *string
+	sqlStatement := `SELECT secret, key_id FROM two_factor WHERE account_uuid = $1`
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, accountUUID).Scan(&stored, &keyId); err != nil {
+		t.Fatalf("loading the two-factor secret: %v", err)
+	}
+	secret, err := openTOTPSecret(stored, keyId)
+	if err != nil {
+		t.Fatalf("openTOTPSecret: %v", err)
+	}
+	codes, err := enableTwoFactor(pgContext, accountUUID, totpCode(secret, time.Now().Unix()/totpPeriod))
+	if err != nil {
+		t.Fatalf("enableTwoFactor: %v", err)
+	}
+	return secret, codes
+}
+
+// startTestChallenge starts a login challenge as a correct password does and returns its token
+func startTestChallenge(t *testing.T, pgContext *pg.PostgresContext, accountUUID string) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/login/", nil), rec)
+	if err := startLoginChallenge(pgContext, c, accountUUID); err != nil {
+		t.Fatalf("startLoginChallenge: %v", err)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == loginChallengeCookie {
+			return cookie.Value
+		}
+	}
+	t.Fatal("startLoginChallenge set no cookie")
+	return ""
+}
+
+func TestLoginChallengeRejectsReplayedCodes(t *testing.T) {
+	pgContext := newTestPG(t)
+	account := createTestAccount(t, pgContext, "replay@example.com")
+	secret, _ := enableTestTwoFactor(t, pgContext, account)
+	var spent int64
+	sqlStatement := `SELECT last_step FROM two_factor WHERE account_uuid = $1`
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, account).Scan(&spent); err != nil {
+		t.Fatalf("loading last_step: %v", err)
+	}
+
+	// the code that turned two-factor on is spent
+	challenge := startTestChallenge(t, pgContext, account)
+	if _, err := completeLoginChallenge(pgContext, challenge, totpCode(secret, spent)); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("login with the code used to turn two-factor on = %v, want ErrInvalidTwoFactorCode", err)
+	}
+	next := totpCode(secret, spent+1)
+	if got, err := completeLoginChallenge(pgContext, challenge, next); err != nil || got != account {
+		t.Fatalf("login with the next code = %q, %v; want the account", got, err)
+	}
+	if _, err := completeLoginChallenge(pgContext, startTestChallenge(t, pgContext, account), next); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("second login with the same code = %v, want ErrInvalidTwoFactorCode", err)
+	}
+}
+
+func TestLoginChallengeAllowsFiveAttempts(t *testing.T) {
+	pgContext := newTestPG(t)
+	account := createTestAccount(t, pgContext, "attempts@example.com")
+	secret, _ := enableTestTwoFactor(t, pgContext, account)
+	current := time.Now().Unix() / totpPeriod
+	challenge := startTestChallenge(t, pgContext, account)
+
+	for i := 0; i < loginChallengeAttempts; i++ {
+		if _, err := completeLoginChallenge(pgContext, challenge, totpCode(secret, current-50)); !errors.Is(err, ErrInvalidTwoFactorCode) {
+			t.Fatalf("wrong code %d = %v, want ErrInvalidTwoFactorCode", i+1, err)
+		}
+	}
+	if _, err := completeLoginChallenge(pgContext, challenge, totpCode(secret, current+1)); !errors.Is(err, ErrLoginChallengeExpired) {
+		t.Errorf("right code after %d wrong ones = %v, want ErrLoginChallengeExpired", loginChallengeAttempts, err)
+	}
+	if checkLoginChallenge(pgContext, challenge) {
+		t.Error("the code page still accepts a challenge that's used up its attempts")
+	}
+
+	// entering the password again starts over
+	if got, err := completeLoginChallenge(pgContext, startTestChallenge(t, pgContext, account), totpCode(secret, current+1)); err != nil || got != account {
+		t.Errorf("login with a new challenge = %q, %v; want the account", got, err)
+	}
+}
+
+func TestRecoveryCodesWorkOnce(t *testing.T) {
+	pgContext := newTestPG(t)
+	withTestJWTKeys(t)
+	account := createTestAccount(t, pgContext, "recovery@example.com")
+	_, codes := enableTestTwoFactor(t, pgContext, account)
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	login := func(code string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/login/two-factor/", strings.NewReader(url.Values{"code": {code}}.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		req.AddCookie(&http.Cookie{Name: loginChallengeCookie, Value: startTestChallenge(t, pgContext, account)})
+		rec := httptest.NewRecorder()
+		if err := TwoFactorLogin(HandlerContext{echo.New().NewContext(req, rec), pgContext}); err != nil {
+			t.Fatalf("TwoFactorLogin: %v", err)
+		}
+		return rec
+	}
+
+	rec := login(codes[0])
+	if rec.Code != http.StatusOK || rec.Header().Get("HX-Redirect") != "/app/" {
+		t.Errorf("login with a recovery code answered %d redirecting to %q, want 200 to /app/", rec.Code, rec.Header().Get("HX-Redirect"))
+	}
+	if rec = login(codes[0]); rec.Header().Get("HX-Redirect") != "" || !strings.Contains(rec.Body.String(), "Invalid code") {
+		t.Errorf("second login with the same recovery code answered %q, want it refused", rec.Body)
+	}
+	if _, err := completeLoginChallenge(pgContext, startTestChallenge(t, pgContext, account), codes[1]); err != nil {
+		t.Errorf("another recovery code = %v, want it accepted", err)
+	}
+}
+
+func TestTwoFactorLockoutDoublesUpToTheCap(t *testing.T) {
+	for failures := 0; failures < twoFactorFreeFailures; failures++ {
+		if got := twoFactorLockout(failures); got != 0 {
+			t.Errorf("lockout after %d wrong codes = %v, want none", failures, got)
+		}
+	}
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute, 32 * time.Minute, time.Hour, time.Hour}
+	for i, w := range want {
+		failures := twoFactorFreeFailures + i
+		if got := twoFactorLockout(failures); got != w {
+			t.Errorf("lockout after %d wrong codes = %v, want %v", failures, got, w)
+		}
+	}
+}
+
+func twoFactorFailures(t *testing.T, pgContext *pg.PostgresContext, accountUUID string) int {
+	t.Helper()
+	var failures int
+	sqlStatement := `SELECT failed_attempts FROM two_factor WHERE account_uuid = $1`
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, accountUUID).Scan(&failures); err != nil {
+		t.Fatalf("loading failed_attempts: %v", err)
+	}
+	return failures
+}
+
+func TestWrongCodesLockTheAccountAcrossChallenges(t *testing.T) {
+	pgContext := newTestPG(t)
+	account := createTestAccount(t, pgContext, "lockout@example.com")
+	secret, codes := enableTestTwoFactor(t, pgContext, account)
+	current := time.Now().Unix() / totpPeriod
+	wrong := totpCode(secret, current-50)
+
+	// wrong codes to the settings panel count as much as ones at login
+	if err := disableTwoFactor(pgContext, account, wrong); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Fatalf("disabling with a wrong code = %v, want ErrInvalidTwoFactorCode", err)
+	}
+	if _, err := regenerateRecoveryCodes(pgContext, account, "aaaaa-aaaaa"); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Fatalf("regenerating with a wrong recovery code = %v, want ErrInvalidTwoFactorCode", err)
+	}
+	if failures := twoFactorFailures(t, pgContext, account); failures != 2 {
+		t.Fatalf("failed_attempts = %d after two wrong codes", failures)
+	}
+
+	// a new challenge each time the per-challenge attempts run out
+	for failures := 2; failures < twoFactorFreeFailures; {
+		challenge := startTestChallenge(t, pgContext, account)
+		for i := 0; i < loginChallengeAttempts && failures < twoFactorFreeFailures; i++ {
+			if _, err := completeLoginChallenge(pgContext, challenge, wrong); !errors.Is(err, ErrInvalidTwoFactorCode) {
+				t.Fatalf("wrong code %d = %v, want ErrInvalidTwoFactorCode", failures+1, err)
+			}
+			failures++
+		}
+	}
+
+	if _, err := completeLoginChallenge(pgContext, startTestChallenge(t, pgContext, account), totpCode(secret, current+1)); !errors.Is(err, ErrTwoFactorLocked) {
+		t.Errorf("right code on a new challenge while locked = %v, want ErrTwoFactorLocked", err)
+	}
+	if err := disableTwoFactor(pgContext, account, totpCode(secret, current+1)); !errors.Is(err, ErrTwoFactorLocked) {
+		t.Errorf("disabling while locked = %v, want ErrTwoFactorLocked", err)
+	}
+	if _, err := regenerateRecoveryCodes(pgContext, account, codes[0]); !errors.Is(err, ErrTwoFactorLocked) {
+		t.Errorf("regenerating recovery codes while locked = %v, want ErrTwoFactorLocked", err)
+	}
+
+	sqlStatement := `UPDATE two_factor SET locked_until = now() - interval '1 second' WHERE account_uuid = $1`
+	if _, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, account); err != nil {
+		t.Fatalf("ending the lockout: %v", err)
+	}
+	if got, err := completeLoginChallenge(pgContext, startTestChallenge(t, pgContext, account), totpCode(secret, current+1)); err != nil || got != account {
+		t.Fatalf("login after the lockout = %q, %v; want the account", got, err)
+	}
+	if failures := twoFactorFailures(t, pgContext, account); failures != 0 {
+		t.Errorf("failed_attempts = %d after a right code, want it reset", failures)
+	}
+}
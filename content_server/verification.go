@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// New accounts prove they own their email address by following a signed link sent to it. Until
+// then they can sign in, but only as far as the page asking them to check their inbox.
+
+var (
+	ErrInvalidVerificationLink = errors.New("verification link is invalid or has expired")
+	ErrAlreadyVerified         = errors.New("account is already verified")
+	ErrVerificationThrottled   = errors.New("a verification email was sent moments ago")
+)
+
+type VerificationConfig struct {
+	// How long a verification link works
+	TTL time.Duration
+	// Another email isn't sent until this long after the last
+	ResendAfter time.Duration
+}
+
+func GetDefaultVerificationConfig() VerificationConfig {
+	hours, err := strconv.Atoi(os.Getenv("VERIFICATION_LINK_HOURS"))
+	if err != nil || hours <= 0 {
+		hours = 48
+	}
+	return VerificationConfig{
+		TTL:         time.Duration(hours) * time.Hour,
+		ResendAfter: time.Minute,
+	}
+}
+
+var verificationConfig = GetDefaultVerificationConfig()
+
+// verificationRequired is false without a mailer, since no account could ever be verified
+func verificationRequired() bool {
+	return mailer != nil
+}
+
+// Verification links are signed with VERIFICATION_SECRET, kept apart from the JWT keys like
+// SHARE_LINK_SECRET so a link sent days ago survives restarts and key rotations. It's only loaded
+// with a mailer, since without one no links are sent.
+var verificationSecret []byte
+
+func getVerificationSecret() ([]byte, error) {
+	return secretFromEnv("VERIFICATION_SECRET")
+}
+
+// signVerification signs the account id, the address being verified and the expiry, so a link
+// stops working if the account's email changes
+func signVerification(accountUUID string, email string, expires int64) string {
+	mac := hmac.New(sha256.New, verificationSecret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", accountUUID, email, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verificationURL(accountUUID string, email string) string {
+	expires := time.Now().Add(verificationConfig.TTL).Unix()
+	return emailLink("/verify-email/", url.Values{
+		"account": {accountUUID},
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {signVerification(accountUUID, email, expires)},
+	})
+}
+
+// sendVerificationEmail emails the account a verification link, unless it's already verified or
+// one went out less than ResendAfter ago
+func sendVerificationEmail(pgContext *pg.PostgresContext, accountUUID string) error {
+	if mailer == nil {
+		return ErrMailNotConfigured
+	}
+	now := time.Now().UTC()
+	var email string
+	sqlStatement := `
+	UPDATE users SET verification_sent_at = $2
+	WHERE id = $1 AND verified_at IS NULL AND (verification_sent_at IS NULL OR verification_sent_at < $3)
+	RETURNING email`
+	err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, accountUUID, now, now.Add(-verificationConfig.ResendAfter)).Scan(&email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		verified, err := isVerified(pgContext, accountUUID)
+		if err != nil {
+			return err
+		}
+		if verified {
+			return ErrAlreadyVerified
+		}
+		return ErrVerificationThrottled
+	}
+	if err != nil {
+		return fmt.Errorf("error recording verification email: %w", err)
+	}
+	link := verificationURL(accountUUID, email)
+
+	sendMail(Message{
+		To:      email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Welcome! Confirm this is your email address to start using your account:\n\n%s\n\n"+
+			"The link expires in %d hours. If you didn't sign up, ignore this email.\n",
+			link, int(verificationConfig.TTL.Hours())),
+	})
+	return nil
+}
+
+// verifyEmail checks a verification link and marks the account verified
+func verifyEmail(pgContext *pg.PostgresContext, accountUUID string, expires int64, sig string) error {
+	// without a secret anyone could sign a link
+	if len(verificationSecret) == 0 || time.Now().Unix() > expires {
+		return ErrInvalidVerificationLink
+	}
+	var email string
+	sqlStatement := `SELECT email FROM users WHERE id = $1`
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, accountUUID).Scan(&email); err != nil {
+		// a malformed id fails uuid parsing in postgres, which is just another bad link
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("Failed to look up account %s to verify: %v", accountUUID, err)
+		}
+		return ErrInvalidVerificationLink
+	}
+	given, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return ErrInvalidVerificationLink
+	}
+	expected, _ := base64.RawURLEncoding.DecodeString(signVerification(accountUUID, email, expires))
+	if !hmac.Equal(given, expected) {
+		return ErrInvalidVerificationLink
+	}
+
+	sqlStatement = `UPDATE users SET verified_at = COALESCE(verified_at, $3) WHERE id = $1 AND email = $2`
+	if _, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, accountUUID, email, time.Now().UTC()); err != nil {
+		return fmt.Errorf("error verifying account %s: %w", accountUUID, err)
+	}
+	return nil
+}
+
+func isVerified(pgContext *pg.PostgresContext, accountUUID string) (bool, error) {
+	var verified bool
+	sqlStatement := `SELECT verified_at IS NOT NULL FROM users WHERE id = $1`
+	if err := pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, accountUUID).Scan(&verified); err != nil {
+		return false, fmt.Errorf("error checking verification of account %s: %w", accountUUID, err)
+	}
+	return verified, nil
+}
+
+// Endpoints
+
+// VerifyEmail follows the emailed link. It's public, so the link works in any browser.
+func VerifyEmail(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	expires, _ := strconv.ParseInt(c.QueryParam("expires"), 10, 64)
+	err := verifyEmail(hCtx.PGCtx, c.QueryParam("account"), expires, c.QueryParam("sig"))
+	if err != nil && !errors.Is(err, ErrInvalidVerificationLink) {
+		log.Printf("Failed to verify email: %v", err)
+	}
+	return c.Render(http.StatusOK, "verify-email", map[string]interface{}{
+		"Verified": err == nil,
+	})
+}
+
+// VerifyPendingPage is where unverified accounts are sent, with the option to resend the email
+func VerifyPendingPage(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	var email string
+	var verified bool
+	sqlStatement := `SELECT email, verified_at IS NOT NULL FROM users WHERE id = $1`
+	if err := hCtx.PGCtx.Pool.QueryRow(hCtx.PGCtx.Ctx, sqlStatement, uuid).Scan(&email, &verified); err != nil {
+		return fmt.Errorf("error loading account %s: %w", uuid, err)
+	}
+	if verified || !verificationRequired() {
+		return c.Redirect(http.StatusFound, "/app/")
+	}
+	return c.Render(http.StatusOK, "verify-pending", map[string]interface{}{
+		"Email": email,
+	})
+}
+
+func VerifyResend(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	err := sendVerificationEmail(hCtx.PGCtx, uuid)
+	switch {
+	case err == nil:
+		return noticeDiv(c, "Sent a new link, check your inbox.")
+	case errors.Is(err, ErrAlreadyVerified):
+		c.Response().Header().Set("HX-Redirect", "/app/")
+		return c.NoContent(http.StatusOK)
+	case errors.Is(err, ErrVerificationThrottled):
+		return errorDiv(c, "A link was sent moments ago. Check your inbox, or try again in a minute.")
+	}
+	log.Printf("Failed to resend verification email to account %s: %v", uuid, err)
+	return errorDiv(c, "Failed to send the email")
+}
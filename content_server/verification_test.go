@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withVerificationSecret(t *testing.T, secret string) {
+	previous := verificationSecret
+	verificationSecret = []byte(secret)
+	t.Cleanup(func() { verificationSecret = previous })
+}
+
+func TestVerificationLinkIsOnPublicBaseURL(t *testing.T) {
+	withRecordingMailer(t, "https://files.example.com")
+	withVerificationSecret(t, "0123456789abcdef0123456789abcdef")
+
+	link, err := url.Parse(verificationURL("account", "someone@example.com"))
+	if err != nil {
+		t.Fatalf("parsing the link: %v", err)
+	}
+	if !strings.HasPrefix(link.String(), "https://files.example.com/verify-email/?") {
+		t.Errorf("verification link %q isn't on PUBLIC_BASE_URL", link)
+	}
+	query := link.Query()
+	expires, _ := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if query.Get("account") != "account" || query.Get("sig") != signVerification("account", "someone@example.com", expires) {
+		t.Errorf("verification link carries %v, want the account and its signature", query)
+	}
+
+	// the same secret signs the same way after a restart; another secret, or another address, doesn't
+	sig := signVerification("account", "someone@example.com", expires)
+	if signVerification("account", "someone-else@example.com", expires) == sig {
+		t.Error("a link for one address verifies another")
+	}
+	withVerificationSecret(t, "fedcba9876543210fedcba9876543210")
+	if signVerification("account", "someone@example.com", expires) == sig {
+		t.Error("a different VERIFICATION_SECRET gives the same signature")
+	}
+}
+
+func TestVerifyEmailWithoutASecret(t *testing.T) {
+	// without mail VERIFICATION_SECRET isn't loaded, and a link signed with no key proves nothing
+	withVerificationSecret(t, "")
+	expires := time.Now().Add(time.Hour).Unix()
+	sig := signVerification("account", "someone@example.com", expires)
+	// refused before postgres is asked anything
+	if err := verifyEmail(nil, "account", expires, sig); !errors.Is(err, ErrInvalidVerificationLink) {
+		t.Errorf("verifyEmail without a secret = %v, want ErrInvalidVerificationLink", err)
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	pgContext := newTestPG(t)
+	withVerificationSecret(t, "0123456789abcdef0123456789abcdef")
+	account := createTestAccount(t, pgContext, "verify@example.com")
+	sqlStatement := `UPDATE users SET verified_at = NULL WHERE id = $1`
+	if _, err := pgContext.Pool.Exec(pgContext.Ctx, sqlStatement, account); err != nil {
+		t.Fatalf("unverifying the account: %v", err)
+	}
+	expires := time.Now().Add(time.Hour).Unix()
+
+	tampered := signVerification(account, "someone-else@example.com", expires)
+	if err := verifyEmail(pgContext, account, expires, tampered); !errors.Is(err, ErrInvalidVerificationLink) {
+		t.Errorf("link signed for another address = %v, want ErrInvalidVerificationLink", err)
+	}
+	if err := verifyEmail(pgContext, account, expires+1, signVerification(account, "verify@example.com", expires)); !errors.Is(err, ErrInvalidVerificationLink) {
+		t.Errorf("link with its expiry pushed back = %v, want ErrInvalidVerificationLink", err)
+	}
+	past := time.Now().Add(-time.Minute).Unix()
+	if err := verifyEmail(pgContext, account, past, signVerification(account, "verify@example.com", past)); !errors.Is(err, ErrInvalidVerificationLink) {
+		t.Errorf("expired link = %v, want ErrInvalidVerificationLink", err)
+	}
+	if verified, _ := isVerified(pgContext, account); verified {
+		t.Fatal("a bad link verified the account")
+	}
+
+	if err := verifyEmail(pgContext, account, expires, signVerification(account, "verify@example.com", expires)); err != nil {
+		t.Fatalf("verifyEmail: %v", err)
+	}
+	if verified, err := isVerified(pgContext, account); err != nil || !verified {
+		t.Errorf("account verified = %v, %v; want verified", verified, err)
+	}
+}
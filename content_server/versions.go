@@ -0,0 +1,467 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+)
+
+// FileVersion is one entry in a file's history. The current version lives in the files row.
+type FileVersion struct {
+	FileId     string
+	Version    int
+	Filename   string
+	FileExt    string
+	Filepath   string
+	UploadTime time.Time
+	RawText    string
+	SHA256     string
+	Size       int64
+	BucketDir  string
+	Location   string
+	KeyID      string
+	// a quarantined version can't be downloaded or restored
+	ScanStatus    string
+	ScanSignature string
+	Current       bool
+}
+
+func (fv FileVersion) SizeLabel() string {
+	return formatBytes(fv.Size)
+}
+
+func (fv FileVersion) fileObject() FileObject {
+	return FileObject{
+		FileId:        fv.FileId,
+		Filepath:      fv.Filepath,
+		Filename:      fv.Filename,
+		FileExt:       fv.FileExt,
+		UploadTime:    fv.UploadTime,
+		RawText:       fv.RawText,
+		SHA256:        fv.SHA256,
+		Size:          fv.Size,
+		Location:      fv.Location,
+		KeyID:         fv.KeyID,
+		ScanStatus:    fv.ScanStatus,
+		ScanSignature: fv.ScanSignature,
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// FileVersionsPanel is the data for the versions dropdown in the Files table
+type FileVersionsPanel struct {
+	FileId   string
+	Versions []FileVersion
+	Diff     *TextDiff
+	Error    string
+}
+
+const fileVersionColumns = `filename, COALESCE(file_ext, ''), filepath, upload_time, COALESCE(raw_text, ''),
+	COALESCE(sha256, ''), COALESCE(size, 0), COALESCE(bucket_dir, ''), COALESCE(location, ''), COALESCE(key_id, ''), scan_status, COALESCE(scan_signature, '')`
+
+func scanFileVersion(row pgx.Row, fv *FileVersion) error {
+	return row.Scan(&fv.Version, &fv.Current, &fv.Filename, &fv.FileExt, &fv.Filepath, &fv.UploadTime, &fv.RawText,
+		&fv.SHA256, &fv.Size, &fv.BucketDir, &fv.Location, &fv.KeyID, &fv.ScanStatus, &fv.ScanSignature)
+}
+
+// listFileVersions returns the current version followed by the archived ones, newest first
+func listFileVersions(pgContext *pg.PostgresContext, fileId string, accountUUID string) ([]FileVersion, error) {
+	sqlStatement := `
+	SELECT version, true, ` + fileVersionColumns + `
+	FROM files WHERE id = $1 AND account_uuid = $2 AND deleted_at IS NULL
+	UNION ALL
+	SELECT v.version, false, ` + fileVersionColumns + `
+	FROM file_versions v
+	WHERE v.file_id = $1 AND EXISTS (SELECT 1 FROM files f WHERE f.id = $1 AND f.account_uuid = $2 AND f.deleted_at IS NULL)
+	ORDER BY 1 DESC`
+	rows, err := pgContext.Pool.Query(pgContext.Ctx, sqlStatement, fileId, accountUUID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing versions of file %s: %w", fileId, err)
+	}
+	defer rows.Close()
+
+	var versions []FileVersion
+	for rows.Next() {
+		fv := FileVersion{FileId: fileId}
+		if err := scanFileVersion(rows, &fv); err != nil {
+			return nil, fmt.Errorf("error scanning file version: %w", err)
+		}
+		versions = append(versions, fv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, ErrFileNotFound
+	}
+	return versions, nil
+}
+
+func getFileVersion(pgContext *pg.PostgresContext, fileId string, version int, accountUUID string) (FileVersion, error) {
+	fv := FileVersion{FileId: fileId}
+	sqlStatement := `
+	SELECT version, true, ` + fileVersionColumns + `
+	FROM files WHERE id = $1 AND version = $2 AND account_uuid = $3 AND deleted_at IS NULL
+	UNION ALL
+	SELECT v.version, false, ` + fileVersionColumns + `
+	FROM file_versions v
+	WHERE v.file_id = $1 AND v.version = $2 AND EXISTS (SELECT 1 FROM files f WHERE f.id = $1 AND f.account_uuid = $3 AND f.deleted_at IS NULL)`
+	err := scanFileVersion(pgContext.Pool.QueryRow(pgContext.Ctx, sqlStatement, fileId, version, accountUUID), &fv)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fv, ErrFileNotFound
+	}
+	if err != nil {
+		return fv, fmt.Errorf("error loading version %d of file %s: %w", version, fileId, err)
+	}
+	return fv, nil
+}
+
+// archiveCurrentVersion locks the files row and copies its current state into file_versions.
+// The stored bytes' reference moves with it, so refcounts don't change.
+func archiveCurrentVersion(pgContext *pg.PostgresContext, tx pgx.Tx, fileId string, accountUUID string) error {
+	var locked string
+	lockSql := `SELECT id FROM files WHERE id = $1 AND account_uuid = $2 AND deleted_at IS NULL FOR UPDATE`
+	err := tx.QueryRow(pgContext.Ctx, lockSql, fileId, accountUUID).Scan(&locked)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrFileNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error locking file %s: %w", fileId, err)
+	}
+
+	archiveSql := `
+	INSERT INTO file_versions (file_id, version, filename, filepath, file_ext, upload_time, raw_text, sha256, size, bucket_dir, location, key_id,
+		scan_status, scan_signature)
+	SELECT id, version, filename, filepath, file_ext, upload_time, raw_text, sha256, size, bucket_dir, location, key_id,
+		scan_status, scan_signature
+	FROM files WHERE id = $1`
+	if _, err := tx.Exec(pgContext.Ctx, archiveSql, fileId); err != nil {
+		return fmt.Errorf("error archiving current version of file %s: %w", fileId, err)
+	}
+	return nil
+}
+
+// replaceCurrentVersion points the files row at new content and bumps its version
+func replaceCurrentVersion(pgContext *pg.PostgresContext, tx pgx.Tx, filesystem Filesystem, fo *FileObject) error {
+	rawText := &fo.RawText
+	if fo.RawText == "" {
+		rawText = nil
+	}
+	sqlStatement := `
+	UPDATE files
+	SET filename = $2, filepath = $3, file_ext = $4, upload_time = $5, raw_text = $6, sha256 = $7, size = $8,
+		bucket_dir = $9, location = $10, extraction_status = $11, extraction_error = NULL, missing_at = NULL, key_id = NULLIF($12, ''),
+		scan_status = $13, scan_signature = NULLIF($14, ''), preview_status = 'pending', version = version + 1
+	WHERE id = $1`
+	_, err := tx.Exec(pgContext.Ctx, sqlStatement, fo.FileId, fo.Filename, fo.Filepath, fo.FileExt, fo.UploadTime, rawText,
+		fo.SHA256, fo.Size, filesystem.GetStorageClass().Config.BucketDir, filesystem.GetLocation(), fo.ExtractionStatus, fo.KeyID,
+		fo.ScanStatus, fo.ScanSignature)
+	if err != nil {
+		return fmt.Errorf("error updating file %s to its new version: %w", fo.FileId, err)
+	}
+	return nil
+}
+
+// SaveFileVersion stores an upload as the new current version of an existing file
+func SaveFileVersion(pgContext *pg.PostgresContext, filesystem Filesystem, fileId string, fileInput FileInput) error {
+	fo, err := fileInput.createFileOutput()
+	if err != nil {
+		return err
+	}
+	fo.FileId = fileId
+
+	file, err := limitToQuota(pgContext, fileInput.AccountUUID, fileInput.File)
+	if err != nil {
+		return err
+	}
+	file, finishScan := scanUpload(file)
+	blob, err := putBlob(pgContext, filesystem, file)
+	fo.setScanResult(finishScan())
+	if err != nil {
+		return err
+	}
+	fo.Filepath, fo.SHA256, fo.Size, fo.KeyID = blob.Key, blob.SHA256, blob.Size, blob.KeyID
+
+	err = commitNewVersion(pgContext, filesystem, &fo)
+	if err != nil {
+		if relErr := releaseBlob(pgContext, filesystem, blob); relErr != nil {
+			log.Printf("Failed to release blob after versioning failure: %v", relErr)
+		}
+		return err
+	}
+	return queueExtraction(pgContext, fo)
+}
+
+func commitNewVersion(pgContext *pg.PostgresContext, filesystem Filesystem, fo *FileObject) error {
+	if fo.Size == 0 && fo.RawText == "" {
+		return fmt.Errorf("empty file and no raw text? There's nothing here!")
+	}
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	// the current version is kept as history, so the account's usage grows by the whole new version
+	if err := checkQuotaTx(pgContext, tx, fo.AccountUUID, fo.Size); err != nil {
+		return err
+	}
+	if err := archiveCurrentVersion(pgContext, tx, fo.FileId, fo.AccountUUID); err != nil {
+		return err
+	}
+	if err := replaceCurrentVersion(pgContext, tx, filesystem, fo); err != nil {
+		return err
+	}
+	return tx.Commit(pgContext.Ctx)
+}
+
+func queueExtraction(pgContext *pg.PostgresContext, fo FileObject) error {
+	if fo.ExtractionStatus != ExtractionPending {
+		return nil
+	}
+	if err := extractionQueue.Enqueue(pgContext, fo.FileId); err != nil {
+		log.Printf("Error queueing text extraction for file %s: %v", fo.FileId, err)
+		return err
+	}
+	return nil
+}
+
+// RestoreFileVersion makes an earlier version current again. History is kept: the restore is
+// itself a new version, with the old one's content and extracted text.
+func RestoreFileVersion(pgContext *pg.PostgresContext, fileId string, version int, accountUUID string) error {
+	old, err := getFileVersion(pgContext, fileId, version, accountUUID)
+	if err != nil {
+		return err
+	}
+	if old.Current {
+		return nil
+	}
+	if old.ScanStatus == ScanInfected {
+		return ErrQuarantined
+	}
+	filesystem, err := getFilesystem(old.Location)
+	if err != nil {
+		return err
+	}
+
+	fo := old.fileObject()
+	fo.AccountUUID = accountUUID
+	fo.ExtractionStatus = ExtractionDone
+	if fo.RawText == "" {
+		fo.ExtractionStatus = ExtractionPending
+	}
+
+	tx, err := pgContext.Pool.Begin(pgContext.Ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pgContext.Ctx)
+
+	shared, err := addBlobRefTx(pgContext, tx, old.SHA256, old.Location, old.Filepath)
+	if err != nil {
+		return err
+	}
+	if !shared {
+		// stored before content addressing, so the bytes belong to the old version alone.
+		// Copy them into a blob rather than have two rows own one file.
+		tx.Rollback(pgContext.Ctx)
+		return restoreLegacyVersion(pgContext, filesystem, old, fo)
+	}
+
+	if err := checkQuotaTx(pgContext, tx, accountUUID, fo.Size); err != nil {
+		return err
+	}
+	if err := archiveCurrentVersion(pgContext, tx, fileId, accountUUID); err != nil {
+		return err
+	}
+	if err := replaceCurrentVersion(pgContext, tx, filesystem, &fo); err != nil {
+		return err
+	}
+	if err := tx.Commit(pgContext.Ctx); err != nil {
+		return err
+	}
+	return queueExtraction(pgContext, fo)
+}
+
+func restoreLegacyVersion(pgContext *pg.PostgresContext, filesystem Filesystem, old FileVersion, fo FileObject) error {
+	file, err := filesystem.Read(old.Filepath)
+	if err != nil {
+		return fmt.Errorf("error reading version %d of file %s: %w", old.Version, old.FileId, err)
+	}
+	defer file.Close()
+
+	blob, err := putBlob(pgContext, filesystem, file)
+	if err != nil {
+		return err
+	}
+	fo.Filepath, fo.SHA256, fo.Size, fo.KeyID = blob.Key, blob.SHA256, blob.Size, blob.KeyID
+
+	if err := commitNewVersion(pgContext, filesystem, &fo); err != nil {
+		if relErr := releaseBlob(pgContext, filesystem, blob); relErr != nil {
+			log.Printf("Failed to release blob after restore failure: %v", relErr)
+		}
+		return err
+	}
+	return queueExtraction(pgContext, fo)
+}
+
+// Endpoints
+
+func renderFileVersions(hCtx HandlerContext, fileId string, panel FileVersionsPanel) error {
+	uuid, ok := hCtx.EchoCtx.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	versions, err := listFileVersions(hCtx.PGCtx, fileId, uuid)
+	if errors.Is(err, ErrFileNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	if err != nil {
+		log.Printf("Failed to list versions of file %s: %v", fileId, err)
+		return errorDiv(hCtx.EchoCtx, "Failed to load file versions")
+	}
+	panel.FileId = fileId
+	panel.Versions = versions
+	return hCtx.EchoCtx.Render(http.StatusOK, "file/versions", panel)
+}
+
+func FileVersions(hCtx HandlerContext) error {
+	return renderFileVersions(hCtx, hCtx.EchoCtx.QueryParam("file_id"), FileVersionsPanel{})
+}
+
+func FileVersionUpload(hCtx HandlerContext) error {
+	fileId := hCtx.EchoCtx.QueryParam("file_id")
+
+	saved := false
+	_, err := _readFileUploads(hCtx.EchoCtx, func(fileInput FileInput) error {
+		if saved {
+			// one new version per request, drain the rest
+			_, err := io.Copy(io.Discard, fileInput.File)
+			return err
+		}
+		saved = true
+		return SaveFileVersion(hCtx.PGCtx, filesystem, fileId, fileInput)
+	})
+	if errors.Is(err, ErrFileNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	if errors.Is(err, ErrFileTooLarge) {
+		return renderFileVersions(hCtx, fileId, FileVersionsPanel{Error: fmt.Sprintf("File is larger than the %d MB upload limit", maxUploadBytes>>20)})
+	}
+	if errors.Is(err, ErrQuotaExceeded) {
+		uuid, _ := hCtx.EchoCtx.Get("ID").(string)
+		return renderFileVersions(hCtx, fileId, FileVersionsPanel{Error: quotaExceededMessage(hCtx.PGCtx, uuid)})
+	}
+	if err != nil {
+		log.Printf("Failed to save new version of file %s: %v", fileId, err)
+		return renderFileVersions(hCtx, fileId, FileVersionsPanel{Error: "Failed to upload new version"})
+	}
+	// refresh the Files table row for the new current version
+	hCtx.EchoCtx.Response().Header().Set("HX-Trigger", "fileUploaded")
+	return renderFileVersions(hCtx, fileId, FileVersionsPanel{})
+}
+
+func FileVersionRestore(hCtx HandlerContext) error {
+	fileId := hCtx.EchoCtx.QueryParam("file_id")
+
+	uuid, ok := hCtx.EchoCtx.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+	version, err := strconv.Atoi(hCtx.EchoCtx.QueryParam("version"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid version")
+	}
+
+	err = RestoreFileVersion(hCtx.PGCtx, fileId, version, uuid)
+	if errors.Is(err, ErrFileNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "File version not found")
+	}
+	if errors.Is(err, ErrQuarantined) {
+		return renderFileVersions(hCtx, fileId, FileVersionsPanel{Error: "This version was flagged by the malware scan and can't be restored"})
+	}
+	if errors.Is(err, ErrQuotaExceeded) {
+		return renderFileVersions(hCtx, fileId, FileVersionsPanel{Error: quotaExceededMessage(hCtx.PGCtx, uuid)})
+	}
+	if err != nil {
+		log.Printf("Failed to restore version %d of file %s: %v", version, fileId, err)
+		return renderFileVersions(hCtx, fileId, FileVersionsPanel{Error: "Failed to restore version"})
+	}
+	hCtx.EchoCtx.Response().Header().Set("HX-Trigger", "fileUploaded")
+	return renderFileVersions(hCtx, fileId, FileVersionsPanel{})
+}
+
+func FileVersionDiff(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	fileId := c.QueryParam("file_id")
+
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+	from, fromErr := strconv.Atoi(c.QueryParam("from"))
+	to, toErr := strconv.Atoi(c.QueryParam("to"))
+	if fromErr != nil || toErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid version")
+	}
+
+	fromVersion, err := getFileVersion(hCtx.PGCtx, fileId, from, uuid)
+	if err == nil {
+		var toVersion FileVersion
+		toVersion, err = getFileVersion(hCtx.PGCtx, fileId, to, uuid)
+		if err == nil {
+			diff := DiffText(fromVersion.RawText, toVersion.RawText)
+			diff.From, diff.To = from, to
+			return c.Render(http.StatusOK, "file/diff", diff)
+		}
+	}
+	if errors.Is(err, ErrFileNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "File version not found")
+	}
+	log.Printf("Failed to diff versions of file %s: %v", fileId, err)
+	return errorDiv(c, "Failed to compare versions")
+}
+
+func FileVersionDownload(hCtx HandlerContext) error {
+	fileId := hCtx.EchoCtx.Param("id")
+
+	uuid, ok := hCtx.EchoCtx.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+	version, err := strconv.Atoi(hCtx.EchoCtx.Param("version"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+
+	fv, err := getFileVersion(hCtx.PGCtx, fileId, version, uuid)
+	if err != nil {
+		if !errors.Is(err, ErrFileNotFound) {
+			log.Printf("Failed to look up file version for download: %v", err)
+		}
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	inline := hCtx.EchoCtx.QueryParam("disposition") == "inline"
+	return serveFile(hCtx.EchoCtx, fv.fileObject(), inline)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	pg "goserve/postgres"
+	"goserve/tables/cells"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Bulk upload from a ZIP, one files row per entry, and export of selected files as a ZIP.
+// Entry sizes in a ZIP's headers are whatever the archive claims, so the limits below are checked
+// against the headers up front and enforced again on the bytes actually decompressed.
+
+var (
+	ErrZipTooManyEntries = errors.New("archive has too many entries")
+	ErrZipTooLarge       = errors.New("archive expands past the decompression limit")
+	ErrZipRatio          = errors.New("entry compresses suspiciously well")
+)
+
+type ZipConfig struct {
+	// Most entries an archive may have, and most files one export may hold
+	MaxEntries int
+	// Most bytes all of an archive's entries may decompress to
+	MaxTotalBytes int64
+	// Highest uncompressed:compressed ratio an entry may have, zip bombs run into the thousands
+	MaxRatio int64
+}
+
+func GetDefaultZipConfig() ZipConfig {
+	config := ZipConfig{
+		MaxEntries:    500,
+		MaxTotalBytes: 1 << 30,
+		MaxRatio:      100,
+	}
+	if n, err := strconv.Atoi(os.Getenv("ZIP_MAX_ENTRIES")); err == nil && n > 0 {
+		config.MaxEntries = n
+	}
+	if mb, err := strconv.ParseInt(os.Getenv("ZIP_MAX_UNCOMPRESSED_MB"), 10, 64); err == nil && mb > 0 {
+		config.MaxTotalBytes = mb << 20
+	}
+	if ratio, err := strconv.ParseInt(os.Getenv("ZIP_MAX_RATIO"), 10, 64); err == nil && ratio > 0 {
+		config.MaxRatio = ratio
+	}
+	return config
+}
+
+var zipConfig = GetDefaultZipConfig()
+
+// ZipEntryResult is one line of the upload summary
+type ZipEntryResult struct {
+	Filename   string
+	FileId     string
+	Error      string
+	Extraction cells.ExtractionCell
+}
+
+func (r ZipEntryResult) Saved() bool {
+	return r.FileId != ""
+}
+
+type ZipUploadSummary struct {
+	Archive string
+	Error   string
+	Entries []ZipEntryResult
+}
+
+func (s ZipUploadSummary) SavedCount() int {
+	saved := 0
+	for _, entry := range s.Entries {
+		if entry.Saved() {
+			saved++
+		}
+	}
+	return saved
+}
+
+func (s ZipUploadSummary) FailedCount() int {
+	return len(s.Entries) - s.SavedCount()
+}
+
+// skipZipEntry leaves out folders and the metadata archivers add, which aren't anyone's files
+func skipZipEntry(f *zip.File) bool {
+	name := f.Name
+	if f.FileInfo().IsDir() || strings.HasSuffix(name, "/") {
+		return true
+	}
+	if strings.HasPrefix(name, "__MACOSX/") || strings.Contains(name, "/__MACOSX/") {
+		return true
+	}
+	return strings.HasPrefix(path.Base(name), ".")
+}
+
+// importZip saves each entry of archive as its own file. The archive is spooled to a temp file
+// first, since its directory is at the end. Errors with one entry are reported on that entry;
+// the returned error is for the archive as a whole.
+func importZip(pgContext *pg.PostgresContext, filesystem Filesystem, input FileInput, config ZipConfig) (ZipUploadSummary, error) {
+	summary := ZipUploadSummary{Archive: input.Filename}
+
+	spool, err := os.CreateTemp("", "zip-upload-*")
+	if err != nil {
+		return summary, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	size, err := io.Copy(spool, &sizeLimitReader{Reader: input.File, Limit: maxUploadBytes})
+	if err != nil {
+		return summary, asUploadErr(err)
+	}
+
+	archive, err := zip.NewReader(spool, size)
+	if err != nil {
+		return summary, fmt.Errorf("not a readable ZIP archive: %w", err)
+	}
+
+	var entries []*zip.File
+	var declared uint64
+	for _, f := range archive.File {
+		if skipZipEntry(f) {
+			continue
+		}
+		entries = append(entries, f)
+		declared += f.UncompressedSize64
+	}
+	if len(entries) > config.MaxEntries {
+		return summary, fmt.Errorf("%w: %d, the limit is %d", ErrZipTooManyEntries, len(entries), config.MaxEntries)
+	}
+	if declared > uint64(config.MaxTotalBytes) {
+		return summary, fmt.Errorf("%w of %d MB", ErrZipTooLarge, config.MaxTotalBytes>>20)
+	}
+
+	remaining := config.MaxTotalBytes
+	var stop string
+	for _, f := range entries {
+		result := ZipEntryResult{Filename: path.Base(f.Name)}
+		if stop != "" {
+			result.Error = stop
+			summary.Entries = append(summary.Entries, result)
+			continue
+		}
+
+		fo, written, err := importZipEntry(pgContext, filesystem, input, f, remaining, config)
+		remaining -= written
+		switch {
+		case err == nil:
+			result.FileId = fo.FileId
+			result.Extraction = cells.NewExtractionCell(fo.FileId, fo.ExtractionStatus, "")
+		case errors.Is(err, ErrZipTooLarge):
+			result.Error = "Archive expands past the decompression limit"
+			stop = "Skipped, the archive's decompression limit was reached"
+		case errors.Is(err, ErrQuotaExceeded):
+			result.Error = quotaExceededMessage(pgContext, input.AccountUUID)
+			stop = "Skipped, storage quota reached"
+		default:
+			result.Error = zipEntryErrorMessage(err)
+			if result.Error == "" {
+				log.Printf("Failed to save %s from %s: %v", f.Name, input.Filename, err)
+				result.Error = "Failed to save file"
+			}
+		}
+		summary.Entries = append(summary.Entries, result)
+	}
+	return summary, nil
+}
+
+// importZipEntry saves one entry, returning how many bytes it decompressed to
+func importZipEntry(pgContext *pg.PostgresContext, filesystem Filesystem, input FileInput, f *zip.File, remaining int64, config ZipConfig) (FileObject, int64, error) {
+	if f.Flags&0x1 != 0 {
+		return FileObject{}, 0, zip.ErrAlgorithm
+	}
+	// stored entries can't be bombs, and the ratio of tiny entries says nothing
+	ratioLimit := int64(f.CompressedSize64) * config.MaxRatio
+	if f.Method == zip.Store || f.CompressedSize64 < 1<<10 {
+		ratioLimit = maxUploadBytes
+	}
+	if f.UncompressedSize64 > uint64(ratioLimit) {
+		return FileObject{}, 0, ErrZipRatio
+	}
+
+	entry, err := f.Open()
+	if err != nil {
+		return FileObject{}, 0, err
+	}
+	defer entry.Close()
+
+	// the per-file upload limit still applies, the archive's limits are checked on what's actually read
+	limited := &sizeLimitReader{Reader: entry, Limit: maxUploadBytes}
+	counted := &sizeLimitReader{Reader: limited, Limit: remaining, Err: ErrZipTooLarge}
+	ratio := &sizeLimitReader{Reader: counted, Limit: ratioLimit, Err: ErrZipRatio}
+	fo, err := saveFileObject(pgContext, filesystem, FileInput{
+		Filename:    path.Base(f.Name),
+		AccountUUID: input.AccountUUID,
+		FolderId:    input.FolderId,
+		File:        ratio,
+	})
+	return fo, counted.N, err
+}
+
+// zipEntryErrorMessage is what the summary says about an entry that wasn't saved, or "" if the
+// error is ours rather than the entry's
+func zipEntryErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrFileTooLarge):
+		return fmt.Sprintf("File is larger than the %d MB upload limit", maxUploadBytes>>20)
+	case errors.Is(err, ErrFolderNotFound):
+		return "Folder not found"
+	case errors.Is(err, ErrZipRatio):
+		return "Compression ratio is too high, the entry looks like a zip bomb"
+	case errors.Is(err, zip.ErrAlgorithm):
+		return "Encrypted or unsupported compression method"
+	case errors.Is(err, zip.ErrChecksum), errors.Is(err, zip.ErrFormat):
+		return "Entry is corrupt"
+	case strings.HasPrefix(err.Error(), "file has no extension"):
+		return "File has no extension"
+	case strings.HasPrefix(err.Error(), "empty file"):
+		return "File is empty"
+	}
+	return ""
+}
+
+func FileZipUpload(hCtx HandlerContext) error {
+	var summaries []ZipUploadSummary
+	_, err := _readFileUploads(hCtx.EchoCtx, func(fileInput FileInput) error {
+		summary, err := importZip(hCtx.PGCtx, filesystem, fileInput, zipConfig)
+		if err != nil {
+			if errors.Is(err, ErrFileTooLarge) {
+				return err
+			}
+			log.Printf("Failed to import %s: %v", fileInput.Filename, err)
+			summary.Error = err.Error()
+		}
+		summaries = append(summaries, summary)
+		return nil
+	})
+	if errors.Is(err, ErrFileTooLarge) {
+		return errorDiv(hCtx.EchoCtx, fmt.Sprintf("Archive is larger than the %d MB upload limit", maxUploadBytes>>20))
+	}
+	if err != nil && len(summaries) == 0 {
+		log.Printf("Failed to read ZIP upload: %v", err)
+		return errorDiv(hCtx.EchoCtx, "Failed to upload archive")
+	}
+	hCtx.EchoCtx.Response().Header().Set("HX-Trigger", "fileUploaded")
+	return hCtx.EchoCtx.Render(http.StatusOK, "files/zipSummary", summaries)
+}
+
+// FileZipExport streams the files picked with file_id query params as one ZIP. Quarantined files
+// are left out.
+func FileZipExport(hCtx HandlerContext) error {
+	c := hCtx.EchoCtx
+	uuid, ok := c.Get("ID").(string)
+	if !ok {
+		return fmt.Errorf("Could not cast ID claim to string")
+	}
+
+	fileIds := c.QueryParams()["file_id"]
+	if len(fileIds) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "No files selected")
+	}
+	if len(fileIds) > zipConfig.MaxEntries {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("At most %d files can be exported at once", zipConfig.MaxEntries))
+	}
+
+	// everything is looked up before the response starts, while an error can still be sent
+	var files []FileObject
+	seen := map[string]bool{}
+	for _, fileId := range fileIds {
+		if seen[fileId] {
+			continue
+		}
+		seen[fileId] = true
+		// shared files can be exported too, any role may download
+		fo, _, err := getAccessibleFileObject(hCtx.PGCtx, fileId, uuid)
+		if err != nil {
+			if !errors.Is(err, ErrFileNotFound) {
+				log.Printf("Failed to look up file for export: %v", err)
+			}
+			return echo.NewHTTPError(http.StatusNotFound, "File not found")
+		}
+		if fo.ScanStatus == ScanInfected {
+			continue
+		}
+		files = append(files, fo)
+	}
+
+	filename := fmt.Sprintf("files-%s.zip", time.Now().Format("2006-01-02"))
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, "application/zip")
+	header.Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	header.Set("Cache-Control", "private, no-store")
+	c.Response().WriteHeader(http.StatusOK)
+
+	archive := zip.NewWriter(c.Response())
+	names := map[string]bool{}
+	for _, fo := range files {
+		if err := writeZipEntry(archive, fo, uniqueZipName(names, fo.Filename)); err != nil {
+			// headers are already sent; leaving the archive unfinished makes the download fail
+			// instead of quietly missing files
+			log.Printf("Export interrupted at file %s: %v", fo.FileId, err)
+			return nil
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Failed to finish export: %v", err)
+	}
+	return nil
+}
+
+func writeZipEntry(archive *zip.Writer, fo FileObject, name string) error {
+	fs, err := getFilesystem(fo.Location)
+	if err != nil {
+		return err
+	}
+	file, err := fs.Read(fo.Filepath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: fo.UploadTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// uniqueZipName numbers repeats of a filename, "cv.pdf", "cv (2).pdf", since entries share one folder
+func uniqueZipName(used map[string]bool, filename string) string {
+	name := filename
+	ext := path.Ext(filename)
+	for n := 2; used[name]; n++ {
+		name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(filename, ext), n, ext)
+	}
+	used[name] = true
+	return name
+}